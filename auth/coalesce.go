@@ -0,0 +1,154 @@
+package auth
+
+import (
+	"context"
+	"expvar"
+	"strings"
+	"sync"
+
+	"github.com/mainflux/mainflux/things/policies"
+)
+
+const (
+	identifyMethod  = "identify"
+	authorizeMethod = "authorize"
+)
+
+var coalescingMetrics = expvar.NewMap("auth_coalescing")
+
+func init() {
+	coalescingMetrics.Set("ratio", expvar.Func(func() interface{} {
+		var calls, coalesced int64
+		for _, m := range []string{identifyMethod, authorizeMethod} {
+			calls += intValue(coalescingMetrics.Get(m + "_calls"))
+			coalesced += intValue(coalescingMetrics.Get(m + "_coalesced"))
+		}
+		if calls == 0 {
+			return 0.0
+		}
+		return float64(coalesced) / float64(calls)
+	}))
+}
+
+// Invalidator invalidates the auth decisions of the client, such as when
+// the thing's access changes in Things.
+type Invalidator interface {
+	// Invalidate invalidates the decisions about the thing with the secret.
+	// If the channel ID is set, only the decisions about the access to the
+	// channel are invalidated. If the secret is empty, the decisions about
+	// the access of any thing to the channel are invalidated.
+	Invalidate(secret, chanID string)
+}
+
+var (
+	_ AuthServiceClient = (*coalescingClient)(nil)
+	_ Invalidator       = (*coalescingClient)(nil)
+)
+
+// call is the request in flight, shared by all the identical requests.
+type call struct {
+	secret string
+	chanID string
+	done   chan struct{}
+	res    interface{}
+	err    error
+}
+
+type coalescingClient struct {
+	client AuthServiceClient
+	mu     sync.Mutex
+	calls  map[string]*call
+}
+
+// NewCoalescingClient returns the auth client which sends identical concurrent
+// requests only once and shares the result between them, such as when many
+// things reconnect at the same time.
+func NewCoalescingClient(client AuthServiceClient) AuthServiceClient {
+	return &coalescingClient{
+		client: client,
+		calls:  make(map[string]*call),
+	}
+}
+
+// Authorize implements AuthServiceClient.
+func (cc *coalescingClient) Authorize(ctx context.Context, in *policies.AuthorizeReq) (*policies.AuthorizeRes, error) {
+	key := strings.Join([]string{authorizeMethod, in.GetSubject(), in.GetObject(), in.GetAction(), in.GetEntityType()}, "\x00")
+	res, err := cc.do(ctx, authorizeMethod, key, in.GetSubject(), in.GetObject(), func(ctx context.Context) (interface{}, error) {
+		return cc.client.Authorize(ctx, in)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res.(*policies.AuthorizeRes), nil
+}
+
+// Identify implements AuthServiceClient.
+func (cc *coalescingClient) Identify(ctx context.Context, in *policies.IdentifyReq) (*policies.IdentifyRes, error) {
+	key := identifyMethod + "\x00" + in.GetSecret()
+	res, err := cc.do(ctx, identifyMethod, key, in.GetSecret(), "", func(ctx context.Context) (interface{}, error) {
+		return cc.client.Identify(ctx, in)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res.(*policies.IdentifyRes), nil
+}
+
+// Invalidate implements Invalidator. The requests in flight are not shared
+// with the later identical requests, which are sent again.
+func (cc *coalescingClient) Invalidate(secret, chanID string) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	for key, c := range cc.calls {
+		if (secret == "" || c.secret == secret) && (chanID == "" || c.chanID == chanID) {
+			delete(cc.calls, key)
+		}
+	}
+}
+
+// do calls fn unless the identical request is in flight, and waits for the
+// result. The request is not canceled if the caller which sent it gives up,
+// so the other callers still get the result.
+func (cc *coalescingClient) do(ctx context.Context, method, key, secret, chanID string, fn func(context.Context) (interface{}, error)) (interface{}, error) {
+	coalescingMetrics.Add(method+"_calls", 1)
+
+	cc.mu.Lock()
+	c, ok := cc.calls[key]
+	if ok {
+		coalescingMetrics.Add(method+"_coalesced", 1)
+	} else {
+		c = &call{
+			secret: secret,
+			chanID: chanID,
+			done:   make(chan struct{}),
+		}
+		cc.calls[key] = c
+		go func() {
+			c.res, c.err = fn(context.WithoutCancel(ctx))
+			cc.mu.Lock()
+			if cc.calls[key] == c {
+				delete(cc.calls, key)
+			}
+			cc.mu.Unlock()
+			close(c.done)
+		}()
+	}
+	cc.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.res, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func intValue(v expvar.Var) int64 {
+	if i, ok := v.(*expvar.Int); ok {
+		return i.Value()
+	}
+	return 0
+}
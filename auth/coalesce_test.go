@@ -0,0 +1,270 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package auth_test
+
+import (
+	"context"
+	"expvar"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/absmach/aproxy/auth"
+	"github.com/absmach/aproxy/auth/mocks"
+	"github.com/mainflux/mainflux/pkg/errors"
+	"github.com/mainflux/mainflux/things/policies"
+)
+
+const (
+	thingID     = "513d02d2-16c1-4f23-98be-9e12f8fee898"
+	thingSecret = "thing-secret"
+	otherSecret = "other-secret"
+	chanID      = "123e4567-e89b-12d3-a456-000000000001"
+	otherChanID = "123e4567-e89b-12d3-a456-000000000002"
+	callers     = 10
+	timeout     = time.Second
+)
+
+func newCoalescingClient() (auth.AuthServiceClient, *mocks.BlockingAuthService) {
+	svc := mocks.NewBlockingAuthService(mocks.NewAuthService(
+		map[string]string{thingSecret: thingID},
+		map[string]string{chanID: thingSecret},
+	))
+
+	return auth.NewCoalescingClient(svc), svc
+}
+
+// coalesced returns the number of the calls of the method which share the
+// calls in flight.
+func coalesced(method string) int64 {
+	m := expvar.Get("auth_coalescing").(*expvar.Map)
+	if v, ok := m.Get(method + "_coalesced").(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// waitCoalesced waits until n more calls of the method than before share the
+// calls in flight.
+func waitCoalesced(t *testing.T, method string, before int64, n int) {
+	deadline := time.Now().Add(timeout)
+	for coalesced(method) < before+int64(n) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d %s calls coalesced got %d", n, method, coalesced(method)-before)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+type result struct {
+	id  string
+	err error
+}
+
+// identify calls Identify with the secret from n goroutines.
+func identify(client auth.AuthServiceClient, secret string, n int) chan result {
+	results := make(chan result, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			res, err := client.Identify(context.Background(), &policies.IdentifyReq{Secret: secret})
+			results <- result{id: res.GetId(), err: err}
+		}()
+	}
+
+	return results
+}
+
+func TestCoalesceIdentify(t *testing.T) {
+	cases := []struct {
+		desc   string
+		secret string
+		id     string
+		err    error
+	}{
+		{
+			desc:   "share result",
+			secret: thingSecret,
+			id:     thingID,
+		},
+		{
+			desc:   "share error",
+			secret: otherSecret,
+			err:    errors.ErrAuthentication,
+		},
+	}
+
+	for _, tc := range cases {
+		client, svc := newCoalescingClient()
+		before := coalesced("identify")
+		results := identify(client, tc.secret, callers)
+		waitCoalesced(t, "identify", before, callers-1)
+		svc.Release()
+
+		for i := 0; i < callers; i++ {
+			res := <-results
+			if !errors.Contains(res.err, tc.err) || (res.err == nil) != (tc.err == nil) {
+				t.Errorf("%s: expected error %v got %v", tc.desc, tc.err, res.err)
+			}
+			if res.id != tc.id {
+				t.Errorf("%s: expected thing ID %q got %q", tc.desc, tc.id, res.id)
+			}
+		}
+		if n := svc.IdentifyCalls(tc.secret); n != 1 {
+			t.Errorf("%s: expected 1 upstream call got %d", tc.desc, n)
+		}
+
+		// The finished call is not shared with the later ones.
+		<-identify(client, tc.secret, 1)
+		if n := svc.IdentifyCalls(tc.secret); n != 2 {
+			t.Errorf("%s: expected 2 upstream calls got %d", tc.desc, n)
+		}
+	}
+}
+
+func TestCoalesceAuthorize(t *testing.T) {
+	client, svc := newCoalescingClient()
+	before := coalesced("authorize")
+
+	var wg sync.WaitGroup
+	authorized := make(map[string]int)
+	var mu sync.Mutex
+	for i := 0; i < callers; i++ {
+		for _, ch := range []string{chanID, otherChanID} {
+			wg.Add(1)
+			go func(ch string) {
+				defer wg.Done()
+				res, err := client.Authorize(context.Background(), &policies.AuthorizeReq{Subject: thingSecret, Object: ch})
+				if err != nil {
+					t.Errorf("%s: unexpected error %v", ch, err)
+					return
+				}
+				if res.GetAuthorized() {
+					mu.Lock()
+					authorized[ch]++
+					mu.Unlock()
+				}
+			}(ch)
+		}
+	}
+	waitCoalesced(t, "authorize", before, 2*(callers-1))
+	svc.Release()
+	wg.Wait()
+
+	// Each channel is authorized once, and the decision is shared.
+	for ch, n := range map[string]int{chanID: callers, otherChanID: 0} {
+		if calls := svc.AuthorizeCalls(ch); calls != 1 {
+			t.Errorf("%s: expected 1 upstream call got %d", ch, calls)
+		}
+		if authorized[ch] != n {
+			t.Errorf("%s: expected %d callers authorized got %d", ch, n, authorized[ch])
+		}
+	}
+}
+
+func TestCoalesceInvalidate(t *testing.T) {
+	cases := []struct {
+		desc   string
+		secret string
+		chanID string
+		// shared tells if the call in flight is shared after invalidation.
+		shared bool
+	}{
+		{
+			desc:   "invalidate thing",
+			secret: thingSecret,
+		},
+		{
+			desc:   "invalidate thing access to channel",
+			secret: thingSecret,
+			chanID: chanID,
+		},
+		{
+			desc:   "invalidate any thing access to channel",
+			chanID: chanID,
+		},
+		{
+			desc:   "invalidate other thing",
+			secret: otherSecret,
+			shared: true,
+		},
+		{
+			desc:   "invalidate thing access to other channel",
+			secret: thingSecret,
+			chanID: otherChanID,
+			shared: true,
+		},
+	}
+
+	req := &policies.AuthorizeReq{Subject: thingSecret, Object: chanID}
+	for _, tc := range cases {
+		client, svc := newCoalescingClient()
+		inv, ok := client.(auth.Invalidator)
+		if !ok {
+			t.Fatalf("expected coalescing client to implement Invalidator")
+		}
+
+		errs := make(chan error, 2)
+		authorize := func() {
+			_, err := client.Authorize(context.Background(), req)
+			errs <- err
+		}
+		go authorize()
+		if !svc.WaitInFlight(1, timeout) {
+			t.Fatalf("%s: expected call in flight", tc.desc)
+		}
+		inv.Invalidate(tc.secret, tc.chanID)
+
+		before := coalesced("authorize")
+		go authorize()
+		if tc.shared {
+			waitCoalesced(t, "authorize", before, 1)
+		} else if !svc.WaitInFlight(2, timeout) {
+			t.Fatalf("%s: expected 2 calls in flight", tc.desc)
+		}
+		svc.Release()
+		for i := 0; i < 2; i++ {
+			if err := <-errs; err != nil {
+				t.Errorf("%s: unexpected error %v", tc.desc, err)
+			}
+		}
+
+		expected := 2
+		if tc.shared {
+			expected = 1
+		}
+		if n := svc.AuthorizeCalls(chanID); n != expected {
+			t.Errorf("%s: expected %d upstream calls got %d", tc.desc, expected, n)
+		}
+	}
+}
+
+func TestCoalesceCanceled(t *testing.T) {
+	client, svc := newCoalescingClient()
+
+	// The caller which gives up doesn't cancel the call shared with the others.
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		_, err := client.Identify(ctx, &policies.IdentifyReq{Secret: thingSecret})
+		errs <- err
+	}()
+	if !svc.WaitInFlight(1, timeout) {
+		t.Fatalf("expected call in flight")
+	}
+	before := coalesced("identify")
+	results := identify(client, thingSecret, 1)
+	waitCoalesced(t, "identify", before, 1)
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("expected error %v got %v", context.Canceled, err)
+	}
+
+	svc.Release()
+	if res := <-results; res.err != nil || res.id != thingID {
+		t.Errorf("expected thing ID %s got %q and error %v", thingID, res.id, res.err)
+	}
+	if n := svc.IdentifyCalls(thingSecret); n != 1 {
+		t.Errorf("expected 1 upstream call got %d", n)
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package mocks
+
+import (
+	"context"
+
+	"github.com/absmach/aproxy/auth"
+	"github.com/mainflux/mainflux/pkg/errors"
+	"github.com/mainflux/mainflux/things/policies"
+)
+
+var _ auth.AuthServiceClient = (*authServiceMock)(nil)
+
+type authServiceMock struct {
+	things   map[string]string
+	channels map[string]string
+}
+
+// NewAuthService creates mock of the auth service. Things maps thing secrets
+// to thing IDs, and channels maps channel IDs to the secrets of connected things.
+func NewAuthService(things, channels map[string]string) auth.AuthServiceClient {
+	return &authServiceMock{
+		things:   things,
+		channels: channels,
+	}
+}
+
+func (svc *authServiceMock) Authorize(ctx context.Context, in *policies.AuthorizeReq) (*policies.AuthorizeRes, error) {
+	secret, ok := svc.channels[in.GetObject()]
+	return &policies.AuthorizeRes{Authorized: ok && secret == in.GetSubject()}, nil
+}
+
+func (svc *authServiceMock) Identify(ctx context.Context, in *policies.IdentifyReq) (*policies.IdentifyRes, error) {
+	id, ok := svc.things[in.GetSecret()]
+	if !ok {
+		return nil, errors.ErrAuthentication
+	}
+	return &policies.IdentifyRes{Id: id}, nil
+}
@@ -0,0 +1,135 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package mocks
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/absmach/aproxy/auth"
+	"github.com/mainflux/mainflux/things/policies"
+)
+
+var _ auth.AuthServiceClient = (*BlockingAuthService)(nil)
+
+// BlockingAuthService wraps the auth service, counts the calls to it and
+// blocks them until they are released, so the tests can check how many calls
+// are sent and how many of them are in flight at the same time.
+type BlockingAuthService struct {
+	svc       auth.AuthServiceClient
+	release   chan struct{}
+	once      sync.Once
+	mu        sync.Mutex
+	identify  map[string]int
+	authorize map[string]int
+	inFlight  int
+	maxFlight int
+}
+
+// NewBlockingAuthService returns the auth service which blocks the calls to
+// the wrapped service until Release is called.
+func NewBlockingAuthService(svc auth.AuthServiceClient) *BlockingAuthService {
+	return &BlockingAuthService{
+		svc:       svc,
+		release:   make(chan struct{}),
+		identify:  make(map[string]int),
+		authorize: make(map[string]int),
+	}
+}
+
+func (svc *BlockingAuthService) Authorize(ctx context.Context, in *policies.AuthorizeReq) (*policies.AuthorizeRes, error) {
+	svc.enter(svc.authorize, in.GetObject())
+	defer svc.leave()
+	if err := svc.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	return svc.svc.Authorize(ctx, in)
+}
+
+func (svc *BlockingAuthService) Identify(ctx context.Context, in *policies.IdentifyReq) (*policies.IdentifyRes, error) {
+	svc.enter(svc.identify, in.GetSecret())
+	defer svc.leave()
+	if err := svc.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	return svc.svc.Identify(ctx, in)
+}
+
+// Release unblocks the calls in flight and the later ones.
+func (svc *BlockingAuthService) Release() {
+	svc.once.Do(func() {
+		close(svc.release)
+	})
+}
+
+// IdentifyCalls returns the number of Identify calls with the secret.
+func (svc *BlockingAuthService) IdentifyCalls(secret string) int {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	return svc.identify[secret]
+}
+
+// AuthorizeCalls returns the number of Authorize calls for the channel.
+func (svc *BlockingAuthService) AuthorizeCalls(chanID string) int {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	return svc.authorize[chanID]
+}
+
+// MaxInFlight returns the maximum number of calls in flight at the same time.
+func (svc *BlockingAuthService) MaxInFlight() int {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	return svc.maxFlight
+}
+
+// WaitInFlight waits until n calls are in flight. It returns false if they
+// are not within the timeout.
+func (svc *BlockingAuthService) WaitInFlight(n int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		svc.mu.Lock()
+		inFlight := svc.inFlight
+		svc.mu.Unlock()
+		if inFlight >= n {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	return false
+}
+
+func (svc *BlockingAuthService) enter(calls map[string]int, key string) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	calls[key]++
+	svc.inFlight++
+	if svc.inFlight > svc.maxFlight {
+		svc.maxFlight = svc.inFlight
+	}
+}
+
+func (svc *BlockingAuthService) leave() {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	svc.inFlight--
+}
+
+func (svc *BlockingAuthService) wait(ctx context.Context) error {
+	select {
+	case <-svc.release:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -2,26 +2,34 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"expvar"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"time"
 
 	"github.com/absmach/aproxy"
 	"github.com/absmach/aproxy/auth"
+	"github.com/absmach/aproxy/internal/admin"
+	"github.com/absmach/aproxy/internal/certmap"
 	"github.com/absmach/aproxy/internal/config"
+	grpcclient "github.com/absmach/aproxy/internal/grpc"
 	thingsclient "github.com/absmach/aproxy/internal/grpc/things"
+	"github.com/absmach/aproxy/internal/lockout"
+	"github.com/absmach/aproxy/internal/msgbroker"
+	"github.com/absmach/aproxy/internal/proxy"
+	"github.com/absmach/aproxy/internal/revocation"
+	"github.com/absmach/aproxy/internal/upstream"
 	mproxy "github.com/absmach/aproxy/mqtt"
 	"github.com/cenkalti/backoff/v4"
 	mflog "github.com/mainflux/mainflux/logger"
 	"github.com/mainflux/mainflux/pkg/errors"
-	mqttpub "github.com/mainflux/mainflux/pkg/messaging/mqtt"
 	"github.com/mainflux/mainflux/pkg/uuid"
-	mp "github.com/mainflux/mproxy/pkg/mqtt"
 	"github.com/mainflux/mproxy/pkg/session"
-	"github.com/mainflux/mproxy/pkg/websocket"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -65,38 +73,301 @@ func main() {
 		}
 	}
 
-	mpub, err := mqttpub.NewPublisher(fmt.Sprintf("%s:%s", cfg.MQTTAdapter.MQTTTargetHost, cfg.MQTTAdapter.MQTTTargetPort), time.Duration(cfg.MQTTAdapter.MQTTForwarderTimeout))
+	tc, tcHandler, err := thingsclient.Setup()
 	if err != nil {
-		logger.Error(fmt.Sprintf("failed to create MQTT publisher: %s", err))
+		logger.Error(err.Error())
 		exitCode = 1
 		return
 	}
-	defer mpub.Close()
+	defer tcHandler.Close()
 
-	tc, tcHandler, err := thingsclient.Setup()
+	logger.Info("Successfully connected to things grpc server " + tcHandler.Secure())
+	warnSystemRoots(logger, proxy.DefaultHost, tcHandler)
+	grpcClients := map[string]grpcclient.ClientHandler{proxy.DefaultHost: tcHandler}
+
+	authClient := auth.NewCoalescingClient(auth.NewGrpcAuthClient(tc))
+
+	var hosts []config.VirtualHost
+	if cfg.TLS.HostsFile != "" {
+		if hosts, err = config.LoadVirtualHosts(cfg.TLS.HostsFile); err != nil {
+			logger.Error(fmt.Sprintf("failed to load virtual hosts: %s", err))
+			exitCode = 1
+			return
+		}
+	}
+	hostAuth := make(map[string]auth.AuthServiceClient)
+	for _, vh := range hosts {
+		if vh.ThingsGRPCURL == "" {
+			continue
+		}
+		tc, tcHandler, err := thingsclient.SetupWithURL(vh.ThingsGRPCURL)
+		if err != nil {
+			logger.Error(fmt.Sprintf("failed to connect to things grpc server of virtual host %s: %s", vh.Name, err))
+			exitCode = 1
+			return
+		}
+		defer tcHandler.Close()
+		warnSystemRoots(logger, vh.Name, tcHandler)
+		hostAuth[vh.Name] = auth.NewCoalescingClient(auth.NewGrpcAuthClient(tc))
+		grpcClients[vh.Name] = tcHandler
+	}
+	for _, c := range grpcClients {
+		c := c
+		g.Go(func() error {
+			c.Watch(ctx, logger)
+			return nil
+		})
+	}
+
+	thingNetworks := make(map[string][]*net.IPNet)
+	for id, cidrs := range cfg.MQTTAdapter.ThingNetworks {
+		if thingNetworks[id], err = proxy.ParseCIDRs(cidrs); err != nil {
+			logger.Error(fmt.Sprintf("failed to parse networks of thing %s: %s", id, err))
+			exitCode = 1
+			return
+		}
+	}
+
+	sessions, err := mproxy.NewRegistry(mproxy.RegistryConfig{
+		MaxThingSessions: cfg.Limits.MaxThingSessions,
+		ThingPolicy:      cfg.Limits.ThingSessionPolicy,
+		ClientIDPolicy:   cfg.Limits.ClientIDPolicy,
+	})
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to create session registry: %s", err))
+		exitCode = 1
+		return
+	}
+	limiter := proxy.NewConnLimiter(cfg.Limits.MaxConns, cfg.Limits.MaxConnsPerIP)
+	expvar.Publish("connections", expvar.Func(func() interface{} { return limiter.Stats() }))
+	expvar.Publish("sessions", expvar.Func(func() interface{} { return sessions.Stats() }))
+
+	tenants := make(map[string]string)
+	for tenant, thingIDs := range cfg.MQTTAdapter.Tenants {
+		for _, id := range thingIDs {
+			tenants[id] = tenant
+		}
+	}
+
+	rewrite, err := upstreamConfig(cfg.MQTTAdapter)
 	if err != nil {
 		logger.Error(err.Error())
 		exitCode = 1
 		return
 	}
-	defer tcHandler.Close()
 
-	logger.Info("Successfully connected to things grpc server " + tcHandler.Secure())
+	revocations, err := revocation.New(cfg.Revocation.CRLFiles, clientCAFiles(cfg.TLS, hosts), cfg.Revocation.DenylistFile, logger)
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to load certificate revocations: %s", err))
+		exitCode = 1
+		return
+	}
+	g.Go(func() error {
+		return revocations.Run(ctx, time.Duration(cfg.Revocation.CRLReloadInterval))
+	})
 
-	authClient := auth.NewGrpcAuthClient(tc)
+	mapper, err := certMapper(cfg.CertMapping)
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to create certificate mapping: %s", err))
+		exitCode = 1
+		return
+	}
+	if err := checkCertMapping(cfg.CertMapping, cfg.TLS, hosts); err != nil {
+		logger.Error(fmt.Sprintf("failed to create certificate mapping: %s", err))
+		exitCode = 1
+		return
+	}
 
-	h := mproxy.NewHandler(logger, authClient)
+	mappings, err := credentialMappings(cfg.MQTTAdapter.CredentialMappings)
+	if err != nil {
+		logger.Error(err.Error())
+		exitCode = 1
+		return
+	}
+
+	clientIDs, err := mproxy.NewClientIDPolicy(mproxy.ClientIDRules{
+		Match:     cfg.ClientID.Match,
+		Pattern:   cfg.ClientID.Pattern,
+		Assign:    cfg.ClientID.Assign,
+		MaxLength: cfg.ClientID.MaxLength,
+		Charset:   cfg.ClientID.Charset,
+	})
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to create client_id policy: %s", err))
+		exitCode = 1
+		return
+	}
+
+	maxAge, err := maxAgeConfig(cfg.Sessions)
+	if err != nil {
+		logger.Error(err.Error())
+		exitCode = 1
+		return
+	}
+
+	opts := []mproxy.Option{
+		mproxy.WithRegistry(sessions),
+		mproxy.WithSysAccess(cfg.MQTTAdapter.SysThings...),
+		mproxy.WithContentTypes(cfg.MQTTAdapter.ContentTypes),
+		mproxy.WithThingNetworks(thingNetworks),
+		mproxy.WithTenants(tenants),
+		mproxy.WithUpstream(rewrite),
+		mproxy.WithHostAuth(hostAuth),
+		mproxy.WithRevocation(revocations),
+		mproxy.WithCertMapping(mapper),
+		mproxy.WithAuthParallelism(cfg.Limits.AuthParallelism),
+		mproxy.WithMaxAge(maxAge),
+		mproxy.WithCredentialMappings(mappings),
+		mproxy.WithClientIDPolicy(clientIDs),
+	}
+
+	var lockouts *lockout.Tracker
+	if cfg.Lockout.Threshold > 0 {
+		lockouts = lockout.New(lockout.Config{
+			Threshold:   cfg.Lockout.Threshold,
+			Delay:       time.Duration(cfg.Lockout.Delay),
+			MaxDelay:    time.Duration(cfg.Lockout.MaxDelay),
+			Duration:    time.Duration(cfg.Lockout.Duration),
+			MaxDuration: time.Duration(cfg.Lockout.MaxDuration),
+			Window:      time.Duration(cfg.Lockout.Window),
+		})
+		opts = append(opts, mproxy.WithLockout(lockouts))
+	}
+
+	if cfg.MQTTAdapter.MsgBrokerURL != "" {
+		pub, err := msgbroker.NewPublisher(cfg.MQTTAdapter.MsgBrokerURL, fmt.Sprintf("%s-%s-publisher", svcName, cfg.General.InstanceID), time.Duration(cfg.MQTTAdapter.MQTTForwarderTimeout))
+		if err != nil {
+			logger.Error(fmt.Sprintf("failed to create MQTT publisher: %s", err))
+			exitCode = 1
+			return
+		}
+		mpub := msgbroker.NewAsyncPublisher(pub, cfg.MQTTAdapter.MsgBrokerQueue, logger)
+		defer mpub.Close()
+
+		opts = append(opts, mproxy.WithPublisher(mpub))
+		logger.Info("Publishing messages to the message broker at " + cfg.MQTTAdapter.MsgBrokerURL)
+
+		if cfg.MQTTAdapter.EventsTopic != "" {
+			opts = append(opts, mproxy.WithEvents(mproxy.NewEventPublisher(mpub, cfg.MQTTAdapter.EventsTopic)))
+			logger.Info("Publishing session events to the topic " + cfg.MQTTAdapter.EventsTopic)
+		}
+	}
+
+	h := mproxy.NewHandler(logger, authClient, opts...)
+	g.Go(func() error {
+		return h.Run(ctx, time.Duration(cfg.Sessions.RevalidateInterval))
+	})
+
+	if cfg.ThingsEvents.URL != "" {
+		sub := msgbroker.NewSubscriber(cfg.ThingsEvents.URL, time.Duration(cfg.MQTTAdapter.MQTTForwarderTimeout), logger)
+		defer sub.Close()
+
+		id := fmt.Sprintf("%s-%s", svcName, cfg.General.InstanceID)
+		if err := sub.Subscribe(ctx, id, cfg.ThingsEvents.Topic, mproxy.NewThingsEventHandler(h, logger)); err != nil {
+			logger.Error(fmt.Sprintf("failed to subscribe to Things events: %s", err))
+			exitCode = 1
+			return
+		}
+		logger.Info("Consuming Things events from the topic " + cfg.ThingsEvents.Topic)
+	}
+
+	resolve := func(ctx context.Context) (upstream.Route, bool) {
+		s, ok := session.FromContext(ctx)
+		if !ok {
+			return upstream.Route{}, false
+		}
+		info, ok := sessions.Info(s)
+		route := upstream.Route{ThingID: info.ThingID, Tenant: info.Tenant}
+		if c, ok := proxy.FromContext(ctx); ok {
+			route.Host = c.ServerName
+			route.Listener = c.Listener
+		}
+		return route, ok
+	}
+
+	mqttTarget := fmt.Sprintf("%s:%s", cfg.MQTTAdapter.MQTTTargetHost, cfg.MQTTAdapter.MQTTTargetPort)
+	mqttUpstreams, err := newRouter(cfg.Upstream, cfg.MQTTAdapter.MQTTTargets, mqttTarget, cfg.MQTTAdapter.MQTTTargetProbe, hostRoutes(cfg.MQTTAdapter.MQTTRoutes, hosts, mqttTargets), resolve, logger)
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to create MQTT broker pool: %s", err))
+		exitCode = 1
+		return
+	}
+	wsTarget := fmt.Sprintf("%s:%s", cfg.HTTPAdapter.HTTPTargetHost, cfg.HTTPAdapter.HTTPTargetPort)
+	wsUpstreams, err := newRouter(cfg.Upstream, cfg.HTTPAdapter.HTTPTargets, wsTarget, cfg.HTTPAdapter.HTTPTargetProbe, hostRoutes(cfg.HTTPAdapter.HTTPRoutes, hosts, wsTargets), resolve, logger)
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to create WS broker pool: %s", err))
+		exitCode = 1
+		return
+	}
+	g.Go(func() error {
+		return mqttUpstreams.Run(ctx)
+	})
+	g.Go(func() error {
+		return wsUpstreams.Run(ctx)
+	})
+
+	details := []aproxy.HealthDetail{
+		{Name: "connections", Value: func() interface{} { return limiter.Stats() }},
+		{Name: "sessions", Value: func() interface{} { return sessions.Stats() }},
+		{Name: "mqtt_upstreams", Value: func() interface{} { return mqttUpstreams.Status() }},
+		{Name: "ws_upstreams", Value: func() interface{} { return wsUpstreams.Status() }},
+		{Name: "things_grpc", Value: func() interface{} { return grpcStates(grpcClients) }},
+	}
+
+	var certs *proxy.Reloader
+	if cfg.TLS.MQTTPort != "" || cfg.TLS.WSPort != "" {
+		if certs, err = newReloader(cfg.TLS, hosts, logger); err != nil {
+			logger.Error(fmt.Sprintf("failed to load TLS configuration: %s", err))
+			exitCode = 1
+			return
+		}
+		expvar.Publish("certificates", expvar.Func(func() interface{} { return certs.Status() }))
+		details = append(details, aproxy.HealthDetail{Name: "certificates", Value: func() interface{} { return certs.Status() }})
+		g.Go(func() error {
+			return certs.Run(ctx, time.Duration(cfg.TLS.ReloadInterval))
+		})
+	}
 
 	logger.Info(fmt.Sprintf("Starting MQTT proxy on port %s", cfg.MQTTAdapter.MQTTPort))
 	g.Go(func() error {
-		return proxyMQTT(ctx, cfg.MQTTAdapter, logger, h)
+		return proxyMQTT(ctx, cfg, cfg.MQTTAdapter.MQTTPort, nil, limiter, mqttUpstreams, logger, h)
 	})
 
 	logger.Info(fmt.Sprintf("Starting MQTT over WS  proxy on port %s", cfg.HTTPAdapter.HTTPPort))
 	g.Go(func() error {
-		return proxyWS(ctx, cfg, logger, h)
+		return proxyWS(ctx, cfg, cfg.HTTPAdapter.HTTPPort, nil, limiter, wsUpstreams, logger, h, details)
 	})
 
+	if cfg.TLS.MQTTPort != "" {
+		logger.Info(fmt.Sprintf("Starting MQTTS proxy on port %s", cfg.TLS.MQTTPort))
+		g.Go(func() error {
+			return proxyMQTT(ctx, cfg, cfg.TLS.MQTTPort, certs.Config(), limiter, mqttUpstreams, logger, h)
+		})
+	}
+	if cfg.TLS.WSPort != "" {
+		logger.Info(fmt.Sprintf("Starting MQTT over WSS proxy on port %s", cfg.TLS.WSPort))
+		g.Go(func() error {
+			return proxyWS(ctx, cfg, cfg.TLS.WSPort, certs.Config(), limiter, wsUpstreams, logger, h, details)
+		})
+	}
+
+	if cfg.Admin.Port != "" {
+		if cfg.Admin.Token == "" {
+			logger.Error("admin API token is not set")
+			exitCode = 1
+			return
+		}
+		logger.Info(fmt.Sprintf("Starting admin API on port %s", cfg.Admin.Port))
+		g.Go(func() error {
+			return serveAdmin(ctx, cfg.Admin, logger, admin.Resources{
+				Lockouts:   lockouts,
+				Sessions:   sessions,
+				Revocation: revocations,
+				Handler:    h,
+			})
+		})
+	}
+
 	g.Go(func() error {
 		if sig := errors.SignalHandler(ctx); sig != nil {
 			cancel()
@@ -110,10 +381,28 @@ func main() {
 	}
 }
 
-func proxyMQTT(ctx context.Context, cfg config.MQTTAdapterConfig, logger mflog.Logger, handler session.Handler) error {
-	address := fmt.Sprintf(":%s", cfg.MQTTPort)
-	target := fmt.Sprintf("%s:%s", cfg.MQTTTargetHost, cfg.MQTTTargetPort)
-	mp := mp.New(address, target, handler, logger)
+func proxyMQTT(ctx context.Context, cfg config.Config, port string, serverTLS *tls.Config, limiter *proxy.ConnLimiter, upstreams upstream.Balancer, logger mflog.Logger, handler session.Handler) error {
+	mcfg := cfg.MQTTAdapter
+	address := fmt.Sprintf(":%s", port)
+	pcfg, err := proxyConfig(address, upstreams, mcfg.ProxyProtocol, mcfg.TrustedProxies, mcfg.AllowCIDRs, mcfg.DenyCIDRs)
+	if err != nil {
+		return err
+	}
+	pcfg = withLimits(pcfg, cfg.Limits, limiter)
+	pcfg.TLS = serverTLS
+	if mcfg.TargetTLS {
+		pcfg.TargetTLS, err = proxy.ClientTLS(proxy.TLSConfig{
+			CAFile:     mcfg.TargetCAFile,
+			CertFile:   mcfg.TargetCertFile,
+			KeyFile:    mcfg.TargetKeyFile,
+			ServerName: mcfg.TargetServerName,
+			MinVersion: mcfg.TargetTLSMinVersion,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	mp := proxy.NewMQTT(pcfg, handler, logger)
 
 	errCh := make(chan error)
 	go func() {
@@ -122,34 +411,358 @@ func proxyMQTT(ctx context.Context, cfg config.MQTTAdapterConfig, logger mflog.L
 
 	select {
 	case <-ctx.Done():
-		logger.Info(fmt.Sprintf("proxy MQTT shutdown at %s", target))
+		logger.Info(fmt.Sprintf("proxy MQTT shutdown at %s", address))
 		return nil
 	case err := <-errCh:
 		return err
 	}
 }
 
-func proxyWS(ctx context.Context, cfg config.Config, logger mflog.Logger, handler session.Handler) error {
-	target := fmt.Sprintf("%s:%s", cfg.HTTPAdapter.HTTPTargetHost, cfg.HTTPAdapter.HTTPTargetPort)
-	wp := websocket.New(target, cfg.HTTPAdapter.HTTPTargetPath, "ws", handler, logger)
-	http.Handle("/mqtt", wp.Handler())
-	http.Handle("/health", aproxy.Health(svcName, cfg.General.InstanceID))
+func proxyWS(ctx context.Context, cfg config.Config, port string, serverTLS *tls.Config, limiter *proxy.ConnLimiter, upstreams upstream.Balancer, logger mflog.Logger, handler session.Handler, details []aproxy.HealthDetail) error {
+	address := fmt.Sprintf(":%s", port)
+	hcfg := cfg.HTTPAdapter
+	pcfg, err := proxyConfig(address, upstreams, hcfg.ProxyProtocol, hcfg.TrustedProxies, hcfg.AllowCIDRs, hcfg.DenyCIDRs)
+	if err != nil {
+		return err
+	}
+	pcfg = withLimits(pcfg, cfg.Limits, limiter)
+	pcfg.TLS = serverTLS
+	scheme := "ws"
+	if hcfg.TargetTLS {
+		pcfg.TargetTLS, err = proxy.ClientTLS(proxy.TLSConfig{
+			CAFile:     hcfg.TargetCAFile,
+			CertFile:   hcfg.TargetCertFile,
+			KeyFile:    hcfg.TargetKeyFile,
+			ServerName: hcfg.TargetServerName,
+			MinVersion: hcfg.TargetTLSMinVersion,
+		})
+		if err != nil {
+			return err
+		}
+		scheme = "wss"
+	}
+	wp := proxy.NewWebSocket(pcfg, cfg.HTTPAdapter.HTTPTargetPath, scheme, handler, logger)
+	mux := http.NewServeMux()
+	mux.Handle("/mqtt", wp.Handler())
+	mux.Handle("/health", wp.Protect(aproxy.Health(svcName, cfg.General.InstanceID, details...)))
+
+	l, err := wp.Listen()
+	if err != nil {
+		return err
+	}
+	// The clients have the connect timeout to send the request headers,
+	// and the idle connections are closed after it.
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: pcfg.ConnectTimeout,
+		IdleTimeout:       pcfg.ConnectTimeout,
+	}
 
 	errCh := make(chan error)
 
 	go func() {
-		errCh <- wp.Listen(cfg.HTTPAdapter.HTTPPort)
+		errCh <- server.Serve(l)
 	}()
 
 	select {
 	case <-ctx.Done():
-		logger.Info(fmt.Sprintf("proxy MQTT WS shutdown at %s", target))
-		return nil
+		logger.Info(fmt.Sprintf("proxy MQTT WS shutdown at %s", address))
+		return server.Close()
+	case err := <-errCh:
+		return err
+	}
+}
+
+func serveAdmin(ctx context.Context, cfg config.AdminConfig, logger mflog.Logger, res admin.Resources) error {
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%s", cfg.Port),
+		Handler: admin.MakeHandler(cfg.Token, res),
+	}
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- server.ListenAndServe()
+	}()
+
+	select {
+	case <-ctx.Done():
+		logger.Info(fmt.Sprintf("admin API shutdown at %s", server.Addr))
+		return server.Close()
 	case err := <-errCh:
 		return err
 	}
 }
 
+func proxyConfig(address string, upstreams upstream.Balancer, proxyProtocol bool, trustedProxies, allowCIDRs, denyCIDRs []string) (proxy.Config, error) {
+	trusted, err := proxy.ParseCIDRs(trustedProxies)
+	if err != nil {
+		return proxy.Config{}, err
+	}
+	if proxyProtocol && len(trusted) == 0 {
+		return proxy.Config{}, errors.New("PROXY protocol is enabled without trusted proxies")
+	}
+	allowed, err := proxy.ParseCIDRs(allowCIDRs)
+	if err != nil {
+		return proxy.Config{}, err
+	}
+	denied, err := proxy.ParseCIDRs(denyCIDRs)
+	if err != nil {
+		return proxy.Config{}, err
+	}
+
+	return proxy.Config{
+		Address:         address,
+		Upstreams:       upstreams,
+		ProxyProtocol:   proxyProtocol,
+		TrustedProxies:  trusted,
+		AllowedNetworks: allowed,
+		DeniedNetworks:  denied,
+	}, nil
+}
+
+func newPool(cfg config.UpstreamConfig, targets []string, target, probe string, logger mflog.Logger) (*upstream.Pool, error) {
+	if len(targets) == 0 {
+		targets = []string{target}
+	}
+
+	return upstream.NewPool(upstream.Config{
+		Targets:  targets,
+		Strategy: cfg.Strategy,
+		Probe:    probe,
+		Interval: time.Duration(cfg.ProbeInterval),
+		Timeout:  time.Duration(cfg.ProbeTimeout),
+		Cooldown: time.Duration(cfg.Cooldown),
+	}, logger)
+}
+
+func newRouter(cfg config.UpstreamConfig, targets []string, target, probe string, routes config.ListMap, resolve upstream.Resolver, logger mflog.Logger) (*upstream.Router, error) {
+	fallback, err := newPool(cfg, targets, target, probe, logger)
+	if err != nil {
+		return nil, err
+	}
+	router := upstream.NewRouter(fallback, resolve)
+	for match, targets := range routes {
+		pool, err := newPool(cfg, targets, target, probe, logger)
+		if err != nil {
+			return nil, err
+		}
+		if err := router.AddRoute(match, pool); err != nil {
+			return nil, err
+		}
+	}
+
+	return router, nil
+}
+
+func upstreamConfig(cfg config.MQTTAdapterConfig) (mproxy.UpstreamConfig, error) {
+	ucfg := mproxy.UpstreamConfig{
+		ClientIDTemplate: cfg.UpstreamClientID,
+	}
+	if cfg.UpstreamUsername != "" {
+		ucfg.Credentials = &mproxy.Credentials{
+			Username: cfg.UpstreamUsername,
+			Password: cfg.UpstreamPassword,
+		}
+	}
+	if cfg.UpstreamSecretsFile != "" {
+		creds, err := mproxy.LoadCredentials(cfg.UpstreamSecretsFile)
+		if err != nil {
+			return mproxy.UpstreamConfig{}, err
+		}
+		ucfg.TenantCredentials = creds
+	}
+
+	return ucfg, nil
+}
+
+func credentialMappings(cfg config.ListMap) (map[string]mproxy.CredentialMapping, error) {
+	mappings := make(map[string]mproxy.CredentialMapping, len(cfg))
+	for listener, fields := range cfg {
+		switch listener {
+		case proxy.MQTT, proxy.MQTTS, proxy.WebSocket, proxy.WSS:
+		default:
+			return nil, fmt.Errorf("credential mapping of unknown listener %s", listener)
+		}
+		m, err := mproxy.ParseCredentialMapping(fields)
+		if err != nil {
+			return nil, fmt.Errorf("credential mapping of listener %s: %w", listener, err)
+		}
+		mappings[listener] = m
+	}
+
+	return mappings, nil
+}
+
+func maxAgeConfig(cfg config.SessionsConfig) (mproxy.MaxAgeConfig, error) {
+	mcfg := mproxy.MaxAgeConfig{
+		MaxAge: time.Duration(cfg.MaxAge),
+		Jitter: time.Duration(cfg.MaxAgeJitter),
+		Things: make(map[string]time.Duration),
+	}
+	for id, ages := range cfg.ThingMaxAge {
+		if len(ages) != 1 {
+			return mproxy.MaxAgeConfig{}, fmt.Errorf("invalid maximum session age of thing %s", id)
+		}
+		age, err := time.ParseDuration(ages[0])
+		if err != nil {
+			return mproxy.MaxAgeConfig{}, fmt.Errorf("invalid maximum session age of thing %s: %w", id, err)
+		}
+		mcfg.Things[id] = age
+	}
+
+	return mcfg, nil
+}
+
+// newReloader returns the reloader of the certificates of the TLS listeners
+// and their virtual hosts.
+func newReloader(cfg config.TLSConfig, hosts []config.VirtualHost, logger mflog.Logger) (*proxy.Reloader, error) {
+	vhosts := make(map[string]proxy.ServerTLSConfig, len(hosts))
+	for _, vh := range hosts {
+		vhosts[vh.Name] = proxy.ServerTLSConfig{
+			CertFile:     vh.CertFile,
+			KeyFile:      vh.KeyFile,
+			ClientCAFile: vh.ClientCAFile,
+			ClientAuth:   vh.ClientAuth,
+		}
+	}
+
+	return proxy.NewReloader(proxy.ServerTLSConfig{
+		CertFile:     cfg.CertFile,
+		KeyFile:      cfg.KeyFile,
+		ClientCAFile: cfg.ClientCAFile,
+		ClientAuth:   cfg.ClientAuth,
+	}, vhosts, logger)
+}
+
+// clientCAFiles returns the client CA files of the TLS listeners and their
+// virtual hosts, which issue the CRLs client certificates are checked against.
+func clientCAFiles(cfg config.TLSConfig, hosts []config.VirtualHost) []string {
+	var files []string
+	if cfg.ClientCAFile != "" {
+		files = append(files, cfg.ClientCAFile)
+	}
+	for _, vh := range hosts {
+		if vh.ClientCAFile != "" {
+			files = append(files, vh.ClientCAFile)
+		}
+	}
+
+	return files
+}
+
+// hostRoutes adds the routes of the virtual hosts which have their own
+// MQTT brokers to the configured routes.
+func hostRoutes(routes config.ListMap, hosts []config.VirtualHost, targets func(config.VirtualHost) []string) config.ListMap {
+	all := make(config.ListMap, len(routes)+len(hosts))
+	for match, t := range routes {
+		all[match] = t
+	}
+	for _, vh := range hosts {
+		if t := targets(vh); len(t) > 0 {
+			all[upstream.HostMatch+"="+vh.Name] = t
+		}
+	}
+
+	return all
+}
+
+func mqttTargets(vh config.VirtualHost) []string {
+	return vh.MQTTTargets
+}
+
+func wsTargets(vh config.VirtualHost) []string {
+	return vh.WSTargets
+}
+
+// certMapper returns the mapper of client certificates to things. The rules
+// of the mapping file take precedence over the configured ones, and the
+// secrets of the mapped things are loaded from the mapping file.
+func certMapper(cfg config.CertMappingConfig) (*certmap.Mapper, error) {
+	var f certmap.File
+	if cfg.File != "" {
+		var err error
+		if f, err = certmap.LoadFile(cfg.File); err != nil {
+			return nil, err
+		}
+	}
+	for attr := range cfg.Rules {
+		switch attr {
+		case certmap.Serial, certmap.SPKI, certmap.URI, certmap.DNS, certmap.CN:
+		default:
+			return nil, errors.Wrap(certmap.ErrInvalidRule, errors.New("unknown attribute "+attr))
+		}
+	}
+	// Attributes are applied from the most to the least specific one.
+	for _, attr := range []string{certmap.Serial, certmap.SPKI, certmap.URI, certmap.DNS, certmap.CN} {
+		for _, template := range cfg.Rules[attr] {
+			f.Rules = append(f.Rules, certmap.Rule{Attribute: attr, ThingID: template})
+		}
+	}
+
+	return certmap.NewMapper(f.Rules, f.Secrets)
+}
+
+// checkCertMapping requires the client CA bundles when the certificates are
+// mapped to things. The CA bundle may be set for the listeners, for the
+// virtual hosts, or for both, but the listeners and the virtual hosts which
+// accept client certificates need their own. Without it, client certificates
+// are verified against the system roots, so any publicly issued certificate
+// could be mapped.
+func checkCertMapping(cfg config.CertMappingConfig, tcfg config.TLSConfig, hosts []config.VirtualHost) error {
+	if cfg.File == "" && len(cfg.Rules) == 0 {
+		return nil
+	}
+	if acceptsWithoutCA(tcfg.ClientCAFile, tcfg.ClientAuth) {
+		return errors.New("certificate mapping is enabled without APROXY_TLS_CLIENT_CA_FILE")
+	}
+	cas := tcfg.ClientCAFile != ""
+	for _, vh := range hosts {
+		if acceptsWithoutCA(vh.ClientCAFile, vh.ClientAuth) {
+			return fmt.Errorf("certificate mapping is enabled without client CA file of virtual host %s", vh.Name)
+		}
+		cas = cas || vh.ClientCAFile != ""
+	}
+	if !cas {
+		return errors.New("certificate mapping is enabled without APROXY_TLS_CLIENT_CA_FILE or client CA file of any virtual host")
+	}
+
+	return nil
+}
+
+// acceptsWithoutCA checks if the client certificates are requested without
+// the CA bundle to verify them with.
+func acceptsWithoutCA(caFile, clientAuth string) bool {
+	return caFile == "" && clientAuth != "" && clientAuth != proxy.ClientAuthNone
+}
+
+// warnSystemRoots warns that the Things gRPC server certificate is verified
+// against the system roots. Earlier versions skipped the verification when the
+// CA certificates were not set, so self-signed certificates stop working.
+func warnSystemRoots(logger mflog.Logger, host string, c grpcclient.ClientHandler) {
+	if c.SystemRoots() {
+		logger.Warn(fmt.Sprintf("Things grpc server certificate of host %s is verified against the system roots, since APROXY_THINGS_AUTH_GRPC_CA_CERTS is not set; set it if the certificate is self-signed", host))
+	}
+}
+
+// grpcStates returns the connection states of the gRPC clients by name.
+func grpcStates(clients map[string]grpcclient.ClientHandler) map[string]string {
+	states := make(map[string]string, len(clients))
+	for name, c := range clients {
+		states[name] = c.State()
+	}
+
+	return states
+}
+
+func withLimits(pcfg proxy.Config, limits config.LimitsConfig, limiter *proxy.ConnLimiter) proxy.Config {
+	pcfg.Limiter = limiter
+	pcfg.ConnectTimeout = time.Duration(limits.ConnectTimeout)
+	pcfg.MaxKeepAlive = time.Duration(limits.MaxKeepAlive)
+	pcfg.MaxPacketSize = limits.MaxPacketSize
+
+	return pcfg
+}
+
 func healthcheck(cfg config.MQTTAdapterConfig) func() error {
 	return func() error {
 		res, err := http.Get(cfg.MQTTTargetHealthCheck)
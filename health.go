@@ -46,10 +46,19 @@ type HealthInfo struct {
 
 	// InstanceID contains the ID of the current service instance
 	InstanceID string `json:"instance_id"`
+
+	// Details contains additional service details, such as connection counts.
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// HealthDetail provides a named detail of the service health.
+type HealthDetail struct {
+	Name  string
+	Value func() interface{}
 }
 
 // Health exposes an HTTP handler for retrieving service health.
-func Health(service, instanceID string) http.HandlerFunc {
+func Health(service, instanceID string, details ...HealthDetail) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add(contentType, contentTypeJSON)
 		if r.Method != http.MethodGet && r.Method != http.MethodHead {
@@ -65,6 +74,12 @@ func Health(service, instanceID string) http.HandlerFunc {
 			BuildTime:   BuildTime,
 			InstanceID:  instanceID,
 		}
+		if len(details) > 0 {
+			res.Details = make(map[string]interface{}, len(details))
+			for _, d := range details {
+				res.Details[d.Name] = d.Value()
+			}
+		}
 
 		w.WriteHeader(http.StatusOK)
 
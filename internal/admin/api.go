@@ -0,0 +1,186 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+// Package admin provides HTTP API for inspecting and managing aProxy state.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"expvar"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/absmach/aproxy/internal/lockout"
+	"github.com/absmach/aproxy/internal/revocation"
+	"github.com/absmach/aproxy/mqtt"
+	"github.com/go-zoo/bone"
+	"github.com/mainflux/mainflux/pkg/errors"
+)
+
+const (
+	contentType     = "Content-Type"
+	contentTypeJSON = "application/json"
+	authorization   = "Authorization"
+	bearerPrefix    = "Bearer "
+)
+
+// Resources contains the state exposed by admin API.
+// Resources which are nil are not exposed.
+type Resources struct {
+	Lockouts   *lockout.Tracker
+	Sessions   *mqtt.Registry
+	Revocation *revocation.Checker
+
+	// Handler closes the live sessions of the denied certificates.
+	Handler mqtt.Handler
+}
+
+// MakeHandler returns HTTP handler for admin API. All the requests
+// must be authorized using the token as bearer token.
+func MakeHandler(token string, res Resources) http.Handler {
+	mux := bone.New()
+
+	mux.Get("/debug/vars", expvar.Handler())
+
+	if res.Lockouts != nil {
+		mux.GetFunc("/lockouts", listLockouts(res.Lockouts))
+		mux.DeleteFunc("/lockouts/:key", unlock(res.Lockouts))
+	}
+	if res.Sessions != nil {
+		mux.GetFunc("/sessions", listSessions(res.Sessions))
+	}
+	if res.Revocation != nil {
+		mux.GetFunc("/denylist", listDenied(res.Revocation))
+		mux.PutFunc("/denylist/:key", deny(res.Revocation, res.Handler))
+		mux.DeleteFunc("/denylist/:key", allow(res.Revocation))
+		mux.GetFunc("/crls", listCRLs(res.Revocation))
+	}
+
+	return authorize(token, mux)
+}
+
+func authorize(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get(authorization)
+		if !strings.HasPrefix(header, bearerPrefix) ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, bearerPrefix)), []byte(token)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func listLockouts(tracker *lockout.Tracker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		encode(w, http.StatusOK, map[string]interface{}{
+			"lockouts": tracker.Locked(),
+		})
+	}
+}
+
+func unlock(tracker *lockout.Tracker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, err := url.PathUnescape(bone.GetValue(r, "key"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if !tracker.Unlock(key) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func listSessions(registry *mqtt.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		encode(w, http.StatusOK, map[string]interface{}{
+			"sessions": registry.Sessions(),
+		})
+	}
+}
+
+func listDenied(checker *revocation.Checker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		encode(w, http.StatusOK, map[string]interface{}{
+			"denylist": checker.Denied(),
+		})
+	}
+}
+
+func deny(checker *revocation.Checker, h mqtt.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, err := url.PathUnescape(bone.GetValue(r, "key"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var req struct {
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		e, err := checker.Deny(key, req.Reason)
+		switch {
+		case errors.Contains(err, revocation.ErrInvalidKey):
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		case err != nil:
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if h != nil {
+			h.RevokeCert(r.Context(), e.Key, deniedReason(e))
+		}
+		encode(w, http.StatusOK, e)
+	}
+}
+
+func deniedReason(e revocation.Entry) string {
+	if e.Reason == "" {
+		return "certificate denied"
+	}
+	return "certificate denied: " + e.Reason
+}
+
+func allow(checker *revocation.Checker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, err := url.PathUnescape(bone.GetValue(r, "key"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		ok, err := checker.Allow(key)
+		switch {
+		case errors.Contains(err, revocation.ErrInvalidKey):
+			w.WriteHeader(http.StatusBadRequest)
+		case err != nil:
+			w.WriteHeader(http.StatusInternalServerError)
+		case !ok:
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
+
+func listCRLs(checker *revocation.Checker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		encode(w, http.StatusOK, map[string]interface{}{
+			"crls": checker.Status(),
+		})
+	}
+}
+
+func encode(w http.ResponseWriter, code int, res interface{}) {
+	w.Header().Set(contentType, contentTypeJSON)
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,199 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+// Package certmap maps client certificates to thing identities, so the
+// things using mutual TLS don't need to send their secrets.
+package certmap
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/mainflux/mainflux/pkg/errors"
+)
+
+// Certificate attributes the rules match on.
+const (
+	CN     = "cn"
+	DNS    = "dns"
+	URI    = "uri"
+	Serial = "serial"
+	SPKI   = "spki"
+)
+
+// Thing ID template placeholders.
+const (
+	CNPlaceholder     = "{CN}"
+	DNSPlaceholder    = "{DNS}"
+	URIPlaceholder    = "{URI}"
+	SerialPlaceholder = "{serial}"
+	SPKIPlaceholder   = "{spki}"
+)
+
+var (
+	// ErrInvalidRule indicates malformed mapping rule.
+	ErrInvalidRule = errors.New("invalid certificate mapping rule")
+
+	// ErrMissingSecret indicates that the certificate is mapped to the thing
+	// whose secret is unknown.
+	ErrMissingSecret = errors.New("secret of the mapped thing not found")
+
+	// ErrFailedLoad indicates that the mapping file can't be loaded.
+	ErrFailedLoad = errors.New("failed to load certificate mapping")
+)
+
+// Identity is the thing identity the certificate is mapped to.
+type Identity struct {
+	ThingID string
+	Secret  string
+}
+
+// Resolver resolves the thing identity of the client certificate. It returns
+// false if the certificate is not mapped to any thing.
+type Resolver interface {
+	Resolve(ctx context.Context, cert *x509.Certificate) (Identity, bool, error)
+}
+
+// ResolverFunc is a function which resolves the thing identity, such as
+// a lookup in an external inventory.
+type ResolverFunc func(ctx context.Context, cert *x509.Certificate) (Identity, bool, error)
+
+// Resolve calls f(ctx, cert).
+func (f ResolverFunc) Resolve(ctx context.Context, cert *x509.Certificate) (Identity, bool, error) {
+	return f(ctx, cert)
+}
+
+// Rule maps the certificates whose attribute matches the pattern to the thing.
+type Rule struct {
+	// Attribute is the certificate attribute: CN, DNS, URI, Serial or SPKI.
+	// Each DNS and URI subject alternative name is matched separately.
+	Attribute string `json:"attribute"`
+
+	// Pattern is the regular expression the attribute must match.
+	// If empty, any value matches.
+	Pattern string `json:"pattern"`
+
+	// ThingID is the template of the thing ID, e.g. "thing-{CN}". The
+	// placeholder of the matched attribute is replaced with the matched
+	// value, and the DNS and URI placeholders of the other attributes with
+	// the first subject alternative name.
+	ThingID string `json:"thing_id"`
+
+	re *regexp.Regexp
+}
+
+// File contains the mapping rules and the secrets of the mapped things.
+type File struct {
+	Rules   []Rule            `json:"rules"`
+	Secrets map[string]string `json:"secrets"`
+}
+
+var _ Resolver = (*Mapper)(nil)
+
+// Mapper maps the certificates to the things by the first rule which matches.
+type Mapper struct {
+	rules   []Rule
+	secrets map[string]string
+}
+
+// NewMapper returns a new mapper. Secrets map thing IDs to the thing secrets.
+func NewMapper(rules []Rule, secrets map[string]string) (*Mapper, error) {
+	m := &Mapper{
+		secrets: secrets,
+	}
+	for _, r := range rules {
+		switch r.Attribute {
+		case CN, DNS, URI, Serial, SPKI:
+		default:
+			return nil, errors.Wrap(ErrInvalidRule, errors.New("unknown attribute "+r.Attribute))
+		}
+		if r.ThingID == "" {
+			return nil, errors.Wrap(ErrInvalidRule, errors.New("thing ID not set"))
+		}
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, errors.Wrap(ErrInvalidRule, err)
+		}
+		r.re = re
+		m.rules = append(m.rules, r)
+	}
+
+	return m, nil
+}
+
+// LoadFile loads the mapping from the JSON file.
+func LoadFile(path string) (File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return File{}, errors.Wrap(ErrFailedLoad, err)
+	}
+	var f File
+	if err := json.Unmarshal(data, &f); err != nil {
+		return File{}, errors.Wrap(ErrFailedLoad, err)
+	}
+
+	return f, nil
+}
+
+// Resolve returns the identity of the thing the certificate is mapped to.
+func (m *Mapper) Resolve(_ context.Context, cert *x509.Certificate) (Identity, bool, error) {
+	attrs := attributes(cert)
+	for _, r := range m.rules {
+		for _, value := range attrs[r.Attribute] {
+			if !r.re.MatchString(value) {
+				continue
+			}
+			thingID := expand(r.ThingID, attrs, r.Attribute, value)
+			secret, ok := m.secrets[thingID]
+			if !ok {
+				return Identity{}, false, errors.Wrap(ErrMissingSecret, errors.New(thingID))
+			}
+			return Identity{ThingID: thingID, Secret: secret}, true, nil
+		}
+	}
+
+	return Identity{}, false, nil
+}
+
+func attributes(cert *x509.Certificate) map[string][]string {
+	spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	attrs := map[string][]string{
+		Serial: {cert.SerialNumber.Text(16)},
+		SPKI:   {hex.EncodeToString(spki[:])},
+		DNS:    cert.DNSNames,
+	}
+	if cert.Subject.CommonName != "" {
+		attrs[CN] = []string{cert.Subject.CommonName}
+	}
+	for _, u := range cert.URIs {
+		attrs[URI] = append(attrs[URI], u.String())
+	}
+
+	return attrs
+}
+
+func expand(template string, attrs map[string][]string, attr, value string) string {
+	first := func(a string) string {
+		if a == attr {
+			return value
+		}
+		if len(attrs[a]) > 0 {
+			return attrs[a][0]
+		}
+		return ""
+	}
+
+	return strings.NewReplacer(
+		CNPlaceholder, first(CN),
+		DNSPlaceholder, first(DNS),
+		URIPlaceholder, first(URI),
+		SerialPlaceholder, first(Serial),
+		SPKIPlaceholder, first(SPKI),
+	).Replace(template)
+}
@@ -0,0 +1,215 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package certmap
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mainflux/mainflux/pkg/errors"
+)
+
+func testCert(t *testing.T) *x509.Certificate {
+	u, err := url.Parse("spiffe://example.com/thing/42")
+	if err != nil {
+		t.Fatalf("failed to parse URI: %s", err)
+	}
+
+	return &x509.Certificate{
+		SerialNumber:            big.NewInt(0x1a2b),
+		Subject:                 pkix.Name{CommonName: "sensor-1"},
+		DNSNames:                []string{"gw.example.com", "sensor-1.devices.example.com"},
+		URIs:                    []*url.URL{u},
+		RawSubjectPublicKeyInfo: []byte("public key"),
+	}
+}
+
+func TestNewMapper(t *testing.T) {
+	cases := []struct {
+		desc string
+		rule Rule
+		err  error
+	}{
+		{
+			desc: "valid rule",
+			rule: Rule{Attribute: CN, Pattern: "^sensor-", ThingID: "{CN}"},
+		},
+		{
+			desc: "rule without pattern",
+			rule: Rule{Attribute: Serial, ThingID: "{serial}"},
+		},
+		{
+			desc: "unknown attribute",
+			rule: Rule{Attribute: "email", ThingID: "{CN}"},
+			err:  ErrInvalidRule,
+		},
+		{
+			desc: "rule without thing ID",
+			rule: Rule{Attribute: CN},
+			err:  ErrInvalidRule,
+		},
+		{
+			desc: "invalid pattern",
+			rule: Rule{Attribute: CN, Pattern: "sensor-[", ThingID: "{CN}"},
+			err:  ErrInvalidRule,
+		},
+	}
+
+	for _, tc := range cases {
+		_, err := NewMapper([]Rule{tc.rule}, nil)
+		if !errors.Contains(err, tc.err) || (err == nil) != (tc.err == nil) {
+			t.Errorf("%s: expected error %v got %v", tc.desc, tc.err, err)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	cert := testCert(t)
+	spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	spkiHex := hex.EncodeToString(spki[:])
+	secrets := map[string]string{
+		"sensor-1":                          "cn-secret",
+		"dns-sensor-1.devices.example.com":  "dns-secret",
+		"uri-spiffe://example.com/thing/42": "uri-secret",
+		"serial-1a2b":                       "serial-secret",
+		"spki-" + spkiHex:                   "spki-secret",
+		"sensor-1/gw.example.com/1a2b":      "combined-secret",
+	}
+
+	cases := []struct {
+		desc   string
+		rules  []Rule
+		cert   *x509.Certificate
+		id     Identity
+		mapped bool
+		err    error
+	}{
+		{
+			desc:   "CN",
+			rules:  []Rule{{Attribute: CN, ThingID: "{CN}"}},
+			id:     Identity{ThingID: "sensor-1", Secret: "cn-secret"},
+			mapped: true,
+		},
+		{
+			desc:   "matched DNS name instead of the first one",
+			rules:  []Rule{{Attribute: DNS, Pattern: `\.devices\.example\.com$`, ThingID: "dns-{DNS}"}},
+			id:     Identity{ThingID: "dns-sensor-1.devices.example.com", Secret: "dns-secret"},
+			mapped: true,
+		},
+		{
+			desc:   "URI",
+			rules:  []Rule{{Attribute: URI, Pattern: "^spiffe://", ThingID: "uri-{URI}"}},
+			id:     Identity{ThingID: "uri-spiffe://example.com/thing/42", Secret: "uri-secret"},
+			mapped: true,
+		},
+		{
+			desc:   "serial number",
+			rules:  []Rule{{Attribute: Serial, ThingID: "serial-{serial}"}},
+			id:     Identity{ThingID: "serial-1a2b", Secret: "serial-secret"},
+			mapped: true,
+		},
+		{
+			desc:   "SPKI fingerprint",
+			rules:  []Rule{{Attribute: SPKI, Pattern: "^" + spkiHex + "$", ThingID: "spki-{spki}"}},
+			id:     Identity{ThingID: "spki-" + spkiHex, Secret: "spki-secret"},
+			mapped: true,
+		},
+		{
+			desc:   "placeholders of other attributes with the first values",
+			rules:  []Rule{{Attribute: CN, ThingID: "{CN}/{DNS}/{serial}"}},
+			id:     Identity{ThingID: "sensor-1/gw.example.com/1a2b", Secret: "combined-secret"},
+			mapped: true,
+		},
+		{
+			desc: "first matching rule",
+			rules: []Rule{
+				{Attribute: CN, Pattern: "^gateway-", ThingID: "{CN}"},
+				{Attribute: Serial, ThingID: "serial-{serial}"},
+				{Attribute: CN, ThingID: "{CN}"},
+			},
+			id:     Identity{ThingID: "serial-1a2b", Secret: "serial-secret"},
+			mapped: true,
+		},
+		{
+			desc: "rule mapped to thing without secret",
+			rules: []Rule{
+				{Attribute: CN, ThingID: "unknown-{CN}"},
+				{Attribute: Serial, ThingID: "serial-{serial}"},
+			},
+			err: ErrMissingSecret,
+		},
+		{
+			desc:  "no matching rule",
+			rules: []Rule{{Attribute: CN, Pattern: "^gateway-", ThingID: "{CN}"}},
+		},
+		{
+			desc:  "certificate without the attribute",
+			rules: []Rule{{Attribute: CN, ThingID: "{CN}"}},
+			cert:  &x509.Certificate{SerialNumber: big.NewInt(1)},
+		},
+		{
+			desc:  "no rules",
+			rules: nil,
+		},
+	}
+
+	for _, tc := range cases {
+		m, err := NewMapper(tc.rules, secrets)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", tc.desc, err)
+		}
+		c := cert
+		if tc.cert != nil {
+			c = tc.cert
+		}
+		id, mapped, err := m.Resolve(context.Background(), c)
+		if !errors.Contains(err, tc.err) || (err == nil) != (tc.err == nil) {
+			t.Errorf("%s: expected error %v got %v", tc.desc, tc.err, err)
+		}
+		if id != tc.id || mapped != tc.mapped {
+			t.Errorf("%s: expected identity %+v mapped %t got %+v mapped %t", tc.desc, tc.id, tc.mapped, id, mapped)
+		}
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.json")
+	if err := os.WriteFile(valid, []byte(`{"rules": [{"attribute": "cn", "thing_id": "{CN}"}], "secrets": {"sensor-1": "secret"}}`), 0o600); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+	malformed := filepath.Join(dir, "malformed.json")
+	if err := os.WriteFile(malformed, []byte(`{"rules": `), 0o600); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+
+	cases := []struct {
+		desc  string
+		path  string
+		rules int
+		err   error
+	}{
+		{desc: "valid file", path: valid, rules: 1},
+		{desc: "malformed file", path: malformed, err: ErrFailedLoad},
+		{desc: "missing file", path: filepath.Join(dir, "missing.json"), err: ErrFailedLoad},
+	}
+
+	for _, tc := range cases {
+		f, err := LoadFile(tc.path)
+		if !errors.Contains(err, tc.err) || (err == nil) != (tc.err == nil) {
+			t.Errorf("%s: expected error %v got %v", tc.desc, tc.err, err)
+		}
+		if len(f.Rules) != tc.rules {
+			t.Errorf("%s: expected %d rules got %d", tc.desc, tc.rules, len(f.Rules))
+		}
+	}
+}
@@ -1,8 +1,10 @@
 package config
 
 import (
+	"fmt"
 	"io"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/caarlos0/env/v7"
@@ -11,19 +13,142 @@ import (
 
 // MQTTAdapterConfig configuration for mqtt proxy.
 type MQTTAdapterConfig struct {
-	MQTTPort              string   `toml:"PORT"              env:"APROXY_MQTT_ADAPTER_MQTT_PORT"                envDefault:"1883"`
-	MQTTTargetHost        string   `toml:"TARGET_HOST"       env:"APROXY_MQTT_ADAPTER_MQTT_TARGET_HOST"         envDefault:"localhost"`
-	MQTTTargetPort        string   `toml:"TARGET_PORT"       env:"APROXY_MQTT_ADAPTER_MQTT_TARGET_PORT"         envDefault:"1883"`
-	MQTTForwarderTimeout  Duration `toml:"FORWARDER_TIMEOUT" env:"APROXY_MQTT_ADAPTER_FORWARDER_TIMEOUT"        envDefault:"30s"`
-	MQTTTargetHealthCheck string   `toml:"HEALTH_CHECK"      env:"APROXY_MQTT_ADAPTER_MQTT_TARGET_HEALTH_CHECK" envDefault:""`
+	MQTTPort              string   `toml:"PORT"                   env:"APROXY_MQTT_ADAPTER_MQTT_PORT"                   envDefault:"1883"`
+	MQTTTargetHost        string   `toml:"TARGET_HOST"            env:"APROXY_MQTT_ADAPTER_MQTT_TARGET_HOST"            envDefault:"localhost"`
+	MQTTTargets           []string `toml:"TARGETS"                env:"APROXY_MQTT_ADAPTER_MQTT_TARGETS"                envDefault:""`
+	MQTTTargetProbe       string   `toml:"TARGET_PROBE"           env:"APROXY_MQTT_ADAPTER_MQTT_TARGET_PROBE"           envDefault:""`
+	MQTTRoutes            ListMap  `toml:"ROUTES"                 env:"APROXY_MQTT_ADAPTER_MQTT_ROUTES"                 envDefault:""`
+	MQTTTargetPort        string   `toml:"TARGET_PORT"            env:"APROXY_MQTT_ADAPTER_MQTT_TARGET_PORT"            envDefault:"1883"`
+	MQTTForwarderTimeout  Duration `toml:"FORWARDER_TIMEOUT"      env:"APROXY_MQTT_ADAPTER_FORWARDER_TIMEOUT"           envDefault:"30s"`
+	MQTTTargetHealthCheck string   `toml:"HEALTH_CHECK"           env:"APROXY_MQTT_ADAPTER_MQTT_TARGET_HEALTH_CHECK"    envDefault:""`
+	SysThings             []string `toml:"SYS_THINGS"             env:"APROXY_MQTT_ADAPTER_SYS_THINGS"                  envDefault:""`
+	ContentTypes          ListMap  `toml:"CONTENT_TYPES"          env:"APROXY_MQTT_ADAPTER_CONTENT_TYPES"               envDefault:""`
+	MsgBrokerURL          string   `toml:"MSG_BROKER_URL"         env:"APROXY_MQTT_ADAPTER_MSG_BROKER_URL"              envDefault:""`
+	MsgBrokerQueue        int      `toml:"MSG_BROKER_QUEUE"       env:"APROXY_MQTT_ADAPTER_MSG_BROKER_QUEUE"            envDefault:"1000"`
+	EventsTopic           string   `toml:"EVENTS_TOPIC"           env:"APROXY_MQTT_ADAPTER_EVENTS_TOPIC"                envDefault:""`
+	ProxyProtocol         bool     `toml:"PROXY_PROTOCOL"         env:"APROXY_MQTT_ADAPTER_MQTT_PROXY_PROTOCOL"         envDefault:"false"`
+	TrustedProxies        []string `toml:"TRUSTED_PROXIES"        env:"APROXY_MQTT_ADAPTER_MQTT_TRUSTED_PROXIES"        envDefault:""`
+	AllowCIDRs            []string `toml:"ALLOW_CIDRS"            env:"APROXY_MQTT_ADAPTER_MQTT_ALLOW_CIDRS"            envDefault:""`
+	DenyCIDRs             []string `toml:"DENY_CIDRS"             env:"APROXY_MQTT_ADAPTER_MQTT_DENY_CIDRS"             envDefault:""`
+	ThingNetworks         ListMap  `toml:"THING_NETWORKS"         env:"APROXY_MQTT_ADAPTER_THING_NETWORKS"              envDefault:""`
+	Tenants               ListMap  `toml:"TENANTS"                env:"APROXY_MQTT_ADAPTER_TENANTS"                     envDefault:""`
+	CredentialMappings    ListMap  `toml:"CREDENTIAL_MAPPINGS"    env:"APROXY_MQTT_ADAPTER_CREDENTIAL_MAPPINGS"         envDefault:""`
+	UpstreamUsername      string   `toml:"UPSTREAM_USERNAME"      env:"APROXY_MQTT_ADAPTER_UPSTREAM_USERNAME"           envDefault:""`
+	UpstreamPassword      string   `toml:"UPSTREAM_PASSWORD"      env:"APROXY_MQTT_ADAPTER_UPSTREAM_PASSWORD"           envDefault:""`
+	UpstreamSecretsFile   string   `toml:"UPSTREAM_SECRETS_FILE"  env:"APROXY_MQTT_ADAPTER_UPSTREAM_SECRETS_FILE"       envDefault:""`
+	UpstreamClientID      string   `toml:"UPSTREAM_CLIENT_ID"     env:"APROXY_MQTT_ADAPTER_UPSTREAM_CLIENT_ID"          envDefault:""`
+	TargetTLS             bool     `toml:"TARGET_TLS"             env:"APROXY_MQTT_ADAPTER_MQTT_TARGET_TLS"             envDefault:"false"`
+	TargetCAFile          string   `toml:"TARGET_CA_FILE"         env:"APROXY_MQTT_ADAPTER_MQTT_TARGET_CA_FILE"         envDefault:""`
+	TargetCertFile        string   `toml:"TARGET_CERT_FILE"       env:"APROXY_MQTT_ADAPTER_MQTT_TARGET_CERT_FILE"       envDefault:""`
+	TargetKeyFile         string   `toml:"TARGET_KEY_FILE"        env:"APROXY_MQTT_ADAPTER_MQTT_TARGET_KEY_FILE"        envDefault:""`
+	TargetServerName      string   `toml:"TARGET_SERVER_NAME"     env:"APROXY_MQTT_ADAPTER_MQTT_TARGET_SERVER_NAME"     envDefault:""`
+	TargetTLSMinVersion   string   `toml:"TARGET_TLS_MIN_VERSION" env:"APROXY_MQTT_ADAPTER_MQTT_TARGET_TLS_MIN_VERSION" envDefault:"1.2"`
 }
 
 // HTTPAdapterConfig configuration for ws proxy.
 type HTTPAdapterConfig struct {
-	HTTPPort       string `toml:"PORT"        env:"APROXY_MQTT_ADAPTER_WS_PORT"        envDefault:"8080"`
-	HTTPTargetHost string `toml:"TARGET_HOST" env:"APROXY_MQTT_ADAPTER_WS_TARGET_HOST" envDefault:"localhost"`
-	HTTPTargetPort string `toml:"TARGET_PORT" env:"APROXY_MQTT_ADAPTER_WS_TARGET_PORT" envDefault:"8080"`
-	HTTPTargetPath string `toml:"TARGET_PATH" env:"APROXY_MQTT_ADAPTER_WS_TARGET_PATH" envDefault:"/mqtt"`
+	HTTPPort            string   `toml:"PORT"                   env:"APROXY_MQTT_ADAPTER_WS_PORT"                   envDefault:"8080"`
+	HTTPTargetHost      string   `toml:"TARGET_HOST"            env:"APROXY_MQTT_ADAPTER_WS_TARGET_HOST"            envDefault:"localhost"`
+	HTTPTargetPort      string   `toml:"TARGET_PORT"            env:"APROXY_MQTT_ADAPTER_WS_TARGET_PORT"            envDefault:"8080"`
+	HTTPTargets         []string `toml:"TARGETS"                env:"APROXY_MQTT_ADAPTER_WS_TARGETS"                envDefault:""`
+	HTTPTargetProbe     string   `toml:"TARGET_PROBE"           env:"APROXY_MQTT_ADAPTER_WS_TARGET_PROBE"           envDefault:""`
+	HTTPRoutes          ListMap  `toml:"ROUTES"                 env:"APROXY_MQTT_ADAPTER_WS_ROUTES"                 envDefault:""`
+	HTTPTargetPath      string   `toml:"TARGET_PATH"            env:"APROXY_MQTT_ADAPTER_WS_TARGET_PATH"            envDefault:"/mqtt"`
+	ProxyProtocol       bool     `toml:"PROXY_PROTOCOL"         env:"APROXY_MQTT_ADAPTER_WS_PROXY_PROTOCOL"         envDefault:"false"`
+	TrustedProxies      []string `toml:"TRUSTED_PROXIES"        env:"APROXY_MQTT_ADAPTER_WS_TRUSTED_PROXIES"        envDefault:""`
+	AllowCIDRs          []string `toml:"ALLOW_CIDRS"            env:"APROXY_MQTT_ADAPTER_WS_ALLOW_CIDRS"            envDefault:""`
+	DenyCIDRs           []string `toml:"DENY_CIDRS"             env:"APROXY_MQTT_ADAPTER_WS_DENY_CIDRS"             envDefault:""`
+	TargetTLS           bool     `toml:"TARGET_TLS"             env:"APROXY_MQTT_ADAPTER_WS_TARGET_TLS"             envDefault:"false"`
+	TargetCAFile        string   `toml:"TARGET_CA_FILE"         env:"APROXY_MQTT_ADAPTER_WS_TARGET_CA_FILE"         envDefault:""`
+	TargetCertFile      string   `toml:"TARGET_CERT_FILE"       env:"APROXY_MQTT_ADAPTER_WS_TARGET_CERT_FILE"       envDefault:""`
+	TargetKeyFile       string   `toml:"TARGET_KEY_FILE"        env:"APROXY_MQTT_ADAPTER_WS_TARGET_KEY_FILE"        envDefault:""`
+	TargetServerName    string   `toml:"TARGET_SERVER_NAME"     env:"APROXY_MQTT_ADAPTER_WS_TARGET_SERVER_NAME"     envDefault:""`
+	TargetTLSMinVersion string   `toml:"TARGET_TLS_MIN_VERSION" env:"APROXY_MQTT_ADAPTER_WS_TARGET_TLS_MIN_VERSION" envDefault:"1.2"`
+}
+
+// LimitsConfig configuration for connection and session limits.
+type LimitsConfig struct {
+	MaxConns           int      `toml:"MAX_CONNS"            env:"APROXY_LIMITS_MAX_CONNS"            envDefault:"0"`
+	MaxConnsPerIP      int      `toml:"MAX_CONNS_PER_IP"     env:"APROXY_LIMITS_MAX_CONNS_PER_IP"     envDefault:"0"`
+	MaxThingSessions   int      `toml:"MAX_THING_SESSIONS"   env:"APROXY_LIMITS_MAX_THING_SESSIONS"   envDefault:"0"`
+	ThingSessionPolicy string   `toml:"THING_SESSION_POLICY" env:"APROXY_LIMITS_THING_SESSION_POLICY" envDefault:"reject"`
+	ClientIDPolicy     string   `toml:"CLIENT_ID_POLICY"     env:"APROXY_LIMITS_CLIENT_ID_POLICY"     envDefault:"allow"`
+	ConnectTimeout     Duration `toml:"CONNECT_TIMEOUT"      env:"APROXY_LIMITS_CONNECT_TIMEOUT"      envDefault:"10s"`
+	MaxKeepAlive       Duration `toml:"MAX_KEEP_ALIVE"       env:"APROXY_LIMITS_MAX_KEEP_ALIVE"       envDefault:"0s"`
+	MaxPacketSize      int      `toml:"MAX_PACKET_SIZE"      env:"APROXY_LIMITS_MAX_PACKET_SIZE"      envDefault:"0"`
+	AuthParallelism    int      `toml:"AUTH_PARALLELISM"     env:"APROXY_LIMITS_AUTH_PARALLELISM"     envDefault:"10"`
+}
+
+// ClientIDConfig configuration for client ID rules.
+type ClientIDConfig struct {
+	Match     string `toml:"MATCH"      env:"APROXY_CLIENT_ID_MATCH"      envDefault:"any"`
+	Pattern   string `toml:"PATTERN"    env:"APROXY_CLIENT_ID_PATTERN"    envDefault:""`
+	Assign    string `toml:"ASSIGN"     env:"APROXY_CLIENT_ID_ASSIGN"     envDefault:""`
+	MaxLength int    `toml:"MAX_LENGTH" env:"APROXY_CLIENT_ID_MAX_LENGTH" envDefault:"0"`
+	Charset   string `toml:"CHARSET"    env:"APROXY_CLIENT_ID_CHARSET"    envDefault:""`
+}
+
+// SessionsConfig configuration for re-validation and maximum age of the live sessions.
+type SessionsConfig struct {
+	RevalidateInterval Duration `toml:"REVALIDATE_INTERVAL" env:"APROXY_SESSIONS_REVALIDATE_INTERVAL" envDefault:"0s"`
+	MaxAge             Duration `toml:"MAX_AGE"             env:"APROXY_SESSIONS_MAX_AGE"             envDefault:"0s"`
+	MaxAgeJitter       Duration `toml:"MAX_AGE_JITTER"      env:"APROXY_SESSIONS_MAX_AGE_JITTER"      envDefault:"0s"`
+	ThingMaxAge        ListMap  `toml:"THING_MAX_AGE"       env:"APROXY_SESSIONS_THING_MAX_AGE"       envDefault:""`
+}
+
+// ThingsEventsConfig configuration for Things change events subscription.
+type ThingsEventsConfig struct {
+	URL   string `toml:"URL"   env:"APROXY_THINGS_EVENTS_URL"   envDefault:""`
+	Topic string `toml:"TOPIC" env:"APROXY_THINGS_EVENTS_TOPIC" envDefault:"mainflux/things"`
+}
+
+// UpstreamConfig configuration for MQTT broker selection and health probing.
+type UpstreamConfig struct {
+	Strategy      string   `toml:"STRATEGY"       env:"APROXY_UPSTREAM_STRATEGY"       envDefault:"round-robin"`
+	ProbeInterval Duration `toml:"PROBE_INTERVAL" env:"APROXY_UPSTREAM_PROBE_INTERVAL" envDefault:"10s"`
+	ProbeTimeout  Duration `toml:"PROBE_TIMEOUT"  env:"APROXY_UPSTREAM_PROBE_TIMEOUT"  envDefault:"2s"`
+	Cooldown      Duration `toml:"COOLDOWN"       env:"APROXY_UPSTREAM_COOLDOWN"       envDefault:"5s"`
+}
+
+// TLSConfig configuration for the TLS listeners and their virtual hosts.
+type TLSConfig struct {
+	MQTTPort       string   `toml:"MQTT_PORT"       env:"APROXY_TLS_MQTT_PORT"       envDefault:""`
+	WSPort         string   `toml:"WS_PORT"         env:"APROXY_TLS_WS_PORT"         envDefault:""`
+	CertFile       string   `toml:"CERT_FILE"       env:"APROXY_TLS_CERT_FILE"       envDefault:""`
+	KeyFile        string   `toml:"KEY_FILE"        env:"APROXY_TLS_KEY_FILE"        envDefault:""`
+	ClientCAFile   string   `toml:"CLIENT_CA_FILE"  env:"APROXY_TLS_CLIENT_CA_FILE"  envDefault:""`
+	ClientAuth     string   `toml:"CLIENT_AUTH"     env:"APROXY_TLS_CLIENT_AUTH"     envDefault:""`
+	HostsFile      string   `toml:"HOSTS_FILE"      env:"APROXY_TLS_HOSTS_FILE"      envDefault:""`
+	ReloadInterval Duration `toml:"RELOAD_INTERVAL" env:"APROXY_TLS_RELOAD_INTERVAL" envDefault:"1m"`
+}
+
+// RevocationConfig configuration for client certificate revocation checks.
+type RevocationConfig struct {
+	CRLFiles          []string `toml:"CRL_FILES"           env:"APROXY_REVOCATION_CRL_FILES"           envDefault:""`
+	CRLReloadInterval Duration `toml:"CRL_RELOAD_INTERVAL" env:"APROXY_REVOCATION_CRL_RELOAD_INTERVAL" envDefault:"5m"`
+	DenylistFile      string   `toml:"DENYLIST_FILE"       env:"APROXY_REVOCATION_DENYLIST_FILE"       envDefault:""`
+}
+
+// CertMappingConfig configuration for mapping client certificates to things.
+type CertMappingConfig struct {
+	File  string  `toml:"FILE"  env:"APROXY_CERT_MAPPING_FILE"  envDefault:""`
+	Rules ListMap `toml:"RULES" env:"APROXY_CERT_MAPPING_RULES" envDefault:""`
+}
+
+// LockoutConfig configuration for failed connection attempts tracking.
+type LockoutConfig struct {
+	Threshold   int      `toml:"THRESHOLD"    env:"APROXY_LOCKOUT_THRESHOLD"    envDefault:"0"`
+	Delay       Duration `toml:"DELAY"        env:"APROXY_LOCKOUT_DELAY"        envDefault:"100ms"`
+	MaxDelay    Duration `toml:"MAX_DELAY"    env:"APROXY_LOCKOUT_MAX_DELAY"    envDefault:"5s"`
+	Duration    Duration `toml:"DURATION"     env:"APROXY_LOCKOUT_DURATION"     envDefault:"1m"`
+	MaxDuration Duration `toml:"MAX_DURATION" env:"APROXY_LOCKOUT_MAX_DURATION" envDefault:"1h"`
+	Window      Duration `toml:"WINDOW"       env:"APROXY_LOCKOUT_WINDOW"       envDefault:"15m"`
+}
+
+// AdminConfig configuration for admin API.
+type AdminConfig struct {
+	Port  string `toml:"PORT"  env:"APROXY_ADMIN_PORT"  envDefault:""`
+	Token string `toml:"TOKEN" env:"APROXY_ADMIN_TOKEN" envDefault:""`
 }
 
 // GeneralConfig general service configuration.
@@ -36,10 +161,20 @@ type GeneralConfig struct {
 
 // Config all configuration params for service.
 type Config struct {
-	MQTTAdapter MQTTAdapterConfig `toml:"MQTTAdapter"`
-	HTTPAdapter HTTPAdapterConfig `toml:"HTTPAdapter"`
-	General     GeneralConfig     `toml:"General"`
-	ConfigFile  string            `toml:"-" env:"APROXY_MQTT_ADAPTER_CONFIG_FILE" envDefault:"config.toml"`
+	MQTTAdapter  MQTTAdapterConfig  `toml:"MQTTAdapter"`
+	HTTPAdapter  HTTPAdapterConfig  `toml:"HTTPAdapter"`
+	Limits       LimitsConfig       `toml:"Limits"`
+	ClientID     ClientIDConfig     `toml:"ClientID"`
+	Sessions     SessionsConfig     `toml:"Sessions"`
+	ThingsEvents ThingsEventsConfig `toml:"ThingsEvents"`
+	Upstream     UpstreamConfig     `toml:"Upstream"`
+	TLS          TLSConfig          `toml:"TLS"`
+	Revocation   RevocationConfig   `toml:"Revocation"`
+	CertMapping  CertMappingConfig  `toml:"CertMapping"`
+	Lockout      LockoutConfig      `toml:"Lockout"`
+	Admin        AdminConfig        `toml:"Admin"`
+	General      GeneralConfig      `toml:"General"`
+	ConfigFile   string             `toml:"-" env:"APROXY_MQTT_ADAPTER_CONFIG_FILE" envDefault:"config.toml"`
 }
 
 // Duration time duration.
@@ -55,6 +190,28 @@ func (d *Duration) UnmarshalText(b []byte) error {
 	return nil
 }
 
+// ListMap maps keys to the lists of values, such as channel IDs
+// to the allowed content types.
+type ListMap map[string][]string
+
+// UnmarshalText custom unmarshaler for ListMap in the format:
+// <key>:<value>|<value>,<key>:<value>.
+func (lm *ListMap) UnmarshalText(b []byte) error {
+	m := ListMap{}
+	for _, entry := range strings.Split(string(b), ",") {
+		if entry == "" {
+			continue
+		}
+		key, values, ok := strings.Cut(entry, ":")
+		if !ok || key == "" || values == "" {
+			return fmt.Errorf("invalid list map entry %q", entry)
+		}
+		m[key] = append(m[key], strings.Split(values, "|")...)
+	}
+	*lm = m
+	return nil
+}
+
 func parseConfigFile(cfg *Config) error {
 	file, err := os.Open(cfg.ConfigFile)
 	if err != nil {
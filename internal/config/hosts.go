@@ -0,0 +1,51 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// VirtualHost configuration of the host served on the TLS listeners. The host
+// is selected by the server name the client requests using TLS SNI.
+type VirtualHost struct {
+	Name          string   `json:"name"`
+	CertFile      string   `json:"cert_file"`
+	KeyFile       string   `json:"key_file"`
+	ClientCAFile  string   `json:"client_ca_file"`
+	ClientAuth    string   `json:"client_auth"`
+	MQTTTargets   []string `json:"mqtt_targets"`
+	WSTargets     []string `json:"ws_targets"`
+	ThingsGRPCURL string   `json:"things_grpc_url"`
+}
+
+// LoadVirtualHosts loads virtual hosts from the JSON file which contains
+// the list of the hosts.
+func LoadVirtualHosts(path string) ([]VirtualHost, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var hosts []VirtualHost
+	if err := json.Unmarshal(data, &hosts); err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool, len(hosts))
+	for _, h := range hosts {
+		name := strings.ToLower(h.Name)
+		if name == "" {
+			return nil, fmt.Errorf("virtual host name is not set in %s", path)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("duplicate virtual host %q in %s", h.Name, path)
+		}
+		names[name] = true
+	}
+
+	return hosts, nil
+}
@@ -0,0 +1,75 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadVirtualHosts(t *testing.T) {
+	cases := []struct {
+		desc  string
+		data  string
+		hosts []VirtualHost
+		err   string
+	}{
+		{
+			desc: "virtual hosts",
+			data: `[
+				{"name": "a.example.com", "cert_file": "a.crt", "key_file": "a.key", "client_auth": "required", "mqtt_targets": ["broker-a:1883"], "things_grpc_url": "things-a:7000"},
+				{"name": "b.example.com", "cert_file": "b.crt", "key_file": "b.key", "client_ca_file": "ca.crt", "ws_targets": ["broker-b:8080"]}
+			]`,
+			hosts: []VirtualHost{
+				{Name: "a.example.com", CertFile: "a.crt", KeyFile: "a.key", ClientAuth: "required", MQTTTargets: []string{"broker-a:1883"}, ThingsGRPCURL: "things-a:7000"},
+				{Name: "b.example.com", CertFile: "b.crt", KeyFile: "b.key", ClientCAFile: "ca.crt", WSTargets: []string{"broker-b:8080"}},
+			},
+		},
+		{
+			desc:  "no virtual hosts",
+			data:  `[]`,
+			hosts: []VirtualHost{},
+		},
+		{
+			desc: "virtual host without name",
+			data: `[{"cert_file": "a.crt", "key_file": "a.key"}]`,
+			err:  "virtual host name is not set",
+		},
+		{
+			desc: "duplicate virtual host in other case",
+			data: `[{"name": "a.example.com"}, {"name": "A.Example.com"}]`,
+			err:  `duplicate virtual host "A.Example.com"`,
+		},
+		{
+			desc: "invalid JSON",
+			data: `{"name": "a.example.com"}`,
+			err:  "cannot unmarshal object",
+		},
+	}
+
+	for _, tc := range cases {
+		path := filepath.Join(t.TempDir(), "hosts.json")
+		if err := os.WriteFile(path, []byte(tc.data), 0o600); err != nil {
+			t.Fatalf("%s: failed to write %s: %s", tc.desc, path, err)
+		}
+		hosts, err := LoadVirtualHosts(path)
+		switch {
+		case tc.err != "":
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: expected error containing %q got %v", tc.desc, tc.err, err)
+			}
+		case err != nil:
+			t.Errorf("%s: expected no error got %v", tc.desc, err)
+		case !reflect.DeepEqual(hosts, tc.hosts):
+			t.Errorf("%s: expected hosts %+v got %+v", tc.desc, tc.hosts, hosts)
+		}
+	}
+
+	if _, err := LoadVirtualHosts(filepath.Join(t.TempDir(), "missing.json")); !os.IsNotExist(err) {
+		t.Errorf("missing file: expected not exist error got %v", err)
+	}
+}
@@ -4,36 +4,72 @@
 package grpc
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
 	"time"
 
+	mflog "github.com/mainflux/mainflux/logger"
 	"github.com/mainflux/mainflux/pkg/errors"
 	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	gogrpc "google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/resolver"
 )
 
+// staticScheme is the scheme of the targets which consist of several addresses.
+const staticScheme = "static"
+
 var (
 	errGrpcConnect = errors.New("failed to connect to grpc server")
 	errGrpcClose   = errors.New("failed to close grpc connection")
+	errParseCA     = errors.New("failed to parse CA certificates")
+
+	// ErrClientCertWithoutTLS indicates that the client certificate is set,
+	// but TLS is not enabled, so it would never be presented.
+	ErrClientCertWithoutTLS = errors.New("client certificate is set without client TLS")
 )
 
+// Config contains gRPC client configuration. URL is either a single target,
+// such as "things:7000" or "dns:///things:7000", or a comma-separated list of
+// addresses the client balances across.
 type Config struct {
-	ClientTLS bool          `env:"CLIENT_TLS"    envDefault:"false"`
-	CACerts   string        `env:"CA_CERTS"      envDefault:""`
-	URL       string        `env:"URL"           envDefault:""`
-	Timeout   time.Duration `env:"TIMEOUT"       envDefault:"1s"`
+	ClientTLS           bool          `env:"CLIENT_TLS"            envDefault:"false"`
+	CACerts             string        `env:"CA_CERTS"              envDefault:""`
+	ClientCert          string        `env:"CLIENT_CERT"           envDefault:""`
+	ClientKey           string        `env:"CLIENT_KEY"            envDefault:""`
+	ServerName          string        `env:"SERVER_NAME"           envDefault:""`
+	URL                 string        `env:"URL"                   envDefault:""`
+	Timeout             time.Duration `env:"TIMEOUT"               envDefault:"1s"`
+	LBPolicy            string        `env:"LB_POLICY"             envDefault:"pick_first"`
+	KeepAliveTime       time.Duration `env:"KEEPALIVE_TIME"        envDefault:"0s"`
+	KeepAliveTimeout    time.Duration `env:"KEEPALIVE_TIMEOUT"     envDefault:"20s"`
+	RetryMaxAttempts    int           `env:"RETRY_MAX_ATTEMPTS"    envDefault:"3"`
+	RetryInitialBackoff time.Duration `env:"RETRY_INITIAL_BACKOFF" envDefault:"100ms"`
+	RetryMaxBackoff     time.Duration `env:"RETRY_MAX_BACKOFF"     envDefault:"1s"`
 }
 
 type ClientHandler interface {
 	Close() error
 	IsSecure() bool
 	Secure() string
+	SystemRoots() bool
+	State() string
+	Watch(ctx context.Context, logger mflog.Logger)
 }
 
 type Client struct {
 	*gogrpc.ClientConn
-	secure bool
+	secure      bool
+	systemRoots bool
+	name        string
 }
 
 var _ ClientHandler = (*Client)(nil)
@@ -49,18 +85,43 @@ func Connect(cfg Config) (*gogrpc.ClientConn, bool, error) {
 	secure := false
 	tc := insecure.NewCredentials()
 
-	if cfg.ClientTLS && cfg.CACerts != "" {
-		var err error
-		tc, err = credentials.NewClientTLSFromFile(cfg.CACerts, "")
+	if !cfg.ClientTLS && (cfg.ClientCert != "" || cfg.ClientKey != "") {
+		return nil, secure, ErrClientCertWithoutTLS
+	}
+	if cfg.ClientTLS {
+		tlsCfg, err := clientTLS(cfg)
 		if err != nil {
 			return nil, secure, err
 		}
+		tc = credentials.NewTLS(tlsCfg)
 		secure = true
 	}
 
-	opts = append(opts, gogrpc.WithTransportCredentials(tc), gogrpc.WithUnaryInterceptor(otelgrpc.UnaryClientInterceptor()))
+	sc, err := serviceConfig(cfg)
+	if err != nil {
+		return nil, secure, err
+	}
+	opts = append(opts,
+		gogrpc.WithTransportCredentials(tc),
+		gogrpc.WithUnaryInterceptor(otelgrpc.UnaryClientInterceptor()),
+		gogrpc.WithDefaultServiceConfig(sc),
+	)
+	if cfg.KeepAliveTime > 0 {
+		opts = append(opts, gogrpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:    cfg.KeepAliveTime,
+			Timeout: cfg.KeepAliveTimeout,
+		}))
+	}
 
-	conn, err := gogrpc.Dial(cfg.URL, opts...)
+	target := cfg.URL
+	if addrs := strings.Split(cfg.URL, ","); len(addrs) > 1 {
+		// The first address is the authority the server certificate is
+		// verified for, unless the server name is set.
+		target = staticScheme + ":///" + strings.TrimSpace(addrs[0])
+		opts = append(opts, gogrpc.WithResolvers(newStaticBuilder(addrs)))
+	}
+
+	conn, err := gogrpc.Dial(target, opts...)
 	if err != nil {
 		return nil, secure, err
 	}
@@ -77,7 +138,7 @@ func Setup(config Config, svcName string) (*Client, ClientHandler, error) {
 		return nil, nil, errors.Wrap(errGrpcConnect, err)
 	}
 
-	c := &Client{grpcClient, secure}
+	c := &Client{ClientConn: grpcClient, secure: secure, systemRoots: secure && config.CACerts == "", name: svcName}
 
 	return c, NewClientHandler(c), nil
 }
@@ -105,3 +166,125 @@ func (c *Client) Secure() string {
 	}
 	return "without TLS"
 }
+
+// SystemRoots checks if the server certificate is verified against
+// the system roots, since the CA certificates are not set.
+func (c *Client) SystemRoots() bool {
+	return c.systemRoots
+}
+
+// State returns the state of the connection.
+func (c *Client) State() string {
+	return c.GetState().String()
+}
+
+// Watch connects to the gRPC server and logs the changes of the connection
+// state until the context is canceled.
+func (c *Client) Watch(ctx context.Context, logger mflog.Logger) {
+	c.Connect()
+	state := c.GetState()
+	for c.WaitForStateChange(ctx, state) {
+		state = c.GetState()
+		msg := fmt.Sprintf("%s gRPC connection is %s", c.name, strings.ToLower(state.String()))
+		if state == connectivity.TransientFailure {
+			logger.Warn(msg)
+			continue
+		}
+		logger.Info(msg)
+	}
+}
+
+// clientTLS returns TLS configuration of the client. The server is verified
+// with the CA certificates, or with the system roots if they are not set, and
+// the client certificate is presented if it's set.
+func clientTLS(cfg Config) (*tls.Config, error) {
+	tc := &tls.Config{
+		ServerName: cfg.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if cfg.CACerts != "" {
+		pem, err := os.ReadFile(cfg.CACerts)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, errParseCA
+		}
+		tc.RootCAs = roots
+	}
+	if cfg.ClientCert != "" || cfg.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCert, cfg.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+
+	return tc, nil
+}
+
+// serviceConfig returns the service config with the load balancing policy
+// and the policy of retrying all the calls which fail as unavailable.
+func serviceConfig(cfg Config) (string, error) {
+	sc := map[string]interface{}{
+		"loadBalancingConfig": []map[string]interface{}{
+			{cfg.LBPolicy: map[string]interface{}{}},
+		},
+	}
+	if cfg.RetryMaxAttempts > 1 {
+		sc["methodConfig"] = []map[string]interface{}{{
+			"name": []map[string]interface{}{{}},
+			"retryPolicy": map[string]interface{}{
+				"maxAttempts":          cfg.RetryMaxAttempts,
+				"initialBackoff":       duration(cfg.RetryInitialBackoff),
+				"maxBackoff":           duration(cfg.RetryMaxBackoff),
+				"backoffMultiplier":    2,
+				"retryableStatusCodes": []string{"UNAVAILABLE"},
+			},
+		}}
+	}
+	data, err := json.Marshal(sc)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// duration formats the duration as the service config expects it.
+func duration(d time.Duration) string {
+	return fmt.Sprintf("%.3fs", d.Seconds())
+}
+
+// staticBuilder resolves the static target to the fixed list of addresses.
+type staticBuilder struct {
+	addrs []resolver.Address
+}
+
+func newStaticBuilder(addrs []string) resolver.Builder {
+	b := staticBuilder{}
+	for _, addr := range addrs {
+		b.addrs = append(b.addrs, resolver.Address{Addr: strings.TrimSpace(addr)})
+	}
+
+	return b
+}
+
+func (b staticBuilder) Build(_ resolver.Target, cc resolver.ClientConn, _ resolver.BuildOptions) (resolver.Resolver, error) {
+	if err := cc.UpdateState(resolver.State{Addresses: b.addrs}); err != nil {
+		return nil, err
+	}
+
+	return staticResolver{}, nil
+}
+
+func (b staticBuilder) Scheme() string {
+	return staticScheme
+}
+
+type staticResolver struct{}
+
+func (staticResolver) ResolveNow(resolver.ResolveNowOptions) {}
+
+func (staticResolver) Close() {}
@@ -0,0 +1,145 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package grpc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mainflux/mainflux/pkg/errors"
+)
+
+func TestConnect(t *testing.T) {
+	dir := t.TempDir()
+	invalidCA := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(invalidCA, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatalf("failed to write CA file: %s", err)
+	}
+	missing := filepath.Join(dir, "missing.pem")
+
+	cases := []struct {
+		desc   string
+		cfg    Config
+		secure bool
+		err    error
+	}{
+		{
+			desc: "without TLS",
+			cfg:  Config{URL: "things:7000"},
+		},
+		{
+			desc:   "TLS with system roots",
+			cfg:    Config{URL: "things:7000", ClientTLS: true},
+			secure: true,
+		},
+		{
+			desc: "client certificate without TLS",
+			cfg:  Config{URL: "things:7000", ClientCert: "client.crt", ClientKey: "client.key"},
+			err:  ErrClientCertWithoutTLS,
+		},
+		{
+			desc: "client key without TLS",
+			cfg:  Config{URL: "things:7000", ClientKey: "client.key"},
+			err:  ErrClientCertWithoutTLS,
+		},
+		{
+			desc: "invalid CA certificates",
+			cfg:  Config{URL: "things:7000", ClientTLS: true, CACerts: invalidCA},
+			err:  errParseCA,
+		},
+		{
+			desc: "missing client certificate without CA certificates",
+			cfg:  Config{URL: "things:7000", ClientTLS: true, ClientCert: missing, ClientKey: missing},
+			err:  errors.New("open " + missing + ": no such file or directory"),
+		},
+	}
+
+	for _, tc := range cases {
+		tc.cfg.LBPolicy = "pick_first"
+		conn, secure, err := Connect(tc.cfg)
+		if !errors.Contains(err, tc.err) || (err == nil) != (tc.err == nil) {
+			t.Errorf("%s: expected error %v got %v", tc.desc, tc.err, err)
+		}
+		if err != nil {
+			continue
+		}
+		if secure != tc.secure {
+			t.Errorf("%s: expected secure %t got %t", tc.desc, tc.secure, secure)
+		}
+		conn.Close()
+	}
+}
+
+func TestSetupSystemRoots(t *testing.T) {
+	ca := writeCA(t, t.TempDir())
+
+	cases := []struct {
+		desc        string
+		cfg         Config
+		systemRoots bool
+	}{
+		{
+			desc: "without TLS",
+			cfg:  Config{URL: "things:7000"},
+		},
+		{
+			desc:        "TLS without CA certificates",
+			cfg:         Config{URL: "things:7000", ClientTLS: true},
+			systemRoots: true,
+		},
+		{
+			desc: "TLS with CA certificates",
+			cfg:  Config{URL: "things:7000", ClientTLS: true, CACerts: ca},
+		},
+	}
+
+	for _, tc := range cases {
+		tc.cfg.LBPolicy = "pick_first"
+		c, _, err := Setup(tc.cfg, "things")
+		if err != nil {
+			t.Errorf("%s: expected no error got %v", tc.desc, err)
+			continue
+		}
+		if c.SystemRoots() != tc.systemRoots {
+			t.Errorf("%s: expected system roots %t got %t", tc.desc, tc.systemRoots, c.SystemRoots())
+		}
+		c.Close()
+	}
+}
+
+// writeCA writes self-signed PEM CA certificate to the directory.
+func writeCA(t *testing.T, dir string) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "things-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create CA certificate: %s", err)
+	}
+	file := filepath.Join(dir, "things-ca.pem")
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("failed to write CA file: %s", err)
+	}
+
+	return file
+}
@@ -17,10 +17,19 @@ var errGrpcConfig = errors.New("failed to load grpc configuration")
 
 // Setup loads Things gRPC configuration from environment variable and creates new Things gRPC API.
 func Setup() (policies.AuthServiceClient, grpcclient.ClientHandler, error) {
+	return SetupWithURL("")
+}
+
+// SetupWithURL creates new Things gRPC API like Setup, but connects to the Things
+// gRPC server at the given URL. If the URL is empty, the configured one is used.
+func SetupWithURL(url string) (policies.AuthServiceClient, grpcclient.ClientHandler, error) {
 	config := grpcclient.Config{}
 	if err := env.ParseWithOptions(&config, env.Options{Prefix: envThingsAuthGrpcPrefix}); err != nil {
 		return nil, nil, errors.Wrap(errGrpcConfig, err)
 	}
+	if url != "" {
+		config.URL = url
+	}
 
 	c, ch, err := grpcclient.Setup(config, "things")
 	if err != nil {
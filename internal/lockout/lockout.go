@@ -0,0 +1,224 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+// Package lockout tracks failed authentication attempts and temporarily locks
+// out entities, such as source IP addresses or usernames, which fail too often.
+package lockout
+
+import (
+	"expvar"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mainflux/mainflux/pkg/errors"
+)
+
+const pruneInterval = time.Minute
+
+// ErrLocked indicates that the entity is temporarily locked out.
+var ErrLocked = errors.New("too many failed attempts, temporarily locked out")
+
+var lockoutMetrics = expvar.NewMap("lockouts")
+
+// Config contains lockout thresholds.
+type Config struct {
+	// Threshold is the number of consecutive failures after which
+	// the entity is locked out. Zero disables lockouts.
+	Threshold int
+
+	// Delay is the delay applied after the first failure.
+	// It doubles with each next failure, up to MaxDelay.
+	Delay    time.Duration
+	MaxDelay time.Duration
+
+	// Duration is the first lockout duration. It doubles with
+	// each next lockout of the same entity, up to MaxDuration.
+	Duration    time.Duration
+	MaxDuration time.Duration
+
+	// Window is the period after the last failure
+	// in which the failures are remembered.
+	Window time.Duration
+}
+
+// Lock contains the details of a locked out entity.
+type Lock struct {
+	Key         string    `json:"key"`
+	Failures    int       `json:"failures"`
+	Lockouts    int       `json:"lockouts"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+type entry struct {
+	failures    int
+	lockouts    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// Tracker tracks failed attempts per entity key.
+type Tracker struct {
+	cfg       Config
+	now       func() time.Time
+	mu        sync.Mutex
+	entries   map[string]*entry
+	lastPrune time.Time
+}
+
+// New returns new failed attempts tracker.
+func New(cfg Config) *Tracker {
+	return &Tracker{
+		cfg:       cfg,
+		now:       time.Now,
+		entries:   make(map[string]*entry),
+		lastPrune: time.Now(),
+	}
+}
+
+// Check returns ErrLocked if any of the entities is locked out.
+// Otherwise, it returns the delay to apply before the attempt,
+// based on the number of the previous failures.
+func (t *Tracker) Check(keys ...string) (time.Duration, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	var failures int
+	for _, key := range keys {
+		e, ok := t.entries[key]
+		if !ok {
+			continue
+		}
+		if now.Before(e.lockedUntil) {
+			lockoutMetrics.Add("rejected", 1)
+			return 0, ErrLocked
+		}
+		if now.Sub(e.lastFailure) > t.cfg.Window {
+			continue
+		}
+		if e.failures > failures {
+			failures = e.failures
+		}
+	}
+
+	return backoff(t.cfg.Delay, t.cfg.MaxDelay, failures), nil
+}
+
+// Failure records a failed attempt of the entities, and locks out those
+// which reached the threshold. It returns true if any of them got locked out.
+func (t *Tracker) Failure(keys ...string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	t.prune(now)
+
+	var locked bool
+	for _, key := range keys {
+		e, ok := t.entries[key]
+		if !ok {
+			e = &entry{}
+			t.entries[key] = e
+		}
+		if now.Sub(e.lastFailure) > t.cfg.Window {
+			e.failures = 0
+		}
+		e.failures++
+		e.lastFailure = now
+		if t.cfg.Threshold > 0 && e.failures >= t.cfg.Threshold {
+			e.lockouts++
+			e.failures = 0
+			e.lockedUntil = now.Add(backoff(t.cfg.Duration, t.cfg.MaxDuration, e.lockouts))
+			lockoutMetrics.Add("locked", 1)
+			locked = true
+		}
+	}
+
+	return locked
+}
+
+// Success resets the failures of the entities.
+func (t *Tracker) Success(keys ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, key := range keys {
+		e, ok := t.entries[key]
+		switch {
+		case !ok:
+		case e.lockouts == 0:
+			delete(t.entries, key)
+		default:
+			// Keep the lockouts count so that repeated lockouts last longer.
+			e.failures = 0
+		}
+	}
+}
+
+// Locked returns the entities which are currently locked out.
+func (t *Tracker) Locked() []Lock {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	locks := []Lock{}
+	for key, e := range t.entries {
+		if now.Before(e.lockedUntil) {
+			locks = append(locks, Lock{
+				Key:         key,
+				Failures:    e.failures,
+				Lockouts:    e.lockouts,
+				LockedUntil: e.lockedUntil,
+			})
+		}
+	}
+	sort.Slice(locks, func(i, j int) bool {
+		return locks[i].Key < locks[j].Key
+	})
+
+	return locks
+}
+
+// Unlock removes the lockout and the failures history of the entity.
+// It returns false if the entity is not tracked.
+func (t *Tracker) Unlock(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.entries[key]; !ok {
+		return false
+	}
+	delete(t.entries, key)
+
+	return true
+}
+
+// prune removes entries which are neither locked out nor failed within the window.
+func (t *Tracker) prune(now time.Time) {
+	if now.Sub(t.lastPrune) < pruneInterval {
+		return
+	}
+	t.lastPrune = now
+	for key, e := range t.entries {
+		if now.After(e.lockedUntil) && now.Sub(e.lastFailure) > t.cfg.Window {
+			delete(t.entries, key)
+		}
+	}
+}
+
+// backoff returns base duration doubled n-1 times, up to max.
+func backoff(base, max time.Duration, n int) time.Duration {
+	if n <= 0 || base <= 0 {
+		return 0
+	}
+	d := base
+	for i := 1; i < n && d < max; i++ {
+		d *= 2
+	}
+	if max > 0 && d > max {
+		d = max
+	}
+
+	return d
+}
@@ -0,0 +1,220 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package lockout
+
+import (
+	"testing"
+	"time"
+)
+
+const (
+	ipKey       = "ip:10.0.0.1"
+	usernameKey = "username:thing"
+)
+
+var testConfig = Config{
+	Threshold:   3,
+	Delay:       100 * time.Millisecond,
+	MaxDelay:    400 * time.Millisecond,
+	Duration:    time.Minute,
+	MaxDuration: 4 * time.Minute,
+	Window:      10 * time.Minute,
+}
+
+// clock is the time of the tracker, advanced by the tests.
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time {
+	return c.t
+}
+
+func (c *clock) advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func newTracker(cfg Config) (*Tracker, *clock) {
+	c := &clock{t: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)}
+	t := New(cfg)
+	t.now = c.now
+	t.lastPrune = c.t
+
+	return t, c
+}
+
+func TestDelay(t *testing.T) {
+	cfg := testConfig
+	cfg.Threshold = 0
+	tracker, _ := newTracker(cfg)
+
+	// The delay doubles with each failure, up to the maximum delay.
+	for i, delay := range []time.Duration{0, 100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 400 * time.Millisecond} {
+		got, err := tracker.Check(ipKey)
+		if err != nil {
+			t.Fatalf("after %d failures: expected no error got %v", i, err)
+		}
+		if got != delay {
+			t.Errorf("after %d failures: expected delay %s got %s", i, delay, got)
+		}
+		if tracker.Failure(ipKey) {
+			t.Errorf("after %d failures: expected no lockout without threshold", i+1)
+		}
+	}
+}
+
+func TestLockout(t *testing.T) {
+	tracker, clock := newTracker(testConfig)
+
+	// The lockout duration doubles with each lockout, up to the maximum duration.
+	for _, duration := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 4 * time.Minute} {
+		for i := 1; i <= testConfig.Threshold; i++ {
+			if _, err := tracker.Check(ipKey); err != nil {
+				t.Fatalf("failure %d: expected no error got %v", i, err)
+			}
+			if locked := tracker.Failure(ipKey); locked != (i == testConfig.Threshold) {
+				t.Fatalf("failure %d: expected locked out %t got %t", i, i == testConfig.Threshold, locked)
+			}
+		}
+
+		locks := tracker.Locked()
+		if len(locks) != 1 || locks[0].Key != ipKey || !locks[0].LockedUntil.Equal(clock.t.Add(duration)) {
+			t.Fatalf("expected %s locked out until %s got %+v", ipKey, clock.t.Add(duration), locks)
+		}
+		clock.advance(duration - time.Nanosecond)
+		if _, err := tracker.Check(ipKey); err != ErrLocked {
+			t.Errorf("before lockout of %s ends: expected error %v got %v", duration, ErrLocked, err)
+		}
+		clock.advance(time.Nanosecond)
+		// The failures are reset by the lockout, so there is no delay after it.
+		delay, err := tracker.Check(ipKey)
+		if err != nil || delay != 0 {
+			t.Errorf("after lockout of %s ends: expected no delay and no error got %s and %v", duration, delay, err)
+		}
+		if locks := tracker.Locked(); len(locks) != 0 {
+			t.Errorf("after lockout of %s ends: expected no lockouts got %+v", duration, locks)
+		}
+	}
+}
+
+func TestLockoutKeys(t *testing.T) {
+	tracker, _ := newTracker(testConfig)
+
+	tracker.Failure(ipKey, usernameKey)
+	tracker.Failure(ipKey)
+
+	// The delay is based on the key with the most failures.
+	if delay, err := tracker.Check(usernameKey, ipKey); err != nil || delay != 200*time.Millisecond {
+		t.Errorf("expected delay %s got %s and error %v", 200*time.Millisecond, delay, err)
+	}
+	if !tracker.Failure(ipKey, usernameKey) {
+		t.Fatalf("expected %s locked out", ipKey)
+	}
+	if _, err := tracker.Check(usernameKey); err != nil {
+		t.Errorf("expected %s not locked out got %v", usernameKey, err)
+	}
+	// The attempt is rejected if any of the keys is locked out.
+	if _, err := tracker.Check(usernameKey, ipKey); err != ErrLocked {
+		t.Errorf("expected error %v got %v", ErrLocked, err)
+	}
+}
+
+func TestWindow(t *testing.T) {
+	tracker, clock := newTracker(testConfig)
+
+	tracker.Failure(ipKey)
+	tracker.Failure(ipKey)
+	clock.advance(testConfig.Window)
+	if delay, _ := tracker.Check(ipKey); delay != 200*time.Millisecond {
+		t.Errorf("within window: expected delay %s got %s", 200*time.Millisecond, delay)
+	}
+
+	// The failures older than the window are forgotten.
+	clock.advance(time.Nanosecond)
+	if delay, _ := tracker.Check(ipKey); delay != 0 {
+		t.Errorf("after window: expected no delay got %s", delay)
+	}
+	if tracker.Failure(ipKey) {
+		t.Errorf("after window: expected failures counted from the start")
+	}
+	if delay, _ := tracker.Check(ipKey); delay != testConfig.Delay {
+		t.Errorf("after window: expected delay %s got %s", testConfig.Delay, delay)
+	}
+}
+
+func TestSuccess(t *testing.T) {
+	tracker, clock := newTracker(testConfig)
+
+	tracker.Failure(ipKey)
+	tracker.Failure(ipKey)
+	tracker.Success(ipKey)
+	if delay, _ := tracker.Check(ipKey); delay != 0 {
+		t.Errorf("after success: expected no delay got %s", delay)
+	}
+	if tracker.Unlock(ipKey) {
+		t.Errorf("after success: expected %s not tracked", ipKey)
+	}
+
+	for i := 0; i < testConfig.Threshold; i++ {
+		tracker.Failure(ipKey)
+	}
+	clock.advance(testConfig.Duration)
+	tracker.Success(ipKey)
+
+	// The lockouts are remembered after success,
+	// so the next lockout lasts longer.
+	for i := 0; i < testConfig.Threshold; i++ {
+		tracker.Failure(ipKey)
+	}
+	locks := tracker.Locked()
+	if len(locks) != 1 || locks[0].Lockouts != 2 || !locks[0].LockedUntil.Equal(clock.t.Add(2*testConfig.Duration)) {
+		t.Errorf("expected second lockout until %s got %+v", clock.t.Add(2*testConfig.Duration), locks)
+	}
+}
+
+func TestUnlock(t *testing.T) {
+	tracker, clock := newTracker(testConfig)
+
+	for i := 0; i < testConfig.Threshold; i++ {
+		tracker.Failure(ipKey)
+	}
+	if !tracker.Unlock(ipKey) {
+		t.Fatalf("expected %s unlocked", ipKey)
+	}
+	if delay, err := tracker.Check(ipKey); err != nil || delay != 0 {
+		t.Errorf("after unlock: expected no delay and no error got %s and %v", delay, err)
+	}
+	if tracker.Unlock(ipKey) {
+		t.Errorf("expected %s not tracked after unlock", ipKey)
+	}
+
+	// Unlock removes the lockouts history, so the next lockout is the first one.
+	for i := 0; i < testConfig.Threshold; i++ {
+		tracker.Failure(ipKey)
+	}
+	locks := tracker.Locked()
+	if len(locks) != 1 || locks[0].Lockouts != 1 || !locks[0].LockedUntil.Equal(clock.t.Add(testConfig.Duration)) {
+		t.Errorf("expected first lockout until %s got %+v", clock.t.Add(testConfig.Duration), locks)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	tracker, clock := newTracker(testConfig)
+
+	for i := 0; i < testConfig.Threshold; i++ {
+		tracker.Failure(ipKey)
+	}
+	tracker.Failure(usernameKey)
+
+	// The entries which are neither locked out nor failed
+	// within the window are removed on the next failure.
+	clock.advance(testConfig.Window + time.Nanosecond)
+	tracker.Failure("ip:10.0.0.2")
+	if tracker.Unlock(ipKey) || tracker.Unlock(usernameKey) {
+		t.Errorf("expected expired entries removed")
+	}
+	if !tracker.Unlock("ip:10.0.0.2") {
+		t.Errorf("expected the last failure tracked")
+	}
+}
@@ -0,0 +1,326 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+// Package msgbroker connects to the Mainflux message broker over MQTT with the
+// client IDs of the aProxy instance, so the instances don't take over each
+// other's connections, and publishes without blocking the publishers.
+package msgbroker
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	mflog "github.com/mainflux/mainflux/logger"
+	"github.com/mainflux/mainflux/pkg/errors"
+	"github.com/mainflux/mainflux/pkg/messaging"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	username = "mainflux-mqtt"
+	qos      = 2
+)
+
+var (
+	// ErrConnect indicates that the connection to the message broker failed.
+	ErrConnect = errors.New("failed to connect to message broker")
+
+	// ErrTimeout indicates that the message broker didn't respond in time.
+	ErrTimeout = errors.New("message broker timed out")
+
+	// ErrEmptyTopic indicates that the topic is not set.
+	ErrEmptyTopic = errors.New("empty topic")
+
+	// ErrEmptyID indicates that the subscription ID is not set.
+	ErrEmptyID = errors.New("empty subscription ID")
+
+	// ErrNotSubscribed indicates that the topic is not subscribed to.
+	ErrNotSubscribed = errors.New("not subscribed")
+
+	// ErrQueueFull indicates that the message is dropped, since the queue of
+	// the messages to publish is full.
+	ErrQueueFull = errors.New("publish queue is full")
+
+	// ErrClosed indicates that the publisher is closed.
+	ErrClosed = errors.New("publisher is closed")
+)
+
+var publishMetrics = expvar.NewMap("msg_broker_publishes")
+
+var (
+	_ messaging.Publisher  = (*publisher)(nil)
+	_ messaging.Publisher  = (*asyncPublisher)(nil)
+	_ messaging.Subscriber = (*subscriber)(nil)
+)
+
+type publisher struct {
+	client  mqtt.Client
+	timeout time.Duration
+}
+
+// NewPublisher returns the publisher connected to the message broker with
+// the client ID.
+func NewPublisher(url, clientID string, timeout time.Duration) (messaging.Publisher, error) {
+	client, err := connect(url, clientID, timeout, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &publisher{
+		client:  client,
+		timeout: timeout,
+	}, nil
+}
+
+func (pub *publisher) Publish(_ context.Context, topic string, msg *messaging.Message) error {
+	if topic == "" {
+		return ErrEmptyTopic
+	}
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	return wait(pub.client.Publish(topic, qos, false, data), pub.timeout)
+}
+
+func (pub *publisher) Close() error {
+	pub.client.Disconnect(uint(pub.timeout.Milliseconds()))
+	return nil
+}
+
+type message struct {
+	ctx   context.Context
+	topic string
+	msg   *messaging.Message
+}
+
+type asyncPublisher struct {
+	publisher messaging.Publisher
+	logger    mflog.Logger
+	queue     chan message
+	mu        sync.RWMutex
+	closed    bool
+	done      chan struct{}
+}
+
+// NewAsyncPublisher returns the publisher which queues the messages and
+// publishes them in the background, so the callers are never blocked by the
+// message broker. If the queue is full, the messages are dropped. The failures
+// are logged and counted, but not returned to the callers.
+func NewAsyncPublisher(pub messaging.Publisher, size int, logger mflog.Logger) messaging.Publisher {
+	ap := &asyncPublisher{
+		publisher: pub,
+		logger:    logger,
+		queue:     make(chan message, size),
+		done:      make(chan struct{}),
+	}
+	go ap.run()
+
+	return ap
+}
+
+// Publish queues the message. The message is published with the values of
+// the context, but the cancellation of the context doesn't cancel it.
+func (ap *asyncPublisher) Publish(ctx context.Context, topic string, msg *messaging.Message) error {
+	ap.mu.RLock()
+	defer ap.mu.RUnlock()
+	if ap.closed {
+		return ErrClosed
+	}
+
+	select {
+	case ap.queue <- message{ctx: context.WithoutCancel(ctx), topic: topic, msg: msg}:
+		return nil
+	default:
+		publishMetrics.Add("dropped", 1)
+		return ErrQueueFull
+	}
+}
+
+// Close publishes the queued messages and closes the publisher.
+func (ap *asyncPublisher) Close() error {
+	ap.mu.Lock()
+	if !ap.closed {
+		ap.closed = true
+		close(ap.queue)
+	}
+	ap.mu.Unlock()
+	<-ap.done
+
+	return ap.publisher.Close()
+}
+
+func (ap *asyncPublisher) run() {
+	defer close(ap.done)
+	for m := range ap.queue {
+		if err := ap.publisher.Publish(m.ctx, m.topic, m.msg); err != nil {
+			publishMetrics.Add("failed", 1)
+			ap.logger.Warn(fmt.Sprintf("Failed to publish to the topic %s of the message broker: %s", m.topic, err))
+			continue
+		}
+		publishMetrics.Add("published", 1)
+	}
+}
+
+type subscription struct {
+	client mqtt.Client
+	topics map[string]mqtt.MessageHandler
+	cancel []func() error
+}
+
+type subscriber struct {
+	url           string
+	timeout       time.Duration
+	logger        mflog.Logger
+	mu            sync.Mutex
+	subscriptions map[string]*subscription
+}
+
+// NewSubscriber returns the subscriber which connects to the message broker
+// once per subscription ID, using the ID as the client ID. The topics are
+// subscribed to again whenever the client reconnects.
+func NewSubscriber(url string, timeout time.Duration, logger mflog.Logger) messaging.Subscriber {
+	return &subscriber{
+		url:           url,
+		timeout:       timeout,
+		logger:        logger,
+		subscriptions: make(map[string]*subscription),
+	}
+}
+
+func (sub *subscriber) Subscribe(_ context.Context, id, topic string, handler messaging.MessageHandler) error {
+	if id == "" {
+		return ErrEmptyID
+	}
+	if topic == "" {
+		return ErrEmptyTopic
+	}
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	s, ok := sub.subscriptions[id]
+	if !ok {
+		s = &subscription{
+			topics: make(map[string]mqtt.MessageHandler),
+		}
+		client, err := connect(sub.url, id, sub.timeout, func(c mqtt.Client) {
+			sub.resubscribe(id, c)
+		})
+		if err != nil {
+			return err
+		}
+		s.client = client
+		sub.subscriptions[id] = s
+	}
+	mh := sub.handler(handler)
+	s.topics[topic] = mh
+	s.cancel = append(s.cancel, handler.Cancel)
+
+	return wait(s.client.Subscribe(topic, qos, mh), sub.timeout)
+}
+
+func (sub *subscriber) Unsubscribe(_ context.Context, id, topic string) error {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	s, ok := sub.subscriptions[id]
+	if !ok {
+		return ErrNotSubscribed
+	}
+	if _, ok := s.topics[topic]; !ok {
+		return ErrNotSubscribed
+	}
+	delete(s.topics, topic)
+	if err := wait(s.client.Unsubscribe(topic), sub.timeout); err != nil {
+		return err
+	}
+	if len(s.topics) == 0 {
+		delete(sub.subscriptions, id)
+		return sub.close(s)
+	}
+
+	return nil
+}
+
+func (sub *subscriber) Close() error {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	var err error
+	for id, s := range sub.subscriptions {
+		delete(sub.subscriptions, id)
+		if e := sub.close(s); e != nil {
+			err = e
+		}
+	}
+
+	return err
+}
+
+// resubscribe subscribes to the topics of the subscription again, since
+// the subscriptions are lost when the client reconnects with clean session.
+func (sub *subscriber) resubscribe(id string, c mqtt.Client) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	s, ok := sub.subscriptions[id]
+	if !ok {
+		return
+	}
+	for topic, mh := range s.topics {
+		// The lock is held, so the token can't be waited for.
+		c.Subscribe(topic, qos, mh)
+	}
+}
+
+func (sub *subscriber) close(s *subscription) error {
+	var err error
+	for _, cancel := range s.cancel {
+		if e := cancel(); e != nil {
+			err = e
+		}
+	}
+	s.client.Disconnect(uint(sub.timeout.Milliseconds()))
+
+	return err
+}
+
+func (sub *subscriber) handler(h messaging.MessageHandler) mqtt.MessageHandler {
+	return func(_ mqtt.Client, m mqtt.Message) {
+		var msg messaging.Message
+		if err := proto.Unmarshal(m.Payload(), &msg); err != nil {
+			sub.logger.Warn(fmt.Sprintf("Failed to unmarshal message from the topic %s: %s", m.Topic(), err))
+			return
+		}
+		if err := h.Handle(&msg); err != nil {
+			sub.logger.Warn(fmt.Sprintf("Failed to handle message from the topic %s: %s", m.Topic(), err))
+		}
+	}
+}
+
+func connect(url, clientID string, timeout time.Duration, onConnect mqtt.OnConnectHandler) (mqtt.Client, error) {
+	opts := mqtt.NewClientOptions().
+		SetUsername(username).
+		AddBroker(url).
+		SetClientID(clientID).
+		SetOnConnectHandler(onConnect)
+	client := mqtt.NewClient(opts)
+	if err := wait(client.Connect(), timeout); err != nil {
+		return nil, errors.Wrap(ErrConnect, err)
+	}
+
+	return client, nil
+}
+
+func wait(token mqtt.Token, timeout time.Duration) error {
+	if !token.WaitTimeout(timeout) {
+		return ErrTimeout
+	}
+
+	return token.Error()
+}
@@ -0,0 +1,101 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package msgbroker_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/absmach/aproxy/internal/msgbroker"
+	mflog "github.com/mainflux/mainflux/logger"
+	"github.com/mainflux/mainflux/pkg/errors"
+	"github.com/mainflux/mainflux/pkg/messaging"
+)
+
+// publisher blocks publishing until it's released.
+type publisher struct {
+	release chan struct{}
+	mu      sync.Mutex
+	topics  []string
+	closed  bool
+}
+
+func (pub *publisher) Publish(ctx context.Context, topic string, msg *messaging.Message) error {
+	<-pub.release
+	pub.mu.Lock()
+	defer pub.mu.Unlock()
+	pub.topics = append(pub.topics, topic)
+	return errors.New("failed")
+}
+
+func (pub *publisher) Close() error {
+	pub.mu.Lock()
+	defer pub.mu.Unlock()
+	pub.closed = true
+	return nil
+}
+
+func TestAsyncPublisher(t *testing.T) {
+	pub := &publisher{release: make(chan struct{})}
+	ap := msgbroker.NewAsyncPublisher(pub, 2, mflog.NewMock())
+
+	// The first message is taken from the queue by the blocked publisher,
+	// unless the queue is filled before.
+	var queued int
+	for _, topic := range []string{"t1", "t2", "t3", "t4"} {
+		err := ap.Publish(context.Background(), topic, &messaging.Message{})
+		switch {
+		case err == nil:
+			queued++
+		case !errors.Contains(err, msgbroker.ErrQueueFull):
+			t.Fatalf("expected error %v got %v", msgbroker.ErrQueueFull, err)
+		}
+	}
+	if queued < 2 || queued > 3 {
+		t.Fatalf("expected 2 or 3 messages queued got %d", queued)
+	}
+
+	close(pub.release)
+	if err := ap.Close(); err != nil {
+		t.Fatalf("expected no error got %v", err)
+	}
+	if len(pub.topics) != queued || !pub.closed {
+		t.Errorf("expected %d messages published before close got %d, closed %t", queued, len(pub.topics), pub.closed)
+	}
+	if err := ap.Publish(context.Background(), "t5", &messaging.Message{}); !errors.Contains(err, msgbroker.ErrClosed) {
+		t.Errorf("expected error %v got %v", msgbroker.ErrClosed, err)
+	}
+}
+
+func TestAsyncPublisherContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), contextKey{}, "value"))
+	got := make(chan context.Context, 1)
+	ap := msgbroker.NewAsyncPublisher(publisherFunc(func(ctx context.Context) {
+		got <- ctx
+	}), 1, mflog.NewMock())
+	defer ap.Close()
+
+	cancel()
+	if err := ap.Publish(ctx, "topic", &messaging.Message{}); err != nil {
+		t.Fatalf("expected no error got %v", err)
+	}
+	pctx := <-got
+	if pctx.Err() != nil || pctx.Value(contextKey{}) != "value" {
+		t.Errorf("expected context values without cancellation got error %v and value %v", pctx.Err(), pctx.Value(contextKey{}))
+	}
+}
+
+type contextKey struct{}
+
+type publisherFunc func(ctx context.Context)
+
+func (f publisherFunc) Publish(ctx context.Context, topic string, msg *messaging.Message) error {
+	f(ctx)
+	return nil
+}
+
+func (f publisherFunc) Close() error {
+	return nil
+}
@@ -0,0 +1,188 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/mainflux/mainflux/pkg/errors"
+)
+
+// Listener names.
+const (
+	MQTT      = "mqtt"
+	MQTTS     = "mqtts"
+	WebSocket = "ws"
+	WSS       = "wss"
+)
+
+var (
+	// ErrNotProxied indicates that the session is not proxied to the MQTT broker.
+	ErrNotProxied = errors.New("session is not proxied to the MQTT broker")
+
+	errInvalidCIDR = errors.New("invalid CIDR or IP address")
+)
+
+// The clientKey type is unexported to prevent collisions with context keys defined in
+// other packages.
+type clientKey struct{}
+
+// Client stores details of the client connection.
+type Client struct {
+	// Listener contains the name of the listener client connected to.
+	Listener string
+
+	// RemoteAddr contains the real client address. If the connection
+	// comes from a trusted proxy, it's the address reported by the proxy.
+	RemoteAddr net.Addr
+
+	// ServerName is the lowercase host name the client requested using
+	// TLS SNI. It's empty for plain connections.
+	ServerName string
+
+	close func() error
+
+	mu       sync.Mutex
+	outbound *outbound
+}
+
+// NewClient returns client details of the connection. Close function
+// is used to forcibly close the client connection.
+func NewClient(listener string, remoteAddr net.Addr, close func() error) *Client {
+	return &Client{
+		Listener:   listener,
+		RemoteAddr: remoteAddr,
+		close:      close,
+	}
+}
+
+// Close closes the client connection, which ends the session.
+func (c *Client) Close() error {
+	if c.close == nil {
+		return nil
+	}
+	return c.close()
+}
+
+// Unsubscribe unsubscribes the client from the topic filters at the MQTT
+// broker on behalf of the client, such as when the client loses access to
+// the channels. It fails if the session is not proxied to the broker.
+func (c *Client) Unsubscribe(topics []string) error {
+	out := c.upstream()
+	if out == nil {
+		return ErrNotProxied
+	}
+	return out.unsubscribe(topics)
+}
+
+// Disconnect gracefully ends the session. DISCONNECT is sent to the MQTT
+// broker on behalf of the client, so the broker discards the client's will,
+// and the client connection is closed. MQTT 3.1.1 doesn't let the server
+// send DISCONNECT to the client, so the client only sees the connection
+// closed.
+func (c *Client) Disconnect() error {
+	if out := c.upstream(); out != nil {
+		if err := out.disconnect(); err != nil {
+			c.Close()
+			return err
+		}
+	}
+	return c.Close()
+}
+
+func (c *Client) upstream() *outbound {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.outbound
+}
+
+func (c *Client) setUpstream(out *outbound) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.outbound = out
+}
+
+// IP returns IP address of the client.
+func (c *Client) IP() net.IP {
+	return addrIP(c.RemoteAddr)
+}
+
+// NewContext stores Client in context.Context values.
+func NewContext(ctx context.Context, c *Client) context.Context {
+	return context.WithValue(ctx, clientKey{}, c)
+}
+
+// FromContext retrieves Client from context.Context.
+// Second value indicates if client is present in the context.
+func FromContext(ctx context.Context) (*Client, bool) {
+	if c, ok := ctx.Value(clientKey{}).(*Client); ok && c != nil {
+		return c, true
+	}
+	return nil, false
+}
+
+// ParseCIDRs parses the list of CIDRs. Plain IP addresses are
+// treated as networks containing a single address.
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, errors.Wrap(errInvalidCIDR, errors.New(cidr))
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.Wrap(errInvalidCIDR, err)
+		}
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+// Contains checks if any of the networks contains the IP address.
+func Contains(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	case nil:
+		return nil
+	default:
+		host, _, err := net.SplitHostPort(a.String())
+		if err != nil {
+			return net.ParseIP(a.String())
+		}
+		return net.ParseIP(host)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package proxy
+
+import (
+	"net"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/mainflux/mainflux/pkg/errors"
+)
+
+const (
+	// refuseTimeout is the maximum time the refused client has to send
+	// CONNECT and to read CONNACK.
+	refuseTimeout = 5 * time.Second
+
+	// maxRefusedConnectSize is the maximum size of CONNECT read from the
+	// refused client, regardless of the maximum packet size of the listener.
+	maxRefusedConnectSize = 4096
+
+	// maxRefusing is the maximum number of the refused clients of the
+	// listener responded to at once.
+	maxRefusing = 64
+)
+
+// ErrIdentifierRejected indicates that the client ID is not allowed. Handlers
+// wrap their errors with it, so the client is refused with the matching
+// CONNACK return code.
+var ErrIdentifierRejected = errors.New("client identifier rejected")
+
+// returnCode returns CONNACK return code of MQTT 3.1.1 matching the reason the
+// client is refused for. Errors which are not caused by the client, such as
+// the connection limits or the MQTT broker being down, make the server
+// unavailable to the client.
+func returnCode(err error) byte {
+	switch {
+	case errors.Contains(err, ErrIdentifierRejected):
+		return packets.ErrRefusedIDRejected
+	case errors.Contains(err, errors.ErrAuthentication):
+		return packets.ErrRefusedBadUsernameOrPassword
+	case errors.Contains(err, errors.ErrAuthorization):
+		return packets.ErrRefusedNotAuthorised
+	default:
+		return packets.ErrRefusedServerUnavailable
+	}
+}
+
+// refuse sends CONNACK refusing the client for the reason, so the client can
+// tell the refusal from a network failure and doesn't reconnect immediately.
+func refuse(conn net.Conn, reason error) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(refuseTimeout)); err != nil {
+		return err
+	}
+	ack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	ack.ReturnCode = returnCode(reason)
+
+	return ack.Write(conn)
+}
+
+// refuseConnect reads CONNECT of the client refused before its session
+// starts, such as by the connection limits, and refuses it.
+func (cfg Config) refuseConnect(conn net.Conn, reason error) error {
+	timeout := cfg.ConnectTimeout
+	if timeout <= 0 || timeout > refuseTimeout {
+		timeout = refuseTimeout
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	size := maxRefusedConnectSize
+	if cfg.MaxPacketSize > 0 && cfg.MaxPacketSize < size {
+		size = cfg.MaxPacketSize
+	}
+	pkt, err := readPacket(conn, size)
+	if err != nil {
+		return err
+	}
+	if _, ok := pkt.(*packets.ConnectPacket); !ok {
+		return ErrNotConnect
+	}
+
+	return refuse(conn, reason)
+}
+
+// refusals bounds the work spent on the refused clients, so a connection storm
+// can't exhaust goroutines and memory. The clients refused above the bound are
+// disconnected without a response.
+type refusals chan struct{}
+
+func newRefusals(size int) refusals {
+	return make(refusals, size)
+}
+
+// start refuses the connection in the background if the bound isn't reached.
+// Otherwise, it closes the connection and returns false.
+func (r refusals) start(conn net.Conn, refuse func(net.Conn)) bool {
+	select {
+	case r <- struct{}{}:
+		go func() {
+			defer func() { <-r }()
+			refuse(conn)
+		}()
+		return true
+	default:
+		conn.Close()
+		return false
+	}
+}
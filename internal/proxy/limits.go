@@ -0,0 +1,88 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package proxy
+
+import (
+	"net"
+	"sync"
+
+	"github.com/mainflux/mainflux/pkg/errors"
+)
+
+var (
+	// ErrConnLimit indicates that the total number of connections is reached.
+	ErrConnLimit = errors.New("maximum number of connections reached")
+
+	// ErrConnLimitPerIP indicates that the number of connections from the IP address is reached.
+	ErrConnLimitPerIP = errors.New("maximum number of connections from the IP address reached")
+)
+
+// ConnStats contains connection counts.
+type ConnStats struct {
+	Total int `json:"total"`
+	IPs   int `json:"ips"`
+}
+
+// ConnLimiter limits the number of concurrent connections, in total
+// and per source IP address. It's safe to share among the listeners.
+type ConnLimiter struct {
+	maxTotal int
+	maxPerIP int
+	mu       sync.Mutex
+	total    int
+	perIP    map[string]int
+}
+
+// NewConnLimiter returns a new connection limiter. Zero limit means unlimited.
+func NewConnLimiter(maxTotal, maxPerIP int) *ConnLimiter {
+	return &ConnLimiter{
+		maxTotal: maxTotal,
+		maxPerIP: maxPerIP,
+		perIP:    make(map[string]int),
+	}
+}
+
+// Acquire reserves a connection slot for the IP address.
+func (l *ConnLimiter) Acquire(ip net.IP) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := ip.String()
+	if l.maxTotal > 0 && l.total >= l.maxTotal {
+		return ErrConnLimit
+	}
+	if l.maxPerIP > 0 && l.perIP[key] >= l.maxPerIP {
+		return ErrConnLimitPerIP
+	}
+	l.total++
+	l.perIP[key]++
+
+	return nil
+}
+
+// Release frees the connection slot of the IP address.
+func (l *ConnLimiter) Release(ip net.IP) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := ip.String()
+	if l.perIP[key] == 0 {
+		return
+	}
+	l.total--
+	if l.perIP[key]--; l.perIP[key] == 0 {
+		delete(l.perIP, key)
+	}
+}
+
+// Stats returns current connection counts.
+func (l *ConnLimiter) Stats() ConnStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return ConnStats{
+		Total: l.total,
+		IPs:   len(l.perIP),
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/absmach/aproxy/internal/upstream"
+	mflog "github.com/mainflux/mainflux/logger"
+	"github.com/mainflux/mproxy/pkg/session"
+)
+
+// Config contains listener configuration.
+type Config struct {
+	// Address is the address to listen on.
+	Address string
+
+	// TLS is TLS configuration of the listener. If nil, the listener
+	// accepts plain connections.
+	TLS *tls.Config
+
+	// Upstreams are the MQTT brokers the sessions are proxied to.
+	Upstreams upstream.Balancer
+
+	// TargetTLS is TLS configuration of the connection to the MQTT broker.
+	// If nil, the connection is not encrypted.
+	TargetTLS *tls.Config
+
+	// ProxyProtocol enables PROXY protocol headers on the listener.
+	ProxyProtocol bool
+
+	// TrustedProxies are the networks PROXY protocol headers
+	// and X-Forwarded-For headers are accepted from.
+	TrustedProxies []*net.IPNet
+
+	// AllowedNetworks are the networks clients are allowed to connect from.
+	// If empty, clients may connect from any network which is not denied.
+	AllowedNetworks []*net.IPNet
+
+	// DeniedNetworks are the networks clients are not allowed to connect from.
+	DeniedNetworks []*net.IPNet
+
+	// Limiter limits the number of concurrent connections. If nil, the number
+	// of connections is not limited.
+	Limiter *ConnLimiter
+
+	// ConnectTimeout is the time the client has to send CONNECT after the
+	// connection is established. Zero means no timeout.
+	ConnectTimeout time.Duration
+
+	// MaxKeepAlive is the maximum keep alive of the client. Clients which
+	// don't send any packet in 1.5 times the keep alive are disconnected.
+	// Zero means that the keep alive requested by the client is used.
+	MaxKeepAlive time.Duration
+
+	// MaxPacketSize is the maximum size of the packet sent by the client,
+	// in bytes. Zero means no limit.
+	MaxPacketSize int
+}
+
+// MQTTProxy proxies MQTT traffic between clients and the MQTT broker.
+type MQTTProxy struct {
+	cfg      Config
+	handler  session.Handler
+	logger   mflog.Logger
+	dialer   net.Dialer
+	refusals refusals
+}
+
+// NewMQTT returns a new MQTT proxy instance.
+func NewMQTT(cfg Config, handler session.Handler, logger mflog.Logger) *MQTTProxy {
+	return &MQTTProxy{
+		cfg:      cfg,
+		handler:  handler,
+		logger:   logger,
+		refusals: newRefusals(maxRefusing),
+	}
+}
+
+// Listen accepts client connections until the context is canceled.
+func (p *MQTTProxy) Listen(ctx context.Context) error {
+	l, err := Listen(p.cfg, p.logger)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				p.logger.Info("Server Exiting...")
+				return nil
+			}
+			p.logger.Warn("Accept error " + err.Error())
+			continue
+		}
+
+		if !p.cfg.permitted(p.cfg.listener(MQTT, MQTTS), conn.RemoteAddr(), p.logger) {
+			p.close(conn)
+			continue
+		}
+		ip := addrIP(conn.RemoteAddr())
+		if err := p.cfg.acquire(ip); err != nil {
+			p.logger.Warn(fmt.Sprintf("Rejected client from %s: %s", conn.RemoteAddr(), err))
+			if !p.refusals.start(conn, func(conn net.Conn) { p.refuse(conn, err) }) {
+				p.logger.Debug(fmt.Sprintf("Closed client from %s without CONNACK, too many clients are being refused", conn.RemoteAddr()))
+			}
+			continue
+		}
+
+		p.logger.Info("Accepted new client from " + conn.RemoteAddr().String())
+		go func() {
+			defer p.cfg.release(ip)
+			p.handle(ctx, conn)
+		}()
+	}
+}
+
+func (p *MQTTProxy) handle(ctx context.Context, inbound net.Conn) {
+	defer p.close(inbound)
+
+	clientCert, serverName, err := handshake(inbound, p.cfg.ConnectTimeout)
+	if err != nil {
+		p.logger.Warn(fmt.Sprintf("TLS handshake with %s failed: %s", inbound.RemoteAddr(), err))
+		return
+	}
+
+	c := NewClient(p.cfg.listener(MQTT, MQTTS), inbound.RemoteAddr(), inbound.Close)
+	c.ServerName = serverName
+	ctx = NewContext(ctx, c)
+	if err = p.cfg.stream(ctx, inbound, p.dial, p.handler, clientCert); err != io.EOF {
+		p.logger.Warn(err.Error())
+	}
+}
+
+func (p *MQTTProxy) dial(ctx context.Context) (net.Conn, error) {
+	return p.cfg.Upstreams.Dial(ctx, p.dialAddress)
+}
+
+func (p *MQTTProxy) dialAddress(ctx context.Context, address string) (net.Conn, error) {
+	if p.cfg.TargetTLS == nil {
+		return p.dialer.DialContext(ctx, "tcp", address)
+	}
+	dialer := tls.Dialer{
+		NetDialer: &p.dialer,
+		Config:    p.cfg.TargetTLS,
+	}
+	return dialer.DialContext(ctx, "tcp", address)
+}
+
+// refuse refuses the client which is not allowed to start the session.
+func (p *MQTTProxy) refuse(conn net.Conn, reason error) {
+	defer p.close(conn)
+	if err := p.cfg.refuseConnect(conn, reason); err != nil {
+		p.logger.Debug(fmt.Sprintf("Failed to refuse client from %s: %s", conn.RemoteAddr(), err))
+	}
+}
+
+func (p *MQTTProxy) close(conn net.Conn) {
+	if err := conn.Close(); err != nil {
+		p.logger.Warn(fmt.Sprintf("Error closing connection %s", err.Error()))
+	}
+}
+
+func (cfg Config) acquire(ip net.IP) error {
+	if cfg.Limiter == nil {
+		return nil
+	}
+	return cfg.Limiter.Acquire(ip)
+}
+
+func (cfg Config) release(ip net.IP) {
+	if cfg.Limiter != nil {
+		cfg.Limiter.Release(ip)
+	}
+}
+
+// listener returns the name of the plain or the TLS listener.
+func (cfg Config) listener(plain, secure string) string {
+	if cfg.TLS != nil {
+		return secure
+	}
+	return plain
+}
+
+// Listen announces on the configured address, consuming PROXY protocol
+// headers if enabled.
+func Listen(cfg Config, logger mflog.Logger) (net.Listener, error) {
+	l, err := net.Listen("tcp", cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ProxyProtocol {
+		l = NewProxyProtocolListener(l, cfg.TrustedProxies, logger)
+	}
+	if cfg.TLS != nil {
+		l = tls.NewListener(l, cfg.TLS)
+	}
+
+	return l, nil
+}
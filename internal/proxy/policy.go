@@ -0,0 +1,37 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package proxy
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+
+	mflog "github.com/mainflux/mainflux/logger"
+)
+
+// Network policy decisions, counted per listener.
+const (
+	decisionAllow = "allow"
+	decisionDeny  = "deny"
+)
+
+var networkDecisions = expvar.NewMap("network_policy_decisions")
+
+// permitted checks the client address against the listener network policy.
+// Denied networks take precedence over the allowed ones, and if no allowed
+// networks are configured, all the addresses which are not denied are allowed.
+func (cfg Config) permitted(listener string, addr net.Addr, logger mflog.Logger) bool {
+	ip := addrIP(addr)
+	allowed := !Contains(cfg.DeniedNetworks, ip) && (len(cfg.AllowedNetworks) == 0 || Contains(cfg.AllowedNetworks, ip))
+	if !allowed {
+		networkDecisions.Add(listener+"_"+decisionDeny, 1)
+		logger.Warn(fmt.Sprintf("Rejected %s connection from %s by network policy", listener, addr))
+		return false
+	}
+	networkDecisions.Add(listener+"_"+decisionAllow, 1)
+	logger.Debug(fmt.Sprintf("Accepted %s connection from %s by network policy", listener, addr))
+
+	return true
+}
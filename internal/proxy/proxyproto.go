@@ -0,0 +1,273 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mflog "github.com/mainflux/mainflux/logger"
+	"github.com/mainflux/mainflux/pkg/errors"
+)
+
+const (
+	proxyHeaderTimeout = 5 * time.Second
+	// Maximum length of PROXY protocol v1 header, including CRLF.
+	v1MaxLen = 107
+	v1Prefix = "PROXY "
+	v2Len    = 16
+
+	v2CmdLocal   = 0x0
+	v2CmdProxy   = 0x1
+	v2FamTCP4    = 0x11
+	v2FamTCP6    = 0x21
+	v2AddrLenIP4 = 12
+	v2AddrLenIP6 = 36
+)
+
+// PROXY protocol v2 signature.
+var v2Sig = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+var (
+	errMalformedProxyHeader = errors.New("malformed PROXY protocol header")
+	errMissingProxyHeader   = errors.New("missing PROXY protocol header")
+)
+
+var _ net.Listener = (*proxyProtoListener)(nil)
+
+type proxyProtoListener struct {
+	net.Listener
+	trusted []*net.IPNet
+	logger  mflog.Logger
+	conns   chan net.Conn
+	errs    chan error
+	done    chan struct{}
+	once    sync.Once
+}
+
+// NewProxyProtocolListener wraps the listener so that PROXY protocol v1 and v2
+// headers sent by trusted proxies are consumed, and the client address they carry
+// is reported as connection remote address. Connections of trusted proxies
+// without the header are closed, and connections from other sources are
+// passed through unchanged. Headers are read in a separate goroutine per connection,
+// so a slow client can't block accepting the others.
+func NewProxyProtocolListener(l net.Listener, trusted []*net.IPNet, logger mflog.Logger) net.Listener {
+	pl := &proxyProtoListener{
+		Listener: l,
+		trusted:  trusted,
+		logger:   logger,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		done:     make(chan struct{}),
+	}
+	go pl.accept()
+
+	return pl
+}
+
+// Accept waits for and returns the next connection with PROXY header consumed.
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the underlying listener.
+func (l *proxyProtoListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+	return l.Listener.Close()
+}
+
+func (l *proxyProtoListener) accept() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+				continue
+			case <-l.done:
+				return
+			}
+		}
+
+		go l.handle(conn)
+	}
+}
+
+func (l *proxyProtoListener) handle(conn net.Conn) {
+	if !Contains(l.trusted, addrIP(conn.RemoteAddr())) {
+		l.pass(conn)
+		return
+	}
+
+	pc, err := readProxyHeader(conn)
+	if err != nil {
+		l.logger.Warn(fmt.Sprintf("Failed to read PROXY protocol header from %s: %s", conn.RemoteAddr(), err))
+		conn.Close()
+		return
+	}
+	l.pass(pc)
+}
+
+func (l *proxyProtoListener) pass(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// proxyProtoConn is a connection with the PROXY protocol header consumed.
+type proxyProtoConn struct {
+	net.Conn
+	r          *bufio.Reader
+	remoteAddr net.Addr
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout)); err != nil {
+		return nil, err
+	}
+
+	pc := &proxyProtoConn{
+		Conn:       conn,
+		r:          bufio.NewReader(conn),
+		remoteAddr: conn.RemoteAddr(),
+	}
+
+	first, err := pc.r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	var addr net.Addr
+	switch first[0] {
+	case v1Prefix[0]:
+		prefix, err := pc.r.Peek(len(v1Prefix))
+		if err != nil || string(prefix) != v1Prefix {
+			return nil, errMissingProxyHeader
+		}
+		if addr, err = readV1(pc.r); err != nil {
+			return nil, err
+		}
+	case v2Sig[0]:
+		sig, err := pc.r.Peek(len(v2Sig))
+		if err != nil || !bytes.Equal(sig, v2Sig) {
+			return nil, errMissingProxyHeader
+		}
+		if addr, err = readV2(pc.r); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errMissingProxyHeader
+	}
+	if addr != nil {
+		pc.remoteAddr = addr
+	}
+
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+
+	return pc, nil
+}
+
+// readV1 reads human-readable header in the format:
+// PROXY TCP4|TCP6|UNKNOWN <src_ip> <dst_ip> <src_port> <dst_port>\r\n.
+func readV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < v1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errMalformedProxyHeader
+	}
+
+	fields := strings.Fields(strings.TrimSpace(string(line)))
+	if len(fields) < 2 {
+		return nil, errMalformedProxyHeader
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+		if len(fields) != 6 {
+			return nil, errMalformedProxyHeader
+		}
+		ip := net.ParseIP(fields[2])
+		port, err := strconv.ParseUint(fields[4], 10, 16)
+		if ip == nil || err != nil {
+			return nil, errMalformedProxyHeader
+		}
+		return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+	default:
+		return nil, errMalformedProxyHeader
+	}
+}
+
+// readV2 reads binary header consisting of 12 bytes signature, version and
+// command, address family, addresses length and the addresses.
+func readV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, v2Len)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 0x2 {
+		return nil, errMalformedProxyHeader
+	}
+	cmd, fam := hdr[12]&0x0F, hdr[13]
+	addrs := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, addrs); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case cmd == v2CmdLocal:
+		return nil, nil
+	case cmd != v2CmdProxy:
+		return nil, errMalformedProxyHeader
+	case fam == v2FamTCP4 && len(addrs) >= v2AddrLenIP4:
+		return &net.TCPAddr{
+			IP:   net.IP(addrs[0:4]),
+			Port: int(binary.BigEndian.Uint16(addrs[8:10])),
+		}, nil
+	case fam == v2FamTCP6 && len(addrs) >= v2AddrLenIP6:
+		return &net.TCPAddr{
+			IP:   net.IP(addrs[0:16]),
+			Port: int(binary.BigEndian.Uint16(addrs[32:34])),
+		}, nil
+	default:
+		// Unix sockets and unspecified families keep the address of the proxy.
+		return nil, nil
+	}
+}
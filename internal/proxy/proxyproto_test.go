@@ -0,0 +1,283 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package proxy
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	mflog "github.com/mainflux/mainflux/logger"
+	"github.com/mainflux/mainflux/pkg/errors"
+)
+
+const payload = "payload"
+
+func v2Header(cmd, fam byte, addrs []byte) []byte {
+	hdr := append([]byte{}, v2Sig...)
+	hdr = append(hdr, 0x20|cmd, fam, 0, 0)
+	binary.BigEndian.PutUint16(hdr[14:16], uint16(len(addrs)))
+	return append(hdr, addrs...)
+}
+
+func v2Addrs(src, dst net.IP, srcPort, dstPort uint16) []byte {
+	addrs := append(append([]byte{}, src...), dst...)
+	return binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(addrs, srcPort), dstPort)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	proxyAddr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4000}
+
+	cases := []struct {
+		desc   string
+		header []byte
+		addr   string
+		err    error
+	}{
+		{
+			desc:   "v1 TCP4",
+			header: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 1883\r\n"),
+			addr:   "192.0.2.1:56324",
+		},
+		{
+			desc:   "v1 TCP6",
+			header: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 1883\r\n"),
+			addr:   "[2001:db8::1]:56324",
+		},
+		{
+			desc:   "v1 UNKNOWN",
+			header: []byte("PROXY UNKNOWN\r\n"),
+			addr:   proxyAddr.String(),
+		},
+		{
+			desc:   "v1 without CRLF",
+			header: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 1883\n"),
+			err:    errMalformedProxyHeader,
+		},
+		{
+			desc:   "v1 with missing fields",
+			header: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n"),
+			err:    errMalformedProxyHeader,
+		},
+		{
+			desc:   "v1 with invalid address",
+			header: []byte("PROXY TCP4 192.0.2 198.51.100.1 56324 1883\r\n"),
+			err:    errMalformedProxyHeader,
+		},
+		{
+			desc:   "v1 with invalid port",
+			header: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 65536 1883\r\n"),
+			err:    errMalformedProxyHeader,
+		},
+		{
+			desc:   "v1 with unknown protocol",
+			header: []byte("PROXY UDP4 192.0.2.1 198.51.100.1 56324 1883\r\n"),
+			err:    errMalformedProxyHeader,
+		},
+		{
+			desc:   "v1 truncated",
+			header: []byte("PROXY TCP4 192.0.2.1"),
+			err:    io.EOF,
+		},
+		{
+			desc:   "v2 PROXY TCP4",
+			header: v2Header(v2CmdProxy, v2FamTCP4, v2Addrs(net.ParseIP("192.0.2.1").To4(), net.ParseIP("198.51.100.1").To4(), 56324, 1883)),
+			addr:   "192.0.2.1:56324",
+		},
+		{
+			desc:   "v2 PROXY TCP6",
+			header: v2Header(v2CmdProxy, v2FamTCP6, v2Addrs(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), 56324, 1883)),
+			addr:   "[2001:db8::1]:56324",
+		},
+		{
+			desc:   "v2 PROXY with TLVs",
+			header: v2Header(v2CmdProxy, v2FamTCP4, append(v2Addrs(net.ParseIP("192.0.2.1").To4(), net.ParseIP("198.51.100.1").To4(), 56324, 1883), 0x04, 0x00, 0x01, 0xFF)),
+			addr:   "192.0.2.1:56324",
+		},
+		{
+			desc:   "v2 PROXY with unspecified family",
+			header: v2Header(v2CmdProxy, 0x00, nil),
+			addr:   proxyAddr.String(),
+		},
+		{
+			desc:   "v2 LOCAL",
+			header: v2Header(v2CmdLocal, 0x00, nil),
+			addr:   proxyAddr.String(),
+		},
+		{
+			desc:   "v2 LOCAL with addresses",
+			header: v2Header(v2CmdLocal, v2FamTCP4, v2Addrs(net.ParseIP("192.0.2.1").To4(), net.ParseIP("198.51.100.1").To4(), 56324, 1883)),
+			addr:   proxyAddr.String(),
+		},
+		{
+			desc:   "v2 with unknown command",
+			header: v2Header(0x2, v2FamTCP4, v2Addrs(net.ParseIP("192.0.2.1").To4(), net.ParseIP("198.51.100.1").To4(), 56324, 1883)),
+			err:    errMalformedProxyHeader,
+		},
+		{
+			desc: "v2 with unknown version",
+			header: func() []byte {
+				hdr := v2Header(v2CmdProxy, 0x00, nil)
+				hdr[12] = 0x11
+				return hdr
+			}(),
+			err: errMalformedProxyHeader,
+		},
+		{
+			desc:   "v2 truncated header",
+			header: v2Header(v2CmdProxy, v2FamTCP4, nil)[:14],
+			err:    io.ErrUnexpectedEOF,
+		},
+		{
+			desc:   "v2 truncated addresses",
+			header: v2Header(v2CmdProxy, v2FamTCP4, v2Addrs(net.ParseIP("192.0.2.1").To4(), net.ParseIP("198.51.100.1").To4(), 56324, 1883))[:20],
+			err:    io.ErrUnexpectedEOF,
+		},
+		{
+			desc:   "missing header",
+			header: []byte{0x10, 0x0C},
+			err:    errMissingProxyHeader,
+		},
+		{
+			desc:   "missing header starting like v1",
+			header: []byte("PRO"),
+			err:    errMissingProxyHeader,
+		},
+		{
+			desc:   "missing header starting like v2",
+			header: []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0B},
+			err:    errMissingProxyHeader,
+		},
+	}
+
+	for _, tc := range cases {
+		client, server := net.Pipe()
+		go func(header []byte, ok bool) {
+			client.Write(header)
+			if ok {
+				client.Write([]byte(payload))
+			}
+			client.Close()
+		}(tc.header, tc.err == nil)
+
+		conn, err := readProxyHeader(&addrConn{Conn: server, remoteAddr: proxyAddr})
+		if !errors.Contains(err, tc.err) || (err == nil) != (tc.err == nil) {
+			t.Errorf("%s: expected error %v got %v", tc.desc, tc.err, err)
+		}
+		if err != nil {
+			server.Close()
+			continue
+		}
+		if got := conn.RemoteAddr().String(); got != tc.addr {
+			t.Errorf("%s: expected remote address %s got %s", tc.desc, tc.addr, got)
+		}
+		data, err := io.ReadAll(conn)
+		if err != nil || string(data) != payload {
+			t.Errorf("%s: expected payload %q after the header got %q and error %v", tc.desc, payload, data, err)
+		}
+		server.Close()
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	_, other, _ := net.ParseCIDR("10.0.0.0/8")
+	header := "PROXY TCP4 192.0.2.1 198.51.100.1 56324 1883\r\n"
+
+	cases := []struct {
+		desc    string
+		trusted []*net.IPNet
+		data    string
+		addr    string
+		payload string
+		closed  bool
+	}{
+		{
+			desc:    "header from trusted source",
+			trusted: []*net.IPNet{loopback},
+			data:    header + payload,
+			addr:    "192.0.2.1",
+			payload: payload,
+		},
+		{
+			desc:    "header from untrusted source",
+			trusted: []*net.IPNet{other},
+			data:    header + payload,
+			addr:    "127.0.0.1",
+			payload: header + payload,
+		},
+		{
+			desc:    "missing header from untrusted source",
+			trusted: []*net.IPNet{other},
+			data:    payload,
+			addr:    "127.0.0.1",
+			payload: payload,
+		},
+		{
+			desc:    "missing header from trusted source",
+			trusted: []*net.IPNet{loopback},
+			data:    payload,
+			closed:  true,
+		},
+		{
+			desc:    "malformed header from trusted source",
+			trusted: []*net.IPNet{loopback},
+			data:    "PROXY TCP4 192.0.2.1\r\n" + payload,
+			closed:  true,
+		},
+	}
+
+	for _, tc := range cases {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to listen: %s", err)
+		}
+		pl := NewProxyProtocolListener(l, tc.trusted, mflog.NewMock())
+
+		client, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to dial: %s", err)
+		}
+		if _, err := client.Write([]byte(tc.data)); err != nil {
+			t.Fatalf("failed to write: %s", err)
+		}
+		client.(*net.TCPConn).CloseWrite()
+
+		if tc.closed {
+			// The connection is closed without being accepted.
+			if _, err := io.ReadAll(client); err != nil {
+				t.Errorf("%s: expected connection closed got %v", tc.desc, err)
+			}
+			client.Close()
+			pl.Close()
+			continue
+		}
+
+		conn, err := pl.Accept()
+		if err != nil {
+			t.Fatalf("%s: expected no error got %v", tc.desc, err)
+		}
+		if ip := addrIP(conn.RemoteAddr()).String(); ip != tc.addr {
+			t.Errorf("%s: expected remote address %s got %s", tc.desc, tc.addr, ip)
+		}
+		data, err := io.ReadAll(conn)
+		if err != nil || string(data) != tc.payload {
+			t.Errorf("%s: expected payload %q got %q and error %v", tc.desc, tc.payload, data, err)
+		}
+		conn.Close()
+		client.Close()
+		pl.Close()
+	}
+}
+
+// addrConn reports the remote address, which net.Pipe doesn't have.
+type addrConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
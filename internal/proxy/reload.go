@@ -0,0 +1,217 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	mflog "github.com/mainflux/mainflux/logger"
+)
+
+// DefaultHost is the name the default TLS configuration is reported under.
+const DefaultHost = "default"
+
+// CertStatus contains the state of the server certificate of the host.
+type CertStatus struct {
+	Host       string    `json:"host"`
+	Subject    string    `json:"subject"`
+	NotAfter   time.Time `json:"not_after"`
+	ReloadedAt time.Time `json:"reloaded_at"`
+}
+
+type certs struct {
+	def      *tls.Config
+	hosts    map[string]*tls.Config
+	statuses []CertStatus
+}
+
+// Reloader keeps TLS configuration of the listeners up to date with the
+// certificates, keys and client CA bundles on disk. The configuration of
+// the default host is served to the clients which request no or an unknown
+// host using TLS SNI, and host names are case-insensitive.
+type Reloader struct {
+	def     ServerTLSConfig
+	hosts   map[string]ServerTLSConfig
+	current atomic.Pointer[certs]
+	mu      sync.Mutex
+	modTime map[string]time.Time
+	logger  mflog.Logger
+}
+
+// NewReloader returns a new reloader with the certificates loaded.
+func NewReloader(def ServerTLSConfig, hosts map[string]ServerTLSConfig, logger mflog.Logger) (*Reloader, error) {
+	r := &Reloader{
+		def:     def,
+		hosts:   make(map[string]ServerTLSConfig, len(hosts)),
+		modTime: make(map[string]time.Time),
+		logger:  logger,
+	}
+	for name, hc := range hosts {
+		r.hosts[strings.ToLower(name)] = hc
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Config returns TLS configuration of the listener which serves the
+// certificates loaded last.
+func (r *Reloader) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			c := r.current.Load()
+			if hc, ok := c.hosts[strings.ToLower(hello.ServerName)]; ok {
+				return hc, nil
+			}
+			return c.def, nil
+		},
+	}
+}
+
+// Reload loads the certificates and swaps them for the ones in use. If any
+// of them fails to load, the ones in use are kept.
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modTime := r.modTimes()
+	now := time.Now()
+	c := &certs{
+		hosts: make(map[string]*tls.Config, len(r.hosts)),
+	}
+
+	var err error
+	if c.def, err = ServerTLS(r.def); err != nil {
+		return err
+	}
+	c.statuses = appendStatus(c.statuses, DefaultHost, c.def, now)
+	for name, hcfg := range r.hosts {
+		hc, err := ServerTLS(hcfg)
+		if err != nil {
+			return fmt.Errorf("virtual host %s: %w", name, err)
+		}
+		c.hosts[name] = hc
+		c.statuses = appendStatus(c.statuses, name, hc, now)
+	}
+	sort.Slice(c.statuses, func(i, j int) bool {
+		return c.statuses[i].Host < c.statuses[j].Host
+	})
+
+	r.current.Store(c)
+	r.modTime = modTime
+
+	return nil
+}
+
+// Run reloads the certificates when the files change on disk, checking them
+// at the interval, or when the process receives SIGHUP, until the context is
+// canceled. If the interval is zero, the files are not checked.
+func (r *Reloader) Run(ctx context.Context, interval time.Duration) error {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-hup:
+			r.reload("SIGHUP")
+		case <-tick:
+			if r.changed() {
+				r.reload("certificate files changed")
+			}
+		}
+	}
+}
+
+// Status returns the state of the server certificates.
+func (r *Reloader) Status() []CertStatus {
+	return r.current.Load().statuses
+}
+
+func (r *Reloader) reload(reason string) {
+	if err := r.Reload(); err != nil {
+		r.logger.Error(fmt.Sprintf("Failed to reload TLS certificates on %s: %s", reason, err))
+		return
+	}
+	r.logger.Info(fmt.Sprintf("Reloaded TLS certificates on %s", reason))
+}
+
+func (r *Reloader) changed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modTime := r.modTimes()
+	if len(modTime) != len(r.modTime) {
+		return true
+	}
+	for path, t := range modTime {
+		if !t.Equal(r.modTime[path]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *Reloader) modTimes() map[string]time.Time {
+	modTime := make(map[string]time.Time)
+	add := func(cfg ServerTLSConfig) {
+		for _, path := range []string{cfg.CertFile, cfg.KeyFile, cfg.ClientCAFile} {
+			if path == "" {
+				continue
+			}
+			// Missing files are left out, so removing the file is a change
+			// and the reload reports the error.
+			if fi, err := os.Stat(path); err == nil {
+				modTime[path] = fi.ModTime()
+			}
+		}
+	}
+	add(r.def)
+	for _, hc := range r.hosts {
+		add(hc)
+	}
+
+	return modTime
+}
+
+func appendStatus(statuses []CertStatus, host string, tc *tls.Config, now time.Time) []CertStatus {
+	if len(tc.Certificates) == 0 || len(tc.Certificates[0].Certificate) == 0 {
+		return statuses
+	}
+	leaf, err := x509.ParseCertificate(tc.Certificates[0].Certificate[0])
+	if err != nil {
+		return statuses
+	}
+
+	return append(statuses, CertStatus{
+		Host:       host,
+		Subject:    leaf.Subject.String(),
+		NotAfter:   leaf.NotAfter,
+		ReloadedAt: now,
+	})
+}
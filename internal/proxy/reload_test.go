@@ -0,0 +1,200 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"testing"
+	"time"
+
+	mflog "github.com/mainflux/mainflux/logger"
+)
+
+// served returns the expiry of the certificate served for the server name.
+func served(t *testing.T, r *Reloader, serverName string) time.Time {
+	tc, err := r.Config().GetConfigForClient(&tls.ClientHelloInfo{ServerName: serverName})
+	if err != nil {
+		t.Fatalf("failed to get configuration of %q: %s", serverName, err)
+	}
+	leaf, err := x509.ParseCertificate(tc.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatalf("failed to parse certificate of %q: %s", serverName, err)
+	}
+
+	return leaf.NotAfter
+}
+
+// touch moves the modification time of the files forward, so the change is
+// detected regardless of the file system time resolution.
+func touch(t *testing.T, files ...string) {
+	mtime := time.Now().Add(time.Minute)
+	for _, file := range files {
+		if err := os.Chtimes(file, mtime, mtime); err != nil {
+			t.Fatalf("failed to touch %s: %s", file, err)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	root := newCA(t, "root")
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	defCert, defKey := root.issue(t, dir, "default.example.com", expiry)
+	hostCert, hostKey := root.issue(t, dir, "a.example.com", expiry)
+	r, err := NewReloader(ServerTLSConfig{CertFile: defCert, KeyFile: defKey}, map[string]ServerTLSConfig{
+		"a.example.com": {CertFile: hostCert, KeyFile: hostKey},
+	}, mflog.NewMock())
+	if err != nil {
+		t.Fatalf("failed to load certificates: %s", err)
+	}
+
+	// The configuration of the listener serves the rotated certificates.
+	listener := r.Config()
+	rotated := expiry.Add(time.Hour)
+	root.issue(t, dir, "a.example.com", rotated)
+	if err := r.Reload(); err != nil {
+		t.Fatalf("failed to reload certificates: %s", err)
+	}
+	cases := []struct {
+		desc       string
+		serverName string
+		notAfter   time.Time
+	}{
+		{
+			desc:       "rotated virtual host certificate",
+			serverName: "a.example.com",
+			notAfter:   rotated,
+		},
+		{
+			desc:     "default certificate",
+			notAfter: expiry,
+		},
+	}
+	for _, tc := range cases {
+		if notAfter := served(t, r, tc.serverName); !notAfter.Equal(tc.notAfter) {
+			t.Errorf("%s: expected certificate expiring at %s got %s", tc.desc, tc.notAfter, notAfter)
+		}
+	}
+	cert, _, err := handshakeWith(listener, "a.example.com")
+	if err != nil || cert != "a.example.com" {
+		t.Errorf("expected handshake with a.example.com certificate got %s and error %v", cert, err)
+	}
+
+	// Invalid files are not loaded, and the certificates in use are kept.
+	writeFile(t, dir, "a.example.com.crt", []byte("not a certificate"))
+	if err := r.Reload(); err == nil {
+		t.Errorf("expected error reloading invalid certificate got none")
+	}
+	if notAfter := served(t, r, "a.example.com"); !notAfter.Equal(rotated) {
+		t.Errorf("expected previous certificate expiring at %s got %s", rotated, notAfter)
+	}
+	os.Remove(defKey)
+	if err := r.Reload(); err == nil {
+		t.Errorf("expected error reloading missing key got none")
+	}
+	if notAfter := served(t, r, ""); !notAfter.Equal(expiry) {
+		t.Errorf("expected previous default certificate expiring at %s got %s", expiry, notAfter)
+	}
+}
+
+func TestReloaderChanged(t *testing.T) {
+	dir := t.TempDir()
+	root := newCA(t, "root")
+	caFile := root.write(t, dir)
+	certFile, keyFile := root.issue(t, dir, "default.example.com", time.Now().Add(time.Hour))
+	r, err := NewReloader(ServerTLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile}, nil, mflog.NewMock())
+	if err != nil {
+		t.Fatalf("failed to load certificates: %s", err)
+	}
+
+	if r.changed() {
+		t.Errorf("expected no change after loading")
+	}
+	touch(t, caFile)
+	if !r.changed() {
+		t.Errorf("expected change of client CA bundle to be detected")
+	}
+	if err := r.Reload(); err != nil {
+		t.Fatalf("failed to reload certificates: %s", err)
+	}
+	if r.changed() {
+		t.Errorf("expected no change after reload")
+	}
+	os.Remove(keyFile)
+	if !r.changed() {
+		t.Errorf("expected removal of key to be detected")
+	}
+}
+
+func TestReloaderRun(t *testing.T) {
+	dir := t.TempDir()
+	root := newCA(t, "root")
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	certFile, keyFile := root.issue(t, dir, "default.example.com", expiry)
+	r, err := NewReloader(ServerTLSConfig{CertFile: certFile, KeyFile: keyFile}, nil, mflog.NewMock())
+	if err != nil {
+		t.Fatalf("failed to load certificates: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- r.Run(ctx, 10*time.Millisecond)
+	}()
+
+	rotated := expiry.Add(time.Hour)
+	root.issue(t, dir, "default.example.com", rotated)
+	touch(t, certFile, keyFile)
+	deadline := time.Now().Add(5 * time.Second)
+	for !served(t, r, "").Equal(rotated) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected certificate expiring at %s to be reloaded", rotated)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("expected no error got %v", err)
+	}
+}
+
+func TestReloaderStatus(t *testing.T) {
+	dir := t.TempDir()
+	root := newCA(t, "root")
+	defExpiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	hostExpiry := defExpiry.Add(24 * time.Hour)
+	defCert, defKey := root.issue(t, dir, "default.example.com", defExpiry)
+	hostCert, hostKey := root.issue(t, dir, "a.example.com", hostExpiry)
+
+	before := time.Now()
+	r, err := NewReloader(ServerTLSConfig{CertFile: defCert, KeyFile: defKey}, map[string]ServerTLSConfig{
+		"A.Example.com": {CertFile: hostCert, KeyFile: hostKey},
+		// Hosts without own certificates are not reported.
+		"b.example.com": {},
+	}, mflog.NewMock())
+	if err != nil {
+		t.Fatalf("failed to load certificates: %s", err)
+	}
+
+	expected := []CertStatus{
+		{Host: "a.example.com", Subject: "CN=a.example.com", NotAfter: hostExpiry},
+		{Host: DefaultHost, Subject: "CN=default.example.com", NotAfter: defExpiry},
+	}
+	statuses := r.Status()
+	if len(statuses) != len(expected) {
+		t.Fatalf("expected statuses %+v got %+v", expected, statuses)
+	}
+	for i, status := range statuses {
+		if status.ReloadedAt.Before(before) {
+			t.Errorf("%s: expected reload time after %s got %s", status.Host, before, status.ReloadedAt)
+		}
+		status.ReloadedAt = time.Time{}
+		if status.Host != expected[i].Host || status.Subject != expected[i].Subject || !status.NotAfter.Equal(expected[i].NotAfter) {
+			t.Errorf("expected status %+v got %+v", expected[i], status)
+		}
+	}
+}
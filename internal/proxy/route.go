@@ -0,0 +1,147 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"time"
+
+	"github.com/absmach/aproxy/internal/upstream"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/mainflux/mainflux/pkg/errors"
+	"github.com/mainflux/mproxy/pkg/session"
+)
+
+var (
+	// ErrNotRouted indicates that the client sent a packet the proxy can't
+	// answer before the session is routed by the topic.
+	ErrNotRouted = errors.New("unexpected packet before the session is routed")
+
+	// ErrTopicRoute indicates that the topic is routed to other MQTT brokers
+	// than the session.
+	ErrTopicRoute = errors.New("topic is routed to other MQTT brokers than the session")
+
+	// ErrUpstreamRefused indicates that the MQTT broker refused CONNECT of
+	// the session routed by the topic.
+	ErrUpstreamRefused = errors.New("MQTT broker refused the connection")
+)
+
+// topicRoute checks that the topics the session publishes or subscribes to
+// are routed to the same MQTT brokers as the session.
+type topicRoute struct {
+	balancer upstream.TopicBalancer
+	// topic is the topic the session is routed by. It's empty if the
+	// session is routed without the topic.
+	topic string
+}
+
+// topicRouting returns the topic route of the session, or nil if the sessions
+// are not routed by the topics.
+func (cfg Config) topicRouting() *topicRoute {
+	tb, ok := cfg.Upstreams.(upstream.TopicBalancer)
+	if !ok || !tb.RoutesTopics() {
+		return nil
+	}
+	return &topicRoute{balancer: tb}
+}
+
+func (tr *topicRoute) check(ctx context.Context, pkt packets.ControlPacket) error {
+	if tr == nil {
+		return nil
+	}
+	for _, topic := range topics(pkt) {
+		if !tr.balancer.SameRoute(ctx, tr.topic, topic) {
+			return errors.Wrap(ErrTopicRoute, errors.New(topic))
+		}
+	}
+
+	return nil
+}
+
+// route accepts CONNECT and answers the client on behalf of the MQTT broker
+// until the client publishes or subscribes, so the session can be routed by
+// the topic. It returns the authorized packet, which the session is routed by.
+func (cfg Config) route(ctx context.Context, inbound net.Conn, h session.Handler, keepAlive uint16) (packets.ControlPacket, error) {
+	ack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	if err := ack.Write(inbound); err != nil {
+		return nil, err
+	}
+
+	idle := cfg.idleTimeout(keepAlive)
+	for {
+		if idle > 0 {
+			if err := inbound.SetReadDeadline(time.Now().Add(idle)); err != nil {
+				return nil, err
+			}
+		}
+		pkt, err := readPacket(inbound, cfg.MaxPacketSize)
+		if err != nil {
+			return nil, err
+		}
+
+		var res packets.ControlPacket
+		switch p := pkt.(type) {
+		case *packets.PublishPacket, *packets.SubscribePacket:
+			if err := authorize(ctx, pkt, h); err != nil {
+				return nil, err
+			}
+			if len(topics(pkt)) == 0 {
+				return nil, ErrNotRouted
+			}
+			return pkt, nil
+		case *packets.PingreqPacket:
+			res = packets.NewControlPacket(packets.Pingresp)
+		case *packets.UnsubscribePacket:
+			// Nothing is subscribed to before the session is routed.
+			unsuback := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+			unsuback.MessageID = p.MessageID
+			res = unsuback
+		case *packets.DisconnectPacket:
+			return nil, io.EOF
+		default:
+			return nil, ErrNotRouted
+		}
+		if err := res.Write(inbound); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// connack reads CONNACK of the MQTT broker to CONNECT sent on behalf of the
+// client which is already accepted by the proxy.
+func (cfg Config) connack(outbound net.Conn) error {
+	if cfg.ConnectTimeout > 0 {
+		if err := outbound.SetReadDeadline(time.Now().Add(cfg.ConnectTimeout)); err != nil {
+			return err
+		}
+		defer outbound.SetReadDeadline(time.Time{})
+	}
+	pkt, err := packets.ReadPacket(outbound)
+	if err != nil {
+		return err
+	}
+	ack, ok := pkt.(*packets.ConnackPacket)
+	if !ok {
+		return ErrUpstreamRefused
+	}
+	if ack.ReturnCode != packets.Accepted {
+		return errors.Wrap(ErrUpstreamRefused, errors.New(packets.ConnackReturnCodes[ack.ReturnCode]))
+	}
+
+	return nil
+}
+
+// topics returns the topics the client publishes or subscribes to.
+func topics(pkt packets.ControlPacket) []string {
+	switch p := pkt.(type) {
+	case *packets.PublishPacket:
+		return []string{p.TopicName}
+	case *packets.SubscribePacket:
+		return p.Topics
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,369 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/absmach/aproxy/internal/upstream"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/mainflux/mainflux/pkg/errors"
+	"github.com/mainflux/mproxy/pkg/session"
+)
+
+type direction int
+
+const (
+	up direction = iota
+	down
+)
+
+const (
+	unknownID = "unknown"
+	// maxLengthBytes is the maximum number of bytes of the remaining length.
+	maxLengthBytes = 4
+)
+
+var (
+	errUp   = "failed to proxy from MQTT client with id %s to MQTT broker with error: %s"
+	errDown = "failed to proxy from MQTT broker to client with id %s with error: %s"
+)
+
+var (
+	// ErrPacketTooLarge indicates that the packet exceeds the maximum packet size.
+	ErrPacketTooLarge = errors.New("packet exceeds maximum packet size")
+
+	// ErrNotConnect indicates that the first packet of the client is not CONNECT.
+	ErrNotConnect = errors.New("first packet is not CONNECT")
+
+	// ErrUnexpectedConnect indicates that the client sent CONNECT more than once.
+	ErrUnexpectedConnect = errors.New("unexpected CONNECT")
+
+	// ErrFailedDial indicates that the connection to the MQTT broker failed.
+	ErrFailedDial = errors.New("failed to connect to MQTT broker")
+
+	errMalformedLength = errors.New("malformed remaining length")
+)
+
+// Dialer dials the MQTT broker. The context contains the authorized session.
+type Dialer func(ctx context.Context) (net.Conn, error)
+
+// stream proxies MQTT packets between the client and the MQTT broker.
+// The broker is dialed only once the client CONNECT is authorized, so
+// connections which never authenticate don't reach the broker. Clients
+// which are refused get CONNACK with the reason before being disconnected.
+// If the sessions are routed by the topics, clean sessions are accepted by
+// the proxy, and the broker is dialed once they publish or subscribe.
+func (cfg Config) stream(ctx context.Context, inbound net.Conn, dial Dialer, h session.Handler, cert x509.Certificate) error {
+	s := session.Session{
+		Cert: cert,
+	}
+	ctx = session.NewContext(ctx, &s)
+	defer h.Disconnect(ctx)
+
+	if cfg.ConnectTimeout > 0 {
+		if err := inbound.SetReadDeadline(time.Now().Add(cfg.ConnectTimeout)); err != nil {
+			return err
+		}
+	}
+	pkt, err := readPacket(inbound, cfg.MaxPacketSize)
+	if err != nil {
+		return wrap(ctx, err, up)
+	}
+	connect, ok := pkt.(*packets.ConnectPacket)
+	if !ok {
+		return wrap(ctx, ErrNotConnect, up)
+	}
+
+	s.ID = connect.ClientIdentifier
+	s.Username = connect.Username
+	s.Password = connect.Password
+	if err := h.AuthConnect(ctx); err != nil {
+		refuse(inbound, err)
+		return wrap(ctx, err, up)
+	}
+	// Copy back to the packet in case values are changed by the handler.
+	connect.ClientIdentifier = s.ID
+	connect.Username = s.Username
+	connect.Password = s.Password
+
+	if err := inbound.SetReadDeadline(time.Time{}); err != nil {
+		return err
+	}
+
+	// Persistent sessions are routed without the topic, since the broker
+	// which keeps them has to be dialed on CONNECT.
+	route := cfg.topicRouting()
+	var first packets.ControlPacket
+	if route != nil && connect.CleanSession {
+		if first, err = cfg.route(ctx, inbound, h, connect.Keepalive); err != nil {
+			return wrap(ctx, err, up)
+		}
+		route.topic = topics(first)[0]
+		ctx = upstream.NewTopicContext(ctx, route.topic)
+		// The other topics of the packet have to be routed to the same brokers.
+		if err := route.check(ctx, first); err != nil {
+			return wrap(ctx, err, up)
+		}
+	}
+
+	conn, err := dial(ctx)
+	if err != nil {
+		if first == nil {
+			refuse(inbound, ErrFailedDial)
+		}
+		return wrap(ctx, errors.Wrap(ErrFailedDial, err), down)
+	}
+	defer conn.Close()
+
+	outbound := newOutbound(conn)
+	if err := connect.Write(outbound); err != nil {
+		return wrap(ctx, err, down)
+	}
+	if first != nil {
+		if err := cfg.connack(outbound); err != nil {
+			return wrap(ctx, err, down)
+		}
+	}
+	if c, ok := FromContext(ctx); ok {
+		c.setUpstream(outbound)
+		defer c.setUpstream(nil)
+	}
+	if err := h.Connect(ctx); err != nil {
+		return wrap(ctx, err, up)
+	}
+	if first != nil {
+		if err := first.Write(outbound); err != nil {
+			return wrap(ctx, err, down)
+		}
+		if err := notify(ctx, first, h); err != nil {
+			return wrap(ctx, err, up)
+		}
+	}
+
+	errs := make(chan error, 2)
+	go cfg.pipe(ctx, up, inbound, outbound, h, route, cfg.idleTimeout(connect.Keepalive), errs)
+	go cfg.pipe(ctx, down, outbound, inbound, h, nil, 0, errs)
+
+	// Handle whichever error happens first.
+	// The other routine won't be blocked when writing
+	// to the errors channel because it is buffered.
+	return <-errs
+}
+
+// pipe copies the packets from r to w. If idle is not zero, reading from r
+// fails if no packet is received in that time. If route is not nil, the
+// topics of the packets are checked to be routed to the same MQTT brokers.
+func (cfg Config) pipe(ctx context.Context, dir direction, r, w net.Conn, h session.Handler, route *topicRoute, idle time.Duration, errs chan error) {
+	maxSize := 0
+	if dir == up {
+		maxSize = cfg.MaxPacketSize
+	}
+
+	for {
+		if idle > 0 {
+			if err := r.SetReadDeadline(time.Now().Add(idle)); err != nil {
+				errs <- wrap(ctx, err, dir)
+				return
+			}
+		}
+
+		pkt, err := readPacket(r, maxSize)
+		if err != nil {
+			errs <- wrap(ctx, err, dir)
+			return
+		}
+
+		// The client doesn't expect the acknowledgements
+		// of the packets sent on its behalf.
+		if o, ok := r.(*outbound); ok && o.acknowledged(pkt) {
+			continue
+		}
+
+		if dir == up {
+			if err = authorize(ctx, pkt, h); err != nil {
+				errs <- wrap(ctx, err, dir)
+				return
+			}
+			if err = route.check(ctx, pkt); err != nil {
+				errs <- wrap(ctx, err, dir)
+				return
+			}
+		}
+
+		if err := pkt.Write(w); err != nil {
+			errs <- wrap(ctx, err, dir)
+			return
+		}
+
+		if dir == up {
+			if err := notify(ctx, pkt, h); err != nil {
+				errs <- wrap(ctx, err, dir)
+				return
+			}
+		}
+	}
+}
+
+// outbound is the connection to the MQTT broker, which is written to both by
+// the client and by the proxy on behalf of the client. Each packet is written
+// using a single write, so the packets are never interleaved.
+type outbound struct {
+	net.Conn
+	mu      sync.Mutex
+	lastID  uint16
+	pending map[uint16]bool
+}
+
+func newOutbound(conn net.Conn) *outbound {
+	return &outbound{
+		Conn:    conn,
+		pending: make(map[uint16]bool),
+	}
+}
+
+func (o *outbound) Write(b []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.Conn.Write(b)
+}
+
+// unsubscribe sends UNSUBSCRIBE on behalf of the client. Packet IDs are
+// allocated downwards from the highest one, since clients usually allocate
+// them upwards from the lowest one.
+func (o *outbound) unsubscribe(topics []string) error {
+	o.mu.Lock()
+	o.lastID--
+	if o.lastID == 0 {
+		o.lastID--
+	}
+	id := o.lastID
+	o.pending[id] = true
+	o.mu.Unlock()
+
+	pkt := packets.NewControlPacket(packets.Unsubscribe).(*packets.UnsubscribePacket)
+	pkt.MessageID = id
+	pkt.Topics = topics
+
+	return pkt.Write(o)
+}
+
+// disconnect sends DISCONNECT on behalf of the client.
+func (o *outbound) disconnect() error {
+	return packets.NewControlPacket(packets.Disconnect).Write(o)
+}
+
+// acknowledged reports whether the packet is the acknowledgement
+// of the packet sent on behalf of the client.
+func (o *outbound) acknowledged(pkt packets.ControlPacket) bool {
+	ack, ok := pkt.(*packets.UnsubackPacket)
+	if !ok {
+		return false
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.pending[ack.MessageID] {
+		return false
+	}
+	delete(o.pending, ack.MessageID)
+
+	return true
+}
+
+// idleTimeout returns the time the client may stay idle, which is 1.5 times
+// the keep alive negotiated between the client and the maximum keep alive.
+func (cfg Config) idleTimeout(keepAlive uint16) time.Duration {
+	d := time.Duration(keepAlive) * time.Second
+	if cfg.MaxKeepAlive > 0 && (d == 0 || d > cfg.MaxKeepAlive) {
+		d = cfg.MaxKeepAlive
+	}
+
+	return d * 3 / 2
+}
+
+// readPacket reads the MQTT packet. If maxSize is not zero, the packet size is
+// checked against it before the packet is read, so oversized packets are
+// never allocated.
+func readPacket(r io.Reader, maxSize int) (packets.ControlPacket, error) {
+	if maxSize <= 0 {
+		return packets.ReadPacket(r)
+	}
+
+	header := make([]byte, 1, 1+maxLengthBytes)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	var length, shift int
+	for {
+		if len(header) > maxLengthBytes {
+			return nil, errMalformedLength
+		}
+		b := make([]byte, 1)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		header = append(header, b[0])
+		length |= int(b[0]&0x7f) << shift
+		if b[0]&0x80 == 0 {
+			break
+		}
+		shift += 7
+	}
+	if len(header)+length > maxSize {
+		return nil, ErrPacketTooLarge
+	}
+
+	return packets.ReadPacket(io.MultiReader(bytes.NewReader(header), r))
+}
+
+func authorize(ctx context.Context, pkt packets.ControlPacket, h session.Handler) error {
+	switch p := pkt.(type) {
+	case *packets.ConnectPacket:
+		return ErrUnexpectedConnect
+	case *packets.PublishPacket:
+		return h.AuthPublish(ctx, &p.TopicName, &p.Payload)
+	case *packets.SubscribePacket:
+		return h.AuthSubscribe(ctx, &p.Topics)
+	default:
+		return nil
+	}
+}
+
+func notify(ctx context.Context, pkt packets.ControlPacket, h session.Handler) error {
+	switch p := pkt.(type) {
+	case *packets.PublishPacket:
+		return h.Publish(ctx, &p.TopicName, &p.Payload)
+	case *packets.SubscribePacket:
+		return h.Subscribe(ctx, &p.Topics)
+	case *packets.UnsubscribePacket:
+		return h.Unsubscribe(ctx, &p.Topics)
+	default:
+		return nil
+	}
+}
+
+func wrap(ctx context.Context, err error, dir direction) error {
+	if err == io.EOF {
+		return err
+	}
+	cid := unknownID
+	if s, ok := session.FromContext(ctx); ok && s.ID != "" {
+		cid = s.ID
+	}
+	switch dir {
+	case up:
+		return fmt.Errorf(errUp, cid, err.Error())
+	case down:
+		return fmt.Errorf(errDown, cid, err.Error())
+	default:
+		return err
+	}
+}
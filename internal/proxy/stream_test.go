@@ -0,0 +1,634 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/absmach/aproxy/internal/upstream"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	mflog "github.com/mainflux/mainflux/logger"
+	"github.com/mainflux/mainflux/pkg/errors"
+)
+
+// handler authorizes CONNECT with the error, and allows everything else.
+type handler struct {
+	err error
+}
+
+func (h handler) AuthConnect(ctx context.Context) error {
+	return h.err
+}
+
+func (h handler) AuthPublish(ctx context.Context, topic *string, payload *[]byte) error {
+	return nil
+}
+
+func (h handler) AuthSubscribe(ctx context.Context, topics *[]string) error {
+	return nil
+}
+
+func (h handler) Connect(ctx context.Context) error {
+	return nil
+}
+
+func (h handler) Publish(ctx context.Context, topic *string, payload *[]byte) error {
+	return nil
+}
+
+func (h handler) Subscribe(ctx context.Context, topics *[]string) error {
+	return nil
+}
+
+func (h handler) Unsubscribe(ctx context.Context, topics *[]string) error {
+	return nil
+}
+
+func (h handler) Disconnect(ctx context.Context) error {
+	return nil
+}
+
+func connectPacket(keepAlive uint16) *packets.ConnectPacket {
+	connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connect.ProtocolName = "MQTT"
+	connect.ProtocolVersion = 4
+	connect.ClientIdentifier = "client"
+	connect.Keepalive = keepAlive
+
+	return connect
+}
+
+// readConnack reads CONNACK sent to the client.
+func readConnack(t *testing.T, client net.Conn) (byte, bool) {
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	pkt, err := packets.ReadPacket(client)
+	if err != nil {
+		return 0, false
+	}
+	ack, ok := pkt.(*packets.ConnackPacket)
+	if !ok {
+		t.Fatalf("expected CONNACK got %s", pkt)
+	}
+
+	return ack.ReturnCode, true
+}
+
+func TestStreamRefuse(t *testing.T) {
+	dialErr := errors.New("connection refused")
+
+	cases := []struct {
+		desc    string
+		authErr error
+		dialErr error
+		code    byte
+	}{
+		{
+			desc:    "rejected client ID",
+			authErr: errors.Wrap(ErrIdentifierRejected, errors.New("client_id doesn't match the thing")),
+			code:    packets.ErrRefusedIDRejected,
+		},
+		{
+			desc:    "bad credentials",
+			authErr: errors.Wrap(errors.ErrAuthentication, errors.New("invalid secret")),
+			code:    packets.ErrRefusedBadUsernameOrPassword,
+		},
+		{
+			desc:    "not authorized",
+			authErr: errors.Wrap(errors.ErrAuthorization, errors.New("network not allowed")),
+			code:    packets.ErrRefusedNotAuthorised,
+		},
+		{
+			desc:    "locked out",
+			authErr: errors.New("too many failed attempts"),
+			code:    packets.ErrRefusedServerUnavailable,
+		},
+		{
+			desc:    "failed dial",
+			dialErr: dialErr,
+			code:    packets.ErrRefusedServerUnavailable,
+		},
+	}
+
+	for _, tc := range cases {
+		client, server := net.Pipe()
+		go connectPacket(0).Write(client)
+
+		dial := func(ctx context.Context) (net.Conn, error) {
+			return nil, tc.dialErr
+		}
+		errs := make(chan error, 1)
+		go func(h handler) {
+			errs <- Config{}.stream(context.Background(), server, dial, h, x509.Certificate{})
+		}(handler{err: tc.authErr})
+
+		code, ok := readConnack(t, client)
+		if !ok || code != tc.code {
+			t.Errorf("%s: expected CONNACK with return code %#x got %#x", tc.desc, tc.code, code)
+		}
+		if err := <-errs; err == nil {
+			t.Errorf("%s: expected error got nil", tc.desc)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestRefuseConnect(t *testing.T) {
+	cfg := Config{ConnectTimeout: 100 * time.Millisecond}
+
+	cases := []struct {
+		desc    string
+		send    packets.ControlPacket
+		err     error
+		timeout bool
+		refused bool
+	}{
+		{
+			desc:    "CONNECT",
+			send:    connectPacket(0),
+			refused: true,
+		},
+		{
+			desc: "not CONNECT",
+			send: packets.NewControlPacket(packets.Pingreq),
+			err:  ErrNotConnect,
+		},
+		{
+			desc: "CONNECT above refused CONNECT size",
+			send: func() packets.ControlPacket {
+				connect := connectPacket(0)
+				connect.PasswordFlag = true
+				connect.Password = make([]byte, maxRefusedConnectSize)
+				return connect
+			}(),
+			err: ErrPacketTooLarge,
+		},
+		{
+			desc:    "nothing within connect timeout",
+			timeout: true,
+		},
+	}
+
+	for _, tc := range cases {
+		client, server := net.Pipe()
+		if tc.send != nil {
+			go tc.send.Write(client)
+		}
+		errs := make(chan error, 1)
+		go func() {
+			errs <- cfg.refuseConnect(server, ErrConnLimitPerIP)
+		}()
+
+		if tc.refused {
+			code, ok := readConnack(t, client)
+			if !ok || code != packets.ErrRefusedServerUnavailable {
+				t.Errorf("%s: expected CONNACK with return code %#x got %#x", tc.desc, packets.ErrRefusedServerUnavailable, code)
+			}
+		}
+		err := <-errs
+		switch {
+		case tc.timeout:
+			if !os.IsTimeout(err) {
+				t.Errorf("%s: expected timeout got %v", tc.desc, err)
+			}
+		case !errors.Contains(err, tc.err) || (err == nil) != (tc.err == nil):
+			t.Errorf("%s: expected error %v got %v", tc.desc, tc.err, err)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestRefusalsBound(t *testing.T) {
+	r := newRefusals(2)
+	release := make(chan struct{})
+	refused := make(chan net.Conn, 3)
+	refuse := func(conn net.Conn) {
+		<-release
+		refused <- conn
+	}
+
+	var clients []net.Conn
+	for i := 0; i < 3; i++ {
+		client, server := net.Pipe()
+		defer client.Close()
+		clients = append(clients, client)
+		started := r.start(server, refuse)
+		if expected := i < 2; started != expected {
+			t.Errorf("refusal %d: expected started %t got %t", i, expected, started)
+		}
+	}
+
+	// The connection above the bound is closed without a response.
+	clients[2].SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := clients[2].Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected connection closed got %v", err)
+	}
+
+	// Finished refusals make room for the next ones.
+	close(release)
+	for i := 0; i < 2; i++ {
+		(<-refused).Close()
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(r) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	if !r.start(server, func(conn net.Conn) { conn.Close() }) {
+		t.Errorf("expected refusal to start after the others finished")
+	}
+}
+
+func TestReadPacket(t *testing.T) {
+	connect := new(bytes.Buffer)
+	connectPacket(0).Write(connect)
+	publish := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	publish.TopicName = "channels/1/messages"
+	publish.Payload = make([]byte, 200)
+	large := new(bytes.Buffer)
+	publish.Write(large)
+
+	cases := []struct {
+		desc    string
+		data    []byte
+		maxSize int
+		// unread is the number of bytes left unread.
+		unread int
+		err    error
+	}{
+		{
+			desc: "packet without maximum size",
+			data: large.Bytes(),
+		},
+		{
+			desc:    "packet of maximum size",
+			data:    connect.Bytes(),
+			maxSize: connect.Len(),
+		},
+		{
+			desc:    "packet over maximum size",
+			data:    connect.Bytes(),
+			maxSize: connect.Len() - 1,
+			unread:  connect.Len() - 2,
+			err:     ErrPacketTooLarge,
+		},
+		{
+			desc:    "packet with multi-byte length over maximum size",
+			data:    large.Bytes(),
+			maxSize: 100,
+			unread:  large.Len() - 3,
+			err:     ErrPacketTooLarge,
+		},
+		{
+			desc:    "packet with malformed length",
+			data:    []byte{0x30, 0xFF, 0xFF, 0xFF, 0xFF, 0x01},
+			maxSize: 100,
+			unread:  1,
+			err:     errMalformedLength,
+		},
+		{
+			desc:    "truncated length",
+			data:    []byte{0x30, 0xFF},
+			maxSize: 100,
+			err:     io.EOF,
+		},
+	}
+
+	for _, tc := range cases {
+		r := bytes.NewReader(tc.data)
+		pkt, err := readPacket(r, tc.maxSize)
+		if !errors.Contains(err, tc.err) || (err == nil) != (tc.err == nil) {
+			t.Errorf("%s: expected error %v got %v", tc.desc, tc.err, err)
+		}
+		if err == nil && pkt == nil {
+			t.Errorf("%s: expected packet got nil", tc.desc)
+		}
+		// Oversized packets are rejected before they are read.
+		if r.Len() != tc.unread {
+			t.Errorf("%s: expected %d bytes unread got %d", tc.desc, tc.unread, r.Len())
+		}
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	cases := []struct {
+		desc         string
+		keepAlive    uint16
+		maxKeepAlive time.Duration
+		timeout      time.Duration
+	}{
+		{
+			desc: "no keep alive",
+		},
+		{
+			desc:      "client keep alive",
+			keepAlive: 60,
+			timeout:   90 * time.Second,
+		},
+		{
+			desc:         "client keep alive below maximum",
+			keepAlive:    30,
+			maxKeepAlive: time.Minute,
+			timeout:      45 * time.Second,
+		},
+		{
+			desc:         "client keep alive over maximum",
+			keepAlive:    120,
+			maxKeepAlive: time.Minute,
+			timeout:      90 * time.Second,
+		},
+		{
+			desc:         "no client keep alive with maximum",
+			maxKeepAlive: time.Minute,
+			timeout:      90 * time.Second,
+		},
+	}
+
+	for _, tc := range cases {
+		cfg := Config{MaxKeepAlive: tc.maxKeepAlive}
+		if got := cfg.idleTimeout(tc.keepAlive); got != tc.timeout {
+			t.Errorf("%s: expected idle timeout %s got %s", tc.desc, tc.timeout, got)
+		}
+	}
+}
+
+func TestStreamConnectTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	cfg := Config{ConnectTimeout: 50 * time.Millisecond}
+	start := time.Now()
+	err := cfg.stream(context.Background(), server, nil, handler{}, x509.Certificate{})
+	if err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Errorf("expected timeout got %v", err)
+	}
+	if d := time.Since(start); d < cfg.ConnectTimeout {
+		t.Errorf("expected timeout after %s got %s", cfg.ConnectTimeout, d)
+	}
+}
+
+// startStream starts proxying the client to the broker, which discards the
+// packets it receives.
+func startStream(t *testing.T, cfg Config, keepAlive uint16) (net.Conn, chan error) {
+	client, server := net.Pipe()
+	broker, upstream := net.Pipe()
+	go io.Copy(io.Discard, broker)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+		broker.Close()
+		upstream.Close()
+	})
+
+	dial := func(ctx context.Context) (net.Conn, error) {
+		return upstream, nil
+	}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- cfg.stream(context.Background(), server, dial, handler{}, x509.Certificate{})
+	}()
+	if err := connectPacket(keepAlive).Write(client); err != nil {
+		t.Fatalf("failed to send CONNECT: %s", err)
+	}
+
+	return client, errs
+}
+
+func TestStreamKeepAlive(t *testing.T) {
+	// The client keep alive is capped, so the client is disconnected
+	// after 1.5 times the maximum keep alive of 100ms.
+	cfg := Config{MaxKeepAlive: 100 * time.Millisecond}
+	client, errs := startStream(t, cfg, 60)
+
+	// The packets of the client keep the session alive.
+	for i := 0; i < 4; i++ {
+		time.Sleep(50 * time.Millisecond)
+		if err := packets.NewControlPacket(packets.Pingreq).Write(client); err != nil {
+			t.Fatalf("expected session alive after %d PINGREQs got %v", i, err)
+		}
+	}
+	select {
+	case err := <-errs:
+		t.Fatalf("expected session alive got %v", err)
+	default:
+	}
+
+	start := time.Now()
+	err := <-errs
+	if err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Errorf("expected timeout got %v", err)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Errorf("expected idle timeout of %s got %s", 150*time.Millisecond, d)
+	}
+}
+
+func TestStreamMaxPacketSize(t *testing.T) {
+	cfg := Config{MaxPacketSize: 64}
+	client, errs := startStream(t, cfg, 0)
+
+	publish := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	publish.TopicName = "channels/1/messages"
+	publish.Payload = make([]byte, 32)
+	if err := publish.Write(client); err != nil {
+		t.Fatalf("failed to publish: %s", err)
+	}
+	publish.Payload = make([]byte, 64)
+	go publish.Write(client)
+
+	err := <-errs
+	if err == nil || !strings.Contains(err.Error(), ErrPacketTooLarge.Error()) {
+		t.Errorf("expected error %v got %v", ErrPacketTooLarge, err)
+	}
+}
+
+// broker accepts CONNECT with the return code, and sends the packets it
+// receives afterwards to the channel.
+func broker(conn net.Conn, code byte, received chan<- packets.ControlPacket) {
+	if _, err := packets.ReadPacket(conn); err != nil {
+		return
+	}
+	ack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	ack.ReturnCode = code
+	if err := ack.Write(conn); err != nil {
+		return
+	}
+	for {
+		pkt, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		received <- pkt
+	}
+}
+
+func publishPacket(topic string) *packets.PublishPacket {
+	publish := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	publish.TopicName = topic
+	publish.Payload = []byte("payload")
+
+	return publish
+}
+
+// topicRouter routes channels/a/ and channels/b/ topics to their own brokers,
+// which accept CONNECT with the return code.
+func topicRouter(t *testing.T, code byte, dialed chan<- string, received chan<- packets.ControlPacket) (*upstream.Router, func(ctx context.Context) (net.Conn, error)) {
+	pool := func(address string) *upstream.Pool {
+		p, err := upstream.NewPool(upstream.Config{Targets: []string{address}}, mflog.NewMock())
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		return p
+	}
+	r := upstream.NewRouter(pool("default:1883"), nil)
+	if err := r.AddRoute("topic=channels/a/", pool("a:1883")); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := r.AddRoute("topic=channels/b/", pool("b:1883")); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	return r, func(ctx context.Context) (net.Conn, error) {
+		return r.Dial(ctx, func(ctx context.Context, address string) (net.Conn, error) {
+			dialed <- address
+			conn, server := net.Pipe()
+			t.Cleanup(func() { server.Close() })
+			go broker(server, code, received)
+			return conn, nil
+		})
+	}
+}
+
+func TestStreamTopicRoute(t *testing.T) {
+	cases := []struct {
+		desc   string
+		clean  bool
+		code   byte
+		before []packets.ControlPacket
+		// publish are the topics published to after CONNACK, the last
+		// of which isn't forwarded if the stream fails.
+		publish []string
+		address string
+		err     error
+	}{
+		{
+			desc:  "clean session routed by the first topic",
+			clean: true,
+			before: []packets.ControlPacket{
+				packets.NewControlPacket(packets.Pingreq),
+				packets.NewControlPacket(packets.Unsubscribe),
+			},
+			publish: []string{"channels/a/messages", "channels/a/messages/temp", "channels/b/messages"},
+			address: "a:1883",
+			err:     ErrTopicRoute,
+		},
+		{
+			desc:    "clean session refused by the broker",
+			clean:   true,
+			code:    packets.ErrRefusedNotAuthorised,
+			publish: []string{"channels/b/messages"},
+			address: "b:1883",
+			err:     ErrUpstreamRefused,
+		},
+		{
+			desc:    "persistent session routed without the topic",
+			publish: []string{"channels/c/messages", "channels/a/messages"},
+			address: "default:1883",
+			err:     ErrTopicRoute,
+		},
+	}
+
+	for _, tc := range cases {
+		dialed := make(chan string, 1)
+		received := make(chan packets.ControlPacket, 10)
+		router, dial := topicRouter(t, tc.code, dialed, received)
+		cfg := Config{Upstreams: router}
+
+		client, server := net.Pipe()
+		errs := make(chan error, 1)
+		go func() {
+			errs <- cfg.stream(context.Background(), server, dial, handler{}, x509.Certificate{})
+		}()
+		connect := connectPacket(0)
+		connect.CleanSession = tc.clean
+		if err := connect.Write(client); err != nil {
+			t.Fatalf("%s: failed to send CONNECT: %s", tc.desc, err)
+		}
+
+		// Both the proxy and the broker accept the persistent session.
+		if code, ok := readConnack(t, client); !ok || code != packets.Accepted {
+			t.Errorf("%s: expected accepted CONNACK got %#x", tc.desc, code)
+		}
+		for _, pkt := range tc.before {
+			if err := pkt.Write(client); err != nil {
+				t.Fatalf("%s: failed to send %s: %s", tc.desc, pkt, err)
+			}
+			client.SetReadDeadline(time.Now().Add(time.Second))
+			if res, err := packets.ReadPacket(client); err != nil {
+				t.Errorf("%s: expected response to %s got %v", tc.desc, pkt, err)
+			} else if _, ok := pkt.(*packets.PingreqPacket); ok {
+				if _, ok := res.(*packets.PingrespPacket); !ok {
+					t.Errorf("%s: expected PINGRESP got %s", tc.desc, res)
+				}
+			}
+		}
+		// The clean session isn't dialed before it's routed.
+		select {
+		case address := <-dialed:
+			if tc.clean {
+				t.Errorf("%s: unexpected dial to %s before publishing", tc.desc, address)
+			}
+			if address != tc.address {
+				t.Errorf("%s: expected dial to %s got %s", tc.desc, tc.address, address)
+			}
+		default:
+			if !tc.clean {
+				t.Errorf("%s: expected dial on CONNECT", tc.desc)
+			}
+		}
+
+		for i, topic := range tc.publish {
+			go publishPacket(topic).Write(client)
+			if i == 0 && tc.clean {
+				if address := <-dialed; address != tc.address {
+					t.Errorf("%s: expected dial to %s got %s", tc.desc, tc.address, address)
+				}
+			}
+			if i == len(tc.publish)-1 {
+				break
+			}
+			select {
+			case pkt := <-received:
+				if p, ok := pkt.(*packets.PublishPacket); !ok || p.TopicName != topic {
+					t.Errorf("%s: expected PUBLISH to %s got %s", tc.desc, topic, pkt)
+				}
+			case <-time.After(time.Second):
+				t.Errorf("%s: expected PUBLISH to %s forwarded", tc.desc, topic)
+			}
+		}
+
+		err := <-errs
+		if err == nil || !strings.Contains(err.Error(), tc.err.Error()) {
+			t.Errorf("%s: expected error %v got %v", tc.desc, tc.err, err)
+		}
+		select {
+		case pkt := <-received:
+			t.Errorf("%s: unexpected %s forwarded", tc.desc, pkt)
+		default:
+		}
+		client.Close()
+		server.Close()
+	}
+}
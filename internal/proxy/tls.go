@@ -0,0 +1,183 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mainflux/mainflux/pkg/errors"
+)
+
+// Client certificate authentication modes.
+const (
+	ClientAuthNone     = "none"
+	ClientAuthOptional = "optional"
+	ClientAuthRequired = "required"
+)
+
+var (
+	// ErrInvalidTLSVersion indicates unknown TLS version.
+	ErrInvalidTLSVersion = errors.New("invalid TLS version")
+
+	// ErrInvalidClientAuth indicates unknown client certificate authentication mode.
+	ErrInvalidClientAuth = errors.New("invalid client certificate authentication mode")
+
+	errParseCA = errors.New("failed to parse CA certificates")
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSConfig contains TLS configuration of the connection to the MQTT broker.
+type TLSConfig struct {
+	// CAFile is the CA bundle the broker certificate is verified with.
+	// If empty, the system roots are used.
+	CAFile string
+
+	// CertFile and KeyFile are the client certificate and key presented
+	// to the broker. If empty, the client certificate is not presented.
+	CertFile string
+	KeyFile  string
+
+	// ServerName overrides the name the broker certificate is verified for.
+	ServerName string
+
+	// MinVersion is the minimum TLS version, e.g. "1.2".
+	MinVersion string
+}
+
+// ClientTLS returns TLS configuration of the connection to the MQTT broker.
+func ClientTLS(cfg TLSConfig) (*tls.Config, error) {
+	tc := &tls.Config{
+		ServerName: cfg.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if cfg.MinVersion != "" {
+		v, ok := tlsVersions[cfg.MinVersion]
+		if !ok {
+			return nil, errors.Wrap(ErrInvalidTLSVersion, errors.New(cfg.MinVersion))
+		}
+		tc.MinVersion = v
+	}
+
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, errParseCA
+		}
+		tc.RootCAs = roots
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+
+	return tc, nil
+}
+
+// ServerTLSConfig contains TLS configuration of the listener or the virtual host.
+type ServerTLSConfig struct {
+	// CertFile and KeyFile are the server certificate and key.
+	CertFile string
+	KeyFile  string
+
+	// ClientCAFile is the CA bundle client certificates are verified with.
+	ClientCAFile string
+
+	// ClientAuth is the client certificate authentication mode: ClientAuthNone,
+	// ClientAuthOptional or ClientAuthRequired. If empty, client certificates
+	// are verified if presented and the client CA bundle is set.
+	ClientAuth string
+}
+
+// ServerTLS returns TLS configuration of the listener.
+func ServerTLS(cfg ServerTLSConfig) (*tls.Config, error) {
+	tc := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+
+	if cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, errParseCA
+		}
+		tc.ClientCAs = roots
+		tc.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	switch cfg.ClientAuth {
+	case "":
+	case ClientAuthNone:
+		tc.ClientAuth = tls.NoClientCert
+	case ClientAuthOptional:
+		tc.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequired:
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, errors.Wrap(ErrInvalidClientAuth, errors.New(cfg.ClientAuth))
+	}
+
+	return tc, nil
+}
+
+// handshake completes TLS handshake of the client connection within the
+// timeout. It returns the client certificate, if any, and the server name
+// requested by the client. Plain connections return zero values.
+func handshake(conn net.Conn, timeout time.Duration) (x509.Certificate, string, error) {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return x509.Certificate{}, "", nil
+	}
+
+	if timeout > 0 {
+		if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			return x509.Certificate{}, "", err
+		}
+		defer conn.SetDeadline(time.Time{})
+	}
+	if err := tc.Handshake(); err != nil {
+		return x509.Certificate{}, "", err
+	}
+
+	return peerCert(tc.ConnectionState())
+}
+
+func peerCert(state tls.ConnectionState) (x509.Certificate, string, error) {
+	serverName := strings.ToLower(state.ServerName)
+	if len(state.PeerCertificates) == 0 {
+		return x509.Certificate{}, serverName, nil
+	}
+
+	return *state.PeerCertificates[0], serverName, nil
+}
@@ -0,0 +1,382 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	stderrors "errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	mflog "github.com/mainflux/mainflux/logger"
+	"github.com/mainflux/mainflux/pkg/errors"
+)
+
+const brokerName = "broker.example.com"
+
+// ca issues the server and the client certificates.
+type ca struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newCA(t *testing.T, name string) ca {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create CA certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse CA certificate: %s", err)
+	}
+
+	return ca{cert: cert, key: key}
+}
+
+// write writes the PEM CA certificate to the directory and returns its path.
+func (c ca) write(t *testing.T, dir string) string {
+	return writeFile(t, dir, c.cert.Subject.CommonName+".crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}))
+}
+
+// issue writes the PEM certificate for the name, valid until notAfter, and its
+// key to the directory, and returns their paths.
+func (c ca) issue(t *testing.T, dir, name string, notAfter time.Time) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatalf("failed to generate serial number: %s", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, c.cert, &key.PublicKey, c.key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %s", err)
+	}
+	certFile := writeFile(t, dir, name+".crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	keyFile := writeFile(t, dir, name+".key", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+
+	return certFile, keyFile
+}
+
+func writeFile(t *testing.T, dir, name string, data []byte) string {
+	file := filepath.Join(dir, name)
+	if err := os.WriteFile(file, data, 0o600); err != nil {
+		t.Fatalf("failed to write %s: %s", file, err)
+	}
+
+	return file
+}
+
+func TestClientTLS(t *testing.T) {
+	dir := t.TempDir()
+	root := newCA(t, "root")
+	caFile := root.write(t, dir)
+	certFile, keyFile := root.issue(t, dir, "client", time.Now().Add(time.Hour))
+	invalidFile := writeFile(t, dir, "invalid.crt", []byte("not a certificate"))
+	roots := x509.NewCertPool()
+	roots.AddCert(root.cert)
+
+	cases := []struct {
+		desc       string
+		cfg        TLSConfig
+		serverName string
+		minVersion uint16
+		roots      *x509.CertPool
+		cert       bool
+		err        error
+	}{
+		{
+			desc:       "defaults",
+			minVersion: tls.VersionTLS12,
+		},
+		{
+			desc:       "minimum version",
+			cfg:        TLSConfig{MinVersion: "1.3"},
+			minVersion: tls.VersionTLS13,
+		},
+		{
+			desc: "invalid minimum version",
+			cfg:  TLSConfig{MinVersion: "1.4"},
+			err:  ErrInvalidTLSVersion,
+		},
+		{
+			desc:       "server name override",
+			cfg:        TLSConfig{ServerName: brokerName},
+			serverName: brokerName,
+			minVersion: tls.VersionTLS12,
+		},
+		{
+			desc:       "CA bundle",
+			cfg:        TLSConfig{CAFile: caFile},
+			minVersion: tls.VersionTLS12,
+			roots:      roots,
+		},
+		{
+			desc: "invalid CA bundle",
+			cfg:  TLSConfig{CAFile: invalidFile},
+			err:  errParseCA,
+		},
+		{
+			desc: "missing CA bundle",
+			cfg:  TLSConfig{CAFile: filepath.Join(dir, "missing.crt")},
+			err:  os.ErrNotExist,
+		},
+		{
+			desc:       "client certificate",
+			cfg:        TLSConfig{CertFile: certFile, KeyFile: keyFile},
+			minVersion: tls.VersionTLS12,
+			cert:       true,
+		},
+		{
+			desc: "client certificate without key",
+			cfg:  TLSConfig{CertFile: certFile},
+			err:  os.ErrNotExist,
+		},
+	}
+
+	for _, tc := range cases {
+		cfg, err := ClientTLS(tc.cfg)
+		if tc.err != nil {
+			if !stderrors.Is(err, tc.err) && !errors.Contains(err, tc.err) {
+				t.Errorf("%s: expected error %v got %v", tc.desc, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: expected no error got %v", tc.desc, err)
+			continue
+		}
+		if cfg.ServerName != tc.serverName {
+			t.Errorf("%s: expected server name %q got %q", tc.desc, tc.serverName, cfg.ServerName)
+		}
+		if cfg.MinVersion != tc.minVersion {
+			t.Errorf("%s: expected minimum version %#x got %#x", tc.desc, tc.minVersion, cfg.MinVersion)
+		}
+		if (tc.roots == nil && cfg.RootCAs != nil) || (tc.roots != nil && !tc.roots.Equal(cfg.RootCAs)) {
+			t.Errorf("%s: expected root CAs %v got %v", tc.desc, tc.roots, cfg.RootCAs)
+		}
+		if cert := len(cfg.Certificates) == 1; cert != tc.cert {
+			t.Errorf("%s: expected client certificate %t got %d certificates", tc.desc, tc.cert, len(cfg.Certificates))
+		}
+		if cfg.InsecureSkipVerify {
+			t.Errorf("%s: expected broker certificate to be verified", tc.desc)
+		}
+	}
+}
+
+func TestClientTLSDial(t *testing.T) {
+	dir := t.TempDir()
+	root := newCA(t, "root")
+	caFile := root.write(t, dir)
+	serverCert, serverKey := root.issue(t, dir, brokerName, time.Now().Add(time.Hour))
+	clientCert, clientKey := root.issue(t, dir, "client", time.Now().Add(time.Hour))
+
+	server, err := ServerTLS(ServerTLSConfig{
+		CertFile:     serverCert,
+		KeyFile:      serverKey,
+		ClientCAFile: caFile,
+		ClientAuth:   ClientAuthRequired,
+	})
+	if err != nil {
+		t.Fatalf("failed to load server TLS configuration: %s", err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", server)
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer l.Close()
+	peers := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			tc := conn.(*tls.Conn)
+			cert, _, err := handshake(tc, time.Second)
+			if err != nil {
+				peers <- ""
+			} else {
+				peers <- cert.Subject.CommonName
+			}
+			conn.Close()
+		}
+	}()
+
+	cases := []struct {
+		desc string
+		cfg  TLSConfig
+		peer string
+		err  bool
+	}{
+		{
+			desc: "mutual TLS",
+			cfg:  TLSConfig{CAFile: caFile, CertFile: clientCert, KeyFile: clientKey, ServerName: brokerName},
+			peer: "client",
+		},
+		{
+			desc: "broker name mismatch",
+			cfg:  TLSConfig{CAFile: caFile, CertFile: clientCert, KeyFile: clientKey, ServerName: "other.example.com"},
+			err:  true,
+		},
+		{
+			desc: "broker not signed by system roots",
+			cfg:  TLSConfig{CertFile: clientCert, KeyFile: clientKey, ServerName: brokerName},
+			err:  true,
+		},
+	}
+
+	for _, tc := range cases {
+		cfg, err := ClientTLS(tc.cfg)
+		if err != nil {
+			t.Fatalf("%s: failed to load client TLS configuration: %s", tc.desc, err)
+		}
+		p := NewMQTT(Config{TargetTLS: cfg}, handler{}, nil)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		conn, err := p.dialAddress(ctx, l.Addr().String())
+		cancel()
+		if tc.err {
+			if err == nil {
+				conn.Close()
+				t.Errorf("%s: expected error got none", tc.desc)
+			}
+			<-peers
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: expected no error got %v", tc.desc, err)
+			continue
+		}
+		// The server completes the handshake once the client reads.
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		conn.Read(make([]byte, 1))
+		conn.Close()
+		if peer := <-peers; peer != tc.peer {
+			t.Errorf("%s: expected broker to see client %q got %q", tc.desc, tc.peer, peer)
+		}
+	}
+}
+
+func TestVirtualHosts(t *testing.T) {
+	dir := t.TempDir()
+	root := newCA(t, "root")
+	defCert, defKey := root.issue(t, dir, "default.example.com", time.Now().Add(time.Hour))
+	aCert, aKey := root.issue(t, dir, "a.example.com", time.Now().Add(time.Hour))
+	bCert, bKey := root.issue(t, dir, "b.example.com", time.Now().Add(time.Hour))
+
+	r, err := NewReloader(ServerTLSConfig{CertFile: defCert, KeyFile: defKey}, map[string]ServerTLSConfig{
+		"a.example.com": {CertFile: aCert, KeyFile: aKey},
+		"B.Example.com": {CertFile: bCert, KeyFile: bKey},
+	}, mflog.NewMock())
+	if err != nil {
+		t.Fatalf("failed to load certificates: %s", err)
+	}
+
+	cases := []struct {
+		desc       string
+		serverName string
+		cert       string
+	}{
+		{
+			desc:       "virtual host",
+			serverName: "a.example.com",
+			cert:       "a.example.com",
+		},
+		{
+			desc:       "virtual host with upper case name",
+			serverName: "b.EXAMPLE.com",
+			cert:       "b.example.com",
+		},
+		{
+			desc:       "unknown host",
+			serverName: "c.example.com",
+			cert:       "default.example.com",
+		},
+		{
+			desc: "no SNI",
+			cert: "default.example.com",
+		},
+	}
+
+	for _, tc := range cases {
+		cert, serverName, err := handshakeWith(r.Config(), tc.serverName)
+		if err != nil {
+			t.Errorf("%s: expected no error got %v", tc.desc, err)
+			continue
+		}
+		if cert != tc.cert {
+			t.Errorf("%s: expected certificate of %s got %s", tc.desc, tc.cert, cert)
+		}
+		if expected := strings.ToLower(tc.serverName); serverName != expected {
+			t.Errorf("%s: expected server name %q got %q", tc.desc, expected, serverName)
+		}
+	}
+}
+
+// handshakeWith completes TLS handshake with the server configuration,
+// requesting the server name. It returns the subject common name of the
+// server certificate, and the server name seen by the server.
+func handshakeWith(server *tls.Config, serverName string) (string, string, error) {
+	client, srv := net.Pipe()
+	defer client.Close()
+	defer srv.Close()
+
+	names := make(chan string, 1)
+	go func() {
+		_, name, err := handshake(tls.Server(srv, server), time.Second)
+		if err != nil {
+			srv.Close()
+		}
+		names <- name
+	}()
+
+	// Only the certificate served is checked, so it's not verified.
+	conn := tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if err := conn.Handshake(); err != nil {
+		return "", "", err
+	}
+	name := <-names
+
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName, name, nil
+}
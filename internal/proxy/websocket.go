@@ -0,0 +1,337 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	mflog "github.com/mainflux/mainflux/logger"
+	"github.com/mainflux/mproxy/pkg/session"
+)
+
+const forwardedForHeader = "X-Forwarded-For"
+
+var upgrader = websocket.Upgrader{
+	// Timeout for WS upgrade request handshake
+	HandshakeTimeout: 10 * time.Second,
+	// Paho JS client expecting header Sec-WebSocket-Protocol:mqtt in Upgrade response during handshake.
+	Subprotocols: []string{"mqttv3.1", "mqtt"},
+	// Allow CORS
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+// WebSocketProxy proxies MQTT over WebSocket traffic between clients and the MQTT broker.
+type WebSocketProxy struct {
+	cfg      Config
+	path     string
+	scheme   string
+	handler  session.Handler
+	logger   mflog.Logger
+	refusals refusals
+}
+
+// NewWebSocket returns a new MQTT over WebSocket proxy instance.
+func NewWebSocket(cfg Config, path, scheme string, handler session.Handler, logger mflog.Logger) *WebSocketProxy {
+	return &WebSocketProxy{
+		cfg:      cfg,
+		path:     path,
+		scheme:   scheme,
+		handler:  handler,
+		logger:   logger,
+		refusals: newRefusals(maxRefusing),
+	}
+}
+
+// Protect applies the listener network policy to the requests of the handler,
+// such as the other handlers served on the WS port.
+func (p *WebSocketProxy) Protect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !p.cfg.permitted(p.cfg.listener(WebSocket, WSS), p.remoteAddr(r), p.logger) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Listen announces on the configured address. The connections hold the
+// slots of the connection limiter until they are closed, so the clients which
+// stall before the upgrade count towards the limits. The connections of the
+// trusted proxies are limited once the request is received instead, since the
+// client address is known only from its headers. The refused clients get
+// HTTP status 503.
+func (p *WebSocketProxy) Listen() (net.Listener, error) {
+	cfg := p.cfg
+	cfg.TLS = nil
+	l, err := Listen(cfg, p.logger)
+	if err != nil {
+		return nil, err
+	}
+	// The slots are acquired before TLS handshake, so the handshake counts
+	// towards the limits and the HTTP server still sees TLS connections.
+	if p.cfg.Limiter != nil {
+		l = &limitListener{Listener: l, proxy: p}
+	}
+	if p.cfg.TLS != nil {
+		l = tls.NewListener(l, p.cfg.TLS)
+	}
+
+	return l, nil
+}
+
+// Handler returns HTTP handler upgrading the requests and proxying WS traffic.
+func (p *WebSocketProxy) Handler() http.Handler {
+	return p.Protect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr := p.remoteAddr(r)
+		listener := p.cfg.listener(WebSocket, WSS)
+		ip := addrIP(addr)
+		// The other clients are limited by the listener.
+		forwarded := p.forwarded(r)
+		if forwarded {
+			if err := p.cfg.acquire(ip); err != nil {
+				p.logger.Warn(fmt.Sprintf("Rejected client from %s: %s", addr, err))
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		release := func() {
+			if forwarded {
+				p.cfg.release(ip)
+			}
+		}
+
+		cconn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			release()
+			p.logger.Error("Error upgrading connection " + err.Error())
+			return
+		}
+
+		var clientCert x509.Certificate
+		c := NewClient(listener, addr, cconn.Close)
+		if r.TLS != nil {
+			// The TLS handshake is already completed by the HTTP server.
+			clientCert, c.ServerName, _ = peerCert(*r.TLS)
+		}
+		ctx := NewContext(context.WithoutCancel(r.Context()), c)
+		go func() {
+			defer release()
+			p.pass(ctx, cconn, clientCert)
+		}()
+	}))
+}
+
+func (p *WebSocketProxy) pass(ctx context.Context, in *websocket.Conn, clientCert x509.Certificate) {
+	inboundConn := newWSConn(in)
+	defer inboundConn.Close()
+
+	if err := p.cfg.stream(ctx, inboundConn, p.dial, p.handler, clientCert); err != io.EOF {
+		p.logger.Warn("Broken connection for client with error: " + err.Error())
+	}
+}
+
+func (p *WebSocketProxy) dial(ctx context.Context) (net.Conn, error) {
+	return p.cfg.Upstreams.Dial(ctx, p.dialAddress)
+}
+
+func (p *WebSocketProxy) dialAddress(ctx context.Context, address string) (net.Conn, error) {
+	u := url.URL{
+		Scheme: p.scheme,
+		Host:   address,
+		Path:   p.path,
+	}
+
+	dialer := &websocket.Dialer{
+		Subprotocols:    []string{"mqtt"},
+		TLSClientConfig: p.cfg.TargetTLS,
+	}
+	srv, _, err := dialer.DialContext(ctx, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return newWSConn(srv), nil
+}
+
+// forwarded checks if the request comes from a trusted proxy, in which case
+// the client address is taken from X-Forwarded-For header.
+func (p *WebSocketProxy) forwarded(r *http.Request) bool {
+	addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	return err == nil && Contains(p.cfg.TrustedProxies, addr.IP)
+}
+
+// refuse responds to the client refused by the connection limits and closes
+// the connection, without reading the request.
+func (p *WebSocketProxy) refuse(conn net.Conn, reason error) {
+	if p.cfg.TLS != nil {
+		conn = tls.Server(conn, p.cfg.TLS)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(refuseTimeout)); err != nil {
+		return
+	}
+	body := reason.Error()
+	res := &http.Response{
+		StatusCode:    http.StatusServiceUnavailable,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         true,
+	}
+	if err := res.Write(conn); err != nil {
+		p.logger.Debug(fmt.Sprintf("Failed to refuse client from %s: %s", conn.RemoteAddr(), err))
+	}
+}
+
+// limitListener acquires the connection slots of the accepted connections.
+type limitListener struct {
+	net.Listener
+	proxy *WebSocketProxy
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ip := addrIP(conn.RemoteAddr())
+		if Contains(l.proxy.cfg.TrustedProxies, ip) {
+			return conn, nil
+		}
+		if err := l.proxy.cfg.acquire(ip); err != nil {
+			l.proxy.logger.Warn(fmt.Sprintf("Rejected client from %s: %s", conn.RemoteAddr(), err))
+			if !l.proxy.refusals.start(conn, func(conn net.Conn) { l.proxy.refuse(conn, err) }) {
+				l.proxy.logger.Debug(fmt.Sprintf("Closed client from %s without response, too many clients are being refused", conn.RemoteAddr()))
+			}
+			continue
+		}
+		return &limitedConn{Conn: conn, release: func() { l.proxy.cfg.release(ip) }}, nil
+	}
+}
+
+// limitedConn releases the connection slot once it's closed. The upgraded
+// connections are closed through the websocket connections, so they hold the
+// slot until the session ends.
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// remoteAddr returns the client address. X-Forwarded-For header is used only if
+// the request comes from a trusted proxy, and the right-most untrusted address
+// in the header is considered to be the client address.
+func (p *WebSocketProxy) remoteAddr(r *http.Request) net.Addr {
+	addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	if !Contains(p.cfg.TrustedProxies, addr.IP) {
+		return addr
+	}
+
+	var hops []string
+	for _, h := range r.Header.Values(forwardedForHeader) {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		addr = &net.TCPAddr{IP: ip}
+		if !Contains(p.cfg.TrustedProxies, ip) {
+			break
+		}
+	}
+
+	return addr
+}
+
+// wsConn is a websocket wrapper so it satisfies the net.Conn interface.
+type wsConn struct {
+	*websocket.Conn
+	r   io.Reader
+	rio sync.Mutex
+	wio sync.Mutex
+}
+
+func newWSConn(ws *websocket.Conn) net.Conn {
+	return &wsConn{
+		Conn: ws,
+	}
+}
+
+// SetDeadline sets both the read and write deadlines.
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// Write writes data to the websocket.
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.wio.Lock()
+	defer c.wio.Unlock()
+
+	if err := c.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Read reads the current websocket frame.
+func (c *wsConn) Read(p []byte) (int, error) {
+	c.rio.Lock()
+	defer c.rio.Unlock()
+	for {
+		if c.r == nil {
+			// Advance to next message.
+			var err error
+			_, c.r, err = c.NextReader()
+			if err != nil {
+				return 0, err
+			}
+		}
+		n, err := c.r.Read(p)
+		if err == io.EOF {
+			// At end of message.
+			c.r = nil
+			if n > 0 {
+				return n, nil
+			}
+			// No data read, continue to next message.
+			continue
+		}
+		return n, err
+	}
+}
+
+// Close closes the underlying websocket connection.
+func (c *wsConn) Close() error {
+	return c.Conn.Close()
+}
@@ -0,0 +1,98 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	mflog "github.com/mainflux/mainflux/logger"
+)
+
+func TestWebSocketListenerLimits(t *testing.T) {
+	_, other, _ := net.ParseCIDR("10.0.0.0/8")
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+
+	cases := []struct {
+		desc    string
+		trusted []*net.IPNet
+		limited bool
+	}{
+		{
+			desc:    "connections of untrusted source",
+			trusted: []*net.IPNet{other},
+			limited: true,
+		},
+		{
+			desc:    "connections of trusted proxy",
+			trusted: []*net.IPNet{loopback},
+		},
+	}
+
+	for _, tc := range cases {
+		limiter := NewConnLimiter(0, 1)
+		cfg := Config{Address: "127.0.0.1:0", Limiter: limiter, TrustedProxies: tc.trusted}
+		l, err := NewWebSocket(cfg, "/mqtt", "ws", handler{}, mflog.NewMock()).Listen()
+		if err != nil {
+			t.Fatalf("%s: failed to listen: %s", tc.desc, err)
+		}
+		accepted := make(chan net.Conn)
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					close(accepted)
+					return
+				}
+				accepted <- conn
+			}
+		}()
+
+		// The connection holds the slot before sending any request.
+		first, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("%s: failed to dial: %s", tc.desc, err)
+		}
+		conn := <-accepted
+		second, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("%s: failed to dial: %s", tc.desc, err)
+		}
+
+		if tc.limited {
+			second.SetReadDeadline(time.Now().Add(time.Second))
+			res, err := http.ReadResponse(bufio.NewReader(second), nil)
+			if err != nil || res.StatusCode != http.StatusServiceUnavailable {
+				t.Errorf("%s: expected response with status %d got %v and error %v", tc.desc, http.StatusServiceUnavailable, res, err)
+			}
+
+			// Closing the connection releases its slot.
+			conn.Close()
+			if stats := limiter.Stats(); stats.Total != 0 {
+				t.Errorf("%s: expected no connections got %+v", tc.desc, stats)
+			}
+			third, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatalf("%s: failed to dial: %s", tc.desc, err)
+			}
+			conn = <-accepted
+			third.Close()
+		} else {
+			// The trusted proxies are limited by the handler.
+			conn2 := <-accepted
+			conn2.Close()
+			if stats := limiter.Stats(); stats.Total != 0 {
+				t.Errorf("%s: expected no connections got %+v", tc.desc, stats)
+			}
+		}
+
+		conn.Close()
+		first.Close()
+		second.Close()
+		l.Close()
+	}
+}
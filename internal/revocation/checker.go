@@ -0,0 +1,404 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+// Package revocation checks client certificates against certificate
+// revocation lists and the local denylist of certificates.
+package revocation
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"expvar"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mflog "github.com/mainflux/mainflux/logger"
+	"github.com/mainflux/mainflux/pkg/errors"
+)
+
+// Denylist key prefixes.
+const (
+	SerialPrefix      = "serial:"
+	FingerprintPrefix = "sha256:"
+)
+
+var (
+	// ErrRevoked indicates that the certificate is revoked by its issuer.
+	ErrRevoked = errors.New("client certificate is revoked")
+
+	// ErrDenied indicates that the certificate is in the denylist.
+	ErrDenied = errors.New("client certificate is denied")
+
+	// ErrInvalidKey indicates malformed denylist key.
+	ErrInvalidKey = errors.New("invalid denylist key, expected serial:<hex> or sha256:<hex>")
+
+	// ErrCRLSignature indicates that the CRL isn't signed by any of the
+	// trusted issuers.
+	ErrCRLSignature = errors.New("CRL is not signed by a trusted issuer")
+
+	errNoCRL = errors.New("no CRL found")
+)
+
+var revocationMetrics = expvar.NewMap("certificate_revocations")
+
+// Entry contains the details of a denied certificate.
+type Entry struct {
+	Key      string    `json:"key"`
+	Reason   string    `json:"reason,omitempty"`
+	DeniedAt time.Time `json:"denied_at"`
+}
+
+// CRLStatus contains the state of the loaded certificate revocation list.
+type CRLStatus struct {
+	File       string    `json:"file"`
+	Issuer     string    `json:"issuer"`
+	Revoked    int       `json:"revoked"`
+	ThisUpdate time.Time `json:"this_update"`
+	NextUpdate time.Time `json:"next_update"`
+	LoadedAt   time.Time `json:"loaded_at"`
+}
+
+type crls struct {
+	// revoked maps raw issuer names to the revoked serial numbers.
+	revoked  map[string]map[string]bool
+	statuses []CRLStatus
+}
+
+// Checker checks client certificates against the CRLs and the denylist.
+type Checker struct {
+	files    []string
+	caFiles  []string
+	denyFile string
+	logger   mflog.Logger
+	crls     atomic.Pointer[crls]
+	mu       sync.Mutex
+	denied   map[string]Entry
+}
+
+// New returns a new checker with the CRLs loaded from the PEM or DER files.
+// Each CRL must be signed by one of the issuers in the PEM CA files. If the
+// denylist file is set, the denylist is loaded from it and saved to it on
+// each change.
+func New(files, caFiles []string, denyFile string, logger mflog.Logger) (*Checker, error) {
+	c := &Checker{
+		files:    files,
+		caFiles:  caFiles,
+		denyFile: denyFile,
+		logger:   logger,
+		denied:   make(map[string]Entry),
+	}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	if err := c.loadDenylist(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Check returns ErrRevoked if the certificate is revoked by any of the CRLs
+// of its issuer, and ErrDenied if it's in the denylist.
+func (c *Checker) Check(cert *x509.Certificate) error {
+	if serials, ok := c.crls.Load().revoked[string(cert.RawIssuer)]; ok && serials[cert.SerialNumber.Text(16)] {
+		revocationMetrics.Add("revoked", 1)
+		return ErrRevoked
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range Keys(cert) {
+		if _, ok := c.denied[key]; ok {
+			revocationMetrics.Add("denied", 1)
+			return ErrDenied
+		}
+	}
+
+	return nil
+}
+
+// Reload loads the CRLs and swaps them for the ones in use. If any of them
+// fails to load or its signature doesn't verify, the ones in use are kept.
+func (c *Checker) Reload() error {
+	now := time.Now()
+	loaded := &crls{
+		revoked: make(map[string]map[string]bool),
+	}
+	if len(c.files) == 0 {
+		c.crls.Store(loaded)
+		return nil
+	}
+	issuers, err := loadIssuers(c.caFiles)
+	if err != nil {
+		return err
+	}
+	for _, file := range c.files {
+		crl, err := loadCRL(file)
+		if err != nil {
+			return fmt.Errorf("CRL %s: %w", file, err)
+		}
+		if err := verifyCRL(crl, issuers); err != nil {
+			return fmt.Errorf("CRL %s: %w", file, err)
+		}
+		serials, ok := loaded.revoked[string(crl.RawIssuer)]
+		if !ok {
+			serials = make(map[string]bool)
+			loaded.revoked[string(crl.RawIssuer)] = serials
+		}
+		for _, rc := range crl.RevokedCertificateEntries {
+			serials[rc.SerialNumber.Text(16)] = true
+		}
+		if !crl.NextUpdate.IsZero() && crl.NextUpdate.Before(now) {
+			c.logger.Warn(fmt.Sprintf("CRL %s of %s is out of date since %s", file, crl.Issuer, crl.NextUpdate))
+		}
+		loaded.statuses = append(loaded.statuses, CRLStatus{
+			File:       file,
+			Issuer:     crl.Issuer.String(),
+			Revoked:    len(crl.RevokedCertificateEntries),
+			ThisUpdate: crl.ThisUpdate,
+			NextUpdate: crl.NextUpdate,
+			LoadedAt:   now,
+		})
+	}
+	c.crls.Store(loaded)
+
+	return nil
+}
+
+// Run reloads the CRLs at the interval until the context is canceled.
+func (c *Checker) Run(ctx context.Context, interval time.Duration) error {
+	if len(c.files) == 0 || interval <= 0 {
+		return nil
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := c.Reload(); err != nil {
+				c.logger.Error(fmt.Sprintf("Failed to reload CRLs: %s", err))
+			}
+		}
+	}
+}
+
+// Status returns the state of the loaded CRLs.
+func (c *Checker) Status() []CRLStatus {
+	return c.crls.Load().statuses
+}
+
+// Deny adds the certificate with the serial number or the SHA-256 fingerprint
+// to the denylist. The key is in the format serial:<hex> or sha256:<hex>.
+func (c *Checker) Deny(key, reason string) (Entry, error) {
+	key, err := normalize(key)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := Entry{
+		Key:      key,
+		Reason:   reason,
+		DeniedAt: time.Now(),
+	}
+	c.denied[key] = e
+
+	return e, c.saveDenylist()
+}
+
+// Allow removes the certificate from the denylist. It returns false
+// if the certificate is not denied.
+func (c *Checker) Allow(key string) (bool, error) {
+	key, err := normalize(key)
+	if err != nil {
+		return false, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.denied[key]; !ok {
+		return false, nil
+	}
+	delete(c.denied, key)
+
+	return true, c.saveDenylist()
+}
+
+// Denied returns the denylist sorted by the time the certificates were denied.
+func (c *Checker) Denied() []Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := make([]Entry, 0, len(c.denied))
+	for _, e := range c.denied {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].DeniedAt.Before(entries[j].DeniedAt)
+	})
+
+	return entries
+}
+
+// Keys returns the denylist keys of the certificate.
+func Keys(cert *x509.Certificate) []string {
+	fp := sha256.Sum256(cert.Raw)
+	return []string{
+		SerialPrefix + cert.SerialNumber.Text(16),
+		FingerprintPrefix + hex.EncodeToString(fp[:]),
+	}
+}
+
+func (c *Checker) loadDenylist() error {
+	if c.denyFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(c.denyFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var entries []Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("denylist %s: %w", c.denyFile, err)
+	}
+	for _, e := range entries {
+		if e.Key, err = normalize(e.Key); err != nil {
+			return fmt.Errorf("denylist %s: %w", c.denyFile, err)
+		}
+		c.denied[e.Key] = e
+	}
+
+	return nil
+}
+
+// saveDenylist writes the denylist to a temporary file and renames it, so the
+// file is never left partially written. The caller must hold the lock.
+func (c *Checker) saveDenylist() error {
+	if c.denyFile == "" {
+		return nil
+	}
+	entries := make([]Entry, 0, len(c.denied))
+	for _, e := range c.denied {
+		entries = append(entries, e)
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.denyFile), filepath.Base(c.denyFile)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), c.denyFile)
+}
+
+// normalize returns the key with lowercase hex value without separators
+// and leading zeros of the serial number.
+func normalize(key string) (string, error) {
+	prefix, value, ok := strings.Cut(strings.ToLower(key), ":")
+	if !ok {
+		return "", errors.Wrap(ErrInvalidKey, errors.New(key))
+	}
+	value = strings.NewReplacer(":", "", "-", "", " ", "").Replace(value)
+	if _, err := hex.DecodeString(strings.Repeat("0", len(value)%2) + value); err != nil || value == "" {
+		return "", errors.Wrap(ErrInvalidKey, errors.New(key))
+	}
+
+	switch prefix + ":" {
+	case SerialPrefix:
+		if value = strings.TrimLeft(value, "0"); value == "" {
+			value = "0"
+		}
+		return SerialPrefix + value, nil
+	case FingerprintPrefix:
+		if len(value) != 2*sha256.Size {
+			return "", errors.Wrap(ErrInvalidKey, errors.New(key))
+		}
+		return FingerprintPrefix + value, nil
+	default:
+		return "", errors.Wrap(ErrInvalidKey, errors.New(key))
+	}
+}
+
+func loadCRL(file string) (*x509.RevocationList, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		if block.Type != "X509 CRL" {
+			return nil, errNoCRL
+		}
+		data = block.Bytes
+	}
+
+	return x509.ParseRevocationList(data)
+}
+
+// verifyCRL checks the signature of the CRL against the issuers with the
+// subject of the CRL issuer.
+func verifyCRL(crl *x509.RevocationList, issuers []*x509.Certificate) error {
+	for _, issuer := range issuers {
+		if string(issuer.RawSubject) != string(crl.RawIssuer) {
+			continue
+		}
+		if err := crl.CheckSignatureFrom(issuer); err == nil {
+			return nil
+		}
+	}
+
+	return errors.Wrap(ErrCRLSignature, errors.New(crl.Issuer.String()))
+}
+
+// loadIssuers loads the certificates from the PEM CA files.
+func loadIssuers(files []string) ([]*x509.Certificate, error) {
+	var issuers []*x509.Certificate
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for {
+			var block *pem.Block
+			if block, data = pem.Decode(data); block == nil {
+				break
+			}
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("CA %s: %w", file, err)
+			}
+			issuers = append(issuers, cert)
+		}
+	}
+
+	return issuers, nil
+}
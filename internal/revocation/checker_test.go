@@ -0,0 +1,388 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package revocation
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	stderrors "errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	mflog "github.com/mainflux/mainflux/logger"
+	"github.com/mainflux/mainflux/pkg/errors"
+)
+
+const fingerprint = "sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+// ca issues the client certificates and the CRLs.
+type ca struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newCA(t *testing.T, name string) ca {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create CA certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse CA certificate: %s", err)
+	}
+
+	return ca{cert: cert, key: key}
+}
+
+func (c ca) issue(t *testing.T, serial int64) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "thing"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, c.cert, &key.PublicKey, c.key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %s", err)
+	}
+
+	return cert
+}
+
+// crl returns DER CRL of the CA revoking the serial numbers.
+func (c ca) crl(t *testing.T, serials ...int64) []byte {
+	tmpl := &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Hour),
+		NextUpdate: time.Now().Add(time.Hour),
+	}
+	for _, serial := range serials {
+		tmpl.RevokedCertificateEntries = append(tmpl.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   big.NewInt(serial),
+			RevocationTime: time.Now(),
+		})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, tmpl, c.cert, c.key)
+	if err != nil {
+		t.Fatalf("failed to create CRL: %s", err)
+	}
+
+	return der
+}
+
+func writeFile(t *testing.T, name string, data []byte) string {
+	file := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(file, data, 0o600); err != nil {
+		t.Fatalf("failed to write %s: %s", file, err)
+	}
+
+	return file
+}
+
+func writePEM(t *testing.T, name, typ string, der []byte) string {
+	return writeFile(t, name, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}))
+}
+
+func TestNormalize(t *testing.T) {
+	cases := []struct {
+		key string
+		res string
+		err error
+	}{
+		{key: "serial:1a2b", res: "serial:1a2b"},
+		{key: "SERIAL:1A:2B", res: "serial:1a2b"},
+		{key: "serial:00-01-a2", res: "serial:1a2"},
+		{key: "serial:00", res: "serial:0"},
+		{key: "serial:1 a2b", res: "serial:1a2b"},
+		{key: "SHA256:9F:86:D0:81:88:4C:7D:65:9A:2F:EA:A0:C5:5A:D0:15:A3:BF:4F:1B:2B:0B:82:2C:D1:5D:6C:15:B0:F0:0A:08", res: fingerprint},
+		{key: fingerprint, res: fingerprint},
+		{key: "sha256:9f86d081", err: ErrInvalidKey},
+		{key: "serial:", err: ErrInvalidKey},
+		{key: "serial:xyz", err: ErrInvalidKey},
+		{key: "1a2b", err: ErrInvalidKey},
+		{key: "md5:1a2b", err: ErrInvalidKey},
+	}
+
+	for _, tc := range cases {
+		res, err := normalize(tc.key)
+		if !errors.Contains(err, tc.err) || (err == nil) != (tc.err == nil) {
+			t.Errorf("%s: expected error %v got %v", tc.key, tc.err, err)
+		}
+		if res != tc.res {
+			t.Errorf("%s: expected key %s got %s", tc.key, tc.res, res)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	issuer := newCA(t, "issuer")
+	other := newCA(t, "other")
+	// forged has the subject of the issuer, but not its key.
+	forged := newCA(t, "issuer")
+	caFile := writePEM(t, "ca.pem", "CERTIFICATE", issuer.cert.Raw)
+	otherFile := writePEM(t, "other.pem", "CERTIFICATE", other.cert.Raw)
+
+	cases := []struct {
+		desc    string
+		files   []string
+		caFiles []string
+		err     error
+		revoked int64
+	}{
+		{
+			desc:    "PEM CRL",
+			files:   []string{writePEM(t, "crl.pem", "X509 CRL", issuer.crl(t, 2))},
+			caFiles: []string{caFile},
+			revoked: 2,
+		},
+		{
+			desc:    "DER CRL",
+			files:   []string{writeFile(t, "crl.der", issuer.crl(t, 3))},
+			caFiles: []string{otherFile, caFile},
+			revoked: 3,
+		},
+		{
+			desc:    "CRL signed by other issuer",
+			files:   []string{writePEM(t, "crl.pem", "X509 CRL", other.crl(t, 2))},
+			caFiles: []string{caFile},
+			err:     ErrCRLSignature,
+		},
+		{
+			desc:    "CRL with forged issuer",
+			files:   []string{writePEM(t, "crl.pem", "X509 CRL", forged.crl(t, 2))},
+			caFiles: []string{caFile},
+			err:     ErrCRLSignature,
+		},
+		{
+			desc:  "CRL without CA files",
+			files: []string{writePEM(t, "crl.pem", "X509 CRL", issuer.crl(t, 2))},
+			err:   ErrCRLSignature,
+		},
+		{
+			desc:    "PEM without CRL",
+			files:   []string{caFile},
+			caFiles: []string{caFile},
+			err:     errNoCRL,
+		},
+		{
+			desc:    "missing CRL file",
+			files:   []string{filepath.Join(t.TempDir(), "crl.pem")},
+			caFiles: []string{caFile},
+			err:     os.ErrNotExist,
+		},
+	}
+
+	revoked := issuer.issue(t, 2)
+	for _, tc := range cases {
+		c, err := New(tc.files, tc.caFiles, "", mflog.NewMock())
+		if tc.err != nil {
+			// The file errors are wrapped with the file name.
+			if err == nil || (!strings.Contains(err.Error(), tc.err.Error()) && !stderrors.Is(err, tc.err)) {
+				t.Errorf("%s: expected error %v got %v", tc.desc, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", tc.desc, err)
+		}
+
+		cert := issuer.issue(t, tc.revoked)
+		if err := c.Check(cert); err != ErrRevoked {
+			t.Errorf("%s: expected error %v got %v", tc.desc, ErrRevoked, err)
+		}
+		if tc.revoked != 2 {
+			if err := c.Check(revoked); err != nil {
+				t.Errorf("%s: expected certificate not revoked got %v", tc.desc, err)
+			}
+		}
+		// The serial number is revoked only for certificates of the CRL issuer.
+		if err := c.Check(other.issue(t, tc.revoked)); err != nil {
+			t.Errorf("%s: expected certificate of other issuer not revoked got %v", tc.desc, err)
+		}
+		if s := c.Status(); len(s) != 1 || s[0].Revoked != 1 || s[0].Issuer != "CN=issuer" {
+			t.Errorf("%s: expected 1 CRL of CN=issuer revoking 1 certificate got %+v", tc.desc, s)
+		}
+	}
+}
+
+func TestReloadKeepsCRLs(t *testing.T) {
+	issuer := newCA(t, "issuer")
+	other := newCA(t, "other")
+	caFile := writePEM(t, "ca.pem", "CERTIFICATE", issuer.cert.Raw)
+	crlFile := writePEM(t, "crl.pem", "X509 CRL", issuer.crl(t, 2))
+
+	c, err := New([]string{crlFile}, []string{caFile}, "", mflog.NewMock())
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	revoked := issuer.issue(t, 2)
+
+	// The CRL which fails to verify doesn't replace the one in use.
+	if err := os.WriteFile(crlFile, other.crl(t), 0o600); err != nil {
+		t.Fatalf("failed to write CRL: %s", err)
+	}
+	if err := c.Reload(); err == nil || !strings.Contains(err.Error(), ErrCRLSignature.Error()) {
+		t.Errorf("expected error %v got %v", ErrCRLSignature, err)
+	}
+	if err := c.Check(revoked); err != ErrRevoked {
+		t.Errorf("expected error %v got %v", ErrRevoked, err)
+	}
+
+	// The valid CRL does.
+	if err := os.WriteFile(crlFile, issuer.crl(t, 3), 0o600); err != nil {
+		t.Fatalf("failed to write CRL: %s", err)
+	}
+	if err := c.Reload(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := c.Check(revoked); err != nil {
+		t.Errorf("expected certificate not revoked after reload got %v", err)
+	}
+	if err := c.Check(issuer.issue(t, 3)); err != ErrRevoked {
+		t.Errorf("expected error %v got %v", ErrRevoked, err)
+	}
+}
+
+func TestDenylist(t *testing.T) {
+	issuer := newCA(t, "issuer")
+	cert := issuer.issue(t, 0x1a2b)
+	keys := Keys(cert)
+	file := filepath.Join(t.TempDir(), "denylist.json")
+
+	c, err := New(nil, nil, file, mflog.NewMock())
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := c.Check(cert); err != nil {
+		t.Errorf("expected certificate not denied got %v", err)
+	}
+	if _, err := c.Deny("serial", "lost"); !errors.Contains(err, ErrInvalidKey) {
+		t.Errorf("expected error %v got %v", ErrInvalidKey, err)
+	}
+	e, err := c.Deny("SERIAL:00:1A:2B", "lost")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if e.Key != keys[0] || e.Reason != "lost" {
+		t.Errorf("expected entry of %s denied for lost got %+v", keys[0], e)
+	}
+	if _, err := c.Deny(keys[1], ""); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := c.Check(cert); err != ErrDenied {
+		t.Errorf("expected error %v got %v", ErrDenied, err)
+	}
+
+	// The denylist is loaded from the file it's saved to.
+	loaded, err := New(nil, nil, file, mflog.NewMock())
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if denied := loaded.Denied(); len(denied) != 2 || denied[0].Key != keys[0] || denied[1].Key != keys[1] {
+		t.Errorf("expected %v denied got %+v", keys, denied)
+	}
+
+	// The certificate is denied until both of its keys are allowed.
+	if ok, err := loaded.Allow(keys[0]); !ok || err != nil {
+		t.Errorf("expected %s allowed got %t and %v", keys[0], ok, err)
+	}
+	if ok, err := loaded.Allow(keys[0]); ok || err != nil {
+		t.Errorf("expected %s not denied got %t and %v", keys[0], ok, err)
+	}
+	if err := loaded.Check(cert); err != ErrDenied {
+		t.Errorf("expected error %v got %v", ErrDenied, err)
+	}
+	if ok, err := loaded.Allow(keys[1]); !ok || err != nil {
+		t.Errorf("expected %s allowed got %t and %v", keys[1], ok, err)
+	}
+	if err := loaded.Check(cert); err != nil {
+		t.Errorf("expected certificate not denied got %v", err)
+	}
+
+	reloaded, err := New(nil, nil, file, mflog.NewMock())
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if denied := reloaded.Denied(); len(denied) != 0 {
+		t.Errorf("expected empty denylist got %+v", denied)
+	}
+	if matches, _ := filepath.Glob(file + ".*"); len(matches) != 0 {
+		t.Errorf("expected no temporary files left got %v", matches)
+	}
+}
+
+func TestLoadDenylist(t *testing.T) {
+	cases := []struct {
+		desc string
+		data string
+		err  error
+	}{
+		{
+			desc: "empty denylist",
+			data: "[]",
+		},
+		{
+			desc: "denylist with keys to normalize",
+			data: `[{"key": "SERIAL:01:A2", "denied_at": "2023-01-01T00:00:00Z"}]`,
+		},
+		{
+			desc: "invalid key",
+			data: `[{"key": "serial:xyz"}]`,
+			err:  ErrInvalidKey,
+		},
+		{
+			desc: "malformed JSON",
+			data: "{",
+			err:  errors.New("unexpected end of JSON input"),
+		},
+	}
+
+	for _, tc := range cases {
+		file := writeFile(t, "denylist.json", []byte(tc.data))
+		c, err := New(nil, nil, file, mflog.NewMock())
+		if tc.err != nil {
+			if err == nil || !strings.Contains(err.Error(), tc.err.Error()) {
+				t.Errorf("%s: expected error %v got %v", tc.desc, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", tc.desc, err)
+		}
+		for _, e := range c.Denied() {
+			if key, _ := normalize(e.Key); key != e.Key {
+				t.Errorf("%s: expected normalized key %s got %s", tc.desc, key, e.Key)
+			}
+		}
+	}
+}
@@ -0,0 +1,346 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+// Package upstream balances client sessions across MQTT brokers,
+// probing their health and failing over to the healthy ones.
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mflog "github.com/mainflux/mainflux/logger"
+	"github.com/mainflux/mainflux/pkg/errors"
+	"github.com/mainflux/mproxy/pkg/session"
+)
+
+// Selection strategies.
+const (
+	RoundRobin       = "round-robin"
+	LeastConnections = "least-connections"
+	Hash             = "hash"
+)
+
+// Probe types and HTTP probe URL placeholders.
+const (
+	TCPProbe            = "tcp"
+	HostPlaceholder     = "{host}"
+	AddressPlaceholder  = "{address}"
+	defaultProbeTimeout = 2 * time.Second
+	defaultCooldown     = 5 * time.Second
+)
+
+var (
+	// ErrNoUpstream indicates that there are no healthy MQTT brokers.
+	ErrNoUpstream = errors.New("no healthy MQTT broker available")
+
+	// ErrInvalidStrategy indicates unknown selection strategy.
+	ErrInvalidStrategy = errors.New("invalid upstream selection strategy")
+
+	// ErrNoTargets indicates that the pool has no MQTT brokers.
+	ErrNoTargets = errors.New("no MQTT brokers configured")
+
+	errProbeStatus = errors.New("unexpected health check status")
+)
+
+// Dialer dials the MQTT broker at the address.
+type Dialer func(ctx context.Context, address string) (net.Conn, error)
+
+// Balancer dials one of the MQTT brokers for the session in the context.
+type Balancer interface {
+	Dial(ctx context.Context, dial Dialer) (net.Conn, error)
+}
+
+// Config contains pool configuration.
+type Config struct {
+	// Targets are the addresses of the MQTT brokers.
+	Targets []string
+
+	// Strategy is the selection strategy: RoundRobin, LeastConnections or
+	// Hash, which consistently maps client IDs to the brokers.
+	Strategy string
+
+	// Probe is either TCPProbe or the URL of the HTTP health check, in which
+	// HostPlaceholder and AddressPlaceholder are replaced with the broker
+	// host and address. If empty, the brokers are not probed.
+	Probe string
+
+	// Interval is the time between the probes.
+	Interval time.Duration
+
+	// Timeout is the probe timeout.
+	Timeout time.Duration
+
+	// Cooldown is the time the broker which failed to dial is ejected for,
+	// if the brokers are not probed. Once it passes, the broker is tried
+	// again. Probed brokers stay ejected until the probe succeeds.
+	Cooldown time.Duration
+}
+
+// Status contains the state of the MQTT broker.
+type Status struct {
+	Address     string `json:"address"`
+	Healthy     bool   `json:"healthy"`
+	Connections int64  `json:"connections"`
+}
+
+type target struct {
+	address string
+	healthy atomic.Bool
+	conns   atomic.Int64
+	// ejected is the time the broker was ejected at without probing,
+	// in Unix nanoseconds.
+	ejected atomic.Int64
+}
+
+var _ Balancer = (*Pool)(nil)
+
+// Pool balances sessions across the MQTT brokers.
+type Pool struct {
+	cfg     Config
+	targets []*target
+	next    atomic.Uint64
+	client  *http.Client
+	logger  mflog.Logger
+	now     func() time.Time
+}
+
+// NewPool returns a new pool of the MQTT brokers. All the brokers are
+// considered healthy until probed.
+func NewPool(cfg Config, logger mflog.Logger) (*Pool, error) {
+	if len(cfg.Targets) == 0 {
+		return nil, ErrNoTargets
+	}
+	switch cfg.Strategy {
+	case "":
+		cfg.Strategy = RoundRobin
+	case RoundRobin, LeastConnections, Hash:
+	default:
+		return nil, errors.Wrap(ErrInvalidStrategy, errors.New(cfg.Strategy))
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultProbeTimeout
+	}
+	if cfg.Cooldown <= 0 {
+		cfg.Cooldown = defaultCooldown
+	}
+
+	p := &Pool{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		logger: logger,
+		now:    time.Now,
+	}
+	for _, addr := range cfg.Targets {
+		t := &target{address: addr}
+		t.healthy.Store(true)
+		p.targets = append(p.targets, t)
+	}
+
+	return p, nil
+}
+
+// Run probes the MQTT brokers until the context is canceled.
+func (p *Pool) Run(ctx context.Context) error {
+	if !p.probing() {
+		return nil
+	}
+
+	ticker := time.NewTicker(p.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		p.probeAll(ctx)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Dial dials the healthy MQTT broker picked by the selection strategy.
+// If dialing fails, the broker is ejected and the next one is tried. The
+// ejected broker is re-admitted by the probe or, if the brokers are not
+// probed, once the cooldown passes.
+func (p *Pool) Dial(ctx context.Context, dial Dialer) (net.Conn, error) {
+	var key string
+	if s, ok := session.FromContext(ctx); ok {
+		key = s.ID
+	}
+
+	candidates := p.pick(key)
+	if len(candidates) == 0 {
+		return nil, ErrNoUpstream
+	}
+
+	var err error
+	for _, t := range candidates {
+		var conn net.Conn
+		if conn, err = dial(ctx, t.address); err == nil {
+			t.conns.Add(1)
+			return &trackedConn{Conn: conn, target: t}, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		if !p.probing() {
+			t.ejected.Store(p.now().UnixNano())
+		}
+		p.setHealthy(t, false, err)
+	}
+
+	return nil, err
+}
+
+// Status returns the state of the MQTT brokers.
+func (p *Pool) Status() []Status {
+	statuses := make([]Status, len(p.targets))
+	for i, t := range p.targets {
+		statuses[i] = Status{
+			Address:     t.address,
+			Healthy:     t.healthy.Load(),
+			Connections: t.conns.Load(),
+		}
+	}
+
+	return statuses
+}
+
+// pick returns the healthy brokers in the order they should be tried.
+func (p *Pool) pick(key string) []*target {
+	var healthy []*target
+	for _, t := range p.targets {
+		p.readmit(t)
+		if t.healthy.Load() {
+			healthy = append(healthy, t)
+		}
+	}
+	if len(healthy) == 0 {
+		return nil
+	}
+
+	switch p.cfg.Strategy {
+	case LeastConnections:
+		sort.SliceStable(healthy, func(i, j int) bool {
+			return healthy[i].conns.Load() < healthy[j].conns.Load()
+		})
+	case Hash:
+		// Rendezvous hashing keeps the client on the same broker as long as
+		// it's healthy, and moves only the clients of the failed broker.
+		sort.SliceStable(healthy, func(i, j int) bool {
+			return score(key, healthy[i].address) > score(key, healthy[j].address)
+		})
+	default:
+		start := int(p.next.Add(1)-1) % len(healthy)
+		ordered := make([]*target, 0, len(healthy))
+		ordered = append(ordered, healthy[start:]...)
+		healthy = append(ordered, healthy[:start]...)
+	}
+
+	return healthy
+}
+
+// probing checks if the brokers are probed.
+func (p *Pool) probing() bool {
+	return p.cfg.Probe != "" && p.cfg.Interval > 0
+}
+
+// readmit re-admits the broker ejected without probing once the cooldown
+// passes. If dialing it fails again, it's ejected for another cooldown.
+func (p *Pool) readmit(t *target) {
+	ejected := t.ejected.Load()
+	if ejected == 0 || p.now().Sub(time.Unix(0, ejected)) < p.cfg.Cooldown {
+		return
+	}
+	if t.ejected.CompareAndSwap(ejected, 0) && !t.healthy.Swap(true) {
+		p.logger.Info(fmt.Sprintf("MQTT broker %s is re-admitted after %s cooldown", t.address, p.cfg.Cooldown))
+	}
+}
+
+func (p *Pool) probeAll(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, t := range p.targets {
+		wg.Add(1)
+		go func(t *target) {
+			defer wg.Done()
+			err := p.probe(ctx, t.address)
+			if ctx.Err() != nil {
+				return
+			}
+			p.setHealthy(t, err == nil, err)
+		}(t)
+	}
+	wg.Wait()
+}
+
+func (p *Pool) probe(ctx context.Context, address string) error {
+	if p.cfg.Probe == TCPProbe {
+		d := net.Dialer{Timeout: p.cfg.Timeout}
+		conn, err := d.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	url := strings.NewReplacer(HostPlaceholder, host, AddressPlaceholder, address).Replace(p.cfg.Probe)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return errors.Wrap(errProbeStatus, errors.New(res.Status))
+	}
+
+	return nil
+}
+
+func (p *Pool) setHealthy(t *target, healthy bool, err error) {
+	if t.healthy.Swap(healthy) == healthy {
+		return
+	}
+	if healthy {
+		p.logger.Info(fmt.Sprintf("MQTT broker %s is healthy", t.address))
+		return
+	}
+	p.logger.Warn(fmt.Sprintf("MQTT broker %s is unhealthy: %s", t.address, err))
+}
+
+func score(key, address string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(address))
+	return h.Sum64()
+}
+
+// trackedConn decrements the number of connections of the broker on close.
+type trackedConn struct {
+	net.Conn
+	target *target
+	once   sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.target.conns.Add(-1)
+	})
+	return c.Conn.Close()
+}
@@ -0,0 +1,204 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package upstream
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	mflog "github.com/mainflux/mainflux/logger"
+	"github.com/mainflux/mainflux/pkg/errors"
+)
+
+var errRefused = errors.New("connection refused")
+
+// clock is the time of the pool, advanced by the tests.
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time {
+	return c.t
+}
+
+func (c *clock) advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+// dialer fails to dial the brokers which are down, and records the dialed ones.
+type dialer struct {
+	mu     sync.Mutex
+	down   map[string]bool
+	dialed []string
+}
+
+func (d *dialer) dial(ctx context.Context, address string) (net.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dialed = append(d.dialed, address)
+	if d.down[address] {
+		return nil, errRefused
+	}
+	client, server := net.Pipe()
+	server.Close()
+	return client, nil
+}
+
+// dialPool dials the pool and returns the addresses dialed for it.
+func (d *dialer) dialPool(p *Pool) ([]string, error) {
+	d.mu.Lock()
+	d.dialed = nil
+	d.mu.Unlock()
+	conn, err := p.Dial(context.Background(), d.dial)
+	if err == nil {
+		conn.Close()
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.dialed, err
+}
+
+func newPool(t *testing.T, cfg Config) (*Pool, *clock) {
+	p, err := NewPool(cfg, mflog.NewMock())
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	c := &clock{t: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)}
+	p.now = c.now
+
+	return p, c
+}
+
+func healthy(p *Pool) map[string]bool {
+	h := make(map[string]bool)
+	for _, s := range p.Status() {
+		h[s.Address] = s.Healthy
+	}
+	return h
+}
+
+func TestPoolEjectWithoutProbe(t *testing.T) {
+	p, clock := newPool(t, Config{Targets: []string{"a:1883", "b:1883"}, Cooldown: time.Minute})
+	d := &dialer{down: map[string]bool{"a:1883": true}}
+
+	// The broker which fails is ejected and the next one is dialed.
+	dialed, err := d.dialPool(p)
+	if err != nil || dialed[len(dialed)-1] != "b:1883" {
+		t.Fatalf("expected b:1883 dialed got %v and error %v", dialed, err)
+	}
+	if h := healthy(p); h["a:1883"] || !h["b:1883"] {
+		t.Fatalf("expected a:1883 ejected got %v", h)
+	}
+
+	// The ejected broker isn't dialed during the cooldown.
+	clock.advance(time.Minute - time.Nanosecond)
+	for i := 0; i < 2; i++ {
+		if dialed, err := d.dialPool(p); err != nil || len(dialed) != 1 || dialed[0] != "b:1883" {
+			t.Errorf("during cooldown: expected only b:1883 dialed got %v and error %v", dialed, err)
+		}
+	}
+
+	// Once the cooldown passes, it's dialed again and ejected if it still fails.
+	clock.advance(time.Nanosecond)
+	var retried bool
+	for i := 0; i < 2; i++ {
+		dialed, err := d.dialPool(p)
+		if err != nil {
+			t.Errorf("after cooldown: expected no error got %v", err)
+		}
+		retried = retried || dialed[0] == "a:1883"
+	}
+	if !retried {
+		t.Errorf("after cooldown: expected a:1883 dialed again")
+	}
+	if h := healthy(p); h["a:1883"] {
+		t.Errorf("after failed retry: expected a:1883 ejected got %v", h)
+	}
+
+	// Once it recovers, it's re-admitted.
+	d.down = nil
+	clock.advance(time.Minute)
+	d.dialPool(p)
+	if h := healthy(p); !h["a:1883"] || !h["b:1883"] {
+		t.Errorf("after recovery: expected all brokers healthy got %v", h)
+	}
+}
+
+func TestPoolSingleTargetWithoutProbe(t *testing.T) {
+	p, clock := newPool(t, Config{Targets: []string{"a:1883"}})
+	d := &dialer{down: map[string]bool{"a:1883": true}}
+
+	if _, err := d.dialPool(p); err != errRefused {
+		t.Fatalf("expected error %v got %v", errRefused, err)
+	}
+	d.down = nil
+	if dialed, err := d.dialPool(p); err != ErrNoUpstream || len(dialed) != 0 {
+		t.Errorf("during cooldown: expected error %v got %v and dialed %v", ErrNoUpstream, err, dialed)
+	}
+
+	// The broker restart doesn't leave the pool without brokers.
+	clock.advance(defaultCooldown)
+	if _, err := d.dialPool(p); err != nil {
+		t.Errorf("after cooldown: expected no error got %v", err)
+	}
+	if h := healthy(p); !h["a:1883"] {
+		t.Errorf("after cooldown: expected a:1883 healthy got %v", h)
+	}
+}
+
+func TestPoolEjectWithProbe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer l.Close()
+	addr := l.Addr().String()
+
+	p, clock := newPool(t, Config{Targets: []string{addr}, Probe: TCPProbe, Interval: time.Minute, Cooldown: time.Second})
+	d := &dialer{down: map[string]bool{addr: true}}
+
+	if _, err := d.dialPool(p); err != errRefused {
+		t.Fatalf("expected error %v got %v", errRefused, err)
+	}
+
+	// The probed broker isn't re-admitted by the cooldown.
+	d.down = nil
+	clock.advance(time.Hour)
+	if _, err := d.dialPool(p); err != ErrNoUpstream {
+		t.Errorf("before probe: expected error %v got %v", ErrNoUpstream, err)
+	}
+
+	// It's re-admitted once the probe succeeds.
+	p.probeAll(context.Background())
+	if _, err := d.dialPool(p); err != nil {
+		t.Errorf("after probe: expected no error got %v", err)
+	}
+
+	// And ejected again once the probe fails.
+	l.Close()
+	p.probeAll(context.Background())
+	if h := healthy(p); h[addr] {
+		t.Errorf("after failed probe: expected %s ejected got %v", addr, h)
+	}
+}
+
+func TestPoolDialCanceled(t *testing.T) {
+	p, _ := newPool(t, Config{Targets: []string{"a:1883"}})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// The broker isn't ejected for the canceled dial.
+	_, err := p.Dial(ctx, func(ctx context.Context, address string) (net.Conn, error) {
+		return nil, ctx.Err()
+	})
+	if err != context.Canceled {
+		t.Errorf("expected error %v got %v", context.Canceled, err)
+	}
+	if h := healthy(p); !h["a:1883"] {
+		t.Errorf("expected a:1883 healthy got %v", h)
+	}
+}
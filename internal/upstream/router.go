@@ -0,0 +1,224 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package upstream
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mainflux/mainflux/pkg/errors"
+)
+
+// Route match kinds.
+const (
+	ThingMatch    = "thing"
+	TenantMatch   = "tenant"
+	HostMatch     = "host"
+	ListenerMatch = "listener"
+	TopicMatch    = "topic"
+	defaultName   = "default"
+)
+
+// sharePrefix prefixes the shared subscriptions, which are routed by the
+// topic filter without the prefix and the share name.
+const sharePrefix = "$share/"
+
+// ErrInvalidRoute indicates malformed route match.
+var ErrInvalidRoute = errors.New("invalid route, expected thing=<thing_id>, tenant=<tenant>, topic=<prefix>, host=<host> or listener=<listener>")
+
+var _ TopicBalancer = (*Router)(nil)
+
+// TopicBalancer is the balancer which picks the MQTT broker by the topic
+// the session first publishes or subscribes to, set in the context using
+// NewTopicContext, so the broker is dialed only once the topic is known.
+type TopicBalancer interface {
+	Balancer
+
+	// RoutesTopics checks if the sessions are routed by the topics.
+	RoutesTopics() bool
+
+	// SameRoute checks if the session is routed to the same MQTT brokers
+	// by both topics. If the topic is empty, the session is routed without
+	// the topic.
+	SameRoute(ctx context.Context, topic, other string) bool
+}
+
+// The topicKey type is unexported to prevent collisions with context keys
+// defined in other packages.
+type topicKey struct{}
+
+// NewTopicContext stores the topic the session is routed by in the context.
+func NewTopicContext(ctx context.Context, topic string) context.Context {
+	return context.WithValue(ctx, topicKey{}, topic)
+}
+
+func topicFromContext(ctx context.Context) (string, bool) {
+	topic, ok := ctx.Value(topicKey{}).(string)
+	return topic, ok && topic != ""
+}
+
+// Route contains the attributes of the authenticated session
+// the MQTT broker is selected by.
+type Route struct {
+	ThingID string
+	Tenant  string
+	// Host is the virtual host the client connected to.
+	Host string
+	// Listener is the name of the listener the client connected to.
+	Listener string
+}
+
+// Resolver returns the route attributes of the session in the context.
+type Resolver func(ctx context.Context) (Route, bool)
+
+type topicRoute struct {
+	prefix string
+	pool   *Pool
+}
+
+// Router routes the sessions to the pools of the MQTT brokers by the topic,
+// the thing, the tenant, the virtual host or the listener of the session.
+// Topic routes take precedence over thing routes, which take precedence over
+// tenant routes, then host routes and listener routes, and the sessions which
+// match no route use the default pool. The longest matching topic prefix wins.
+type Router struct {
+	resolve   Resolver
+	fallback  *Pool
+	topics    []topicRoute
+	things    map[string]*Pool
+	tenants   map[string]*Pool
+	hosts     map[string]*Pool
+	listeners map[string]*Pool
+	names     map[string]*Pool
+}
+
+// NewRouter returns a new router with the default pool.
+func NewRouter(fallback *Pool, resolve Resolver) *Router {
+	return &Router{
+		resolve:   resolve,
+		fallback:  fallback,
+		things:    make(map[string]*Pool),
+		tenants:   make(map[string]*Pool),
+		hosts:     make(map[string]*Pool),
+		listeners: make(map[string]*Pool),
+		names:     map[string]*Pool{defaultName: fallback},
+	}
+}
+
+// AddRoute routes the sessions which match to the pool. The match is in the
+// format thing=<thing_id>, tenant=<tenant>, topic=<prefix>, host=<host> or
+// listener=<listener>. Host names are case-insensitive.
+func (r *Router) AddRoute(match string, pool *Pool) error {
+	kind, value, ok := strings.Cut(match, "=")
+	if !ok || value == "" {
+		return errors.Wrap(ErrInvalidRoute, errors.New(match))
+	}
+	switch kind {
+	case ThingMatch:
+		r.things[value] = pool
+	case TenantMatch:
+		r.tenants[value] = pool
+	case HostMatch:
+		r.hosts[strings.ToLower(value)] = pool
+	case ListenerMatch:
+		r.listeners[value] = pool
+	case TopicMatch:
+		r.topics = append(r.topics, topicRoute{prefix: value, pool: pool})
+		sort.SliceStable(r.topics, func(i, j int) bool {
+			return len(r.topics[i].prefix) > len(r.topics[j].prefix)
+		})
+	default:
+		return errors.Wrap(ErrInvalidRoute, errors.New(match))
+	}
+	r.names[match] = pool
+
+	return nil
+}
+
+// Dial dials the MQTT broker from the pool the session is routed to.
+func (r *Router) Dial(ctx context.Context, dial Dialer) (net.Conn, error) {
+	return r.pool(ctx).Dial(ctx, dial)
+}
+
+// RoutesTopics checks if any topic routes are configured.
+func (r *Router) RoutesTopics() bool {
+	return len(r.topics) > 0
+}
+
+// SameRoute checks if the session is routed to the same pool by both topics.
+func (r *Router) SameRoute(ctx context.Context, topic, other string) bool {
+	return r.pool(NewTopicContext(ctx, topic)) == r.pool(NewTopicContext(ctx, other))
+}
+
+// Run probes the MQTT brokers of all the pools until the context is canceled.
+func (r *Router) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for _, p := range r.names {
+		wg.Add(1)
+		go func(p *Pool) {
+			defer wg.Done()
+			_ = p.Run(ctx)
+		}(p)
+	}
+	wg.Wait()
+
+	return nil
+}
+
+// Status returns the state of the MQTT brokers per route.
+func (r *Router) Status() map[string][]Status {
+	statuses := make(map[string][]Status, len(r.names))
+	for name, p := range r.names {
+		statuses[name] = p.Status()
+	}
+
+	return statuses
+}
+
+func (r *Router) pool(ctx context.Context) *Pool {
+	if topic, ok := topicFromContext(ctx); ok {
+		if p, ok := r.topicPool(topic); ok {
+			return p
+		}
+	}
+	if r.resolve == nil {
+		return r.fallback
+	}
+	route, ok := r.resolve(ctx)
+	if !ok {
+		return r.fallback
+	}
+	if p, ok := r.things[route.ThingID]; ok {
+		return p
+	}
+	if p, ok := r.tenants[route.Tenant]; ok && route.Tenant != "" {
+		return p
+	}
+	if p, ok := r.hosts[strings.ToLower(route.Host)]; ok && route.Host != "" {
+		return p
+	}
+	if p, ok := r.listeners[route.Listener]; ok && route.Listener != "" {
+		return p
+	}
+
+	return r.fallback
+}
+
+// topicPool returns the pool of the longest topic prefix the topic matches.
+func (r *Router) topicPool(topic string) (*Pool, bool) {
+	if strings.HasPrefix(topic, sharePrefix) {
+		// Shared subscriptions are in the format $share/<share>/<filter>.
+		_, topic, _ = strings.Cut(strings.TrimPrefix(topic, sharePrefix), "/")
+	}
+	for _, tr := range r.topics {
+		if strings.HasPrefix(topic, tr.prefix) {
+			return tr.pool, true
+		}
+	}
+
+	return nil, false
+}
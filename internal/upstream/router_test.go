@@ -0,0 +1,181 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package upstream
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mainflux/mainflux/pkg/errors"
+)
+
+func TestAddRoute(t *testing.T) {
+	cases := []struct {
+		match string
+		err   error
+	}{
+		{match: "thing=513d02d2-16c1-4f23-98be-9e12f8fee898"},
+		{match: "tenant=acme"},
+		{match: "topic=channels/1/"},
+		{match: "host=a.example.com"},
+		{match: "listener=mqtts"},
+		{match: "thing=", err: ErrInvalidRoute},
+		{match: "acme", err: ErrInvalidRoute},
+		{match: "channel=1", err: ErrInvalidRoute},
+	}
+
+	p, _ := newPool(t, Config{Targets: []string{"default:1883"}})
+	r := NewRouter(p, nil)
+	for _, tc := range cases {
+		err := r.AddRoute(tc.match, p)
+		if !errors.Contains(err, tc.err) || (err == nil) != (tc.err == nil) {
+			t.Errorf("%s: expected error %v got %v", tc.match, tc.err, err)
+		}
+	}
+}
+
+func TestRouterPrecedence(t *testing.T) {
+	pools := make(map[string]*Pool)
+	for _, name := range []string{"default", "thing", "tenant", "host", "listener", "topic", "long-topic"} {
+		pools[name], _ = newPool(t, Config{Targets: []string{name + ":1883"}})
+	}
+	full := Route{ThingID: "thing-1", Tenant: "acme", Host: "a.example.com", Listener: "mqtts"}
+
+	cases := []struct {
+		desc  string
+		route Route
+		ok    bool
+		topic string
+		pool  string
+	}{
+		{
+			desc:  "thing over tenant, host and listener",
+			route: full,
+			ok:    true,
+			pool:  "thing",
+		},
+		{
+			desc:  "tenant over host and listener",
+			route: Route{ThingID: "thing-2", Tenant: "acme", Host: "a.example.com", Listener: "mqtts"},
+			ok:    true,
+			pool:  "tenant",
+		},
+		{
+			desc:  "host over listener",
+			route: Route{ThingID: "thing-2", Tenant: "other", Host: "A.Example.com", Listener: "mqtts"},
+			ok:    true,
+			pool:  "host",
+		},
+		{
+			desc:  "listener",
+			route: Route{ThingID: "thing-2", Listener: "mqtts"},
+			ok:    true,
+			pool:  "listener",
+		},
+		{
+			desc:  "no matching route",
+			route: Route{ThingID: "thing-2", Tenant: "other", Host: "b.example.com", Listener: "mqtt"},
+			ok:    true,
+			pool:  "default",
+		},
+		{
+			desc:  "unresolved session",
+			route: full,
+			pool:  "default",
+		},
+		{
+			desc:  "topic over thing",
+			route: full,
+			ok:    true,
+			topic: "channels/1/messages/temp",
+			pool:  "topic",
+		},
+		{
+			desc:  "longest topic prefix",
+			route: full,
+			ok:    true,
+			topic: "channels/1/messages/room/1",
+			pool:  "long-topic",
+		},
+		{
+			desc:  "shared subscription topic",
+			route: full,
+			ok:    true,
+			topic: "$share/group/channels/1/messages/#",
+			pool:  "topic",
+		},
+		{
+			desc:  "topic without route",
+			route: Route{Tenant: "acme"},
+			ok:    true,
+			topic: "channels/2/messages",
+			pool:  "tenant",
+		},
+		{
+			desc:  "topic of unresolved session",
+			topic: "channels/1/messages",
+			pool:  "topic",
+		},
+	}
+
+	for _, tc := range cases {
+		resolve := func(ctx context.Context) (Route, bool) {
+			return tc.route, tc.ok
+		}
+		r := NewRouter(pools["default"], resolve)
+		for match, name := range map[string]string{
+			"thing=thing-1":                  "thing",
+			"tenant=acme":                    "tenant",
+			"host=a.example.com":             "host",
+			"listener=mqtts":                 "listener",
+			"topic=channels/1/":              "topic",
+			"topic=channels/1/messages/room": "long-topic",
+		} {
+			if err := r.AddRoute(match, pools[name]); err != nil {
+				t.Fatalf("%s: unexpected error %v", tc.desc, err)
+			}
+		}
+
+		ctx := context.Background()
+		if tc.topic != "" {
+			ctx = NewTopicContext(ctx, tc.topic)
+		}
+		if got := r.pool(ctx); got != pools[tc.pool] {
+			t.Errorf("%s: expected %s pool got %s", tc.desc, tc.pool, got.targets[0].address)
+		}
+	}
+}
+
+func TestRouterSameRoute(t *testing.T) {
+	fallback, _ := newPool(t, Config{Targets: []string{"default:1883"}})
+	a, _ := newPool(t, Config{Targets: []string{"a:1883"}})
+	r := NewRouter(fallback, nil)
+	if r.RoutesTopics() {
+		t.Errorf("expected no topic routes")
+	}
+	if err := r.AddRoute("topic=channels/a/", a); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !r.RoutesTopics() {
+		t.Errorf("expected topic routes")
+	}
+
+	cases := []struct {
+		topic string
+		other string
+		same  bool
+	}{
+		{topic: "channels/a/messages", other: "channels/a/messages/temp", same: true},
+		{topic: "channels/a/messages", other: "channels/b/messages", same: false},
+		{topic: "", other: "channels/b/messages", same: true},
+		{topic: "", other: "channels/a/messages", same: false},
+		{topic: "channels/b/messages", other: "channels/c/messages", same: true},
+	}
+
+	for _, tc := range cases {
+		if same := r.SameRoute(context.Background(), tc.topic, tc.other); same != tc.same {
+			t.Errorf("%q and %q: expected same route %t got %t", tc.topic, tc.other, tc.same, same)
+		}
+	}
+}
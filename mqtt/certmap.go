@@ -0,0 +1,36 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package mqtt
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/absmach/aproxy/internal/certmap"
+	"github.com/mainflux/mproxy/pkg/session"
+)
+
+// WithCertMapping authenticates the clients which present certificates mapped
+// to things as those things. The mapped thing takes precedence over the thing
+// the username and the password identify.
+func WithCertMapping(resolver certmap.Resolver) Option {
+	return func(h *handler) {
+		h.certMapping = resolver
+	}
+}
+
+// certIdentity returns the identity of the thing the client certificate is
+// mapped to. Clients without certificates are not mapped.
+func (h *handler) certIdentity(ctx context.Context, s *session.Session) (certmap.Identity, bool, error) {
+	if h.certMapping == nil || len(s.Cert.Raw) == 0 {
+		return certmap.Identity{}, false, nil
+	}
+	id, ok, err := h.certMapping.Resolve(ctx, &s.Cert)
+	if err != nil {
+		h.logger.Warn(fmt.Sprintf(LogWarnCertMapping, s.ID, s.Cert.SerialNumber.Text(16), err))
+		return certmap.Identity{}, false, err
+	}
+
+	return id, ok, nil
+}
@@ -0,0 +1,222 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package mqtt
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"regexp"
+	"strings"
+
+	"github.com/mainflux/mainflux/pkg/errors"
+	"github.com/mainflux/mproxy/pkg/session"
+)
+
+// Client ID matching rules.
+const (
+	// MatchAny allows any client ID.
+	MatchAny = "any"
+	// MatchThingID requires the client ID to be equal to the thing ID.
+	MatchThingID = "thing_id"
+	// MatchTemplate requires the client ID to match the template, in which
+	// the thing ID and the tenant placeholders are replaced with the ones of
+	// the thing, and the wildcard matches any characters, e.g. "{thingID}-*".
+	MatchTemplate = "template"
+	// MatchRegex requires the whole client ID to match the regular expression.
+	MatchRegex = "regex"
+)
+
+// RandomPlaceholder is replaced with random characters in the template
+// of the assigned client IDs.
+const RandomPlaceholder = "{random}"
+
+const (
+	wildcard    = "*"
+	randomBytes = 8
+)
+
+var (
+	// ErrClientIDTooLong indicates that the client ID exceeds the maximum length.
+	ErrClientIDTooLong = errors.New("client_id exceeds maximum length")
+
+	// ErrClientIDCharset indicates that the client ID contains characters
+	// which are not allowed.
+	ErrClientIDCharset = errors.New("client_id contains characters which are not allowed")
+
+	// ErrClientIDMismatch indicates that the client ID doesn't match the thing.
+	ErrClientIDMismatch = errors.New("client_id doesn't match the thing")
+
+	// ErrInvalidClientIDRules indicates malformed client ID rules.
+	ErrInvalidClientIDRules = errors.New("invalid client_id rules")
+)
+
+// ClientIDRules constrain the client IDs, so the clients can't impersonate
+// other things or collide with their sessions at the MQTT broker.
+type ClientIDRules struct {
+	// Match is MatchAny, MatchThingID, MatchTemplate or MatchRegex.
+	Match string
+
+	// Pattern is the template or the regular expression the client ID must match.
+	Pattern string
+
+	// Assign is the template of the client IDs assigned to the clients which
+	// connect with empty client IDs, e.g. "{thingID}-{random}". If empty,
+	// the client ID is required.
+	Assign string
+
+	// MaxLength is the maximum length of the client ID. Zero means that the
+	// length is not limited.
+	MaxLength int
+
+	// Charset is the regular expression character class of the characters
+	// allowed in the client ID, e.g. "A-Za-z0-9_-". If empty, any characters
+	// are allowed.
+	Charset string
+}
+
+// ClientIDPolicy checks the client IDs against the rules.
+type ClientIDPolicy struct {
+	rules   ClientIDRules
+	re      *regexp.Regexp
+	charset *regexp.Regexp
+}
+
+// NewClientIDPolicy returns a new client ID policy.
+func NewClientIDPolicy(rules ClientIDRules) (*ClientIDPolicy, error) {
+	if rules.Match == "" {
+		rules.Match = MatchAny
+	}
+	p := &ClientIDPolicy{
+		rules: rules,
+	}
+
+	var err error
+	switch rules.Match {
+	case MatchAny, MatchThingID:
+	case MatchTemplate:
+		if rules.Pattern == "" {
+			return nil, errors.Wrap(ErrInvalidClientIDRules, errors.New("template not set"))
+		}
+	case MatchRegex:
+		// The pattern must match the whole client ID, not its part.
+		if p.re, err = regexp.Compile("^(?:" + rules.Pattern + ")$"); err != nil {
+			return nil, errors.Wrap(ErrInvalidClientIDRules, err)
+		}
+	default:
+		return nil, errors.Wrap(ErrInvalidClientIDRules, errors.New("unknown match "+rules.Match))
+	}
+	if rules.Charset != "" {
+		if p.charset, err = regexp.Compile("^[" + rules.Charset + "]*$"); err != nil {
+			return nil, errors.Wrap(ErrInvalidClientIDRules, err)
+		}
+	}
+
+	return p, nil
+}
+
+// WithClientIDPolicy checks the client IDs against the policy on CONNECT.
+func WithClientIDPolicy(policy *ClientIDPolicy) Option {
+	return func(h *handler) {
+		h.clientIDs = policy
+	}
+}
+
+// check checks the length and the characters of the client ID, before the
+// thing is authenticated.
+func (p *ClientIDPolicy) check(clientID string) error {
+	if clientID == "" {
+		if p == nil || p.rules.Assign == "" {
+			return ErrMissingClientID
+		}
+		return nil
+	}
+	if p == nil {
+		return nil
+	}
+	if p.rules.MaxLength > 0 && len(clientID) > p.rules.MaxLength {
+		return ErrClientIDTooLong
+	}
+	if p.charset != nil && !p.charset.MatchString(clientID) {
+		return ErrClientIDCharset
+	}
+
+	return nil
+}
+
+// apply assigns the client ID to the client which connected without one,
+// and checks the client ID of the other clients against the thing.
+func (p *ClientIDPolicy) apply(s *session.Session, thingID, tenant string) error {
+	if p == nil {
+		return nil
+	}
+	if s.ID == "" {
+		id, err := p.assign(thingID, tenant)
+		if err != nil {
+			return err
+		}
+		s.ID = id
+		return nil
+	}
+
+	var ok bool
+	switch p.rules.Match {
+	case MatchThingID:
+		ok = s.ID == thingID
+	case MatchTemplate:
+		ok = matchTemplate(p.rules.Pattern, s.ID, thingID, tenant)
+	case MatchRegex:
+		ok = p.re.MatchString(s.ID)
+	default:
+		ok = true
+	}
+	if !ok {
+		return ErrClientIDMismatch
+	}
+
+	return nil
+}
+
+func (p *ClientIDPolicy) assign(thingID, tenant string) (string, error) {
+	b := make([]byte, randomBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return strings.NewReplacer(
+		ThingIDPlaceholder, thingID,
+		TenantPlaceholder, tenant,
+		RandomPlaceholder, hex.EncodeToString(b),
+	).Replace(p.rules.Assign), nil
+}
+
+// matchTemplate checks if the client ID matches the template, whose
+// wildcards match any characters.
+func matchTemplate(template, clientID, thingID, tenant string) bool {
+	r := strings.NewReplacer(
+		ThingIDPlaceholder, thingID,
+		TenantPlaceholder, tenant,
+	)
+	parts := strings.Split(template, wildcard)
+	for i := range parts {
+		parts[i] = r.Replace(parts[i])
+	}
+
+	first, last := parts[0], parts[len(parts)-1]
+	if !strings.HasPrefix(clientID, first) {
+		return false
+	}
+	if len(parts) == 1 {
+		return clientID == first
+	}
+	rest := clientID[len(first):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(rest, part)
+		if i < 0 {
+			return false
+		}
+		rest = rest[i+len(part):]
+	}
+
+	return strings.HasSuffix(rest, last)
+}
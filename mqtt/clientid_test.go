@@ -0,0 +1,285 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package mqtt
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/mainflux/mainflux/pkg/errors"
+	"github.com/mainflux/mproxy/pkg/session"
+)
+
+const (
+	clientThingID = "513d02d2-16c1-4f23-98be-9e12f8fee898"
+	clientTenant  = "acme"
+)
+
+func TestNewClientIDPolicy(t *testing.T) {
+	cases := []struct {
+		desc  string
+		rules ClientIDRules
+		err   error
+	}{
+		{
+			desc:  "default rules",
+			rules: ClientIDRules{},
+		},
+		{
+			desc:  "template",
+			rules: ClientIDRules{Match: MatchTemplate, Pattern: "{thingID}-*"},
+		},
+		{
+			desc:  "template not set",
+			rules: ClientIDRules{Match: MatchTemplate},
+			err:   ErrInvalidClientIDRules,
+		},
+		{
+			desc:  "regular expression",
+			rules: ClientIDRules{Match: MatchRegex, Pattern: "sensor-[0-9]+"},
+		},
+		{
+			desc:  "invalid regular expression",
+			rules: ClientIDRules{Match: MatchRegex, Pattern: "sensor-[0-9"},
+			err:   ErrInvalidClientIDRules,
+		},
+		{
+			desc:  "unknown match",
+			rules: ClientIDRules{Match: "prefix"},
+			err:   ErrInvalidClientIDRules,
+		},
+		{
+			desc:  "invalid charset",
+			rules: ClientIDRules{Charset: "z-a"},
+			err:   ErrInvalidClientIDRules,
+		},
+	}
+
+	for _, tc := range cases {
+		_, err := NewClientIDPolicy(tc.rules)
+		if !errors.Contains(err, tc.err) || (err == nil) != (tc.err == nil) {
+			t.Errorf("%s: expected error %v got %v", tc.desc, tc.err, err)
+		}
+	}
+}
+
+func TestClientIDCheck(t *testing.T) {
+	cases := []struct {
+		desc     string
+		rules    *ClientIDRules
+		clientID string
+		err      error
+	}{
+		{
+			desc:     "client ID without policy",
+			clientID: "client",
+		},
+		{
+			desc: "empty client ID without policy",
+			err:  ErrMissingClientID,
+		},
+		{
+			desc:  "empty client ID without assign",
+			rules: &ClientIDRules{},
+			err:   ErrMissingClientID,
+		},
+		{
+			desc:  "empty client ID with assign",
+			rules: &ClientIDRules{Assign: "{thingID}-{random}", MaxLength: 4, Charset: "a-z"},
+		},
+		{
+			desc:     "client ID of maximum length",
+			rules:    &ClientIDRules{MaxLength: 6},
+			clientID: "client",
+		},
+		{
+			desc:     "client ID over maximum length",
+			rules:    &ClientIDRules{MaxLength: 5},
+			clientID: "client",
+			err:      ErrClientIDTooLong,
+		},
+		{
+			desc:     "client ID with allowed characters",
+			rules:    &ClientIDRules{Charset: "A-Za-z0-9_-"},
+			clientID: "Sensor_1-a",
+		},
+		{
+			desc:     "client ID with characters not allowed",
+			rules:    &ClientIDRules{Charset: "A-Za-z0-9_-"},
+			clientID: "sensor/1",
+			err:      ErrClientIDCharset,
+		},
+		{
+			desc:     "client ID with character not allowed at the end",
+			rules:    &ClientIDRules{Charset: "a-z"},
+			clientID: "sensor\n",
+			err:      ErrClientIDCharset,
+		},
+	}
+
+	for _, tc := range cases {
+		var p *ClientIDPolicy
+		if tc.rules != nil {
+			var err error
+			if p, err = NewClientIDPolicy(*tc.rules); err != nil {
+				t.Fatalf("%s: unexpected error %v", tc.desc, err)
+			}
+		}
+		err := p.check(tc.clientID)
+		if !errors.Contains(err, tc.err) || (err == nil) != (tc.err == nil) {
+			t.Errorf("%s: expected error %v got %v", tc.desc, tc.err, err)
+		}
+	}
+}
+
+func TestClientIDApply(t *testing.T) {
+	cases := []struct {
+		desc     string
+		rules    *ClientIDRules
+		clientID string
+		tenant   string
+		// assigned matches the assigned client ID.
+		assigned string
+		err      error
+	}{
+		{
+			desc:     "without policy",
+			clientID: "any",
+		},
+		{
+			desc:     "any client ID",
+			rules:    &ClientIDRules{Match: MatchAny},
+			clientID: "any",
+		},
+		{
+			desc:     "thing ID",
+			rules:    &ClientIDRules{Match: MatchThingID},
+			clientID: clientThingID,
+		},
+		{
+			desc:     "other thing ID",
+			rules:    &ClientIDRules{Match: MatchThingID},
+			clientID: clientThingID + "-1",
+			err:      ErrClientIDMismatch,
+		},
+		{
+			desc:     "template",
+			rules:    &ClientIDRules{Match: MatchTemplate, Pattern: "{tenant}/{thingID}-*"},
+			clientID: clientTenant + "/" + clientThingID + "-1",
+			tenant:   clientTenant,
+		},
+		{
+			desc:     "template of other thing",
+			rules:    &ClientIDRules{Match: MatchTemplate, Pattern: "{thingID}-*"},
+			clientID: "other-1",
+			err:      ErrClientIDMismatch,
+		},
+		{
+			desc:     "regular expression",
+			rules:    &ClientIDRules{Match: MatchRegex, Pattern: "sensor-[0-9]+"},
+			clientID: "sensor-1",
+		},
+		{
+			desc:     "regular expression with alternatives",
+			rules:    &ClientIDRules{Match: MatchRegex, Pattern: "sensor-[0-9]+|gateway"},
+			clientID: "gateway",
+		},
+		{
+			desc:     "regular expression matching part of client ID",
+			rules:    &ClientIDRules{Match: MatchRegex, Pattern: "sensor-[0-9]+"},
+			clientID: "evil-sensor-1-other",
+			err:      ErrClientIDMismatch,
+		},
+		{
+			desc:     "alternative matching part of client ID",
+			rules:    &ClientIDRules{Match: MatchRegex, Pattern: "sensor-[0-9]+|gateway"},
+			clientID: "sensor-1-gateway",
+			err:      ErrClientIDMismatch,
+		},
+		{
+			desc:     "assigned client ID",
+			rules:    &ClientIDRules{Match: MatchThingID, Assign: "{tenant}/{thingID}-{random}"},
+			tenant:   clientTenant,
+			assigned: "^" + clientTenant + "/" + clientThingID + "-[0-9a-f]{16}$",
+		},
+	}
+
+	for _, tc := range cases {
+		var p *ClientIDPolicy
+		if tc.rules != nil {
+			var err error
+			if p, err = NewClientIDPolicy(*tc.rules); err != nil {
+				t.Fatalf("%s: unexpected error %v", tc.desc, err)
+			}
+		}
+		s := &session.Session{ID: tc.clientID}
+		err := p.apply(s, clientThingID, tc.tenant)
+		if !errors.Contains(err, tc.err) || (err == nil) != (tc.err == nil) {
+			t.Errorf("%s: expected error %v got %v", tc.desc, tc.err, err)
+		}
+		// The client IDs which are set are kept, and the empty ones assigned.
+		if tc.assigned == "" && s.ID != tc.clientID {
+			t.Errorf("%s: expected client ID %s got %s", tc.desc, tc.clientID, s.ID)
+		}
+		if tc.assigned != "" && !regexp.MustCompile(tc.assigned).MatchString(s.ID) {
+			t.Errorf("%s: expected client ID matching %s got %s", tc.desc, tc.assigned, s.ID)
+		}
+	}
+}
+
+func TestClientIDAssign(t *testing.T) {
+	p, err := NewClientIDPolicy(ClientIDRules{Assign: "{thingID}-{random}"})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// The random part makes the assigned client IDs unique.
+	ids := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id, err := p.assign(clientThingID, "")
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if !strings.HasPrefix(id, clientThingID+"-") || len(id) != len(clientThingID)+1+2*randomBytes {
+			t.Errorf("expected client ID %s-{random} got %s", clientThingID, id)
+		}
+		if ids[id] {
+			t.Errorf("expected unique client IDs got %s twice", id)
+		}
+		ids[id] = true
+	}
+}
+
+func TestMatchTemplate(t *testing.T) {
+	cases := []struct {
+		template string
+		clientID string
+		tenant   string
+		match    bool
+	}{
+		{template: "{thingID}", clientID: clientThingID, match: true},
+		{template: "{thingID}", clientID: clientThingID + "-1", match: false},
+		{template: "{thingID}-*", clientID: clientThingID + "-1", match: true},
+		{template: "{thingID}-*", clientID: clientThingID + "-", match: true},
+		{template: "{thingID}-*", clientID: clientThingID, match: false},
+		{template: "{thingID}-*", clientID: "x" + clientThingID + "-1", match: false},
+		{template: "*-{thingID}", clientID: "sensor-" + clientThingID, match: true},
+		{template: "*-{thingID}", clientID: "sensor-" + clientThingID + "-1", match: false},
+		{template: "{tenant}/*/{thingID}", clientID: clientTenant + "/eu/" + clientThingID, tenant: clientTenant, match: true},
+		{template: "{tenant}/*/{thingID}", clientID: "other/eu/" + clientThingID, tenant: clientTenant, match: false},
+		{template: "*{thingID}*", clientID: "a" + clientThingID + "b", match: true},
+		{template: "*{thingID}*", clientID: "ab", match: false},
+		{template: "a*b*c", clientID: "abc", match: true},
+		{template: "a*b*c", clientID: "ac", match: false},
+		{template: "ab*ba", clientID: "aba", match: false},
+		{template: "*", clientID: "anything", match: true},
+	}
+
+	for _, tc := range cases {
+		if match := matchTemplate(tc.template, tc.clientID, clientThingID, tc.tenant); match != tc.match {
+			t.Errorf("%s with %s: expected match %t got %t", tc.template, tc.clientID, tc.match, match)
+		}
+	}
+}
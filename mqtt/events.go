@@ -0,0 +1,103 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/mainflux/mainflux/pkg/messaging"
+)
+
+const eventsPublisher = "aproxy"
+
+// Session and message event types.
+const (
+	EventTakeover     = "session.takeover"
+	EventRevoked      = "session.revoked"
+	EventUnsubscribed = "session.unsubscribed"
+	EventExpired      = "session.expired"
+	EventRejected     = "message.rejected"
+)
+
+// Event represents a session lifecycle event.
+type Event struct {
+	Type        string    `json:"type"`
+	ClientID    string    `json:"client_id"`
+	ThingID     string    `json:"thing_id"`
+	RemoteAddr  string    `json:"remote_addr"`
+	Reason      string    `json:"reason,omitempty"`
+	Channel     string    `json:"channel,omitempty"`
+	Subtopic    string    `json:"subtopic,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// EventPublisher publishes session lifecycle events.
+type EventPublisher interface {
+	// Publish publishes the event.
+	Publish(ctx context.Context, event Event) error
+}
+
+var _ EventPublisher = (*eventPublisher)(nil)
+
+type eventPublisher struct {
+	publisher messaging.Publisher
+	topic     string
+}
+
+// NewEventPublisher returns event publisher which publishes JSON encoded
+// events to the topic of the message broker.
+func NewEventPublisher(publisher messaging.Publisher, topic string) EventPublisher {
+	return &eventPublisher{
+		publisher: publisher,
+		topic:     topic,
+	}
+}
+
+func (ep *eventPublisher) Publish(ctx context.Context, event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	msg := messaging.Message{
+		Protocol:  protocol,
+		Publisher: eventsPublisher,
+		Payload:   payload,
+		Created:   event.Timestamp.UnixNano(),
+	}
+
+	return ep.publisher.Publish(ctx, ep.topic, &msg)
+}
+
+// WithEvents publishes session lifecycle events using the event publisher.
+func WithEvents(events EventPublisher) Option {
+	return func(h *handler) {
+		h.events = events
+	}
+}
+
+func (h *handler) publishEvent(ctx context.Context, eventType string, info SessionInfo, reason string) {
+	if h.events == nil {
+		return
+	}
+	event := Event{
+		Type:       eventType,
+		ClientID:   info.ClientID,
+		ThingID:    info.ThingID,
+		RemoteAddr: info.RemoteAddr,
+		Reason:     reason,
+		Timestamp:  time.Now(),
+	}
+	if msg, ok := MessageFromContext(ctx); ok {
+		event.Channel = msg.Channel
+		event.Subtopic = msg.Subtopic
+		event.ContentType = msg.ContentType
+	}
+	if err := h.events.Publish(ctx, event); err != nil {
+		h.logger.Warn(fmt.Sprintf(LogWarnPublishEvent, eventType, info.ClientID, err))
+	}
+}
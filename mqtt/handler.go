@@ -5,27 +5,53 @@ package mqtt
 
 import (
 	"context"
+	"expvar"
 	"fmt"
+	"net"
 	"net/url"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/absmach/aproxy/auth"
+	"github.com/absmach/aproxy/internal/certmap"
+	"github.com/absmach/aproxy/internal/lockout"
+	"github.com/absmach/aproxy/internal/proxy"
+	"github.com/absmach/aproxy/internal/revocation"
 	"github.com/mainflux/mainflux/logger"
 	"github.com/mainflux/mainflux/pkg/errors"
+	"github.com/mainflux/mainflux/pkg/messaging"
 	"github.com/mainflux/mainflux/things/policies"
 	"github.com/mainflux/mproxy/pkg/session"
+	"golang.org/x/sync/errgroup"
 )
 
-var _ session.Handler = (*handler)(nil)
+var _ Handler = (*handler)(nil)
 
 // Log message formats.
 const (
 	LogInfoSubscribed   = "subscribed with client_id %s to topics %s"
 	LogInfoUnsubscribed = "unsubscribed client_id %s from topics %s"
-	LogInfoConnected    = "connected with client_id %s"
-	LogInfoDisconnected = "disconnected client_id %s and username %s"
-	LogInfoPublished    = "published with client_id %s to the topic %s"
+	LogInfoConnected    = "connected with client_id %s from %s"
+	LogInfoDisconnected = "disconnected client_id %s of thing %s"
+	LogInfoExpired      = "closed session of client_id %s of thing %s at maximum age %s"
+	LogInfoPublished    = "published with client_id %s to the channel %s and subtopic %s with content type %s"
+	LogWarnNetworkDeny  = "rejected thing %s with client_id %s connecting from %s by thing network policy"
+	LogWarnLocked       = "rejected connection attempt of locked out %v"
+	LogWarnLockedOut    = "locked out %v after repeated failed connection attempts"
+	LogWarnSessionLimit = "rejected thing %s with client_id %s: %s"
+	LogWarnTakeover     = "session of thing %s with client_id %s from %s taken over by client_id %s from %s"
+	LogWarnPublishEvent = "failed to publish %s event of client_id %s: %s"
+	LogWarnMsgBroker    = "message of client_id %s to the channel %s not published: %s"
+	LogWarnFailedClose  = "failed to close session of client_id %s: %s"
+	LogWarnCertRejected = "rejected client_id %s with certificate serial %s: %s"
+	LogWarnCertMapping  = "failed to map certificate of client_id %s with serial %s to thing: %s"
+	LogWarnRevoked      = "revoked session of thing %s with client_id %s: %s"
+	LogWarnUnsubscribed = "revoked subscriptions of client_id %s to topics %s: %s"
+	LogWarnRevalidation = "failed to re-validate session of client_id %s: %s"
+	LogWarnClientID     = "rejected client_id %s of thing %s: %s"
+	LogWarnUpstream     = "rejected client_id %s of thing %s with tenant %q: %s"
 )
 
 // Error wrappers for MQTT errors.
@@ -45,22 +71,166 @@ var (
 	ErrFailedParseSubtopic          = errors.New("failed to parse subtopic")
 	ErrFailedPublishConnectEvent    = errors.New("failed to publish connect event")
 	ErrFailedPublishToMsgBroker     = errors.New("failed to publish to mainflux message broker")
+	ErrWildcardChannel              = errors.New("wildcards are not allowed in place of channel")
+	ErrMalformedContentType         = errors.New("malformed content type")
+	ErrContentTypeNotAllowed        = errors.New("content type is not allowed on the channel")
+	ErrNetworkNotAllowed            = errors.New("thing is not allowed to connect from the network")
 )
 
-var channelRegExp = regexp.MustCompile(`^\/?channels\/([\w\-]+)\/messages(\/[^?]*)?(\?.*)?$`)
+const (
+	sharePrefix         = "$share/"
+	sysPrefix           = "$SYS"
+	singleLevelWildcard = "+"
+	multiLevelWildcard  = "#"
+	channelsLevel       = "channels"
+	messagesLevel       = "messages"
+	protocol            = "mqtt"
+
+	defaultAuthParallelism = 10
+)
+
+var thingNetworkDecisions = expvar.NewMap("thing_network_policy_decisions")
+
+var (
+	channelRegExp   = regexp.MustCompile(`^\/?channels\/([\w\-]+)\/messages(\/[^?]*)?(\?.*)?$`)
+	channelIDRegExp = regexp.MustCompile(`^[\w\-]+$`)
+)
+
+// Handler handles MQTT sessions, and keeps the live ones in line with
+// the things' access.
+type Handler interface {
+	session.Handler
+
+	// Run re-validates the live sessions at the interval until the context
+	// is canceled. If the interval is zero, the sessions are not re-validated.
+	Run(ctx context.Context, interval time.Duration) error
+
+	// Revoke closes the live sessions of the thing which use the channel,
+	// and invalidates the auth decisions about them. If the thing ID is
+	// empty, the sessions of any thing which use the channel are closed, and
+	// if the channel ID is empty, all the sessions of the thing. It returns
+	// the number of the sessions closed.
+	Revoke(ctx context.Context, thingID, chanID, reason string) int
+
+	// RevokeCert closes the live sessions of the clients which presented
+	// the certificate with the denylist key. It returns the number of the
+	// sessions closed.
+	RevokeCert(ctx context.Context, key, reason string) int
+}
 
 // Event implements events.Event interface.
 type handler struct {
-	auth   auth.AuthServiceClient
-	logger logger.Logger
+	auth               auth.AuthServiceClient
+	hostAuth           map[string]auth.AuthServiceClient
+	logger             logger.Logger
+	sysThings          map[string]bool
+	contentTypes       map[string][]string
+	publisher          messaging.Publisher
+	networks           map[string][]*net.IPNet
+	lockout            *lockout.Tracker
+	revocation         *revocation.Checker
+	certMapping        certmap.Resolver
+	authParallelism    int
+	maxAge             MaxAgeConfig
+	credentialMappings map[string]CredentialMapping
+	clientIDs          *ClientIDPolicy
+	sessions           *Registry
+	events             EventPublisher
+	upstream           UpstreamConfig
+	tenants            map[string]string
+}
+
+// Option configures optional handler behaviour.
+type Option func(*handler)
+
+// WithSysAccess allows the things with the given IDs to subscribe to $SYS topics.
+func WithSysAccess(thingIDs ...string) Option {
+	return func(h *handler) {
+		for _, id := range thingIDs {
+			h.sysThings[id] = true
+		}
+	}
+}
+
+// WithContentTypes restricts content types of the messages published to the channels.
+// Channel IDs are mapped to the allowed content types, and AnyChannel applies to all
+// the channels which are not listed explicitly.
+func WithContentTypes(contentTypes map[string][]string) Option {
+	return func(h *handler) {
+		for ch, cts := range contentTypes {
+			h.contentTypes[ch] = append(h.contentTypes[ch], cts...)
+		}
+	}
+}
+
+// WithPublisher publishes each accepted message to the Mainflux message broker
+// in addition to forwarding it to the MQTT broker. The publisher is called in
+// the client's session, so it shouldn't block, such as the publisher returned
+// by msgbroker.NewAsyncPublisher.
+func WithPublisher(publisher messaging.Publisher) Option {
+	return func(h *handler) {
+		h.publisher = publisher
+	}
+}
+
+// WithThingNetworks restricts networks things may connect from.
+// Things which are not listed may connect from any network.
+func WithThingNetworks(networks map[string][]*net.IPNet) Option {
+	return func(h *handler) {
+		for id, nets := range networks {
+			h.networks[id] = append(h.networks[id], nets...)
+		}
+	}
+}
+
+// WithRegistry sets the registry the live sessions are tracked in.
+func WithRegistry(sessions *Registry) Option {
+	return func(h *handler) {
+		h.sessions = sessions
+	}
+}
+
+// WithHostAuth authenticates and authorizes the clients of the virtual hosts
+// with the given auth services. Host names are mapped to the auth services, and
+// the clients of the hosts which are not listed use the default auth service.
+func WithHostAuth(services map[string]auth.AuthServiceClient) Option {
+	return func(h *handler) {
+		for host, svc := range services {
+			h.hostAuth[strings.ToLower(host)] = svc
+		}
+	}
+}
+
+// WithAuthParallelism limits the number of concurrent authorization requests
+// of a single SUBSCRIBE packet.
+func WithAuthParallelism(n int) Option {
+	return func(h *handler) {
+		if n > 0 {
+			h.authParallelism = n
+		}
+	}
 }
 
 // NewHandler creates new Handler entity.
-func NewHandler(logger logger.Logger, auth auth.AuthServiceClient) session.Handler {
-	return &handler{
-		logger: logger,
-		auth:   auth,
+func NewHandler(logger logger.Logger, authClient auth.AuthServiceClient, opts ...Option) Handler {
+	h := &handler{
+		logger:             logger,
+		auth:               authClient,
+		sysThings:          make(map[string]bool),
+		contentTypes:       make(map[string][]string),
+		networks:           make(map[string][]*net.IPNet),
+		tenants:            make(map[string]string),
+		hostAuth:           make(map[string]auth.AuthServiceClient),
+		credentialMappings: make(map[string]CredentialMapping),
+		authParallelism:    defaultAuthParallelism,
+	}
+	for _, opt := range opts {
+		opt(h)
 	}
+	if h.sessions == nil {
+		h.sessions, _ = NewRegistry(RegistryConfig{})
+	}
+	return h
 }
 
 // AuthConnect is called on device connection,
@@ -71,23 +241,70 @@ func (h *handler) AuthConnect(ctx context.Context) error {
 		return ErrClientNotInitialized
 	}
 
-	if s.ID == "" {
-		return ErrMissingClientID
+	if err := h.clientIDs.check(s.ID); err != nil {
+		return errors.Wrap(proxy.ErrIdentifierRejected, err)
 	}
 
-	pwd := string(s.Password)
+	mapping := h.credentialMapping(ctx)
+	keys := lockoutKeys(ctx, s, mapping)
+	if err := h.checkLockout(ctx, keys); err != nil {
+		return err
+	}
+	if err := h.checkCert(s); err != nil {
+		return err
+	}
+
+	id, ok, err := h.certIdentity(ctx, s)
+	if err != nil {
+		return err
+	}
+	var c claim
+	if ok {
+		// The mapped thing is identified by its ID, regardless of the listener.
+		mapping = DefaultCredentialMapping
+		c = claim{secret: id.Secret, thingID: id.ThingID}
+	} else if c, err = mapping.claim(s); err != nil {
+		h.recordAttempt(keys, err)
+		return err
+	}
 
 	t := &policies.IdentifyReq{
-		Secret: pwd,
+		Secret: c.secret,
 	}
 
-	thid, err := h.auth.Identify(ctx, t)
+	thid, err := h.authService(ctx).Identify(ctx, t)
+	switch {
+	case err == nil:
+		err = mapping.verify(c, thid.GetId(), h.tenants[thid.GetId()])
+	case isAuthFailure(err):
+		// Things service errors are mapped, so the client is refused for
+		// the bad credentials rather than the unavailable server.
+		err = errors.Wrap(errors.ErrAuthentication, err)
+	}
+	h.recordAttempt(keys, err)
 	if err != nil {
 		return err
 	}
-	if thid.GetId() != s.Username {
-		return errors.ErrAuthentication
+
+	if err := h.clientIDs.apply(s, thid.GetId(), h.tenants[thid.GetId()]); err != nil {
+		h.logger.Warn(fmt.Sprintf(LogWarnClientID, s.ID, thid.GetId(), err))
+		return errors.Wrap(proxy.ErrIdentifierRejected, err)
+	}
+
+	if err := h.checkNetwork(ctx, thid.GetId(), s.ID); err != nil {
+		return err
+	}
+
+	if _, err := h.upstream.credentials(h.tenants[thid.GetId()]); err != nil {
+		h.logger.Warn(fmt.Sprintf(LogWarnUpstream, s.ID, thid.GetId(), h.tenants[thid.GetId()], err))
+		return errors.Wrap(errors.ErrAuthorization, err)
+	}
+
+	info, err := h.register(ctx, s, thid.GetId(), c.secret)
+	if err != nil {
+		return err
 	}
+	h.rewrite(s, info)
 
 	return nil
 }
@@ -103,7 +320,24 @@ func (h *handler) AuthPublish(ctx context.Context, topic *string, payload *[]byt
 		return ErrClientNotInitialized
 	}
 
-	return h.authAccess(ctx, string(s.Password), *topic, policies.WriteAction)
+	thingID, secret := h.credentials(s)
+	if err := h.authAccess(ctx, thingID, secret, *topic, policies.WriteAction); err != nil {
+		return err
+	}
+
+	msg, err := parseMessage(*topic)
+	if err != nil {
+		return err
+	}
+
+	if err := h.checkContentType(msg); err != nil {
+		if info, ok := h.sessions.Info(s); ok {
+			h.publishEvent(NewMessageContext(ctx, msg), EventRejected, info, err.Error())
+		}
+		return err
+	}
+
+	return nil
 }
 
 // AuthSubscribe is called on device publish,
@@ -117,13 +351,17 @@ func (h *handler) AuthSubscribe(ctx context.Context, topics *[]string) error {
 		return ErrMissingTopicSub
 	}
 
-	for _, v := range *topics {
-		if err := h.authAccess(ctx, string(s.Password), v, policies.ReadAction); err != nil {
+	thingID, secret := h.credentials(s)
+	channels := make([]string, len(*topics))
+	for i, v := range *topics {
+		chanID, err := h.topicChannel(thingID, v, policies.ReadAction)
+		if err != nil {
 			return err
 		}
+		channels[i] = chanID
 	}
 
-	return nil
+	return h.authorizeTopics(ctx, secret, *topics, channels, policies.ReadAction)
 }
 
 // Connect - after client successfully connected.
@@ -132,7 +370,7 @@ func (h *handler) Connect(ctx context.Context) error {
 	if !ok {
 		return errors.Wrap(ErrFailedConnect, ErrClientNotInitialized)
 	}
-	h.logger.Info(fmt.Sprintf(LogInfoConnected, s.ID))
+	h.logger.Info(fmt.Sprintf(LogInfoConnected, s.ID, remoteAddr(ctx)))
 	return nil
 }
 
@@ -142,20 +380,35 @@ func (h *handler) Publish(ctx context.Context, topic *string, payload *[]byte) e
 	if !ok {
 		return errors.Wrap(ErrFailedPublish, ErrClientNotInitialized)
 	}
-	h.logger.Info(fmt.Sprintf(LogInfoPublished, s.ID, *topic))
-	// Topics are in the format:
-	// channels/<channel_id>/messages/<subtopic>/.../ct/<content_type>
 
-	channelParts := channelRegExp.FindStringSubmatch(*topic)
-	if len(channelParts) < 2 {
-		return errors.Wrap(ErrFailedPublish, ErrMalformedTopic)
+	msg, err := parseMessage(*topic)
+	if err != nil {
+		return errors.Wrap(ErrFailedPublish, err)
 	}
 
-	subtopic := channelParts[2]
+	ctx = NewMessageContext(ctx, msg)
+	countMessage(ctx)
 
-	subtopic, err := parseSubtopic(subtopic)
-	if err != nil {
-		return errors.Wrap(ErrFailedParseSubtopic, err)
+	h.logger.Info(fmt.Sprintf(LogInfoPublished, s.ID, msg.Channel, msg.Subtopic, msg.ContentType))
+	h.sessions.published(s, msg.Channel, time.Now())
+
+	if h.publisher == nil {
+		return nil
+	}
+
+	thingID, _ := h.credentials(s)
+	m := messaging.Message{
+		Protocol:  protocol,
+		Channel:   msg.Channel,
+		Subtopic:  msg.Subtopic,
+		Publisher: thingID,
+		Payload:   *payload,
+		Created:   time.Now().UnixNano(),
+	}
+	// The message is accepted by the MQTT broker already,
+	// so the client is not disconnected if it's not published.
+	if err := h.publisher.Publish(ctx, m.Channel, &m); err != nil {
+		h.logger.Warn(fmt.Sprintf(LogWarnMsgBroker, s.ID, msg.Channel, errors.Wrap(ErrFailedPublishToMsgBroker, err)))
 	}
 
 	return nil
@@ -168,6 +421,15 @@ func (h *handler) Subscribe(ctx context.Context, topics *[]string) error {
 		return errors.Wrap(ErrFailedSubscribe, ErrClientNotInitialized)
 	}
 	h.logger.Info(fmt.Sprintf(LogInfoSubscribed, s.ID, strings.Join(*topics, ",")))
+
+	thingID, _ := h.credentials(s)
+	channels := make([]string, len(*topics))
+	for i, topic := range *topics {
+		// The topics are authorized already.
+		channels[i], _ = h.topicChannel(thingID, topic, policies.ReadAction)
+	}
+	h.sessions.subscribe(s, *topics, channels)
+
 	return nil
 }
 
@@ -178,6 +440,7 @@ func (h *handler) Unsubscribe(ctx context.Context, topics *[]string) error {
 		return errors.Wrap(ErrFailedUnsubscribe, ErrClientNotInitialized)
 	}
 	h.logger.Info(fmt.Sprintf(LogInfoUnsubscribed, s.ID, strings.Join(*topics, ",")))
+	h.sessions.unsubscribe(s, *topics)
 	return nil
 }
 
@@ -187,32 +450,60 @@ func (h *handler) Disconnect(ctx context.Context) error {
 	if !ok {
 		return errors.Wrap(ErrFailedDisconnect, ErrClientNotInitialized)
 	}
-	h.logger.Error(fmt.Sprintf(LogInfoDisconnected, s.ID, s.Password))
+	e, ok := h.sessions.remove(s)
+	if !ok {
+		return nil
+	}
+	h.logger.Info(fmt.Sprintf(LogInfoDisconnected, e.info.ClientID, e.info.ThingID))
 
 	return nil
 }
 
-func (h *handler) authAccess(ctx context.Context, password, topic, action string) error {
-	// Topics are in the format:
-	// channels/<channel_id>/messages/<subtopic>/.../ct/<content_type>
-	if !channelRegExp.Match([]byte(topic)) {
-		return ErrMalformedTopic
+func (h *handler) authAccess(ctx context.Context, thingID, password, topic, action string) error {
+	chanID, err := h.topicChannel(thingID, topic, action)
+	if err != nil || chanID == "" {
+		return err
 	}
 
-	channelParts := channelRegExp.FindStringSubmatch(topic)
-	if len(channelParts) < 1 {
-		return ErrMalformedTopic
+	return h.authorize(ctx, password, chanID, action)
+}
+
+// topicChannel returns the ID of the channel the access to the topic is
+// authorized by. It returns an empty ID if the access doesn't depend on
+// the channel, such as the access to $SYS topics.
+func (h *handler) topicChannel(thingID, topic, action string) (string, error) {
+	// Shared subscriptions are in the format:
+	// $share/<group>/<topic_filter>
+	if strings.HasPrefix(topic, sharePrefix) {
+		if action != policies.ReadAction {
+			return "", ErrMalformedTopic
+		}
+		group, filter, ok := strings.Cut(strings.TrimPrefix(topic, sharePrefix), "/")
+		if !ok || group == "" || filter == "" || strings.ContainsAny(group, singleLevelWildcard+multiLevelWildcard) {
+			return "", ErrMalformedTopic
+		}
+		topic = filter
 	}
 
-	chanID := channelParts[1]
+	if topic == sysPrefix || strings.HasPrefix(topic, sysPrefix+"/") {
+		if action != policies.ReadAction || !h.sysThings[thingID] {
+			return "", errors.ErrAuthorization
+		}
+		return "", nil
+	}
+
+	return parseChannel(topic, action)
+}
 
+// authorize checks if the thing with the secret may perform the action on the channel.
+func (h *handler) authorize(ctx context.Context, password, chanID, action string) error {
 	ar := &policies.AuthorizeReq{
 		Subject:    password,
 		Object:     chanID,
 		Action:     action,
 		EntityType: policies.ThingEntityType,
 	}
-	res, err := h.auth.Authorize(ctx, ar)
+	res, err := h.authService(ctx).Authorize(ctx, ar)
 	if err != nil {
 		return err
 	}
@@ -223,6 +514,199 @@ func (h *handler) authAccess(ctx context.Context, password, topic, action string
 	return err
 }
 
+// authorizeTopics authorizes the action on the channels of the topics. Each
+// channel is authorized once, with at most the configured number of requests
+// in flight. If the action is denied, the error names the first topic denied.
+func (h *handler) authorizeTopics(ctx context.Context, password string, topics, channels []string, action string) error {
+	var unique []string
+	results := make(map[string]error)
+	for _, chanID := range channels {
+		if _, ok := results[chanID]; !ok && chanID != "" {
+			results[chanID] = nil
+			unique = append(unique, chanID)
+		}
+	}
+
+	switch len(unique) {
+	case 0:
+	case 1:
+		results[unique[0]] = h.authorize(ctx, password, unique[0], action)
+	default:
+		var mu sync.Mutex
+		var g errgroup.Group
+		g.SetLimit(h.authParallelism)
+		for _, chanID := range unique {
+			chanID := chanID
+			g.Go(func() error {
+				err := h.authorize(ctx, password, chanID, action)
+				mu.Lock()
+				defer mu.Unlock()
+				results[chanID] = err
+				return nil
+			})
+		}
+		_ = g.Wait()
+	}
+
+	for i, chanID := range channels {
+		if err := results[chanID]; chanID != "" && err != nil {
+			return errors.Wrap(err, errors.New(topics[i]))
+		}
+	}
+
+	return nil
+}
+
+// authService returns the auth service of the virtual host the client
+// connected to.
+func (h *handler) authService(ctx context.Context) auth.AuthServiceClient {
+	if c, ok := proxy.FromContext(ctx); ok && c.ServerName != "" {
+		if svc, ok := h.hostAuth[c.ServerName]; ok {
+			return svc
+		}
+	}
+
+	return h.auth
+}
+
+// authServices returns the auth services of all the virtual hosts.
+func (h *handler) authServices() []auth.AuthServiceClient {
+	svcs := []auth.AuthServiceClient{h.auth}
+	for _, svc := range h.hostAuth {
+		svcs = append(svcs, svc)
+	}
+
+	return svcs
+}
+
+// parseChannel extracts channel ID from the topic or topic filter.
+// Wildcards are allowed only for subscriptions and only within a single channel.
+func parseChannel(topic, action string) (string, error) {
+	// Topics are in the format:
+	// channels/<channel_id>/messages/<subtopic>/.../ct/<content_type>
+	if !strings.ContainsAny(topic, singleLevelWildcard+multiLevelWildcard) {
+		channelParts := channelRegExp.FindStringSubmatch(topic)
+		if len(channelParts) < 2 {
+			return "", ErrMalformedTopic
+		}
+		return channelParts[1], nil
+	}
+
+	if action != policies.ReadAction {
+		return "", ErrMalformedTopic
+	}
+
+	levels := strings.Split(strings.TrimPrefix(topic, "/"), "/")
+	for i, level := range levels {
+		if level == multiLevelWildcard && i != len(levels)-1 {
+			return "", ErrMalformedTopic
+		}
+		if len(level) > 1 && strings.ContainsAny(level, singleLevelWildcard+multiLevelWildcard) {
+			return "", ErrMalformedTopic
+		}
+	}
+
+	if isWildcard(levels[0]) || (levels[0] == channelsLevel && (len(levels) < 2 || isWildcard(levels[1]))) {
+		return "", ErrWildcardChannel
+	}
+	if levels[0] != channelsLevel || !channelIDRegExp.MatchString(levels[1]) || len(levels) < 3 {
+		return "", ErrMalformedTopic
+	}
+	if levels[2] != messagesLevel && !isWildcard(levels[2]) {
+		return "", ErrMalformedTopic
+	}
+
+	return levels[1], nil
+}
+
+func isWildcard(level string) bool {
+	return level == singleLevelWildcard || level == multiLevelWildcard
+}
+
+// register adds the session to the registry,
+// and closes the sessions it takes over.
+func (h *handler) register(ctx context.Context, s *session.Session, thingID, secret string) (SessionInfo, error) {
+	info := SessionInfo{
+		ClientID:    s.ID,
+		ThingID:     thingID,
+		Tenant:      h.tenants[thingID],
+		RemoteAddr:  remoteAddr(ctx),
+		ConnectedAt: time.Now(),
+	}
+	e := entry{
+		info:          info,
+		secret:        secret,
+		subscriptions: make(map[string]string),
+		publications:  make(map[string]time.Time),
+	}
+	if c, ok := proxy.FromContext(ctx); ok {
+		e.info.Listener = c.Listener
+		e.client = c
+	}
+	if len(s.Cert.Raw) > 0 {
+		e.certKeys = revocation.Keys(&s.Cert)
+	}
+	if age := h.sessionAge(thingID); age > 0 {
+		expiresAt := info.ConnectedAt.Add(age)
+		e.info.ExpiresAt = &expiresAt
+		e.expiry = time.AfterFunc(age, func() {
+			h.expire(s)
+		})
+	}
+
+	taken, err := h.sessions.add(s, e)
+	if err != nil {
+		e.stop()
+		h.logger.Warn(fmt.Sprintf(LogWarnSessionLimit, info.ThingID, s.ID, err))
+		return SessionInfo{}, err
+	}
+	for _, t := range taken {
+		h.logger.Warn(fmt.Sprintf(LogWarnTakeover, t.info.ThingID, t.info.ClientID, t.info.RemoteAddr, info.ClientID, info.RemoteAddr))
+		h.publishEvent(ctx, EventTakeover, t.info, fmt.Sprintf("taken over by client_id %s from %s", info.ClientID, info.RemoteAddr))
+		if err := t.close(); err != nil {
+			h.logger.Warn(fmt.Sprintf(LogWarnFailedClose, t.info.ClientID, err))
+		}
+	}
+
+	return e.info, nil
+}
+
+// credentials returns the thing ID and secret of the session. The session
+// credentials may be replaced by the upstream ones after the thing is
+// authenticated, so the registered credentials take precedence.
+func (h *handler) credentials(s *session.Session) (string, string) {
+	if e, ok := h.sessions.lookup(s); ok {
+		return e.info.ThingID, e.secret
+	}
+	return s.Username, string(s.Password)
+}
+
+func (h *handler) checkNetwork(ctx context.Context, thingID, clientID string) error {
+	nets, ok := h.networks[thingID]
+	if !ok {
+		return nil
+	}
+	var ip net.IP
+	if c, ok := proxy.FromContext(ctx); ok {
+		ip = c.IP()
+	}
+	if !proxy.Contains(nets, ip) {
+		thingNetworkDecisions.Add("deny", 1)
+		h.logger.Warn(fmt.Sprintf(LogWarnNetworkDeny, thingID, clientID, remoteAddr(ctx)))
+		return errors.Wrap(errors.ErrAuthorization, ErrNetworkNotAllowed)
+	}
+	thingNetworkDecisions.Add("allow", 1)
+
+	return nil
+}
+
+func remoteAddr(ctx context.Context) string {
+	if c, ok := proxy.FromContext(ctx); ok && c.RemoteAddr != nil {
+		return c.RemoteAddr.String()
+	}
+	return "unknown"
+}
+
 func parseSubtopic(subtopic string) (string, error) {
 	if subtopic == "" {
 		return subtopic, nil
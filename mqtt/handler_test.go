@@ -0,0 +1,896 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package mqtt_test
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/absmach/aproxy/auth"
+	"github.com/absmach/aproxy/auth/mocks"
+	"github.com/absmach/aproxy/internal/proxy"
+	"github.com/absmach/aproxy/mqtt"
+	mflog "github.com/mainflux/mainflux/logger"
+	"github.com/mainflux/mainflux/pkg/errors"
+	"github.com/mainflux/mainflux/pkg/messaging"
+	"github.com/mainflux/mproxy/pkg/session"
+)
+
+const (
+	thingID     = "513d02d2-16c1-4f23-98be-9e12f8fee898"
+	sysThingID  = "d0b1e1a6-7ed9-4a1e-8d7f-2a6a4d9b0c31"
+	thingSecret = "thing-secret"
+	sysSecret   = "sys-secret"
+	chanID      = "123e4567-e89b-12d3-a456-000000000001"
+	otherChanID = "123e4567-e89b-12d3-a456-000000000002"
+	thirdChanID = "123e4567-e89b-12d3-a456-000000000003"
+)
+
+func newAuthService() auth.AuthServiceClient {
+	things := map[string]string{
+		thingSecret: thingID,
+		sysSecret:   sysThingID,
+	}
+	channels := map[string]string{
+		chanID:      thingSecret,
+		thirdChanID: thingSecret,
+	}
+	return mocks.NewAuthService(things, channels)
+}
+
+func newHandler(opts ...mqtt.Option) session.Handler {
+	return newAuthHandler(newAuthService(), opts...)
+}
+
+func newAuthHandler(svc auth.AuthServiceClient, opts ...mqtt.Option) mqtt.Handler {
+	opts = append(opts, mqtt.WithSysAccess(sysThingID))
+	return mqtt.NewHandler(mflog.NewMock(), svc, opts...)
+}
+
+func TestAuthConnect(t *testing.T) {
+	_, network, _ := net.ParseCIDR("10.0.0.0/8")
+	h := newHandler(mqtt.WithThingNetworks(map[string][]*net.IPNet{sysThingID: {network}}))
+
+	// The errors are wrapped with the reason the client is refused for,
+	// so the client gets CONNACK with the matching return code.
+	cases := []struct {
+		desc     string
+		clientID string
+		id       string
+		secret   string
+		err      error
+		reason   error
+	}{
+		{
+			desc:     "connect with valid credentials",
+			clientID: "client",
+			id:       thingID,
+			secret:   thingSecret,
+		},
+		{
+			desc:   "connect without client ID",
+			id:     thingID,
+			secret: thingSecret,
+			err:    mqtt.ErrMissingClientID,
+			reason: proxy.ErrIdentifierRejected,
+		},
+		{
+			desc:     "connect with invalid secret",
+			clientID: "client",
+			id:       thingID,
+			secret:   "invalid",
+			err:      errors.ErrAuthentication,
+			reason:   errors.ErrAuthentication,
+		},
+		{
+			desc:     "connect from network which is not allowed",
+			clientID: "client",
+			id:       sysThingID,
+			secret:   sysSecret,
+			err:      mqtt.ErrNetworkNotAllowed,
+			reason:   errors.ErrAuthorization,
+		},
+	}
+
+	for _, tc := range cases {
+		ctx := session.NewContext(context.Background(), &session.Session{
+			ID:       tc.clientID,
+			Username: tc.id,
+			Password: []byte(tc.secret),
+		})
+		err := h.AuthConnect(ctx)
+		if !errors.Contains(err, tc.err) || (err == nil) != (tc.err == nil) {
+			t.Errorf("%s: expected error %v got %v", tc.desc, tc.err, err)
+		}
+		if !errors.Contains(err, tc.reason) {
+			t.Errorf("%s: expected error wrapped with %v got %v", tc.desc, tc.reason, err)
+		}
+	}
+}
+
+func TestAuthConnectUpstream(t *testing.T) {
+	tenants := map[string]string{thingID: "acme"}
+	tenantCreds := map[string]mqtt.Credentials{"acme": {Username: "acme", Password: "acme-password"}}
+	fallback := &mqtt.Credentials{Username: "aproxy", Password: "aproxy-password"}
+
+	cases := []struct {
+		desc     string
+		cfg      mqtt.UpstreamConfig
+		id       string
+		secret   string
+		username string
+		password string
+		err      error
+	}{
+		{
+			desc:     "forward thing credentials",
+			id:       sysThingID,
+			secret:   sysSecret,
+			username: sysThingID,
+			password: sysSecret,
+		},
+		{
+			desc:     "replace credentials",
+			cfg:      mqtt.UpstreamConfig{Credentials: fallback},
+			id:       thingID,
+			secret:   thingSecret,
+			username: fallback.Username,
+			password: fallback.Password,
+		},
+		{
+			desc:     "replace credentials of tenant",
+			cfg:      mqtt.UpstreamConfig{Credentials: fallback, TenantCredentials: tenantCreds},
+			id:       thingID,
+			secret:   thingSecret,
+			username: "acme",
+			password: "acme-password",
+		},
+		{
+			desc:     "replace credentials of thing without tenant",
+			cfg:      mqtt.UpstreamConfig{Credentials: fallback, TenantCredentials: tenantCreds},
+			id:       sysThingID,
+			secret:   sysSecret,
+			username: fallback.Username,
+			password: fallback.Password,
+		},
+		{
+			desc:     "replace credentials of tenant without fallback",
+			cfg:      mqtt.UpstreamConfig{TenantCredentials: tenantCreds},
+			id:       thingID,
+			secret:   thingSecret,
+			username: "acme",
+			password: "acme-password",
+		},
+		{
+			desc:   "reject thing without tenant and without fallback",
+			cfg:    mqtt.UpstreamConfig{TenantCredentials: tenantCreds},
+			id:     sysThingID,
+			secret: sysSecret,
+			err:    mqtt.ErrMissingUpstreamCredentials,
+		},
+		{
+			desc:   "reject thing of tenant without credentials and without fallback",
+			cfg:    mqtt.UpstreamConfig{TenantCredentials: map[string]mqtt.Credentials{"other": {Username: "other"}}},
+			id:     thingID,
+			secret: thingSecret,
+			err:    mqtt.ErrMissingUpstreamCredentials,
+		},
+	}
+
+	for _, tc := range cases {
+		h := newHandler(mqtt.WithUpstream(tc.cfg), mqtt.WithTenants(tenants))
+		s := &session.Session{
+			ID:       "client",
+			Username: tc.id,
+			Password: []byte(tc.secret),
+		}
+		err := h.AuthConnect(session.NewContext(context.Background(), s))
+		if !errors.Contains(err, tc.err) || (err == nil) != (tc.err == nil) {
+			t.Errorf("%s: expected error %v got %v", tc.desc, tc.err, err)
+		}
+		if err != nil {
+			continue
+		}
+		if s.Username != tc.username || string(s.Password) != tc.password {
+			t.Errorf("%s: expected credentials %s:%s got %s:%s", tc.desc, tc.username, tc.password, s.Username, s.Password)
+		}
+	}
+}
+
+func TestAuthConnectVirtualHost(t *testing.T) {
+	const (
+		hostThingID = "6f1e4a5c-2d3b-4c8a-9e7f-0a1b2c3d4e5f"
+		hostSecret  = "host-secret"
+	)
+	hostAuth := mocks.NewAuthService(map[string]string{hostSecret: hostThingID}, map[string]string{chanID: hostSecret})
+
+	cases := []struct {
+		desc       string
+		serverName string
+		id         string
+		secret     string
+		err        error
+	}{
+		{
+			desc:       "thing of virtual host",
+			serverName: "a.example.com",
+			id:         hostThingID,
+			secret:     hostSecret,
+		},
+		{
+			desc:       "thing of default host on virtual host",
+			serverName: "a.example.com",
+			id:         thingID,
+			secret:     thingSecret,
+			err:        errors.ErrAuthentication,
+		},
+		{
+			desc:       "thing of default host on unknown host",
+			serverName: "b.example.com",
+			id:         thingID,
+			secret:     thingSecret,
+		},
+		{
+			desc:   "thing of virtual host without SNI",
+			id:     hostThingID,
+			secret: hostSecret,
+			err:    errors.ErrAuthentication,
+		},
+	}
+
+	h := newHandler(mqtt.WithHostAuth(map[string]auth.AuthServiceClient{"A.Example.com": hostAuth}))
+	for _, tc := range cases {
+		c := proxy.NewClient("mqtts", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 8883}, nil)
+		// Server names are lower cased by the listener.
+		c.ServerName = tc.serverName
+		ctx := session.NewContext(proxy.NewContext(context.Background(), c), &session.Session{
+			ID:       "client",
+			Username: tc.id,
+			Password: []byte(tc.secret),
+		})
+		err := h.AuthConnect(ctx)
+		if !errors.Contains(err, tc.err) || (err == nil) != (tc.err == nil) {
+			t.Errorf("%s: expected error %v got %v", tc.desc, tc.err, err)
+		}
+	}
+}
+
+func TestAuthSubscribe(t *testing.T) {
+	h := newHandler()
+
+	cases := []struct {
+		desc   string
+		id     string
+		secret string
+		topic  string
+		err    error
+	}{
+		{
+			desc:   "subscribe to channel topic",
+			id:     thingID,
+			secret: thingSecret,
+			topic:  "channels/" + chanID + "/messages",
+		},
+		{
+			desc:   "subscribe to channel subtopic",
+			id:     thingID,
+			secret: thingSecret,
+			topic:  "channels/" + chanID + "/messages/temp/room1",
+		},
+		{
+			desc:   "subscribe to unauthorized channel",
+			id:     thingID,
+			secret: thingSecret,
+			topic:  "channels/" + otherChanID + "/messages",
+			err:    errors.ErrAuthorization,
+		},
+		{
+			desc:   "subscribe with multi-level wildcard within channel",
+			id:     thingID,
+			secret: thingSecret,
+			topic:  "channels/" + chanID + "/messages/#",
+		},
+		{
+			desc:   "subscribe with single-level wildcard within channel",
+			id:     thingID,
+			secret: thingSecret,
+			topic:  "channels/" + chanID + "/messages/+/temp",
+		},
+		{
+			desc:   "subscribe with wildcard in place of messages",
+			id:     thingID,
+			secret: thingSecret,
+			topic:  "channels/" + chanID + "/#",
+		},
+		{
+			desc:   "subscribe with wildcard within unauthorized channel",
+			id:     thingID,
+			secret: thingSecret,
+			topic:  "channels/" + otherChanID + "/messages/#",
+			err:    errors.ErrAuthorization,
+		},
+		{
+			desc:   "subscribe with single-level wildcard in place of channel",
+			id:     thingID,
+			secret: thingSecret,
+			topic:  "channels/+/messages/#",
+			err:    mqtt.ErrWildcardChannel,
+		},
+		{
+			desc:   "subscribe with multi-level wildcard in place of channel",
+			id:     thingID,
+			secret: thingSecret,
+			topic:  "channels/#",
+			err:    mqtt.ErrWildcardChannel,
+		},
+		{
+			desc:   "subscribe to all topics",
+			id:     thingID,
+			secret: thingSecret,
+			topic:  "#",
+			err:    mqtt.ErrWildcardChannel,
+		},
+		{
+			desc:   "subscribe with multi-level wildcard not at the end",
+			id:     thingID,
+			secret: thingSecret,
+			topic:  "channels/" + chanID + "/messages/#/temp",
+			err:    mqtt.ErrMalformedTopic,
+		},
+		{
+			desc:   "subscribe with wildcard within topic level",
+			id:     thingID,
+			secret: thingSecret,
+			topic:  "channels/" + chanID + "/messages/temp+",
+			err:    mqtt.ErrMalformedTopic,
+		},
+		{
+			desc:   "subscribe with wildcard to non channel topic",
+			id:     thingID,
+			secret: thingSecret,
+			topic:  "devices/" + chanID + "/#",
+			err:    mqtt.ErrMalformedTopic,
+		},
+		{
+			desc:   "subscribe to shared topic",
+			id:     thingID,
+			secret: thingSecret,
+			topic:  "$share/group/channels/" + chanID + "/messages/#",
+		},
+		{
+			desc:   "subscribe to shared topic of unauthorized channel",
+			id:     thingID,
+			secret: thingSecret,
+			topic:  "$share/group/channels/" + otherChanID + "/messages",
+			err:    errors.ErrAuthorization,
+		},
+		{
+			desc:   "subscribe to shared topic with cross-channel wildcard",
+			id:     thingID,
+			secret: thingSecret,
+			topic:  "$share/group/channels/+/messages",
+			err:    mqtt.ErrWildcardChannel,
+		},
+		{
+			desc:   "subscribe to shared topic without group",
+			id:     thingID,
+			secret: thingSecret,
+			topic:  "$share//channels/" + chanID + "/messages",
+			err:    mqtt.ErrMalformedTopic,
+		},
+		{
+			desc:   "subscribe to shared topic without topic filter",
+			id:     thingID,
+			secret: thingSecret,
+			topic:  "$share/group",
+			err:    mqtt.ErrMalformedTopic,
+		},
+		{
+			desc:   "subscribe to $SYS topics with allowed thing",
+			id:     sysThingID,
+			secret: sysSecret,
+			topic:  "$SYS/#",
+		},
+		{
+			desc:   "subscribe to $SYS topics with not allowed thing",
+			id:     thingID,
+			secret: thingSecret,
+			topic:  "$SYS/broker/clients/connected",
+			err:    errors.ErrAuthorization,
+		},
+	}
+
+	for _, tc := range cases {
+		ctx := session.NewContext(context.Background(), &session.Session{
+			ID:       "client",
+			Username: tc.id,
+			Password: []byte(tc.secret),
+		})
+		topics := []string{tc.topic}
+		err := h.AuthSubscribe(ctx, &topics)
+		if !errors.Contains(err, tc.err) {
+			t.Errorf("%s: expected error %v got %v", tc.desc, tc.err, err)
+		}
+	}
+}
+
+func TestAuthSubscribeTopics(t *testing.T) {
+	cases := []struct {
+		desc   string
+		topics []string
+		// calls are the expected Authorize calls per channel.
+		calls map[string]int
+		err   error
+	}{
+		{
+			desc: "subscribe to topics of the same channel",
+			topics: []string{
+				"channels/" + chanID + "/messages",
+				"channels/" + chanID + "/messages/temp",
+				"$share/group/channels/" + chanID + "/messages/#",
+			},
+			calls: map[string]int{chanID: 1},
+		},
+		{
+			desc: "subscribe to topics of several channels",
+			topics: []string{
+				"channels/" + chanID + "/messages",
+				"channels/" + thirdChanID + "/messages/+/temp",
+				"channels/" + chanID + "/messages/#",
+			},
+			calls: map[string]int{chanID: 1, thirdChanID: 1},
+		},
+		{
+			desc: "subscribe to topics with unauthorized channel",
+			topics: []string{
+				"channels/" + chanID + "/messages",
+				"channels/" + otherChanID + "/messages",
+				"channels/" + thirdChanID + "/messages",
+				"channels/" + otherChanID + "/messages/#",
+			},
+			calls: map[string]int{chanID: 1, otherChanID: 1, thirdChanID: 1},
+			err:   errors.ErrAuthorization,
+		},
+		{
+			desc: "subscribe to topics with malformed topic",
+			topics: []string{
+				"channels/" + chanID + "/messages",
+				"channels/+/messages",
+			},
+			calls: map[string]int{chanID: 0},
+			err:   mqtt.ErrWildcardChannel,
+		},
+	}
+
+	for _, tc := range cases {
+		svc := mocks.NewBlockingAuthService(newAuthService())
+		svc.Release()
+		h := newAuthHandler(svc)
+		ctx := session.NewContext(context.Background(), &session.Session{
+			ID:       "client",
+			Username: thingID,
+			Password: []byte(thingSecret),
+		})
+		topics := tc.topics
+		err := h.AuthSubscribe(ctx, &topics)
+		if !errors.Contains(err, tc.err) || (err == nil) != (tc.err == nil) {
+			t.Errorf("%s: expected error %v got %v", tc.desc, tc.err, err)
+		}
+		for ch, n := range tc.calls {
+			if calls := svc.AuthorizeCalls(ch); calls != n {
+				t.Errorf("%s: expected %d Authorize calls for channel %s got %d", tc.desc, n, ch, calls)
+			}
+		}
+	}
+}
+
+func TestAuthSubscribeParallelism(t *testing.T) {
+	const channels = 6
+
+	cases := []struct {
+		desc        string
+		parallelism int
+	}{
+		{
+			desc:        "sequential",
+			parallelism: 1,
+		},
+		{
+			desc:        "limited",
+			parallelism: 2,
+		},
+		{
+			desc:        "unlimited by the channels",
+			parallelism: channels,
+		},
+	}
+
+	for _, tc := range cases {
+		svc := mocks.NewBlockingAuthService(newAuthService())
+		h := newAuthHandler(svc, mqtt.WithAuthParallelism(tc.parallelism))
+		ctx := session.NewContext(context.Background(), &session.Session{
+			ID:       "client",
+			Username: thingID,
+			Password: []byte(thingSecret),
+		})
+		var topics, ids []string
+		for i := 0; i < channels; i++ {
+			id := fmt.Sprintf("123e4567-e89b-12d3-a456-00000000001%d", i)
+			ids = append(ids, id)
+			topics = append(topics, "channels/"+id+"/messages", "channels/"+id+"/messages/#")
+		}
+
+		errs := make(chan error, 1)
+		go func() {
+			errs <- h.AuthSubscribe(ctx, &topics)
+		}()
+		if !svc.WaitInFlight(tc.parallelism, time.Second) {
+			t.Fatalf("%s: expected %d Authorize calls in flight", tc.desc, tc.parallelism)
+		}
+		// No more calls are sent while the ones in flight are blocked.
+		time.Sleep(20 * time.Millisecond)
+		svc.Release()
+
+		// The thing is not connected to the channels.
+		if err := <-errs; !errors.Contains(err, errors.ErrAuthorization) {
+			t.Errorf("%s: expected error %v got %v", tc.desc, errors.ErrAuthorization, err)
+		}
+		if n := svc.MaxInFlight(); n != tc.parallelism {
+			t.Errorf("%s: expected at most %d Authorize calls in flight got %d", tc.desc, tc.parallelism, n)
+		}
+		for _, id := range ids {
+			if calls := svc.AuthorizeCalls(id); calls != 1 {
+				t.Errorf("%s: expected 1 Authorize call for channel %s got %d", tc.desc, id, calls)
+			}
+		}
+	}
+}
+
+func TestAuthPublish(t *testing.T) {
+	cases := []struct {
+		desc         string
+		id           string
+		secret       string
+		topic        string
+		contentTypes map[string][]string
+		err          error
+	}{
+		{
+			desc:   "publish to channel topic",
+			id:     thingID,
+			secret: thingSecret,
+			topic:  "channels/" + chanID + "/messages/temp",
+		},
+		{
+			desc:   "publish to unauthorized channel",
+			id:     thingID,
+			secret: thingSecret,
+			topic:  "channels/" + otherChanID + "/messages",
+			err:    errors.ErrAuthorization,
+		},
+		{
+			desc:   "publish to topic with wildcard",
+			id:     thingID,
+			secret: thingSecret,
+			topic:  "channels/" + chanID + "/messages/#",
+			err:    mqtt.ErrMalformedTopic,
+		},
+		{
+			desc:   "publish to shared topic",
+			id:     thingID,
+			secret: thingSecret,
+			topic:  "$share/group/channels/" + chanID + "/messages",
+			err:    mqtt.ErrMalformedTopic,
+		},
+		{
+			desc:   "publish to $SYS topic with allowed thing",
+			id:     sysThingID,
+			secret: sysSecret,
+			topic:  "$SYS/broker/uptime",
+			err:    errors.ErrAuthorization,
+		},
+		{
+			desc:   "publish to malformed subtopic",
+			id:     thingID,
+			secret: thingSecret,
+			topic:  "channels/" + chanID + "/messages/temp*",
+			err:    mqtt.ErrFailedParseSubtopic,
+		},
+		{
+			desc:   "publish with content type",
+			id:     thingID,
+			secret: thingSecret,
+			topic:  "channels/" + chanID + "/messages/temp/ct/application%2Fjson",
+		},
+		{
+			desc:   "publish with malformed URL encoded content type",
+			id:     thingID,
+			secret: thingSecret,
+			topic:  "channels/" + chanID + "/messages/temp/ct/application%zzjson",
+			err:    mqtt.ErrMalformedContentType,
+		},
+		{
+			desc:   "publish with malformed content type",
+			id:     thingID,
+			secret: thingSecret,
+			topic:  "channels/" + chanID + "/messages/temp/ct/application%20json",
+			err:    mqtt.ErrMalformedContentType,
+		},
+		{
+			desc:         "publish with content type allowed on channel",
+			id:           thingID,
+			secret:       thingSecret,
+			topic:        "channels/" + chanID + "/messages/ct/application%2Fjson%3B%20charset%3Dutf-8",
+			contentTypes: map[string][]string{chanID: {"application/json"}},
+		},
+		{
+			desc:         "publish with content type not allowed on channel",
+			id:           thingID,
+			secret:       thingSecret,
+			topic:        "channels/" + chanID + "/messages/ct/text%2Fplain",
+			contentTypes: map[string][]string{chanID: {"application/json"}},
+			err:          mqtt.ErrContentTypeNotAllowed,
+		},
+		{
+			desc:         "publish without content type to channel with allowed content types",
+			id:           thingID,
+			secret:       thingSecret,
+			topic:        "channels/" + chanID + "/messages/temp",
+			contentTypes: map[string][]string{chanID: {"application/json"}},
+			err:          mqtt.ErrContentTypeNotAllowed,
+		},
+		{
+			desc:         "publish to other channel than the one with allowed content types",
+			id:           thingID,
+			secret:       thingSecret,
+			topic:        "channels/" + thirdChanID + "/messages/ct/text%2Fplain",
+			contentTypes: map[string][]string{chanID: {"application/json"}},
+		},
+		{
+			desc:         "publish with content type allowed on any channel",
+			id:           thingID,
+			secret:       thingSecret,
+			topic:        "channels/" + thirdChanID + "/messages/ct/application%2Fsenml%2Bjson",
+			contentTypes: map[string][]string{mqtt.AnyChannel: {"application/senml+json"}},
+		},
+		{
+			desc:         "publish with content type not allowed on any channel",
+			id:           thingID,
+			secret:       thingSecret,
+			topic:        "channels/" + thirdChanID + "/messages/ct/application%2Fjson",
+			contentTypes: map[string][]string{mqtt.AnyChannel: {"application/senml+json"}},
+			err:          mqtt.ErrContentTypeNotAllowed,
+		},
+		{
+			desc:   "publish with content type allowed on channel but not on any channel",
+			id:     thingID,
+			secret: thingSecret,
+			topic:  "channels/" + chanID + "/messages/ct/application%2Fjson",
+			contentTypes: map[string][]string{
+				chanID:          {"application/json"},
+				mqtt.AnyChannel: {"application/senml+json"},
+			},
+		},
+		{
+			desc:   "publish with content type allowed on any channel but not on channel",
+			id:     thingID,
+			secret: thingSecret,
+			topic:  "channels/" + chanID + "/messages/ct/application%2Fsenml%2Bjson",
+			contentTypes: map[string][]string{
+				chanID:          {"application/json"},
+				mqtt.AnyChannel: {"application/senml+json"},
+			},
+			err: mqtt.ErrContentTypeNotAllowed,
+		},
+	}
+
+	for _, tc := range cases {
+		h := newHandler(mqtt.WithContentTypes(tc.contentTypes))
+		ctx := session.NewContext(context.Background(), &session.Session{
+			ID:       "client",
+			Username: tc.id,
+			Password: []byte(tc.secret),
+		})
+		topic := tc.topic
+		payload := []byte("payload")
+		err := h.AuthPublish(ctx, &topic, &payload)
+		if !errors.Contains(err, tc.err) {
+			t.Errorf("%s: expected error %v got %v", tc.desc, tc.err, err)
+		}
+	}
+}
+
+func TestPublish(t *testing.T) {
+	cases := []struct {
+		desc  string
+		topic string
+		msg   mqtt.Message
+	}{
+		{
+			desc:  "publish to channel topic",
+			topic: "channels/" + chanID + "/messages",
+			msg:   mqtt.Message{Channel: chanID},
+		},
+		{
+			desc:  "publish to subtopic",
+			topic: "/channels/" + chanID + "/messages/temp//room%201/",
+			msg:   mqtt.Message{Channel: chanID, Subtopic: "temp.room 1"},
+		},
+		{
+			desc:  "publish with content type",
+			topic: "channels/" + chanID + "/messages/temp/ct/application%2FJSON%3B%20charset%3Dutf-8",
+			msg:   mqtt.Message{Channel: chanID, Subtopic: "temp", ContentType: "application/json"},
+		},
+		{
+			desc:  "publish with content type without subtopic",
+			topic: "channels/" + chanID + "/messages/ct/application/senml+json",
+			msg:   mqtt.Message{Channel: chanID, ContentType: "application/senml+json"},
+		},
+	}
+
+	for _, tc := range cases {
+		pub := &publisher{}
+		h := newHandler(mqtt.WithPublisher(pub))
+		ctx := session.NewContext(context.Background(), &session.Session{
+			ID:       "client",
+			Username: thingID,
+			Password: []byte(thingSecret),
+		})
+		topic := tc.topic
+		payload := []byte("payload")
+		if err := h.Publish(ctx, &topic, &payload); err != nil {
+			t.Errorf("%s: expected no error got %v", tc.desc, err)
+			continue
+		}
+		if pub.msg == nil || *pub.msg != tc.msg {
+			t.Errorf("%s: expected message %+v in context got %+v", tc.desc, tc.msg, pub.msg)
+		}
+		if pub.channel != tc.msg.Channel || pub.subtopic != tc.msg.Subtopic {
+			t.Errorf("%s: expected channel %s and subtopic %s got %s and %s", tc.desc, tc.msg.Channel, tc.msg.Subtopic, pub.channel, pub.subtopic)
+		}
+	}
+}
+
+func TestPublishMetrics(t *testing.T) {
+	cases := []struct {
+		desc  string
+		topic string
+		key   string
+	}{
+		{
+			desc:  "publish without content type",
+			topic: "channels/" + chanID + "/messages/temp",
+			key:   "none",
+		},
+		{
+			desc:  "publish with content type",
+			topic: "channels/" + chanID + "/messages/temp/ct/application%2Fsenml%2Bjson",
+			key:   "application/senml+json",
+		},
+	}
+
+	h := newHandler()
+	ctx := session.NewContext(context.Background(), &session.Session{
+		ID:       "client",
+		Username: thingID,
+		Password: []byte(thingSecret),
+	})
+	for _, tc := range cases {
+		before := published(tc.key)
+		topic := tc.topic
+		payload := []byte("payload")
+		if err := h.Publish(ctx, &topic, &payload); err != nil {
+			t.Errorf("%s: expected no error got %v", tc.desc, err)
+			continue
+		}
+		if n := published(tc.key) - before; n != 1 {
+			t.Errorf("%s: expected 1 message counted as %s got %d", tc.desc, tc.key, n)
+		}
+	}
+}
+
+func TestAuthPublishRejectedEvent(t *testing.T) {
+	evs := &events{}
+	h := newHandler(mqtt.WithEvents(evs), mqtt.WithContentTypes(map[string][]string{chanID: {"application/json"}}))
+	ctx := session.NewContext(context.Background(), &session.Session{
+		ID:       "client",
+		Username: thingID,
+		Password: []byte(thingSecret),
+	})
+	if err := h.AuthConnect(ctx); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	topic := "channels/" + chanID + "/messages/temp/ct/text%2Fplain"
+	payload := []byte("payload")
+	if err := h.AuthPublish(ctx, &topic, &payload); !errors.Contains(err, mqtt.ErrContentTypeNotAllowed) {
+		t.Fatalf("expected error %v got %v", mqtt.ErrContentTypeNotAllowed, err)
+	}
+
+	got := evs.all()
+	if len(got) != 1 {
+		t.Fatalf("expected 1 event got %d", len(got))
+	}
+	want := mqtt.Event{
+		Type:        mqtt.EventRejected,
+		ClientID:    "client",
+		ThingID:     thingID,
+		Reason:      mqtt.ErrContentTypeNotAllowed.Error(),
+		Channel:     chanID,
+		Subtopic:    "temp",
+		ContentType: "text/plain",
+	}
+	got[0].RemoteAddr, got[0].Timestamp = "", time.Time{}
+	if got[0] != want {
+		t.Errorf("expected event %+v got %+v", want, got[0])
+	}
+}
+
+func TestPublishFailure(t *testing.T) {
+	h := newHandler(mqtt.WithPublisher(&publisher{err: errors.New("broker down")}))
+	ctx := session.NewContext(context.Background(), &session.Session{
+		ID:       "client",
+		Username: thingID,
+		Password: []byte(thingSecret),
+	})
+	topic := "channels/" + chanID + "/messages"
+	payload := []byte("payload")
+	if err := h.Publish(ctx, &topic, &payload); err != nil {
+		t.Errorf("expected message broker failure to be ignored got %v", err)
+	}
+}
+
+// publisher records the last message published.
+type publisher struct {
+	msg      *mqtt.Message
+	channel  string
+	subtopic string
+	err      error
+}
+
+func (pub *publisher) Publish(ctx context.Context, topic string, msg *messaging.Message) error {
+	pub.msg, _ = mqtt.MessageFromContext(ctx)
+	pub.channel = msg.GetChannel()
+	pub.subtopic = msg.GetSubtopic()
+	return pub.err
+}
+
+func (pub *publisher) Close() error {
+	return nil
+}
+
+// events records the session events published.
+type events struct {
+	mu     sync.Mutex
+	events []mqtt.Event
+}
+
+func (evs *events) Publish(_ context.Context, event mqtt.Event) error {
+	evs.mu.Lock()
+	defer evs.mu.Unlock()
+	evs.events = append(evs.events, event)
+	return nil
+}
+
+func (evs *events) all() []mqtt.Event {
+	evs.mu.Lock()
+	defer evs.mu.Unlock()
+	return append([]mqtt.Event(nil), evs.events...)
+}
+
+func published(contentType string) int64 {
+	m, ok := expvar.Get("published_messages").(*expvar.Map)
+	if !ok {
+		return 0
+	}
+	if v, ok := m.Get(contentType).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
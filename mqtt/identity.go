@@ -0,0 +1,252 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package mqtt
+
+import (
+	"context"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/absmach/aproxy/internal/proxy"
+	"github.com/mainflux/mainflux/pkg/errors"
+	"github.com/mainflux/mproxy/pkg/session"
+)
+
+// CONNECT fields the credentials are taken from.
+const (
+	SourceUsername = "username"
+	SourcePassword = "password"
+	SourceClientID = "client_id"
+	// SourceNone means that the thing ID is not checked.
+	SourceNone = "none"
+)
+
+// Thing ID comparisons.
+const (
+	// CompareExact requires the thing ID to be equal to the ID of the thing
+	// the secret belongs to.
+	CompareExact = "exact"
+	// ComparePrefix requires the thing ID to be the ID of the thing the
+	// secret belongs to, or to start with it followed by a delimiter other
+	// than a letter or a digit, such as client IDs in the format
+	// <thing_id>-<suffix>.
+	ComparePrefix = "prefix"
+)
+
+// Credential mapping fields.
+const (
+	secretField    = "secret"
+	thingIDField   = "thing_id"
+	separatorField = "separator"
+	compareField   = "compare"
+)
+
+var (
+	// ErrMissingSecret indicates that CONNECT doesn't contain the thing secret.
+	ErrMissingSecret = errors.New("thing secret not found")
+
+	// ErrMissingThingID indicates that CONNECT doesn't contain the thing ID.
+	ErrMissingThingID = errors.New("thing ID not found")
+
+	// ErrMissingTenant indicates that the thing ID isn't preceded by the tenant.
+	ErrMissingTenant = errors.New("tenant not found")
+
+	// ErrThingIDMismatch indicates that the thing ID doesn't match the thing
+	// the secret belongs to.
+	ErrThingIDMismatch = errors.New("thing ID doesn't match the thing of the secret")
+
+	// ErrTenantMismatch indicates that the tenant isn't the tenant of the thing
+	// the secret belongs to.
+	ErrTenantMismatch = errors.New("tenant doesn't match the tenant of the thing")
+
+	// ErrInvalidCredentialMapping indicates malformed credential mapping.
+	ErrInvalidCredentialMapping = errors.New("invalid credential mapping")
+)
+
+// DefaultCredentialMapping takes the thing secret from the password, and
+// requires the username to be the thing ID.
+var DefaultCredentialMapping = CredentialMapping{
+	Secret:  SourcePassword,
+	ThingID: SourceUsername,
+	Compare: CompareExact,
+}
+
+// CredentialMapping defines where the thing secret and the thing ID are
+// taken from in CONNECT, and how the thing ID is compared with the ID of
+// the thing the secret belongs to.
+type CredentialMapping struct {
+	// Secret is the field the thing secret is taken from: SourcePassword or
+	// SourceUsername.
+	Secret string
+
+	// ThingID is the field the thing ID is taken from: SourceUsername,
+	// SourcePassword, SourceClientID or SourceNone.
+	ThingID string
+
+	// Separator separates the tenant from the thing ID, as in usernames in
+	// the format <tenant>/<thing_id>. If set, the tenant must be the tenant
+	// of the thing.
+	Separator string
+
+	// Compare is CompareExact or ComparePrefix.
+	Compare string
+}
+
+// claim is the identity the client claims in CONNECT.
+type claim struct {
+	secret  string
+	thingID string
+	tenant  string
+}
+
+// WithCredentialMappings maps the credentials of the clients of the listeners.
+// Listener names are mapped to the credential mappings, and the clients of
+// the listeners which are not listed use DefaultCredentialMapping.
+func WithCredentialMappings(mappings map[string]CredentialMapping) Option {
+	return func(h *handler) {
+		for listener, m := range mappings {
+			h.credentialMappings[listener] = m
+		}
+	}
+}
+
+// ParseCredentialMapping parses the credential mapping from the fields in
+// the format <field>=<value>, e.g. secret=username and thing_id=none. The
+// fields which are not set are taken from DefaultCredentialMapping.
+func ParseCredentialMapping(fields []string) (CredentialMapping, error) {
+	m := DefaultCredentialMapping
+	for _, f := range fields {
+		key, value, ok := strings.Cut(f, "=")
+		if !ok {
+			return CredentialMapping{}, errors.Wrap(ErrInvalidCredentialMapping, errors.New(f))
+		}
+		switch key {
+		case secretField:
+			m.Secret = value
+		case thingIDField:
+			m.ThingID = value
+		case separatorField:
+			m.Separator = value
+		case compareField:
+			m.Compare = value
+		default:
+			return CredentialMapping{}, errors.Wrap(ErrInvalidCredentialMapping, errors.New("unknown field "+key))
+		}
+	}
+
+	return m, m.Validate()
+}
+
+// Validate checks if the credential mapping is well formed.
+func (m CredentialMapping) Validate() error {
+	switch m.Secret {
+	case SourcePassword, SourceUsername:
+	default:
+		return errors.Wrap(ErrInvalidCredentialMapping, errors.New("unknown secret source "+m.Secret))
+	}
+	switch m.ThingID {
+	case SourceUsername, SourcePassword, SourceClientID, SourceNone:
+	default:
+		return errors.Wrap(ErrInvalidCredentialMapping, errors.New("unknown thing ID source "+m.ThingID))
+	}
+	if m.ThingID == m.Secret {
+		return errors.Wrap(ErrInvalidCredentialMapping, errors.New("secret and thing ID taken from "+m.Secret))
+	}
+	switch m.Compare {
+	case CompareExact, ComparePrefix:
+	default:
+		return errors.Wrap(ErrInvalidCredentialMapping, errors.New("unknown comparison "+m.Compare))
+	}
+
+	return nil
+}
+
+// claim extracts the claimed identity from CONNECT.
+func (m CredentialMapping) claim(s *session.Session) (claim, error) {
+	c := claim{
+		secret: field(s, m.Secret),
+	}
+	if c.secret == "" {
+		return claim{}, errors.Wrap(errors.ErrAuthentication, ErrMissingSecret)
+	}
+	if m.ThingID == SourceNone {
+		return c, nil
+	}
+
+	c.thingID = field(s, m.ThingID)
+	if m.Separator != "" {
+		i := strings.LastIndex(c.thingID, m.Separator)
+		if i < 0 {
+			return claim{}, errors.Wrap(errors.ErrAuthentication, ErrMissingTenant)
+		}
+		c.tenant, c.thingID = c.thingID[:i], c.thingID[i+len(m.Separator):]
+	}
+	if c.thingID == "" {
+		return claim{}, errors.Wrap(errors.ErrAuthentication, ErrMissingThingID)
+	}
+
+	return c, nil
+}
+
+// verify checks the claimed identity against the thing the secret belongs to.
+func (m CredentialMapping) verify(c claim, thingID, tenant string) error {
+	if m.ThingID == SourceNone {
+		return nil
+	}
+	if m.Separator != "" && c.tenant != tenant {
+		return errors.Wrap(errors.ErrAuthentication, ErrTenantMismatch)
+	}
+	switch m.Compare {
+	case ComparePrefix:
+		if !hasIDPrefix(c.thingID, thingID) {
+			return errors.Wrap(errors.ErrAuthentication, ErrThingIDMismatch)
+		}
+	default:
+		if c.thingID != thingID {
+			return errors.Wrap(errors.ErrAuthentication, ErrThingIDMismatch)
+		}
+	}
+
+	return nil
+}
+
+// hasIDPrefix checks if the ID is the prefix, or starts with the prefix
+// followed by a delimiter, so that the thing dev can't claim device-x.
+func hasIDPrefix(id, prefix string) bool {
+	if !strings.HasPrefix(id, prefix) {
+		return false
+	}
+	if len(id) == len(prefix) {
+		return true
+	}
+	r, _ := utf8.DecodeRuneInString(id[len(prefix):])
+
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+// credentialMapping returns the credential mapping of the listener the
+// client connected to.
+func (h *handler) credentialMapping(ctx context.Context) CredentialMapping {
+	if c, ok := proxy.FromContext(ctx); ok {
+		if m, ok := h.credentialMappings[c.Listener]; ok {
+			return m
+		}
+	}
+
+	return DefaultCredentialMapping
+}
+
+func field(s *session.Session, source string) string {
+	switch source {
+	case SourceUsername:
+		return s.Username
+	case SourcePassword:
+		return string(s.Password)
+	case SourceClientID:
+		return s.ID
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,289 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/mainflux/mainflux/pkg/errors"
+	"github.com/mainflux/mproxy/pkg/session"
+)
+
+const (
+	mappedThingID = "513d02d2-16c1-4f23-98be-9e12f8fee898"
+	mappedSecret  = "thing-secret"
+	mappedTenant  = "acme"
+)
+
+func TestParseCredentialMapping(t *testing.T) {
+	cases := []struct {
+		desc    string
+		fields  []string
+		mapping CredentialMapping
+		err     error
+	}{
+		{
+			desc:    "default mapping",
+			mapping: DefaultCredentialMapping,
+		},
+		{
+			desc:    "secret from username without thing ID",
+			fields:  []string{"secret=username", "thing_id=none"},
+			mapping: CredentialMapping{Secret: SourceUsername, ThingID: SourceNone, Compare: CompareExact},
+		},
+		{
+			desc:    "thing ID from client ID with prefix comparison",
+			fields:  []string{"thing_id=client_id", "compare=prefix"},
+			mapping: CredentialMapping{Secret: SourcePassword, ThingID: SourceClientID, Compare: ComparePrefix},
+		},
+		{
+			desc:    "tenant separator",
+			fields:  []string{"separator=/"},
+			mapping: CredentialMapping{Secret: SourcePassword, ThingID: SourceUsername, Separator: "/", Compare: CompareExact},
+		},
+		{
+			desc:   "field without value",
+			fields: []string{"secret"},
+			err:    ErrInvalidCredentialMapping,
+		},
+		{
+			desc:   "unknown field",
+			fields: []string{"tenant=acme"},
+			err:    ErrInvalidCredentialMapping,
+		},
+		{
+			desc:   "unknown secret source",
+			fields: []string{"secret=client_id"},
+			err:    ErrInvalidCredentialMapping,
+		},
+		{
+			desc:   "unknown thing ID source",
+			fields: []string{"thing_id=cert"},
+			err:    ErrInvalidCredentialMapping,
+		},
+		{
+			desc:   "secret and thing ID from the same field",
+			fields: []string{"secret=username", "thing_id=username"},
+			err:    ErrInvalidCredentialMapping,
+		},
+		{
+			desc:   "unknown comparison",
+			fields: []string{"compare=suffix"},
+			err:    ErrInvalidCredentialMapping,
+		},
+	}
+
+	for _, tc := range cases {
+		m, err := ParseCredentialMapping(tc.fields)
+		if !errors.Contains(err, tc.err) || (err == nil) != (tc.err == nil) {
+			t.Errorf("%s: expected error %v got %v", tc.desc, tc.err, err)
+		}
+		if err == nil && m != tc.mapping {
+			t.Errorf("%s: expected mapping %+v got %+v", tc.desc, tc.mapping, m)
+		}
+	}
+}
+
+func TestClaim(t *testing.T) {
+	cases := []struct {
+		desc    string
+		mapping CredentialMapping
+		session session.Session
+		claim   claim
+		err     error
+	}{
+		{
+			desc:    "default mapping",
+			mapping: DefaultCredentialMapping,
+			session: session.Session{ID: "client", Username: mappedThingID, Password: []byte(mappedSecret)},
+			claim:   claim{secret: mappedSecret, thingID: mappedThingID},
+		},
+		{
+			desc:    "secret from username",
+			mapping: CredentialMapping{Secret: SourceUsername, ThingID: SourcePassword, Compare: CompareExact},
+			session: session.Session{ID: "client", Username: mappedSecret, Password: []byte(mappedThingID)},
+			claim:   claim{secret: mappedSecret, thingID: mappedThingID},
+		},
+		{
+			desc:    "thing ID from client ID",
+			mapping: CredentialMapping{Secret: SourcePassword, ThingID: SourceClientID, Compare: CompareExact},
+			session: session.Session{ID: mappedThingID, Username: "user", Password: []byte(mappedSecret)},
+			claim:   claim{secret: mappedSecret, thingID: mappedThingID},
+		},
+		{
+			desc:    "thing ID not checked",
+			mapping: CredentialMapping{Secret: SourceUsername, ThingID: SourceNone, Compare: CompareExact},
+			session: session.Session{ID: "client", Username: mappedSecret},
+			claim:   claim{secret: mappedSecret},
+		},
+		{
+			desc:    "tenant before the last separator",
+			mapping: CredentialMapping{Secret: SourcePassword, ThingID: SourceUsername, Separator: "/", Compare: CompareExact},
+			session: session.Session{ID: "client", Username: "acme/eu/" + mappedThingID, Password: []byte(mappedSecret)},
+			claim:   claim{secret: mappedSecret, thingID: mappedThingID, tenant: "acme/eu"},
+		},
+		{
+			desc:    "missing secret",
+			mapping: DefaultCredentialMapping,
+			session: session.Session{ID: "client", Username: mappedThingID},
+			err:     ErrMissingSecret,
+		},
+		{
+			desc:    "missing secret in username",
+			mapping: CredentialMapping{Secret: SourceUsername, ThingID: SourceNone, Compare: CompareExact},
+			session: session.Session{ID: "client", Password: []byte(mappedSecret)},
+			err:     ErrMissingSecret,
+		},
+		{
+			desc:    "missing thing ID",
+			mapping: DefaultCredentialMapping,
+			session: session.Session{ID: "client", Password: []byte(mappedSecret)},
+			err:     ErrMissingThingID,
+		},
+		{
+			desc:    "missing tenant separator",
+			mapping: CredentialMapping{Secret: SourcePassword, ThingID: SourceUsername, Separator: "/", Compare: CompareExact},
+			session: session.Session{ID: "client", Username: mappedThingID, Password: []byte(mappedSecret)},
+			err:     ErrMissingTenant,
+		},
+		{
+			desc:    "missing thing ID after the tenant",
+			mapping: CredentialMapping{Secret: SourcePassword, ThingID: SourceUsername, Separator: "/", Compare: CompareExact},
+			session: session.Session{ID: "client", Username: mappedTenant + "/", Password: []byte(mappedSecret)},
+			err:     ErrMissingThingID,
+		},
+	}
+
+	for _, tc := range cases {
+		s := tc.session
+		c, err := tc.mapping.claim(&s)
+		if !errors.Contains(err, tc.err) || (err == nil) != (tc.err == nil) {
+			t.Errorf("%s: expected error %v got %v", tc.desc, tc.err, err)
+		}
+		// The failed claims are authentication failures.
+		if err != nil && !errors.Contains(err, errors.ErrAuthentication) {
+			t.Errorf("%s: expected error wrapped with %v got %v", tc.desc, errors.ErrAuthentication, err)
+		}
+		if c != tc.claim {
+			t.Errorf("%s: expected claim %+v got %+v", tc.desc, tc.claim, c)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	tenantMapping := CredentialMapping{Secret: SourcePassword, ThingID: SourceUsername, Separator: "/", Compare: CompareExact}
+	prefixMapping := CredentialMapping{Secret: SourcePassword, ThingID: SourceClientID, Compare: ComparePrefix}
+
+	cases := []struct {
+		desc    string
+		mapping CredentialMapping
+		claim   claim
+		thingID string
+		tenant  string
+		err     error
+	}{
+		{
+			desc:    "exact thing ID",
+			mapping: DefaultCredentialMapping,
+			claim:   claim{thingID: mappedThingID},
+		},
+		{
+			desc:    "thing ID mismatch",
+			mapping: DefaultCredentialMapping,
+			claim:   claim{thingID: "other-thing"},
+			err:     ErrThingIDMismatch,
+		},
+		{
+			desc:    "prefix of the exact thing ID",
+			mapping: DefaultCredentialMapping,
+			claim:   claim{thingID: mappedThingID + "-sensor"},
+			err:     ErrThingIDMismatch,
+		},
+		{
+			desc:    "thing ID not checked",
+			mapping: CredentialMapping{Secret: SourceUsername, ThingID: SourceNone, Compare: CompareExact},
+			claim:   claim{thingID: "other-thing"},
+		},
+		{
+			desc:    "thing ID prefix",
+			mapping: prefixMapping,
+			claim:   claim{thingID: mappedThingID + "-sensor"},
+		},
+		{
+			desc:    "thing ID equal to the prefix",
+			mapping: prefixMapping,
+			claim:   claim{thingID: mappedThingID},
+		},
+		{
+			desc:    "thing ID prefix followed by other delimiter",
+			mapping: prefixMapping,
+			claim:   claim{thingID: mappedThingID + "/sensor"},
+		},
+		{
+			desc:    "thing ID extending the prefix",
+			mapping: prefixMapping,
+			claim:   claim{thingID: mappedThingID + "0-sensor"},
+			err:     ErrThingIDMismatch,
+		},
+		{
+			desc:    "thing ID starting with shorter thing ID",
+			mapping: prefixMapping,
+			claim:   claim{thingID: "device-x"},
+			thingID: "dev",
+			err:     ErrThingIDMismatch,
+		},
+		{
+			desc:    "thing ID prefix followed by delimiter",
+			mapping: prefixMapping,
+			claim:   claim{thingID: "dev-x"},
+			thingID: "dev",
+		},
+		{
+			desc:    "thing ID prefix mismatch",
+			mapping: prefixMapping,
+			claim:   claim{thingID: "sensor-" + mappedThingID},
+			err:     ErrThingIDMismatch,
+		},
+		{
+			desc:    "tenant of the thing",
+			mapping: tenantMapping,
+			claim:   claim{thingID: mappedThingID, tenant: mappedTenant},
+			tenant:  mappedTenant,
+		},
+		{
+			desc:    "tenant mismatch",
+			mapping: tenantMapping,
+			claim:   claim{thingID: mappedThingID, tenant: "other"},
+			tenant:  mappedTenant,
+			err:     ErrTenantMismatch,
+		},
+		{
+			desc:    "tenant of thing without tenant",
+			mapping: tenantMapping,
+			claim:   claim{thingID: mappedThingID, tenant: mappedTenant},
+			err:     ErrTenantMismatch,
+		},
+		{
+			desc:    "thing ID mismatch with tenant",
+			mapping: tenantMapping,
+			claim:   claim{thingID: "other-thing", tenant: mappedTenant},
+			tenant:  mappedTenant,
+			err:     ErrThingIDMismatch,
+		},
+	}
+
+	for _, tc := range cases {
+		thingID := tc.thingID
+		if thingID == "" {
+			thingID = mappedThingID
+		}
+		err := tc.mapping.verify(tc.claim, thingID, tc.tenant)
+		if !errors.Contains(err, tc.err) || (err == nil) != (tc.err == nil) {
+			t.Errorf("%s: expected error %v got %v", tc.desc, tc.err, err)
+		}
+		if err != nil && !errors.Contains(err, errors.ErrAuthentication) {
+			t.Errorf("%s: expected error wrapped with %v got %v", tc.desc, errors.ErrAuthentication, err)
+		}
+	}
+}
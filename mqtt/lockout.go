@@ -0,0 +1,112 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/absmach/aproxy/internal/lockout"
+	"github.com/absmach/aproxy/internal/proxy"
+	"github.com/mainflux/mainflux/pkg/errors"
+	"github.com/mainflux/mproxy/pkg/session"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Lockout key prefixes.
+const (
+	ipKeyPrefix       = "ip:"
+	usernameKeyPrefix = "username:"
+)
+
+// WithLockout tracks failed connection attempts per source IP address and
+// username, delaying and locking out those which fail repeatedly.
+func WithLockout(tracker *lockout.Tracker) Option {
+	return func(h *handler) {
+		h.lockout = tracker
+	}
+}
+
+// lockoutKeys returns keys of the entities failed attempts are tracked for.
+// The username isn't tracked if it carries the thing secret, so the secret
+// isn't exposed in the lockout listing.
+func lockoutKeys(ctx context.Context, s *session.Session, mapping CredentialMapping) []string {
+	var keys []string
+	if c, ok := proxy.FromContext(ctx); ok && c.IP() != nil {
+		keys = append(keys, ipKeyPrefix+c.IP().String())
+	}
+	if s.Username != "" && mapping.Secret != SourceUsername {
+		keys = append(keys, usernameKeyPrefix+s.Username)
+	}
+
+	return keys
+}
+
+// checkLockout rejects locked out entities, and delays the attempt
+// of the entities which failed recently.
+func (h *handler) checkLockout(ctx context.Context, keys []string) error {
+	if h.lockout == nil {
+		return nil
+	}
+	delay, err := h.lockout.Check(keys...)
+	if err != nil {
+		h.logger.Warn(fmt.Sprintf(LogWarnLocked, keys))
+		return err
+	}
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// recordAttempt records the outcome of the connection attempt. Errors which
+// are not caused by invalid credentials, such as Things service being
+// unavailable, are not counted as failures. Success resets the failures of
+// the username only. The failures of the source IP address expire with the
+// window, so a client which holds valid credentials can't reset them between
+// the attempts to guess the others.
+func (h *handler) recordAttempt(keys []string, err error) {
+	if h.lockout == nil {
+		return
+	}
+	if err == nil {
+		var usernames []string
+		for _, key := range keys {
+			if strings.HasPrefix(key, usernameKeyPrefix) {
+				usernames = append(usernames, key)
+			}
+		}
+		h.lockout.Success(usernames...)
+		return
+	}
+	if !isAuthFailure(err) {
+		return
+	}
+	if h.lockout.Failure(keys...) {
+		h.logger.Warn(fmt.Sprintf(LogWarnLockedOut, keys))
+	}
+}
+
+func isAuthFailure(err error) bool {
+	if errors.Contains(err, errors.ErrAuthentication) {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.Unauthenticated, codes.NotFound, codes.PermissionDenied, codes.InvalidArgument:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package mqtt_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/absmach/aproxy/internal/lockout"
+	"github.com/absmach/aproxy/internal/proxy"
+	"github.com/absmach/aproxy/mqtt"
+	"github.com/mainflux/mainflux/pkg/errors"
+	"github.com/mainflux/mproxy/pkg/session"
+)
+
+const clientIP = "10.0.0.1"
+
+func connectFrom(h mqtt.Handler, ip, username, secret string) error {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip), Port: 1883}
+	ctx := proxy.NewContext(context.Background(), proxy.NewClient("mqtt", addr, nil))
+	ctx = session.NewContext(ctx, &session.Session{
+		ID:       "client-" + username,
+		Username: username,
+		Password: []byte(secret),
+	})
+	return h.AuthConnect(ctx)
+}
+
+func TestLockoutSuccessKeepsIPFailures(t *testing.T) {
+	tracker := lockout.New(lockout.Config{
+		Threshold:   3,
+		Duration:    time.Minute,
+		MaxDuration: time.Hour,
+		Window:      time.Hour,
+	})
+	h := newAuthHandler(newAuthService(), mqtt.WithLockout(tracker))
+
+	// The failures from the IP address with rotating usernames are
+	// interleaved with the successful connections of a valid thing.
+	for _, username := range []string{"guess-1", "guess-2", "guess-3"} {
+		if err := connectFrom(h, clientIP, username, "wrong-secret"); !errors.Contains(err, errors.ErrAuthentication) {
+			t.Fatalf("%s: expected error %v got %v", username, errors.ErrAuthentication, err)
+		}
+		if err := connectFrom(h, clientIP, thingID, thingSecret); err != nil && !errors.Contains(err, lockout.ErrLocked) {
+			t.Fatalf("%s: unexpected error %v", username, err)
+		}
+	}
+
+	if err := connectFrom(h, clientIP, thingID, thingSecret); !errors.Contains(err, lockout.ErrLocked) {
+		t.Errorf("expected error %v got %v", lockout.ErrLocked, err)
+	}
+	var locked bool
+	for _, l := range tracker.Locked() {
+		if l.Key == "ip:"+clientIP {
+			locked = true
+		}
+	}
+	if !locked {
+		t.Errorf("expected ip:%s to be locked out got %+v", clientIP, tracker.Locked())
+	}
+
+	// The failures of the username are reset by success.
+	other := lockout.New(lockout.Config{Threshold: 2, Duration: time.Minute, Window: time.Hour})
+	h = newAuthHandler(newAuthService(), mqtt.WithLockout(other))
+	for i, ip := range []string{"10.0.0.2", "10.0.0.3", "10.0.0.4"} {
+		if err := connectFrom(h, ip, thingID, "wrong-secret"); !errors.Contains(err, errors.ErrAuthentication) {
+			t.Fatalf("attempt %d: expected error %v got %v", i, errors.ErrAuthentication, err)
+		}
+		if err := connectFrom(h, ip, thingID, thingSecret); err != nil {
+			t.Errorf("attempt %d: expected no error got %v", i, err)
+		}
+	}
+}
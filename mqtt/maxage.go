@@ -0,0 +1,71 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/mainflux/mproxy/pkg/session"
+)
+
+// MaxAgeConfig limits the time the sessions may stay connected, so the
+// things re-authenticate at least that often.
+type MaxAgeConfig struct {
+	// MaxAge is the maximum session age. Zero means that the session age
+	// is not limited.
+	MaxAge time.Duration
+
+	// Jitter is the maximum random time the session age is shortened by,
+	// so the sessions which connected together don't reconnect together.
+	// The jitter is capped at a half of the age.
+	Jitter time.Duration
+
+	// Things map thing IDs to the maximum age of their sessions, which
+	// overrides MaxAge. Zero means that the session age is not limited.
+	Things map[string]time.Duration
+}
+
+// WithMaxAge closes the sessions once they reach the maximum age.
+func WithMaxAge(cfg MaxAgeConfig) Option {
+	return func(h *handler) {
+		h.maxAge = cfg
+	}
+}
+
+// sessionAge returns the time the session of the thing may stay connected.
+func (h *handler) sessionAge(thingID string) time.Duration {
+	age, ok := h.maxAge.Things[thingID]
+	if !ok {
+		age = h.maxAge.MaxAge
+	}
+	if age <= 0 {
+		return 0
+	}
+	jitter := h.maxAge.Jitter
+	if jitter > age/2 {
+		jitter = age / 2
+	}
+	if jitter > 0 {
+		age -= time.Duration(rand.Int63n(int64(jitter)))
+	}
+
+	return age
+}
+
+// expire gracefully closes the session which reached the maximum age.
+func (h *handler) expire(s *session.Session) {
+	e, ok := h.sessions.lookup(s)
+	if !ok {
+		return
+	}
+	age := time.Since(e.info.ConnectedAt).Round(time.Second)
+	h.logger.Info(fmt.Sprintf(LogInfoExpired, e.info.ClientID, e.info.ThingID, age))
+	h.publishEvent(context.Background(), EventExpired, e.info, fmt.Sprintf("maximum session age of %s reached", age))
+	if err := e.disconnect(); err != nil {
+		h.logger.Warn(fmt.Sprintf(LogWarnFailedClose, e.info.ClientID, err))
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package mqtt
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionAge(t *testing.T) {
+	const samples = 1000
+
+	cases := []struct {
+		desc    string
+		cfg     MaxAgeConfig
+		thingID string
+		min     time.Duration
+		max     time.Duration
+	}{
+		{
+			desc: "age not limited",
+			cfg:  MaxAgeConfig{Jitter: time.Minute},
+		},
+		{
+			desc: "maximum age",
+			cfg:  MaxAgeConfig{MaxAge: time.Hour},
+			min:  time.Hour,
+			max:  time.Hour,
+		},
+		{
+			desc: "jitter below half of the age",
+			cfg:  MaxAgeConfig{MaxAge: time.Hour, Jitter: 10 * time.Minute},
+			min:  50*time.Minute + time.Nanosecond,
+			max:  time.Hour,
+		},
+		{
+			desc: "jitter over half of the age",
+			cfg:  MaxAgeConfig{MaxAge: time.Hour, Jitter: 45 * time.Minute},
+			min:  30*time.Minute + time.Nanosecond,
+			max:  time.Hour,
+		},
+		{
+			desc: "jitter over the age",
+			cfg:  MaxAgeConfig{MaxAge: time.Hour, Jitter: 2 * time.Hour},
+			min:  30*time.Minute + time.Nanosecond,
+			max:  time.Hour,
+		},
+		{
+			desc: "age too short for jitter",
+			cfg:  MaxAgeConfig{MaxAge: time.Nanosecond, Jitter: time.Minute},
+			min:  time.Nanosecond,
+			max:  time.Nanosecond,
+		},
+		{
+			desc:    "thing age overrides maximum age",
+			cfg:     MaxAgeConfig{MaxAge: time.Hour, Things: map[string]time.Duration{thing: 2 * time.Hour}},
+			thingID: thing,
+			min:     2 * time.Hour,
+			max:     2 * time.Hour,
+		},
+		{
+			desc:    "thing age with jitter",
+			cfg:     MaxAgeConfig{MaxAge: time.Hour, Jitter: 10 * time.Minute, Things: map[string]time.Duration{thing: 10 * time.Minute}},
+			thingID: thing,
+			min:     5*time.Minute + time.Nanosecond,
+			max:     10 * time.Minute,
+		},
+		{
+			desc:    "thing age not limited",
+			cfg:     MaxAgeConfig{MaxAge: time.Hour, Jitter: time.Minute, Things: map[string]time.Duration{thing: 0}},
+			thingID: thing,
+		},
+		{
+			desc:    "other thing",
+			cfg:     MaxAgeConfig{MaxAge: time.Hour, Things: map[string]time.Duration{thing: 0}},
+			thingID: otherThing,
+			min:     time.Hour,
+			max:     time.Hour,
+		},
+	}
+
+	for _, tc := range cases {
+		h := &handler{maxAge: tc.cfg}
+		shortest := tc.max
+		for i := 0; i < samples; i++ {
+			age := h.sessionAge(tc.thingID)
+			if age < tc.min || age > tc.max {
+				t.Fatalf("%s: expected age between %s and %s got %s", tc.desc, tc.min, tc.max, age)
+			}
+			if age < shortest {
+				shortest = age
+			}
+		}
+		// The jitter shortens the ages of some sessions.
+		if tc.cfg.Jitter > 0 && tc.min != tc.max && shortest == tc.max {
+			t.Errorf("%s: expected ages shortened by jitter got all %s", tc.desc, tc.max)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package mqtt
+
+import (
+	"context"
+	"expvar"
+	"mime"
+	"net/url"
+	"strings"
+
+	"github.com/mainflux/mainflux/pkg/errors"
+)
+
+const (
+	contentTypeLevel = "/ct/"
+	// AnyChannel is used as a channel ID to apply content types to all channels.
+	AnyChannel = "*"
+
+	noContentType = "none"
+)
+
+var messageMetrics = expvar.NewMap("published_messages")
+
+// The messageKey type is unexported to prevent collisions with context keys defined in
+// other packages.
+type messageKey struct{}
+
+// Message contains message details parsed from the publish topic.
+type Message struct {
+	// Channel contains the ID of the channel the message is published to.
+	Channel string
+
+	// Subtopic contains normalized subtopic, with levels separated by dot.
+	Subtopic string
+
+	// ContentType contains message content type, if set in the topic.
+	ContentType string
+}
+
+// NewMessageContext stores Message in context.Context values. The context
+// of each accepted message is passed to the message broker publisher, so its
+// wrappers, such as transformers and validators, can use the message details.
+// The message details are also used by the metrics and the session events.
+func NewMessageContext(ctx context.Context, msg *Message) context.Context {
+	return context.WithValue(ctx, messageKey{}, msg)
+}
+
+// MessageFromContext retrieves Message from context.Context.
+// Second value indicates if message is present in the context.
+func MessageFromContext(ctx context.Context) (*Message, bool) {
+	if msg, ok := ctx.Value(messageKey{}).(*Message); ok && msg != nil {
+		return msg, true
+	}
+	return nil, false
+}
+
+// parseMessage parses the topic in the format:
+// channels/<channel_id>/messages/<subtopic>/.../ct/<content_type>
+// The content type may be URL encoded.
+func parseMessage(topic string) (*Message, error) {
+	channelParts := channelRegExp.FindStringSubmatch(topic)
+	if len(channelParts) < 2 {
+		return nil, ErrMalformedTopic
+	}
+
+	msg := &Message{
+		Channel: channelParts[1],
+	}
+
+	subtopic := channelParts[2]
+	if i := strings.LastIndex(subtopic, contentTypeLevel); i >= 0 {
+		ct, err := url.PathUnescape(subtopic[i+len(contentTypeLevel):])
+		if err != nil {
+			return nil, ErrMalformedContentType
+		}
+		if msg.ContentType, _, err = mime.ParseMediaType(ct); err != nil {
+			return nil, ErrMalformedContentType
+		}
+		subtopic = subtopic[:i]
+	}
+
+	subtopic, err := parseSubtopic(subtopic)
+	if err != nil {
+		return nil, errors.Wrap(ErrFailedParseSubtopic, err)
+	}
+	msg.Subtopic = subtopic
+
+	return msg, nil
+}
+
+// countMessage counts the message of the context by its content type.
+func countMessage(ctx context.Context) {
+	msg, ok := MessageFromContext(ctx)
+	if !ok {
+		return
+	}
+	ct := msg.ContentType
+	if ct == "" {
+		ct = noContentType
+	}
+	messageMetrics.Add(ct, 1)
+}
+
+func (h *handler) checkContentType(msg *Message) error {
+	allowed, ok := h.contentTypes[msg.Channel]
+	if !ok {
+		allowed, ok = h.contentTypes[AnyChannel]
+	}
+	if !ok {
+		return nil
+	}
+	for _, ct := range allowed {
+		if ct == msg.ContentType {
+			return nil
+		}
+	}
+
+	return ErrContentTypeNotAllowed
+}
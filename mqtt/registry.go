@@ -0,0 +1,435 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package mqtt
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/absmach/aproxy/internal/proxy"
+	"github.com/mainflux/mainflux/pkg/errors"
+	"github.com/mainflux/mproxy/pkg/session"
+)
+
+// Session policies applied to the new session which conflicts with the existing ones.
+const (
+	// PolicyAllow keeps both the new and the existing sessions.
+	PolicyAllow = "allow"
+	// PolicyReject rejects the new session.
+	PolicyReject = "reject"
+	// PolicyTakeover disconnects the existing session in favor of the new one.
+	PolicyTakeover = "takeover"
+)
+
+var (
+	// ErrThingSessionLimit indicates that the thing has reached the maximum number of sessions.
+	ErrThingSessionLimit = errors.New("maximum number of sessions of the thing reached")
+
+	// ErrDuplicateClientID indicates that a session with the same client ID already exists.
+	ErrDuplicateClientID = errors.New("session with the same client_id already exists")
+
+	// ErrInvalidPolicy indicates unknown session policy.
+	ErrInvalidPolicy = errors.New("invalid session policy")
+)
+
+// RegistryConfig contains session registry policies.
+type RegistryConfig struct {
+	// MaxThingSessions is the maximum number of sessions per thing.
+	// Zero means that the number of sessions is not limited.
+	MaxThingSessions int
+
+	// ThingPolicy is applied when the thing reaches the maximum number of
+	// sessions. It's either PolicyReject or PolicyTakeover, in which case the
+	// oldest session of the thing is disconnected.
+	ThingPolicy string
+
+	// ClientIDPolicy is applied when a session with the same client ID
+	// already exists. It's PolicyAllow, PolicyReject or PolicyTakeover.
+	ClientIDPolicy string
+}
+
+// SessionInfo contains the details of a live session.
+type SessionInfo struct {
+	ClientID    string    `json:"client_id"`
+	ThingID     string    `json:"thing_id"`
+	Tenant      string    `json:"tenant,omitempty"`
+	Listener    string    `json:"listener"`
+	RemoteAddr  string    `json:"remote_addr"`
+	ConnectedAt time.Time `json:"connected_at"`
+
+	// ExpiresAt is the time the session is closed at, if its age is limited.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	// Age is the time the session is connected for. It's set only in
+	// the session listing.
+	Age string `json:"age,omitempty"`
+}
+
+// SessionStats contains live session counts.
+type SessionStats struct {
+	Total  int `json:"total"`
+	Things int `json:"things"`
+}
+
+type entry struct {
+	info   SessionInfo
+	secret string
+	client *proxy.Client
+	expiry *time.Timer
+
+	// certKeys are the denylist keys of the client certificate.
+	certKeys []string
+
+	// subscriptions map the topic filters the session is subscribed to to
+	// the channel IDs, and publications map the channel IDs the session
+	// published to to the time of the last message.
+	subscriptions map[string]string
+	publications  map[string]time.Time
+}
+
+// close closes the client connection, which ends the session.
+func (e entry) close() error {
+	if e.client == nil {
+		return nil
+	}
+	return e.client.Close()
+}
+
+// disconnect gracefully closes the client connection, which ends the session.
+func (e entry) disconnect() error {
+	if e.client == nil {
+		return nil
+	}
+	return e.client.Disconnect()
+}
+
+// stop stops the timer which closes the session at the maximum age.
+func (e entry) stop() {
+	if e.expiry != nil {
+		e.expiry.Stop()
+	}
+}
+
+// unsubscribe unsubscribes the client from the topic filters at the MQTT broker.
+func (e entry) unsubscribe(topics []string) error {
+	if e.client == nil {
+		return proxy.ErrNotProxied
+	}
+	return e.client.Unsubscribe(topics)
+}
+
+type index map[string]map[*session.Session]struct{}
+
+func (idx index) add(key string, s *session.Session) {
+	if idx[key] == nil {
+		idx[key] = make(map[*session.Session]struct{})
+	}
+	idx[key][s] = struct{}{}
+}
+
+func (idx index) remove(key string, s *session.Session) {
+	if ss := idx[key]; ss != nil {
+		delete(ss, s)
+		if len(ss) == 0 {
+			delete(idx, key)
+		}
+	}
+}
+
+// uses checks if the session subscribed or recently published to the channel.
+func (e entry) uses(chanID string) bool {
+	if _, ok := e.publications[chanID]; ok {
+		return true
+	}
+	for _, id := range e.subscriptions {
+		if id == chanID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Registry tracks live authenticated sessions by client ID, thing ID and
+// the IDs of the channels the sessions subscribed or recently published to.
+type Registry struct {
+	cfg      RegistryConfig
+	mu       sync.RWMutex
+	sessions map[*session.Session]entry
+	things   index
+	clients  index
+	channels index
+}
+
+// NewRegistry returns a new session registry.
+func NewRegistry(cfg RegistryConfig) (*Registry, error) {
+	if cfg.ThingPolicy == "" {
+		cfg.ThingPolicy = PolicyReject
+	}
+	if cfg.ClientIDPolicy == "" {
+		cfg.ClientIDPolicy = PolicyAllow
+	}
+	if cfg.ThingPolicy != PolicyReject && cfg.ThingPolicy != PolicyTakeover {
+		return nil, errors.Wrap(ErrInvalidPolicy, errors.New(cfg.ThingPolicy))
+	}
+	switch cfg.ClientIDPolicy {
+	case PolicyAllow, PolicyReject, PolicyTakeover:
+	default:
+		return nil, errors.Wrap(ErrInvalidPolicy, errors.New(cfg.ClientIDPolicy))
+	}
+
+	return &Registry{
+		cfg:      cfg,
+		sessions: make(map[*session.Session]entry),
+		things:   make(index),
+		clients:  make(index),
+		channels: make(index),
+	}, nil
+}
+
+// Stats returns current session counts.
+func (r *Registry) Stats() SessionStats {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return SessionStats{
+		Total:  len(r.sessions),
+		Things: len(r.things),
+	}
+}
+
+// Sessions returns the details of the live sessions, ordered by connection time.
+func (r *Registry) Sessions() []SessionInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	now := time.Now()
+	infos := make([]SessionInfo, 0, len(r.sessions))
+	for _, e := range r.sessions {
+		info := e.info
+		info.Age = now.Sub(info.ConnectedAt).Round(time.Second).String()
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ConnectedAt.Before(infos[j].ConnectedAt)
+	})
+
+	return infos
+}
+
+// add registers the session, applying the registry policies. It returns
+// the sessions taken over by the new one, which are removed from the registry
+// and need to be closed by the caller.
+func (r *Registry) add(s *session.Session, e entry) ([]entry, error) {
+	info := e.info
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.removeLocked(s)
+
+	kicked := make(map[*session.Session]struct{})
+	if dups := r.clients[info.ClientID]; len(dups) > 0 {
+		switch r.cfg.ClientIDPolicy {
+		case PolicyReject:
+			return nil, ErrDuplicateClientID
+		case PolicyTakeover:
+			for d := range dups {
+				kicked[d] = struct{}{}
+			}
+		}
+	}
+
+	if r.cfg.MaxThingSessions > 0 {
+		var remaining []*session.Session
+		for ts := range r.things[info.ThingID] {
+			if _, ok := kicked[ts]; !ok {
+				remaining = append(remaining, ts)
+			}
+		}
+		if excess := len(remaining) - r.cfg.MaxThingSessions + 1; excess > 0 {
+			if r.cfg.ThingPolicy == PolicyReject {
+				return nil, ErrThingSessionLimit
+			}
+			sort.Slice(remaining, func(i, j int) bool {
+				return r.sessions[remaining[i]].info.ConnectedAt.Before(r.sessions[remaining[j]].info.ConnectedAt)
+			})
+			for _, ts := range remaining[:excess] {
+				kicked[ts] = struct{}{}
+			}
+		}
+	}
+
+	var taken []entry
+	for k := range kicked {
+		taken = append(taken, r.sessions[k])
+		r.removeLocked(k)
+	}
+
+	r.sessions[s] = e
+	r.things.add(info.ThingID, s)
+	r.clients.add(info.ClientID, s)
+
+	return taken, nil
+}
+
+// Info returns the details of the live session.
+func (r *Registry) Info(s *session.Session) (SessionInfo, bool) {
+	e, ok := r.lookup(s)
+	return e.info, ok
+}
+
+func (r *Registry) lookup(s *session.Session) (entry, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	e, ok := r.sessions[s]
+	return e, ok
+}
+
+// subscribe records the subscriptions of the session.
+func (r *Registry) subscribe(s *session.Session, topics, channels []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, ok := r.sessions[s]
+	if !ok {
+		return
+	}
+	for i, topic := range topics {
+		e.subscriptions[topic] = channels[i]
+		if channels[i] != "" {
+			r.channels.add(channels[i], s)
+		}
+	}
+}
+
+// unsubscribe removes the subscriptions of the session.
+func (r *Registry) unsubscribe(s *session.Session, topics []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, ok := r.sessions[s]
+	if !ok {
+		return
+	}
+	for _, topic := range topics {
+		chanID, ok := e.subscriptions[topic]
+		if !ok {
+			continue
+		}
+		delete(e.subscriptions, topic)
+		if !e.uses(chanID) {
+			r.channels.remove(chanID, s)
+		}
+	}
+}
+
+// published records the time the session published to the channel.
+func (r *Registry) published(s *session.Session, chanID string, t time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if e, ok := r.sessions[s]; ok {
+		e.publications[chanID] = t
+		r.channels.add(chanID, s)
+	}
+}
+
+// live returns the copies of the live sessions, with the channels they
+// published to since the given time. Older publications are forgotten.
+func (r *Registry) live(since time.Time) map[*session.Session]entry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	live := make(map[*session.Session]entry, len(r.sessions))
+	for s, e := range r.sessions {
+		c := e
+		c.subscriptions = make(map[string]string, len(e.subscriptions))
+		for topic, chanID := range e.subscriptions {
+			c.subscriptions[topic] = chanID
+		}
+		c.publications = make(map[string]time.Time, len(e.publications))
+		for chanID, t := range e.publications {
+			if t.Before(since) {
+				delete(e.publications, chanID)
+				if !e.uses(chanID) {
+					r.channels.remove(chanID, s)
+				}
+				continue
+			}
+			c.publications[chanID] = t
+		}
+		live[s] = c
+	}
+
+	return live
+}
+
+// matching returns the live sessions of the thing which use the channel. If
+// the thing ID is empty, the sessions of any thing which use the channel are
+// returned, and if the channel ID is empty, all the sessions of the thing.
+func (r *Registry) matching(thingID, chanID string) []entry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	idx, key := r.things, thingID
+	if thingID == "" {
+		idx, key = r.channels, chanID
+	}
+	var entries []entry
+	for s := range idx[key] {
+		e := r.sessions[s]
+		if (thingID == "" || e.info.ThingID == thingID) && (chanID == "" || e.uses(chanID)) {
+			entries = append(entries, e)
+		}
+	}
+
+	return entries
+}
+
+// certified returns the live sessions of the clients which presented the
+// certificate with the denylist key.
+func (r *Registry) certified(key string) []entry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var entries []entry
+	for _, e := range r.sessions {
+		for _, k := range e.certKeys {
+			if k == key {
+				entries = append(entries, e)
+				break
+			}
+		}
+	}
+
+	return entries
+}
+
+func (r *Registry) remove(s *session.Session) (entry, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.removeLocked(s)
+}
+
+func (r *Registry) removeLocked(s *session.Session) (entry, bool) {
+	e, ok := r.sessions[s]
+	if !ok {
+		return entry{}, false
+	}
+	delete(r.sessions, s)
+	e.stop()
+	r.things.remove(e.info.ThingID, s)
+	r.clients.remove(e.info.ClientID, s)
+	for _, chanID := range e.subscriptions {
+		r.channels.remove(chanID, s)
+	}
+	for chanID := range e.publications {
+		r.channels.remove(chanID, s)
+	}
+
+	return e, true
+}
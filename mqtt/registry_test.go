@@ -0,0 +1,328 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package mqtt
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mainflux/mainflux/pkg/errors"
+	"github.com/mainflux/mproxy/pkg/session"
+)
+
+const (
+	thing      = "thing"
+	otherThing = "other-thing"
+)
+
+var connectedAt = time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// conn is a session to register, connected n seconds after connectedAt.
+type conn struct {
+	clientID string
+	thingID  string
+	n        int
+}
+
+func (c conn) entry() entry {
+	return entry{
+		info: SessionInfo{
+			ClientID:    c.clientID,
+			ThingID:     c.thingID,
+			ConnectedAt: connectedAt.Add(time.Duration(c.n) * time.Second),
+		},
+	}
+}
+
+func TestNewRegistry(t *testing.T) {
+	cases := []struct {
+		desc string
+		cfg  RegistryConfig
+		err  error
+	}{
+		{
+			desc: "default policies",
+			cfg:  RegistryConfig{},
+		},
+		{
+			desc: "takeover policies",
+			cfg:  RegistryConfig{ThingPolicy: PolicyTakeover, ClientIDPolicy: PolicyTakeover},
+		},
+		{
+			desc: "allow thing policy",
+			cfg:  RegistryConfig{ThingPolicy: PolicyAllow},
+			err:  ErrInvalidPolicy,
+		},
+		{
+			desc: "unknown client ID policy",
+			cfg:  RegistryConfig{ClientIDPolicy: "drop"},
+			err:  ErrInvalidPolicy,
+		},
+	}
+
+	for _, tc := range cases {
+		_, err := NewRegistry(tc.cfg)
+		if !errors.Contains(err, tc.err) || (err == nil) != (tc.err == nil) {
+			t.Errorf("%s: expected error %v got %v", tc.desc, tc.err, err)
+		}
+	}
+}
+
+func TestRegistryAdd(t *testing.T) {
+	cases := []struct {
+		desc  string
+		cfg   RegistryConfig
+		conns []conn
+		// taken are the indexes of the sessions taken over by the last one.
+		taken []int
+		err   error
+	}{
+		{
+			desc:  "sessions of the thing within the maximum",
+			cfg:   RegistryConfig{MaxThingSessions: 2},
+			conns: []conn{{"c1", thing, 0}, {"c2", thing, 1}},
+		},
+		{
+			desc:  "reject session of the thing over the maximum",
+			cfg:   RegistryConfig{MaxThingSessions: 2, ThingPolicy: PolicyReject},
+			conns: []conn{{"c1", thing, 0}, {"c2", thing, 1}, {"c3", thing, 2}},
+			err:   ErrThingSessionLimit,
+		},
+		{
+			desc:  "session of other thing at the maximum",
+			cfg:   RegistryConfig{MaxThingSessions: 2, ThingPolicy: PolicyReject},
+			conns: []conn{{"c1", thing, 0}, {"c2", thing, 1}, {"c3", otherThing, 2}},
+		},
+		{
+			desc:  "take over the oldest session of the thing over the maximum",
+			cfg:   RegistryConfig{MaxThingSessions: 2, ThingPolicy: PolicyTakeover},
+			conns: []conn{{"c1", thing, 1}, {"c2", thing, 0}, {"c3", thing, 2}},
+			taken: []int{1},
+		},
+		{
+			desc:  "allow duplicate client ID",
+			cfg:   RegistryConfig{ClientIDPolicy: PolicyAllow},
+			conns: []conn{{"c1", thing, 0}, {"c1", otherThing, 1}},
+		},
+		{
+			desc:  "reject duplicate client ID",
+			cfg:   RegistryConfig{ClientIDPolicy: PolicyReject},
+			conns: []conn{{"c1", thing, 0}, {"c1", otherThing, 1}},
+			err:   ErrDuplicateClientID,
+		},
+		{
+			desc:  "take over duplicate client ID",
+			cfg:   RegistryConfig{ClientIDPolicy: PolicyTakeover},
+			conns: []conn{{"c1", thing, 0}, {"c2", thing, 1}, {"c1", otherThing, 2}},
+			taken: []int{0},
+		},
+		{
+			desc:  "reject duplicate client ID before the maximum takes over",
+			cfg:   RegistryConfig{MaxThingSessions: 1, ThingPolicy: PolicyTakeover, ClientIDPolicy: PolicyReject},
+			conns: []conn{{"c1", thing, 0}, {"c1", thing, 1}},
+			err:   ErrDuplicateClientID,
+		},
+		{
+			desc:  "taken over duplicate client ID counts towards the maximum",
+			cfg:   RegistryConfig{MaxThingSessions: 2, ThingPolicy: PolicyReject, ClientIDPolicy: PolicyTakeover},
+			conns: []conn{{"c1", thing, 0}, {"c2", thing, 1}, {"c1", thing, 2}},
+			taken: []int{0},
+		},
+		{
+			desc:  "take over both duplicate client ID and the oldest session",
+			cfg:   RegistryConfig{MaxThingSessions: 2, ThingPolicy: PolicyTakeover, ClientIDPolicy: PolicyTakeover},
+			conns: []conn{{"c1", otherThing, 0}, {"c2", thing, 1}, {"c3", thing, 2}, {"c1", thing, 3}},
+			taken: []int{0, 1},
+		},
+	}
+
+	for _, tc := range cases {
+		r, err := NewRegistry(tc.cfg)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", tc.desc, err)
+		}
+		sessions := make([]*session.Session, len(tc.conns))
+		for i, c := range tc.conns[:len(tc.conns)-1] {
+			sessions[i] = &session.Session{ID: c.clientID}
+			if _, err := r.add(sessions[i], c.entry()); err != nil {
+				t.Fatalf("%s: unexpected error %v adding session %d", tc.desc, err, i)
+			}
+		}
+
+		last := tc.conns[len(tc.conns)-1]
+		sessions[len(sessions)-1] = &session.Session{ID: last.clientID}
+		taken, err := r.add(sessions[len(sessions)-1], last.entry())
+		if !errors.Contains(err, tc.err) || (err == nil) != (tc.err == nil) {
+			t.Errorf("%s: expected error %v got %v", tc.desc, tc.err, err)
+		}
+
+		want := make(map[SessionInfo]bool)
+		for _, i := range tc.taken {
+			want[tc.conns[i].entry().info] = true
+		}
+		if len(taken) != len(want) {
+			t.Errorf("%s: expected %d sessions taken over got %d", tc.desc, len(want), len(taken))
+		}
+		for _, e := range taken {
+			if !want[e.info] {
+				t.Errorf("%s: unexpected session %+v taken over", tc.desc, e.info)
+			}
+		}
+
+		// The taken over sessions are removed, and the rejected one isn't added.
+		for i, s := range sessions {
+			_, ok := r.lookup(s)
+			expected := !want[tc.conns[i].entry().info] && (tc.err == nil || i < len(sessions)-1)
+			if ok != expected {
+				t.Errorf("%s: expected session %d registered %t got %t", tc.desc, i, expected, ok)
+			}
+		}
+	}
+}
+
+func TestRegistryReAdd(t *testing.T) {
+	r, err := NewRegistry(RegistryConfig{MaxThingSessions: 1, ClientIDPolicy: PolicyReject})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	s := &session.Session{ID: "c1"}
+	c := conn{"c1", thing, 0}
+	if _, err := r.add(s, c.entry()); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// The session doesn't conflict with itself.
+	c.n = 1
+	if _, err := r.add(s, c.entry()); err != nil {
+		t.Errorf("expected no error got %v", err)
+	}
+	if stats := r.Stats(); stats.Total != 1 || stats.Things != 1 {
+		t.Errorf("expected 1 session of 1 thing got %+v", stats)
+	}
+
+	if _, ok := r.remove(s); !ok {
+		t.Errorf("expected session removed")
+	}
+	if _, ok := r.remove(s); ok {
+		t.Errorf("expected session removed only once")
+	}
+	if stats := r.Stats(); stats.Total != 0 || stats.Things != 0 {
+		t.Errorf("expected no sessions got %+v", stats)
+	}
+	if len(r.things) != 0 || len(r.clients) != 0 {
+		t.Errorf("expected empty indexes got things %v and clients %v", r.things, r.clients)
+	}
+}
+
+func TestRegistryLive(t *testing.T) {
+	const (
+		subscribed = "subscribed-channel"
+		stale      = "stale-channel"
+		recent     = "recent-channel"
+	)
+	r, err := NewRegistry(RegistryConfig{})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	s := &session.Session{ID: "c1"}
+	e := conn{"c1", thing, 0}.entry()
+	e.subscriptions = make(map[string]string)
+	e.publications = make(map[string]time.Time)
+	if _, err := r.add(s, e); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	r.subscribe(s, []string{"channels/" + subscribed + "/messages"}, []string{subscribed})
+	r.published(s, subscribed, connectedAt)
+	r.published(s, stale, connectedAt)
+	r.published(s, recent, connectedAt.Add(time.Minute))
+
+	live := r.live(connectedAt.Add(time.Second))[s]
+	if len(live.publications) != 1 || !live.publications[recent].Equal(connectedAt.Add(time.Minute)) {
+		t.Errorf("expected only publication to %s got %v", recent, live.publications)
+	}
+	if len(live.subscriptions) != 1 || live.subscriptions["channels/"+subscribed+"/messages"] != subscribed {
+		t.Errorf("expected subscription to %s got %v", subscribed, live.subscriptions)
+	}
+
+	// The stale publications are forgotten, but the channels still used by
+	// the session keep matching it.
+	cases := []struct {
+		chanID  string
+		matches int
+	}{
+		{chanID: subscribed, matches: 1},
+		{chanID: stale},
+		{chanID: recent, matches: 1},
+	}
+	for _, tc := range cases {
+		if n := len(r.matching("", tc.chanID)); n != tc.matches {
+			t.Errorf("%s: expected %d matching sessions got %d", tc.chanID, tc.matches, n)
+		}
+	}
+	if live := r.live(connectedAt)[s]; len(live.publications) != 1 {
+		t.Errorf("expected stale publications to stay forgotten got %v", live.publications)
+	}
+}
+
+func TestRegistryConcurrent(t *testing.T) {
+	const (
+		workers  = 8
+		sessions = 100
+		maxThing = 3
+	)
+	r, err := NewRegistry(RegistryConfig{MaxThingSessions: maxThing, ThingPolicy: PolicyTakeover, ClientIDPolicy: PolicyTakeover})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var exceeded int
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < sessions; i++ {
+				s := &session.Session{ID: fmt.Sprintf("c%d", i%10)}
+				c := conn{s.ID, fmt.Sprintf("thing-%d", i%2), w*sessions + i}
+				if _, err := r.add(s, c.entry()); err != nil {
+					t.Errorf("unexpected error %v", err)
+					return
+				}
+				if n := len(r.matching(c.thingID, "")); n > maxThing {
+					mu.Lock()
+					exceeded = n
+					mu.Unlock()
+				}
+				if i%3 == 0 {
+					r.remove(s)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if exceeded > 0 {
+		t.Errorf("expected at most %d sessions per thing got %d", maxThing, exceeded)
+	}
+	// Each client ID has at most one session, and each thing at most maxThing.
+	stats := r.Stats()
+	if stats.Total > 2*maxThing || stats.Things > 2 {
+		t.Errorf("expected at most %d sessions of 2 things got %+v", 2*maxThing, stats)
+	}
+	for id, ss := range r.clients {
+		if len(ss) > 1 {
+			t.Errorf("expected 1 session with client ID %s got %d", id, len(ss))
+		}
+	}
+
+	for s := range r.sessions {
+		r.remove(s)
+	}
+	if len(r.sessions) != 0 || len(r.things) != 0 || len(r.clients) != 0 {
+		t.Errorf("expected empty registry got %d sessions, things %v and clients %v", len(r.sessions), r.things, r.clients)
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/absmach/aproxy/internal/proxy"
+	"github.com/mainflux/mainflux/pkg/errors"
+	"github.com/mainflux/mainflux/things/policies"
+	"github.com/mainflux/mproxy/pkg/session"
+	"golang.org/x/sync/errgroup"
+)
+
+// Run implements Handler.
+func (h *handler) Run(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		return nil
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			h.revalidate(ctx, time.Now().Add(-interval))
+		}
+	}
+}
+
+// revalidate re-authenticates the things of the live sessions, and
+// re-authorizes their subscriptions and the channels they published to
+// since the given time. The sessions of the things which fail to
+// authenticate or lost access to the channels they published to are closed,
+// and the subscriptions to the channels the things lost access to are
+// removed. If the things' access can't be checked, such as when Things
+// service is unavailable, the sessions are kept.
+func (h *handler) revalidate(ctx context.Context, since time.Time) {
+	var g errgroup.Group
+	g.SetLimit(h.authParallelism)
+	for s, e := range h.sessions.live(since) {
+		s, e := s, e
+		g.Go(func() error {
+			h.revalidateSession(ctx, s, e)
+			return nil
+		})
+	}
+	_ = g.Wait()
+}
+
+func (h *handler) revalidateSession(ctx context.Context, s *session.Session, e entry) {
+	if e.client != nil {
+		ctx = proxy.NewContext(ctx, e.client)
+	}
+
+	res, err := h.authService(ctx).Identify(ctx, &policies.IdentifyReq{Secret: e.secret})
+	if err == nil && res.GetId() != e.info.ThingID {
+		err = errors.ErrAuthentication
+	}
+	if err != nil {
+		h.check(ctx, e, err, "authentication failed")
+		return
+	}
+
+	for chanID := range e.publications {
+		if err := h.authorize(ctx, e.secret, chanID, policies.WriteAction); err != nil {
+			h.check(ctx, e, err, "publish access to channel "+chanID+" revoked")
+			return
+		}
+	}
+
+	denied := make(map[string]error)
+	var topics []string
+	for topic, chanID := range e.subscriptions {
+		if chanID == "" {
+			continue
+		}
+		err, ok := denied[chanID]
+		if !ok {
+			err = h.authorize(ctx, e.secret, chanID, policies.ReadAction)
+			denied[chanID] = err
+		}
+		if isAccessLoss(err) {
+			topics = append(topics, topic)
+			continue
+		}
+		if err != nil {
+			h.logger.Warn(fmt.Sprintf(LogWarnRevalidation, e.info.ClientID, err))
+		}
+	}
+	if len(topics) == 0 {
+		return
+	}
+
+	sort.Strings(topics)
+	reason := "subscribe access revoked"
+	if err := e.unsubscribe(topics); err != nil {
+		h.revoke(ctx, e, fmt.Sprintf("%s, failed to unsubscribe: %s", reason, err))
+		return
+	}
+	h.sessions.unsubscribe(s, topics)
+	h.logger.Warn(fmt.Sprintf(LogWarnUnsubscribed, e.info.ClientID, strings.Join(topics, ","), reason))
+	h.publishEvent(ctx, EventUnsubscribed, e.info, fmt.Sprintf("%s to topics %s", reason, strings.Join(topics, ",")))
+}
+
+// check closes the session if the error means that the thing lost access,
+// and keeps it otherwise.
+func (h *handler) check(ctx context.Context, e entry, err error, reason string) {
+	if !isAccessLoss(err) {
+		h.logger.Warn(fmt.Sprintf(LogWarnRevalidation, e.info.ClientID, err))
+		return
+	}
+	h.revoke(ctx, e, reason)
+}
+
+// revoke closes the session. The session is removed from the registry once
+// the connection is closed.
+func (h *handler) revoke(ctx context.Context, e entry, reason string) {
+	h.logger.Warn(fmt.Sprintf(LogWarnRevoked, e.info.ThingID, e.info.ClientID, reason))
+	h.publishEvent(ctx, EventRevoked, e.info, reason)
+	if err := e.close(); err != nil {
+		h.logger.Warn(fmt.Sprintf(LogWarnFailedClose, e.info.ClientID, err))
+	}
+}
+
+// isAccessLoss checks if the error means that the thing is not authenticated
+// or not authorized, rather than that the access can't be checked.
+func isAccessLoss(err error) bool {
+	return err != nil && (errors.Contains(err, errors.ErrAuthorization) || isAuthFailure(err))
+}
@@ -0,0 +1,373 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package mqtt_test
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/absmach/aproxy/auth"
+	"github.com/absmach/aproxy/auth/mocks"
+	"github.com/absmach/aproxy/internal/proxy"
+	"github.com/absmach/aproxy/internal/upstream"
+	"github.com/absmach/aproxy/mqtt"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/gorilla/websocket"
+	mflog "github.com/mainflux/mainflux/logger"
+	"github.com/mainflux/mainflux/things/policies"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const waitTimeout = 5 * time.Second
+
+var (
+	chanTopic  = "channels/" + chanID + "/messages"
+	thirdTopic = "channels/" + thirdChanID + "/messages"
+)
+
+// things is the auth service the access of the things is changed in while
+// the sessions are live.
+type things struct {
+	mu         sync.Mutex
+	svc        auth.AuthServiceClient
+	err        error
+	identified int
+}
+
+func newThings() *things {
+	return &things{svc: newAuthService()}
+}
+
+// set replaces the things' secrets and the channels they are connected to.
+func (ts *things) set(secrets, channels map[string]string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.svc = mocks.NewAuthService(secrets, channels)
+	ts.identified = 0
+}
+
+// fail makes the calls fail with the error, such as when Things service is
+// unavailable.
+func (ts *things) fail(err error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.err = err
+	ts.identified = 0
+}
+
+// identifications returns the number of Identify calls since the last change.
+func (ts *things) identifications() int {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.identified
+}
+
+func (ts *things) Identify(ctx context.Context, req *policies.IdentifyReq) (*policies.IdentifyRes, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.identified++
+	if ts.err != nil {
+		return nil, ts.err
+	}
+	return ts.svc.Identify(ctx, req)
+}
+
+func (ts *things) Authorize(ctx context.Context, req *policies.AuthorizeReq) (*policies.AuthorizeRes, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.err != nil {
+		return nil, ts.err
+	}
+	return ts.svc.Authorize(ctx, req)
+}
+
+// broker is the MQTT broker the sessions are proxied to.
+type broker struct {
+	conns chan net.Conn
+}
+
+func (b broker) Dial(ctx context.Context, _ upstream.Dialer) (net.Conn, error) {
+	client, server := net.Pipe()
+	b.conns <- server
+	return client, nil
+}
+
+// wsSession is a session proxied over WS between the client and the broker.
+type wsSession struct {
+	t      *testing.T
+	client *websocket.Conn
+	broker net.Conn
+}
+
+// connect connects the thing to the broker through the WS proxy serving
+// the handler.
+func connect(t *testing.T, h mqtt.Handler, id, secret string) wsSession {
+	b := broker{conns: make(chan net.Conn, 1)}
+	p := proxy.NewWebSocket(proxy.Config{Upstreams: b}, "/mqtt", "ws", h, mflog.NewMock())
+	srv := httptest.NewServer(p.Handler())
+	t.Cleanup(srv.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("failed to dial proxy: %s", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connect.ProtocolName = "MQTT"
+	connect.ProtocolVersion = 4
+	connect.ClientIdentifier = "client"
+	connect.UsernameFlag = true
+	connect.Username = id
+	connect.PasswordFlag = true
+	connect.Password = []byte(secret)
+	s := wsSession{t: t, client: client}
+	s.write(connect)
+
+	select {
+	case s.broker = <-b.conns:
+		t.Cleanup(func() { s.broker.Close() })
+	case <-time.After(waitTimeout):
+		t.Fatalf("broker not dialed")
+	}
+	s.expect(packets.Connect)
+
+	return s
+}
+
+func (s wsSession) write(pkt packets.ControlPacket) {
+	var buf bytes.Buffer
+	if err := pkt.Write(&buf); err != nil {
+		s.t.Fatalf("failed to encode packet: %s", err)
+	}
+	if err := s.client.WriteMessage(websocket.BinaryMessage, buf.Bytes()); err != nil {
+		s.t.Fatalf("failed to send packet: %s", err)
+	}
+}
+
+// expect returns the next packet received by the broker, which must be of
+// the type.
+func (s wsSession) expect(typ byte) packets.ControlPacket {
+	s.broker.SetReadDeadline(time.Now().Add(waitTimeout))
+	pkt, err := packets.ReadPacket(s.broker)
+	if err != nil {
+		s.t.Fatalf("failed to read %s at broker: %s", packets.PacketNames[typ], err)
+	}
+	var buf bytes.Buffer
+	if err := pkt.Write(&buf); err != nil || buf.Bytes()[0]>>4 != typ {
+		s.t.Fatalf("expected %s at broker got %s", packets.PacketNames[typ], pkt)
+	}
+
+	return pkt
+}
+
+// subscribe subscribes to the topics, and waits until the subscription
+// is recorded.
+func (s wsSession) subscribe(topics ...string) {
+	sub := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	sub.MessageID = 1
+	sub.Topics = topics
+	sub.Qoss = make([]byte, len(topics))
+	s.write(sub)
+	s.expect(packets.Subscribe)
+	s.sync()
+}
+
+// publish publishes to the topic, and waits until the message is recorded.
+func (s wsSession) publish(topic string) {
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = topic
+	pub.Payload = []byte("payload")
+	s.write(pub)
+	s.expect(packets.Publish)
+	s.sync()
+}
+
+// sync sends PINGREQ. Once the broker receives it, the packets sent before
+// are handled.
+func (s wsSession) sync() {
+	s.write(packets.NewControlPacket(packets.Pingreq))
+	s.expect(packets.Pingreq)
+}
+
+// closed checks if the client connection is closed by the proxy.
+func (s wsSession) closed() bool {
+	s.client.SetReadDeadline(time.Now().Add(waitTimeout))
+	_, _, err := s.client.ReadMessage()
+	return err != nil && !isTimeout(err)
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// waitEvent waits for the event of the type to be published.
+func waitEvent(t *testing.T, evs *events, typ string) (mqtt.Event, bool) {
+	deadline := time.Now().Add(waitTimeout)
+	for time.Now().Before(deadline) {
+		for _, e := range evs.all() {
+			if e.Type == typ {
+				return e, true
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	return mqtt.Event{}, false
+}
+
+func TestRevalidate(t *testing.T) {
+	const interval = 20 * time.Millisecond
+	unavailable := status.Error(codes.Unavailable, "things service unavailable")
+
+	cases := []struct {
+		desc         string
+		subscribe    []string
+		publish      string
+		secrets      map[string]string
+		channels     map[string]string
+		err          error
+		event        string
+		reason       string
+		unsubscribed []string
+	}{
+		{
+			desc:      "disconnect thing which fails to authenticate",
+			subscribe: []string{chanTopic},
+			secrets:   map[string]string{},
+			channels:  map[string]string{chanID: thingSecret},
+			event:     mqtt.EventRevoked,
+			reason:    "authentication failed",
+		},
+		{
+			desc:         "unsubscribe from channel the thing can't read",
+			subscribe:    []string{chanTopic, thirdTopic},
+			secrets:      map[string]string{thingSecret: thingID},
+			channels:     map[string]string{chanID: thingSecret},
+			event:        mqtt.EventUnsubscribed,
+			reason:       "subscribe access revoked to topics " + thirdTopic,
+			unsubscribed: []string{thirdTopic},
+		},
+		{
+			desc:      "forget stale publication to channel the thing can't write",
+			subscribe: []string{chanTopic},
+			publish:   thirdTopic,
+			secrets:   map[string]string{thingSecret: thingID},
+			channels:  map[string]string{chanID: thingSecret},
+		},
+		{
+			desc:      "keep session when Things is unavailable",
+			subscribe: []string{chanTopic, thirdTopic},
+			err:       unavailable,
+		},
+	}
+
+	for _, tc := range cases {
+		ts := newThings()
+		evs := &events{}
+		h := newAuthHandler(ts, mqtt.WithEvents(evs))
+		s := connect(t, h, thingID, thingSecret)
+		s.subscribe(tc.subscribe...)
+		if tc.publish != "" {
+			s.publish(tc.publish)
+			// The publication is older than the interval once revalidated.
+			time.Sleep(2 * interval)
+		}
+		if tc.err != nil {
+			ts.fail(tc.err)
+		} else {
+			ts.set(tc.secrets, tc.channels)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			done <- h.Run(ctx, interval)
+		}()
+
+		for _, topic := range tc.unsubscribed {
+			unsub, ok := s.expect(packets.Unsubscribe).(*packets.UnsubscribePacket)
+			if !ok || len(unsub.Topics) != 1 || unsub.Topics[0] != topic {
+				t.Errorf("%s: expected UNSUBSCRIBE from %s got %v", tc.desc, topic, unsub)
+			}
+		}
+
+		if tc.event == "" {
+			// Two revalidations started, so the first one is completed.
+			deadline := time.Now().Add(waitTimeout)
+			for ts.identifications() < 2 && time.Now().Before(deadline) {
+				time.Sleep(5 * time.Millisecond)
+			}
+			if evs := evs.all(); len(evs) != 0 {
+				t.Errorf("%s: expected no events got %+v", tc.desc, evs)
+			}
+		} else {
+			e, ok := waitEvent(t, evs, tc.event)
+			if !ok {
+				t.Errorf("%s: expected %s event got %+v", tc.desc, tc.event, evs.all())
+			}
+			if e.Reason != tc.reason || e.ThingID != thingID {
+				t.Errorf("%s: expected event of thing %s with reason %q got %+v", tc.desc, thingID, tc.reason, e)
+			}
+		}
+		if tc.event == mqtt.EventRevoked {
+			if !s.closed() {
+				t.Errorf("%s: expected session to be closed", tc.desc)
+			}
+		} else {
+			// The session is kept.
+			s.sync()
+		}
+
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("%s: expected no error got %v", tc.desc, err)
+		}
+	}
+}
+
+func TestRevalidatePublication(t *testing.T) {
+	// The interval is long enough to change the access before the next
+	// revalidation.
+	const interval = 500 * time.Millisecond
+
+	ts := newThings()
+	evs := &events{}
+	h := newAuthHandler(ts, mqtt.WithEvents(evs))
+	s := connect(t, h, thingID, thingSecret)
+	secrets := map[string]string{thingSecret: thingID}
+	ts.set(secrets, map[string]string{chanID: thingSecret, thirdChanID: thingSecret})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.Run(ctx, interval)
+
+	// The publication is recent once it's published after the first
+	// revalidation.
+	deadline := time.Now().Add(waitTimeout)
+	for ts.identifications() < 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	s.publish(thirdTopic)
+	ts.set(secrets, map[string]string{chanID: thingSecret})
+
+	e, ok := waitEvent(t, evs, mqtt.EventRevoked)
+	if !ok {
+		t.Fatalf("expected %s event got %+v", mqtt.EventRevoked, evs.all())
+	}
+	if reason := "publish access to channel " + thirdChanID + " revoked"; e.Reason != reason {
+		t.Errorf("expected reason %q got %q", reason, e.Reason)
+	}
+	if !s.closed() {
+		t.Errorf("expected session to be closed")
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package mqtt
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/absmach/aproxy/internal/revocation"
+	"github.com/mainflux/mainflux/pkg/errors"
+	"github.com/mainflux/mproxy/pkg/session"
+)
+
+// WithRevocation rejects the clients which present revoked or denied certificates.
+func WithRevocation(checker *revocation.Checker) Option {
+	return func(h *handler) {
+		h.revocation = checker
+	}
+}
+
+// checkCert rejects the client certificate if it's revoked or denied.
+// Clients without certificates are not checked.
+func (h *handler) checkCert(s *session.Session) error {
+	if h.revocation == nil || len(s.Cert.Raw) == 0 {
+		return nil
+	}
+	if err := h.revocation.Check(&s.Cert); err != nil {
+		h.logger.Warn(fmt.Sprintf(LogWarnCertRejected, s.ID, s.Cert.SerialNumber.Text(16), err))
+		return errors.Wrap(errors.ErrAuthorization, err)
+	}
+
+	return nil
+}
+
+// RevokeCert implements Handler.
+func (h *handler) RevokeCert(ctx context.Context, key, reason string) int {
+	entries := h.sessions.certified(key)
+	for _, e := range entries {
+		h.revoke(ctx, e, reason)
+	}
+
+	return len(entries)
+}
@@ -0,0 +1,87 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package mqtt_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/absmach/aproxy/internal/revocation"
+	"github.com/absmach/aproxy/mqtt"
+	"github.com/mainflux/mproxy/pkg/session"
+)
+
+func newCert(t *testing.T, serial int64) x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: thingID},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %s", err)
+	}
+
+	return *cert
+}
+
+func TestRevokeCert(t *testing.T) {
+	h := newHandler().(mqtt.Handler)
+	cert := newCert(t, 0x1a2b)
+	keys := revocation.Keys(&cert)
+
+	// Two sessions present the certificate, and one presents none.
+	for _, s := range []*session.Session{
+		{ID: "client-1", Username: thingID, Password: []byte(thingSecret), Cert: cert},
+		{ID: "client-2", Username: thingID, Password: []byte(thingSecret), Cert: cert},
+		{ID: "client-3", Username: thingID, Password: []byte(thingSecret)},
+	} {
+		if err := h.AuthConnect(session.NewContext(context.Background(), s)); err != nil {
+			t.Fatalf("%s: unexpected error %v", s.ID, err)
+		}
+	}
+
+	cases := []struct {
+		desc   string
+		key    string
+		closed int
+	}{
+		{
+			desc:   "serial number of the certificate",
+			key:    keys[0],
+			closed: 2,
+		},
+		{
+			desc:   "fingerprint of the certificate",
+			key:    keys[1],
+			closed: 2,
+		},
+		{
+			desc: "other certificate",
+			key:  revocation.SerialPrefix + "1a2c",
+		},
+	}
+
+	for _, tc := range cases {
+		if closed := h.RevokeCert(context.Background(), tc.key, "certificate denied"); closed != tc.closed {
+			t.Errorf("%s: expected %d sessions closed got %d", tc.desc, tc.closed, closed)
+		}
+	}
+}
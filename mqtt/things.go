@@ -0,0 +1,125 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/absmach/aproxy/auth"
+	"github.com/absmach/aproxy/internal/proxy"
+	"github.com/mainflux/mainflux/logger"
+	"github.com/mainflux/mainflux/pkg/messaging"
+)
+
+// Things event operations which revoke the access of the live sessions.
+const (
+	ThingRemove       = "thing.remove"
+	ThingUpdateSecret = "thing.update_secret"
+	ThingChangeStatus = "thing.change_status"
+	PolicyDelete      = "policy.delete"
+)
+
+const disabledStatus = "disabled"
+
+// LogInfoThingsEvent is the format of the message logged when the Things
+// event revokes the live sessions.
+const LogInfoThingsEvent = "closed %d sessions on %s event of thing %s and channel %s"
+
+// ThingsEvent is the Things change event. Thing events carry the thing ID
+// in ID, and policy events carry the thing ID in Subject and the channel ID
+// in Object.
+type ThingsEvent struct {
+	Operation string `json:"operation"`
+	ID        string `json:"id,omitempty"`
+	Status    string `json:"status,omitempty"`
+	Subject   string `json:"subject,omitempty"`
+	Object    string `json:"object,omitempty"`
+}
+
+var _ messaging.MessageHandler = (*thingsEventHandler)(nil)
+
+type thingsEventHandler struct {
+	handler Handler
+	logger  logger.Logger
+}
+
+// NewThingsEventHandler returns the handler of Things change events, which
+// closes the live sessions of the things as soon as they're removed,
+// disabled, their secrets change or they're disconnected from the channels.
+// The events are JSON encoded in the message payload.
+func NewThingsEventHandler(h Handler, logger logger.Logger) messaging.MessageHandler {
+	return &thingsEventHandler{
+		handler: h,
+		logger:  logger,
+	}
+}
+
+func (teh *thingsEventHandler) Handle(msg *messaging.Message) error {
+	var event ThingsEvent
+	if err := json.Unmarshal(msg.GetPayload(), &event); err != nil {
+		return err
+	}
+
+	var thingID, chanID, reason string
+	switch event.Operation {
+	case ThingRemove:
+		thingID, reason = event.ID, "thing removed"
+	case ThingUpdateSecret:
+		thingID, reason = event.ID, "thing secret changed"
+	case ThingChangeStatus:
+		if event.Status != disabledStatus {
+			return nil
+		}
+		thingID, reason = event.ID, "thing disabled"
+	case PolicyDelete:
+		thingID, chanID, reason = event.Subject, event.Object, "thing disconnected from channel "+event.Object
+	default:
+		return nil
+	}
+	if thingID == "" {
+		return nil
+	}
+
+	if n := teh.handler.Revoke(context.Background(), thingID, chanID, reason); n > 0 {
+		teh.logger.Info(fmt.Sprintf(LogInfoThingsEvent, n, event.Operation, thingID, chanID))
+	}
+
+	return nil
+}
+
+func (teh *thingsEventHandler) Cancel() error {
+	return nil
+}
+
+// Revoke implements Handler.
+func (h *handler) Revoke(ctx context.Context, thingID, chanID, reason string) int {
+	entries := h.sessions.matching(thingID, chanID)
+	for _, e := range entries {
+		h.invalidate(e, chanID)
+		h.revoke(ctx, e, reason)
+	}
+	if thingID == "" {
+		for _, svc := range h.authServices() {
+			if inv, ok := svc.(auth.Invalidator); ok {
+				inv.Invalidate("", chanID)
+			}
+		}
+	}
+
+	return len(entries)
+}
+
+// invalidate invalidates the auth decisions about the session
+// the auth service of its virtual host made.
+func (h *handler) invalidate(e entry, chanID string) {
+	ctx := context.Background()
+	if e.client != nil {
+		ctx = proxy.NewContext(ctx, e.client)
+	}
+	if inv, ok := h.authService(ctx).(auth.Invalidator); ok {
+		inv.Invalidate(e.secret, chanID)
+	}
+}
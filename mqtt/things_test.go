@@ -0,0 +1,165 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package mqtt_test
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/absmach/aproxy/auth"
+	"github.com/absmach/aproxy/mqtt"
+	mflog "github.com/mainflux/mainflux/logger"
+	"github.com/mainflux/mainflux/pkg/messaging"
+)
+
+// invalidation is the call to invalidate the auth decisions.
+type invalidation struct {
+	secret string
+	chanID string
+}
+
+// invalidator is the auth service which records the invalidated decisions.
+type invalidator struct {
+	auth.AuthServiceClient
+	mu    sync.Mutex
+	calls []invalidation
+}
+
+var _ auth.Invalidator = (*invalidator)(nil)
+
+func (inv *invalidator) Invalidate(secret, chanID string) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	inv.calls = append(inv.calls, invalidation{secret: secret, chanID: chanID})
+}
+
+func (inv *invalidator) invalidated() []invalidation {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	return append([]invalidation(nil), inv.calls...)
+}
+
+func TestThingsEventHandler(t *testing.T) {
+	cases := []struct {
+		desc        string
+		payload     string
+		err         bool
+		reason      string
+		invalidated []invalidation
+	}{
+		{
+			desc:        "thing removed",
+			payload:     `{"operation":"thing.remove","id":"` + thingID + `"}`,
+			reason:      "thing removed",
+			invalidated: []invalidation{{secret: thingSecret}},
+		},
+		{
+			desc:        "thing secret changed",
+			payload:     `{"operation":"thing.update_secret","id":"` + thingID + `"}`,
+			reason:      "thing secret changed",
+			invalidated: []invalidation{{secret: thingSecret}},
+		},
+		{
+			desc:        "thing disabled",
+			payload:     `{"operation":"thing.change_status","id":"` + thingID + `","status":"disabled"}`,
+			reason:      "thing disabled",
+			invalidated: []invalidation{{secret: thingSecret}},
+		},
+		{
+			desc:        "thing disconnected from subscribed channel",
+			payload:     `{"operation":"policy.delete","subject":"` + thingID + `","object":"` + chanID + `"}`,
+			reason:      "thing disconnected from channel " + chanID,
+			invalidated: []invalidation{{secret: thingSecret, chanID: chanID}},
+		},
+		{
+			desc:    "thing disconnected from unused channel",
+			payload: `{"operation":"policy.delete","subject":"` + thingID + `","object":"` + otherChanID + `"}`,
+		},
+		{
+			desc:    "thing enabled",
+			payload: `{"operation":"thing.change_status","id":"` + thingID + `","status":"enabled"}`,
+		},
+		{
+			desc:    "other thing removed",
+			payload: `{"operation":"thing.remove","id":"` + sysThingID + `"}`,
+		},
+		{
+			desc:    "thing event without thing ID",
+			payload: `{"operation":"thing.remove"}`,
+		},
+		{
+			desc:    "unknown operation",
+			payload: `{"operation":"thing.update","id":"` + thingID + `"}`,
+		},
+		{
+			desc:    "malformed payload",
+			payload: `{"operation":`,
+			err:     true,
+		},
+	}
+
+	for _, tc := range cases {
+		svc := &invalidator{AuthServiceClient: newAuthService()}
+		evs := &events{}
+		h := newAuthHandler(svc, mqtt.WithEvents(evs))
+		s := connect(t, h, thingID, thingSecret)
+		s.subscribe(chanTopic)
+
+		teh := mqtt.NewThingsEventHandler(h, mflog.NewMock())
+		err := teh.Handle(&messaging.Message{Payload: []byte(tc.payload)})
+		if (err != nil) != tc.err {
+			t.Errorf("%s: expected error %t got %v", tc.desc, tc.err, err)
+		}
+
+		if tc.reason == "" {
+			// The session is kept.
+			s.sync()
+			if evs := evs.all(); len(evs) != 0 {
+				t.Errorf("%s: expected no events got %+v", tc.desc, evs)
+			}
+		} else {
+			e, ok := waitEvent(t, evs, mqtt.EventRevoked)
+			if !ok || e.Reason != tc.reason || e.ThingID != thingID {
+				t.Errorf("%s: expected %s event of thing %s with reason %q got %+v", tc.desc, mqtt.EventRevoked, thingID, tc.reason, evs.all())
+			}
+			if !s.closed() {
+				t.Errorf("%s: expected session to be closed", tc.desc)
+			}
+		}
+		if inv := svc.invalidated(); !reflect.DeepEqual(inv, tc.invalidated) {
+			t.Errorf("%s: expected invalidated decisions %+v got %+v", tc.desc, tc.invalidated, inv)
+		}
+	}
+}
+
+func TestRevokeChannel(t *testing.T) {
+	svc := &invalidator{AuthServiceClient: newAuthService()}
+	evs := &events{}
+	h := newAuthHandler(svc, mqtt.WithEvents(evs))
+	s := connect(t, h, thingID, thingSecret)
+	s.subscribe(chanTopic)
+	other := connect(t, h, thingID, thingSecret)
+	other.subscribe(thirdTopic)
+
+	// Without the thing ID, the sessions of any thing which use the channel
+	// are revoked, and the decisions of all the things about it invalidated.
+	reason := "channel removed"
+	if n := h.Revoke(context.Background(), "", chanID, reason); n != 1 {
+		t.Errorf("expected 1 revoked session got %d", n)
+	}
+	if e, ok := waitEvent(t, evs, mqtt.EventRevoked); !ok || e.Reason != reason {
+		t.Errorf("expected %s event with reason %q got %+v", mqtt.EventRevoked, reason, evs.all())
+	}
+	if !s.closed() {
+		t.Errorf("expected session using the channel to be closed")
+	}
+	other.sync()
+
+	expected := []invalidation{{secret: thingSecret, chanID: chanID}, {chanID: chanID}}
+	if inv := svc.invalidated(); !reflect.DeepEqual(inv, expected) {
+		t.Errorf("expected invalidated decisions %+v got %+v", expected, inv)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package mqtt
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+
+	"github.com/mainflux/mainflux/pkg/errors"
+	"github.com/mainflux/mproxy/pkg/session"
+)
+
+// Client ID template placeholders.
+const (
+	ThingIDPlaceholder  = "{thingID}"
+	ClientIDPlaceholder = "{clientID}"
+	TenantPlaceholder   = "{tenant}"
+)
+
+var (
+	// ErrFailedLoadCredentials indicates that the upstream credentials file can't be loaded.
+	ErrFailedLoadCredentials = errors.New("failed to load upstream credentials")
+
+	// ErrMissingUpstreamCredentials indicates that the tenant credentials are
+	// configured, but there are none for the tenant of the thing.
+	ErrMissingUpstreamCredentials = errors.New("no upstream credentials for the tenant of the thing")
+)
+
+// Credentials are the credentials used to connect to the MQTT broker.
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// UpstreamConfig configures the CONNECT packet forwarded to the MQTT broker,
+// so the broker doesn't need to know the thing secrets.
+type UpstreamConfig struct {
+	// Credentials replace the thing credentials. If nil, the thing
+	// credentials are forwarded unless the tenant credentials are set.
+	Credentials *Credentials
+
+	// TenantCredentials replace the credentials of the things of the tenant.
+	// They take precedence over Credentials. If they are set without
+	// Credentials, the things without tenant credentials are rejected, so
+	// their secrets are never forwarded to the broker.
+	TenantCredentials map[string]Credentials
+
+	// ClientIDTemplate is the template of the client ID forwarded to the
+	// broker, e.g. "{thingID}-{clientID}". If empty, the client ID is
+	// forwarded unchanged.
+	ClientIDTemplate string
+}
+
+// WithUpstream rewrites the credentials and the client ID forwarded to the
+// MQTT broker once the thing is authenticated.
+func WithUpstream(cfg UpstreamConfig) Option {
+	return func(h *handler) {
+		h.upstream = cfg
+	}
+}
+
+// WithTenants assigns the things to the tenants. Thing IDs are mapped to
+// the tenant names.
+func WithTenants(tenants map[string]string) Option {
+	return func(h *handler) {
+		for thingID, tenant := range tenants {
+			h.tenants[thingID] = tenant
+		}
+	}
+}
+
+// LoadCredentials loads tenant credentials from the JSON file which maps
+// tenant names to the credentials.
+func LoadCredentials(path string) (map[string]Credentials, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(ErrFailedLoadCredentials, err)
+	}
+	var creds map[string]Credentials
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, errors.Wrap(ErrFailedLoadCredentials, err)
+	}
+
+	return creds, nil
+}
+
+// credentials returns the credentials forwarded to the MQTT broker for the
+// things of the tenant. If nil, the thing credentials are forwarded.
+func (cfg UpstreamConfig) credentials(tenant string) (*Credentials, error) {
+	if c, ok := cfg.TenantCredentials[tenant]; ok && tenant != "" {
+		return &c, nil
+	}
+	if cfg.Credentials == nil && len(cfg.TenantCredentials) > 0 {
+		return nil, ErrMissingUpstreamCredentials
+	}
+
+	return cfg.Credentials, nil
+}
+
+// rewrite replaces the session credentials and the client ID with the ones
+// forwarded to the MQTT broker. The credentials are checked on CONNECT,
+// before the session is registered.
+func (h *handler) rewrite(s *session.Session, info SessionInfo) {
+	creds, _ := h.upstream.credentials(info.Tenant)
+	if creds != nil {
+		s.Username = creds.Username
+		s.Password = []byte(creds.Password)
+	}
+
+	if h.upstream.ClientIDTemplate != "" {
+		s.ID = strings.NewReplacer(
+			ThingIDPlaceholder, info.ThingID,
+			ClientIDPlaceholder, info.ClientID,
+			TenantPlaceholder, info.Tenant,
+		).Replace(h.upstream.ClientIDTemplate)
+	}
+}